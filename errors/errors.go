@@ -12,6 +12,11 @@ const (
 	RuntimeError
 	TypeError
 	ReferenceError
+	// ArithmeticError is an operation on constants that fails, found before
+	// the program runs
+	ArithmeticError
+	// UnsupportedError is valid source that a build target cannot translate
+	UnsupportedError
 	Break
 	Continue
 	Return
@@ -34,6 +39,10 @@ func (e *Error) Print() {
 		errorType = "type error"
 	case ReferenceError:
 		errorType = "reference error"
+	case ArithmeticError:
+		errorType = "arithmetic error"
+	case UnsupportedError:
+		errorType = "unsupported feature"
 	default:
 		errorType = "runtime error"
 	}
@@ -0,0 +1,1447 @@
+// Package gogen translates a type-checked simpl program into a standalone Go
+// program that behaves like running the script with the interpreter.
+package gogen
+
+import (
+	"fmt"
+	"go/format"
+	"simpl/errors"
+	"simpl/intpr"
+	"simpl/tokens"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+type global struct {
+	name     string
+	dataType intpr.DataType
+}
+
+type generator struct {
+	out      strings.Builder
+	scopes   []map[string]intpr.DataType
+	globals  []global
+	structs  []intpr.DataType
+	enums    []intpr.DataType
+	natives  map[string]bool
+	depth    int
+	function *intpr.Def
+	tmpCount int
+	// loops counts the loops around the current statement, tries are the
+	// try statements around it within the current function
+	loops      int
+	tries      []*tryBody
+	errorsUsed bool
+	// undefined holds the functions declared in each scope whose definitions
+	// are not emitted yet, calls to them check that the definition ran
+	undefined []map[string]bool
+	// concurrent is set for programs with tasks, where the functions keep
+	// the task that called them in an owner variable, one per nesting level
+	// counted by frames, to check assignments to the variables around them
+	concurrent bool
+	frames     int
+	// types holds the composite types of the program
+	types *intpr.Types
+}
+
+// tryBody is a try statement whose body runs in a recovering closure. Break,
+// continue and return leave the closure with a signal, which is dispatched
+// after it.
+type tryBody struct {
+	loops   int
+	results []string
+	signals map[int]bool
+}
+
+const (
+	breakSignal = iota + 1
+	continueSignal
+	returnSignal
+)
+
+// Generate returns the source of a Go main package for the program.
+// filename is only used in the header comment.
+func Generate(program *intpr.Program, filename string) ([]byte, *errors.Error) {
+	g := generator{scopes: []map[string]intpr.DataType{{}}, undefined: []map[string]bool{{}}, natives: map[string]bool{}, concurrent: program.Concurrent, types: program.Types}
+	g.line("func main() {")
+	g.line("defer func() {")
+	g.line("if r := recover(); r != nil {")
+	g.line("report(r)")
+	g.line("}")
+	g.line("}()")
+	if err := g.statements(program.Statements); err != nil {
+		return nil, err
+	}
+	if g.concurrent {
+		g.line("join()")
+	}
+	g.line("fmt.Println(\"Results:\")")
+	g.line("printMemory()")
+	g.line("}")
+	body := g.out.String()
+
+	var src strings.Builder
+	fmt.Fprintf(&src, "// Code generated by simpl from %s. DO NOT EDIT.\n\n", filename)
+	src.WriteString("package main\n\nimport (\n\"fmt\"\n\"os\"\n\"reflect\"\n")
+	if g.concurrent {
+		src.WriteString("\"sync\"\n")
+	}
+	src.WriteString(")\n\n")
+	for _, gl := range g.globals {
+		fmt.Fprintf(&src, "var %s %s\n", mangle(gl.name), goType(gl.dataType))
+	}
+	fmt.Fprintf(&src, "var declared [%d]bool\n\n", len(g.globals))
+	src.WriteString(body)
+	src.WriteString("\n")
+	g.writeRuntime(&src)
+
+	result, err := format.Source([]byte(src.String()))
+	if err != nil {
+		return nil, &errors.Error{Message: fmt.Sprintf("generated invalid Go source: %s", err), Type: errors.SyntaxError, Token: tokens.Token{Filename: filename}}
+	}
+	return result, nil
+}
+
+func (g *generator) line(format string, args ...any) {
+	fmt.Fprintf(&g.out, format, args...)
+	g.out.WriteString("\n")
+}
+
+func (g *generator) extend() {
+	g.scopes = append(g.scopes, map[string]intpr.DataType{})
+	g.undefined = append(g.undefined, map[string]bool{})
+	g.depth++
+}
+
+func (g *generator) shrink() {
+	g.scopes = g.scopes[:len(g.scopes)-1]
+	g.undefined = g.undefined[:len(g.undefined)-1]
+	g.depth--
+}
+
+func (g *generator) declare(name string, dataType intpr.DataType) {
+	g.scopes[len(g.scopes)-1][name] = dataType
+}
+
+// typeOf returns the type of the innermost user-defined name, Invalid for
+// names the script does not define, like the built-in functions.
+func (g *generator) typeOf(name string) intpr.DataType {
+	for i := len(g.scopes) - 1; i >= 0; i-- {
+		if dataType, found := g.scopes[i][name]; found {
+			return dataType
+		}
+	}
+	return intpr.Invalid
+}
+
+func (g *generator) isUserDefined(name string) bool {
+	return g.typeOf(name) != intpr.Invalid
+}
+
+// isDefined reports whether the definition of the innermost function called
+// name is emitted before the current statement.
+func (g *generator) isDefined(name string) bool {
+	for i := len(g.scopes) - 1; i >= 0; i-- {
+		if _, found := g.scopes[i][name]; found {
+			return !g.undefined[i][name]
+		}
+	}
+	return false
+}
+
+// mangle returns the Go name of a script name. Instances of generic functions
+// are named after their type arguments, as in max[int], which only they can
+// contain.
+func mangle(name string) string {
+	if strings.ContainsRune(name, '[') {
+		return "g_" + strings.Map(func(r rune) rune {
+			if r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) {
+				return r
+			}
+			return '_'
+		}, name)
+	}
+	return "v_" + name
+}
+
+func goType(dataType intpr.DataType) string {
+	switch dataType {
+	case intpr.Int:
+		return "int"
+	case intpr.Bool:
+		return "bool"
+	case intpr.String:
+		return "string"
+	}
+	if dataType.IsMap() {
+		info := dataType.Type()
+		return fmt.Sprintf("*omap[%s, %s]", goType(info.Key), goType(info.Value))
+	}
+	if dataType.IsArray() {
+		return fmt.Sprintf("*array[%s]", goType(dataType.Type().Value))
+	}
+	if dataType.IsTuple() {
+		elements := []string{}
+		for _, e := range dataType.Type().Elements {
+			elements = append(elements, goType(e))
+		}
+		return "(" + strings.Join(elements, ", ") + ")"
+	}
+	if dataType.IsEnum() {
+		return fmt.Sprintf("e%d_%s", dataType.ID(), dataType.Type().Name)
+	}
+	if dataType.IsOptional() {
+		return fmt.Sprintf("optional[%s]", goType(dataType.Type().Value))
+	}
+	if dataType.IsChan() {
+		return fmt.Sprintf("*channel[%s]", goType(dataType.Type().Value))
+	}
+	if info := dataType.Type(); info != nil {
+		// struct names get the type id, as different scopes may reuse a name
+		return fmt.Sprintf("s%d_%s", dataType.ID(), info.Name)
+	}
+	return ""
+}
+
+// zeroValue returns the value a variable of the type holds before it is
+// assigned. Unlike in Go, the zero value of a map or an array is an empty one,
+// and the one of a channel an unbuffered one.
+func zeroValue(dataType intpr.DataType) string {
+	switch dataType {
+	case intpr.Int:
+		return "0"
+	case intpr.Bool:
+		return "false"
+	case intpr.String:
+		return `""`
+	}
+	info := dataType.Type()
+	if info.Kind == intpr.EnumKind {
+		return goType(dataType) + "(0)"
+	}
+	if info.Kind == intpr.OptionalKind {
+		return goType(dataType) + "{}"
+	}
+	if info.Kind == intpr.MapKind {
+		return fmt.Sprintf("newMap[%s, %s](%q)", goType(info.Key), goType(info.Value), info.Name)
+	}
+	if info.Kind == intpr.ArrayKind {
+		return fmt.Sprintf("newArray[%s](%q)", goType(info.Value), info.Name)
+	}
+	if info.Kind == intpr.ChanKind {
+		return fmt.Sprintf("newChan[%s](%q, 0, \"\")", goType(info.Value), info.Name)
+	}
+	if info.Kind == intpr.TupleKind {
+		// only used in return statements, which take the values as a list
+		values := []string{}
+		for _, e := range info.Elements {
+			values = append(values, zeroValue(e))
+		}
+		return strings.Join(values, ", ")
+	}
+	fields := []string{}
+	for _, f := range info.Fields {
+		if hasMap(f.DataType) {
+			fields = append(fields, fmt.Sprintf("%s: %s", fieldName(f.Name), zeroValue(f.DataType)))
+		}
+	}
+	return fmt.Sprintf("%s{%s}", goType(dataType), strings.Join(fields, ", "))
+}
+
+// hasMap reports whether values of the type hold a map, an array or a
+// channel, so that their Go zero value differs from the one of the
+// interpreter.
+func hasMap(dataType intpr.DataType) bool {
+	info := dataType.Type()
+	if info == nil {
+		return false
+	}
+	if info.Kind == intpr.MapKind || info.Kind == intpr.ArrayKind || info.Kind == intpr.ChanKind {
+		return true
+	}
+	for _, f := range info.Fields {
+		if hasMap(f.DataType) {
+			return true
+		}
+	}
+	return false
+}
+
+func fieldName(name string) string {
+	return "f_" + name
+}
+
+func position(token tokens.Token) string {
+	return fmt.Sprintf("%q", fmt.Sprintf("%s:%d:%d", token.Filename, token.Line, token.Char))
+}
+
+func (g *generator) block(statements []intpr.Statement) *errors.Error {
+	g.extend()
+	defer g.shrink()
+	return g.statements(statements)
+}
+
+// statements emits the statements of a block. The variables of the functions
+// it defines are declared first, so that they can call each other whatever
+// their order.
+func (g *generator) statements(statements []intpr.Statement) *errors.Error {
+	g.declareFunctions(statements)
+	for i, stmt := range statements {
+		if err := g.statement(stmt); err != nil {
+			return err
+		}
+		if _, open := stmt.(*intpr.OpenScope); open {
+			g.declareFunctions(statements[i+1:])
+		}
+	}
+	return nil
+}
+
+// declareFunctions declares the functions defined in statements up to the
+// end of the current scope.
+func (g *generator) declareFunctions(statements []intpr.Statement) {
+	depth := 0
+	for _, stmt := range statements {
+		switch s := stmt.(type) {
+		case *intpr.OpenScope:
+			depth++
+		case *intpr.CloseScope:
+			if depth == 0 {
+				return
+			}
+			depth--
+		case *intpr.Def:
+			if depth == 0 {
+				g.declareFunction(s)
+			}
+		}
+	}
+}
+
+// declareFunction declares a function, or the instances of a generic one.
+func (g *generator) declareFunction(s *intpr.Def) {
+	if s.TypeParams != nil {
+		for _, instance := range s.Instances {
+			g.declareFunction(instance)
+		}
+		return
+	}
+	g.declare(s.NameToken.Value, intpr.Func)
+	// top-level functions are all defined before the first statement runs
+	if len(g.scopes) > 1 {
+		g.undefined[len(g.undefined)-1][s.NameToken.Value] = true
+	}
+	g.line("var %s %s", mangle(s.NameToken.Value), signature(s))
+}
+
+func signature(s *intpr.Def) string {
+	paramTypes := []string{}
+	for _, p := range s.Params {
+		paramTypes = append(paramTypes, goType(p.DataType))
+	}
+	return fmt.Sprintf("func(%s) %s", strings.Join(paramTypes, ", "), goType(s.DataType))
+}
+
+func (g *generator) statement(stmt intpr.Statement) *errors.Error {
+	switch s := stmt.(type) {
+	case *intpr.Assignment:
+		code, err := g.assignment(s)
+		if err != nil {
+			return err
+		}
+		g.line("%s", code)
+	case *intpr.Destructure:
+		code, err := g.destructure(s)
+		if err != nil {
+			return err
+		}
+		g.line("%s", code)
+	case *intpr.OpenScope:
+		g.line("{")
+		g.extend()
+	case *intpr.CloseScope:
+		g.shrink()
+		g.line("}")
+	case *intpr.Conditional:
+		return g.conditional(s)
+	case *intpr.For:
+		return g.forLoop(s)
+	case *intpr.ForIn:
+		return g.forIn(s)
+	case *intpr.Match:
+		return g.match(s)
+	case *intpr.Def:
+		return g.def(s)
+	case *intpr.StructDef:
+		// struct types are declared at package level, where they can have methods
+		g.structs = append(g.structs, s.DataType)
+	case *intpr.EnumDef:
+		g.enums = append(g.enums, s.DataType)
+	case *intpr.Return:
+		if g.function == nil || g.function.DataType == intpr.Void {
+			g.leave(returnSignal, "")
+			return nil
+		}
+		exp, err := g.expression(g.function.ReturnBranches[s.Id])
+		if err != nil {
+			return err
+		}
+		g.leave(returnSignal, exp)
+	case *intpr.Break:
+		g.leave(breakSignal, "")
+	case *intpr.Continue:
+		g.leave(continueSignal, "")
+	case *intpr.Try:
+		return g.try(s)
+	case *intpr.Raise:
+		message, err := g.expression(s.Exp)
+		if err != nil {
+			return err
+		}
+		g.line("fail(%s, %s)", position(s.Token), message)
+	case *intpr.VoidCall:
+		code, err := g.voidCall(s)
+		if err != nil {
+			return err
+		}
+		g.line("%s", code)
+	case *intpr.Spawn:
+		return g.spawn(s)
+	case *intpr.Select:
+		return g.selectArm(s)
+	default:
+		return &errors.Error{Message: fmt.Sprintf("go target does not support statement %T", stmt), Type: errors.UnsupportedError, Token: intpr.Position(stmt)}
+	}
+	return nil
+}
+
+// assignment returns the assignment as a single Go statement, so it can
+// also be used as the init and post statements of a for loop.
+func (g *generator) assignment(s *intpr.Assignment) (string, *errors.Error) {
+	if s.DataType == intpr.Func && (s.Explicit || s.Operator.Type == tokens.COLON_EQUAL) {
+		return "", &errors.Error{Message: "go target does not support function types", Type: errors.UnsupportedError, Token: s.Var}
+	}
+	code, err := g.assign(s)
+	if err != nil || s.Explicit || s.Operator.Type == tokens.COLON_EQUAL {
+		return code, err
+	}
+	if check := g.owns(s.Var, s.Depth, "assign to"); check != "" {
+		return fmt.Sprintf("func() { %s; %s }()", check, code), nil
+	}
+	return code, nil
+}
+
+// owns returns the check that the running task may change a variable depth
+// frames up, empty for a local variable or a program without tasks.
+func (g *generator) owns(name tokens.Token, depth int, action string) string {
+	if !g.concurrent || depth == 0 {
+		return ""
+	}
+	owner := "0"
+	if level := g.frames - depth; level > 0 {
+		owner = fmt.Sprintf("owner%d", level)
+	}
+	return fmt.Sprintf("owns(%s, %q, %q, %s)", owner, action, name.Value, position(name))
+}
+
+func (g *generator) assign(s *intpr.Assignment) (string, *errors.Error) {
+	if s.Path != nil {
+		return g.pathAssignment(s)
+	}
+	name := mangle(s.Var.Value)
+	switch s.Operator.Type {
+	case tokens.DOUBLE_PLUS:
+		return name + "++", nil
+	case tokens.DOUBLE_MINUS:
+		return name + "--", nil
+	}
+	exp, err := g.expression(s.Exp)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case s.Operator.Type == tokens.COLON_EQUAL || s.Explicit:
+		g.declare(s.Var.Value, s.DataType)
+		if g.depth == 0 && g.function == nil {
+			g.globals = append(g.globals, global{name: s.Var.Value, dataType: s.DataType})
+			return fmt.Sprintf("%s = %s; declared[%d] = true", name, exp, len(g.globals)-1), nil
+		}
+		return fmt.Sprintf("%s := %s; _ = %s", name, exp, name), nil
+	case s.Operator.Type == tokens.EQUAL:
+		return fmt.Sprintf("%s = %s", name, exp), nil
+	}
+	// the interpreter evaluates the right-hand side before reading the variable
+	if hasCall(s.Exp) {
+		g.tmpCount++
+		tmp := fmt.Sprintf("tmp%d", g.tmpCount)
+		update, err := g.compound(s, name, tmp)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("func() { %s := %s; %s }()", tmp, exp, update), nil
+	}
+	return g.compound(s, name, exp)
+}
+
+// destructure returns the destructuring as a single Go statement, like
+// assignment.
+func (g *generator) destructure(s *intpr.Destructure) (string, *errors.Error) {
+	exp, err := g.expression(s.Exp)
+	if err != nil {
+		return "", err
+	}
+	names := []string{}
+	declared := []string{}
+	for i, v := range s.Vars {
+		if s.Slots[i] < 0 {
+			names = append(names, "_")
+			continue
+		}
+		name := mangle(v.Value)
+		names = append(names, name)
+		if s.Operator.Type != tokens.COLON_EQUAL {
+			continue
+		}
+		g.declare(v.Value, s.Exp.DataType.Type().Elements[i])
+		if g.depth == 0 && g.function == nil {
+			g.globals = append(g.globals, global{name: v.Value, dataType: s.Exp.DataType.Type().Elements[i]})
+			declared = append(declared, fmt.Sprintf("declared[%d] = true", len(g.globals)-1))
+		} else {
+			declared = append(declared, fmt.Sprintf("_ = %s", name))
+		}
+	}
+	// globals already exist, and so does "_"
+	operator := "="
+	if s.Operator.Type == tokens.COLON_EQUAL && (g.depth > 0 || g.function != nil) && len(declared) > 0 {
+		operator = ":="
+	}
+	code := fmt.Sprintf("%s %s %s", strings.Join(names, ", "), operator, exp)
+	for _, d := range declared {
+		code += "; " + d
+	}
+	checks := []string{}
+	for i, v := range s.Vars {
+		if check := g.owns(v, s.Depths[i], "assign to"); check != "" && s.Slots[i] >= 0 && s.Operator.Type != tokens.COLON_EQUAL {
+			checks = append(checks, check)
+		}
+	}
+	if len(checks) > 0 {
+		return fmt.Sprintf("func() { %s; %s }()", strings.Join(checks, "; "), code), nil
+	}
+	return code, nil
+}
+
+// pathAssignment assigns to a part of a struct or map variable. Maps hold
+// their elements behind pointers, so an element can be updated in place.
+func (g *generator) pathAssignment(s *intpr.Assignment) (string, *errors.Error) {
+	name := mangle(s.Var.Value)
+	dataType := g.typeOf(s.Var.Value)
+	indexed, set := false, false
+	last := len(s.Path) - 1
+	var key string
+	for i, sel := range s.Path {
+		if sel.Index == nil {
+			field := dataType.Type().Fields[sel.Field]
+			name += "." + fieldName(field.Name)
+			dataType = field.DataType
+			continue
+		}
+		var err *errors.Error
+		key, err = g.expression(sel.Index)
+		if err != nil {
+			return "", err
+		}
+		indexed = true
+		// maps insert missing keys, while array elements are set in place
+		set = i == last && s.Operator.Type == tokens.EQUAL && dataType.IsMap()
+		if !set {
+			name = fmt.Sprintf("(*%s.at(%s, %s))", name, key, position(sel.Token))
+		}
+		dataType = dataType.Type().Value
+	}
+	switch s.Operator.Type {
+	case tokens.DOUBLE_PLUS:
+		return name + "++", nil
+	case tokens.DOUBLE_MINUS:
+		return name + "--", nil
+	}
+	exp, err := g.expression(s.Exp)
+	if err != nil {
+		return "", err
+	}
+	if !indexed {
+		if s.Operator.Type == tokens.EQUAL {
+			return fmt.Sprintf("%s = %s", name, exp), nil
+		}
+		if hasCall(s.Exp) {
+			g.tmpCount++
+			tmp := fmt.Sprintf("tmp%d", g.tmpCount)
+			update, err := g.compound(s, name, tmp)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("func() { %s := %s; %s }()", tmp, exp, update), nil
+		}
+		return g.compound(s, name, exp)
+	}
+	// the interpreter evaluates the right-hand side before looking up the keys
+	g.tmpCount++
+	tmp := fmt.Sprintf("tmp%d", g.tmpCount)
+	if s.Operator.Type == tokens.EQUAL {
+		if set {
+			return fmt.Sprintf("func() { %s := %s; %s.set(%s, %s) }()", tmp, exp, name, key, tmp), nil
+		}
+		return fmt.Sprintf("func() { %s := %s; %s = %s }()", tmp, exp, name, tmp), nil
+	}
+	update, err := g.compound(s, "(*target)", tmp)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("func() { %s := %s; target := &%s; %s }()", tmp, exp, name, update), nil
+}
+
+func (g *generator) compound(s *intpr.Assignment, name, value string) (string, *errors.Error) {
+	switch s.Operator.Type {
+	case tokens.PLUS_EQUAL:
+		return fmt.Sprintf("%s += %s", name, value), nil
+	case tokens.MINUS_EQUAL:
+		return fmt.Sprintf("%s -= %s", name, value), nil
+	case tokens.STAR_EQUAL:
+		return fmt.Sprintf("%s *= %s", name, value), nil
+	case tokens.SLASH_EQUAL:
+		return fmt.Sprintf("%s = div(%s, %s, %s)", name, name, value, position(s.Operator)), nil
+	case tokens.MODULO_EQUAL:
+		return fmt.Sprintf("%s = mod(%s, %s, %s)", name, name, value, position(s.Operator)), nil
+	case tokens.AMPERSAND_EQUAL, tokens.PIPE_EQUAL, tokens.CARET_EQUAL:
+		return fmt.Sprintf("%s %s %s", name, s.Operator.View(), value), nil
+	case tokens.SHIFT_LEFT_EQUAL:
+		return fmt.Sprintf("%s = shl(%s, %s, %s)", name, name, value, position(s.Operator)), nil
+	case tokens.SHIFT_RIGHT_EQUAL:
+		return fmt.Sprintf("%s = shr(%s, %s, %s)", name, name, value, position(s.Operator)), nil
+	}
+	return "", &errors.Error{Message: fmt.Sprintf("go target does not support operator %s", s.Operator.View()), Type: errors.UnsupportedError, Token: s.Operator}
+}
+
+func (g *generator) simpleStatement(stmt intpr.Statement) (string, *errors.Error) {
+	switch s := stmt.(type) {
+	case *intpr.Assignment:
+		return g.assignment(s)
+	case *intpr.Destructure:
+		return g.destructure(s)
+	case *intpr.VoidCall:
+		return g.voidCall(s)
+	}
+	return "", &errors.Error{Message: fmt.Sprintf("go target does not support statement %T in for header", stmt), Type: errors.UnsupportedError, Token: intpr.Position(stmt)}
+}
+
+// voidCall returns the call as a single Go statement, discarding the value
+// of built-ins.
+func (g *generator) voidCall(s *intpr.VoidCall) (string, *errors.Error) {
+	if s.Builtin != intpr.NoBuiltin {
+		call, err := g.builtin(s.Builtin, s.Args, s.NameToken)
+		if err != nil {
+			return "", err
+		}
+		switch s.Builtin {
+		case intpr.DeleteBuiltin:
+			if v := s.Args[0].Variable(); v != nil {
+				if check := g.owns(v.Token, v.Depth, "delete from"); check != "" {
+					return fmt.Sprintf("func() { %s; %s }()", check, call), nil
+				}
+			}
+			return call, nil
+		case intpr.SendBuiltin, intpr.CloseBuiltin:
+			return call, nil
+		}
+		return fmt.Sprintf("func() { _ = %s }()", call), nil
+	}
+	call, err := g.call(s.NameToken, s.Args)
+	if err != nil {
+		return "", err
+	}
+	if g.isUserDefined(s.NameToken.Value) {
+		return call, nil
+	}
+	return fmt.Sprintf("func() { _ = %s }()", call), nil
+}
+
+func (g *generator) conditional(s *intpr.Conditional) *errors.Error {
+	if s.Condition.Token.Type == tokens.IS {
+		// the variable of x is some v is declared around the statement, the
+		// condition stores into it
+		bound := s.Condition.Right
+		g.line("{")
+		g.extend()
+		defer func() {
+			g.shrink()
+			g.line("}")
+		}()
+		g.declare(bound.Token.Value, bound.DataType)
+		g.line("var %s %s", mangle(bound.Token.Value), goType(bound.DataType))
+	}
+	condition, err := g.expression(s.Condition)
+	if err != nil {
+		return err
+	}
+	if s.Token.Type == tokens.IF {
+		g.line("if %s {", condition)
+		if err := g.block(s.Then.Statements); err != nil {
+			return err
+		}
+		if s.Else != nil {
+			g.line("} else {")
+			if err := g.block(s.Else.Statements); err != nil {
+				return err
+			}
+		}
+		g.line("}")
+		return nil
+	}
+	// the else block runs when the loop body never does
+	g.line("{")
+	if s.Else != nil {
+		g.line("loopEntered := false")
+	}
+	g.line("for %s {", condition)
+	if s.Else != nil {
+		g.line("loopEntered = true")
+	}
+	if err := g.loopBody(s.Then); err != nil {
+		return err
+	}
+	g.line("}")
+	if s.Else != nil {
+		g.line("if !loopEntered {")
+		if err := g.block(s.Else.Statements); err != nil {
+			return err
+		}
+		g.line("}")
+	}
+	g.line("}")
+	return nil
+}
+
+// match becomes an if chain rather than a switch, so that break and continue
+// in the arms apply to the enclosing loop.
+func (g *generator) match(s *intpr.Match) *errors.Error {
+	subject, err := g.expression(s.Subject)
+	if err != nil {
+		return err
+	}
+	g.tmpCount++
+	tmp := fmt.Sprintf("tmp%d", g.tmpCount)
+	g.line("{")
+	g.line("%s := %s", tmp, subject)
+	g.line("_ = %s", tmp)
+	keyword := "if"
+	for _, arm := range s.Arms {
+		conditions := []string{}
+		for _, v := range arm.Values {
+			value, err := g.expression(v)
+			if err != nil {
+				return err
+			}
+			conditions = append(conditions, fmt.Sprintf("%s == %s", tmp, value))
+		}
+		g.line("%s %s {", keyword, strings.Join(conditions, " || "))
+		if err := g.block(arm.Block.Statements); err != nil {
+			return err
+		}
+		keyword = "} else if"
+	}
+	if len(s.Arms) > 0 && (s.Default != nil || s.Exhaustive) {
+		g.line("} else {")
+	}
+	if s.Default != nil {
+		if err := g.block(s.Default.Statements); err != nil {
+			return err
+		}
+	} else if s.Exhaustive {
+		// lets Go see that a match whose arms all return terminates
+		g.line("panic(\"unreachable\")")
+	}
+	if len(s.Arms) > 0 {
+		g.line("}")
+	}
+	g.line("}")
+	return nil
+}
+
+func (g *generator) forLoop(s *intpr.For) *errors.Error {
+	g.line("{")
+	g.extend()
+	defer g.shrink()
+	init, err := g.simpleStatement(s.Init)
+	if err != nil {
+		return err
+	}
+	g.line("%s", init)
+	condition, err := g.expression(s.Condition)
+	if err != nil {
+		return err
+	}
+	after, err := g.simpleStatement(s.After)
+	if err != nil {
+		return err
+	}
+	g.line("for ; %s; %s {", condition, after)
+	if s.Block != nil {
+		if err := g.loopBody(s.Block); err != nil {
+			return err
+		}
+	}
+	g.line("}")
+	g.line("}")
+	return nil
+}
+
+func (g *generator) forIn(s *intpr.ForIn) *errors.Error {
+	name := mangle(s.Var.Value)
+	if s.Collection != nil {
+		collection, err := g.expression(s.Collection)
+		if err != nil {
+			return err
+		}
+		if s.Collection.DataType.IsArray() {
+			g.line("for _, %s := range %s.values {", name, collection)
+		} else {
+			g.line("for _, %s := range %s.keyList() {", name, collection)
+		}
+	} else {
+		start, err := g.expression(s.Start)
+		if err != nil {
+			return err
+		}
+		end, err := g.expression(s.End)
+		if err != nil {
+			return err
+		}
+		// a separate counter keeps assignments to the loop variable from
+		// changing the iterations
+		g.tmpCount++
+		counter, limit := fmt.Sprintf("tmp%d", g.tmpCount), fmt.Sprintf("end%d", g.tmpCount)
+		g.line("for %s, %s := %s, %s; %s < %s; %s++ {", counter, limit, start, end, counter, limit, counter)
+		g.line("%s := %s", name, counter)
+	}
+	g.line("_ = %s", name)
+	g.extend()
+	defer g.shrink()
+	g.declare(s.Var.Value, s.DataType)
+	if err := g.loopBody(s.Block); err != nil {
+		return err
+	}
+	g.line("}")
+	return nil
+}
+
+func (g *generator) def(s *intpr.Def) *errors.Error {
+	if s.TypeParams != nil {
+		for _, instance := range s.Instances {
+			if err := g.def(instance); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	name := mangle(s.NameToken.Value)
+	params := []string{}
+	for _, p := range s.Params {
+		params = append(params, fmt.Sprintf("%s %s", mangle(p.NameToken.Value), goType(p.DataType)))
+	}
+	delete(g.undefined[len(g.undefined)-1], s.NameToken.Value)
+	g.line("%s = func(%s) %s {", name, strings.Join(params, ", "), goType(s.DataType))
+	if g.concurrent {
+		g.frames++
+		defer func() { g.frames-- }()
+		g.line("owner%d := running", g.frames)
+		g.line("_ = owner%d", g.frames)
+	}
+
+	function, loops, tries := g.function, g.loops, g.tries
+	g.function, g.loops, g.tries = s, 0, nil
+	g.extend()
+	for _, p := range s.Params {
+		g.declare(p.NameToken.Value, p.DataType)
+	}
+	if err := g.statements(s.Body.Statements); err != nil {
+		return err
+	}
+	g.shrink()
+	g.function, g.loops, g.tries = function, loops, tries
+
+	// a function that runs off its end returns the zero value
+	if terminates(s.Body.Statements) {
+		g.line("}")
+		g.line("_ = %s", name)
+		return nil
+	}
+	if s.DataType != intpr.Void {
+		g.line("return %s", zeroValue(s.DataType))
+	}
+	g.line("}")
+	g.line("_ = %s", name)
+	return nil
+}
+
+// loopBody emits the body of a loop. A body with a frame of its own in the
+// interpreter is a nesting level of its own here as well.
+func (g *generator) loopBody(body *intpr.Program) *errors.Error {
+	g.loops++
+	defer func() { g.loops-- }()
+	if g.concurrent && body.Frame {
+		g.frames++
+		defer func() { g.frames-- }()
+		g.line("owner%d := running", g.frames)
+		g.line("_ = owner%d", g.frames)
+	}
+	return g.block(body.Statements)
+}
+
+// leave emits a break, continue or return, which becomes a signal when it
+// has to leave the closure of a try statement first. values are the return
+// values, if any.
+func (g *generator) leave(signal int, values string) {
+	var try *tryBody
+	if len(g.tries) > 0 {
+		try = g.tries[len(g.tries)-1]
+	}
+	if try == nil || signal != returnSignal && g.loops > try.loops {
+		switch signal {
+		case breakSignal:
+			g.line("break")
+		case continueSignal:
+			g.line("continue")
+		default:
+			g.line("return %s", values)
+		}
+		return
+	}
+	if values != "" {
+		g.line("%s = %s", strings.Join(try.results, ", "), values)
+	}
+	try.signals[signal] = true
+	g.line("return %d", signal)
+}
+
+func (g *generator) try(s *intpr.Try) *errors.Error {
+	g.tmpCount++
+	id := g.tmpCount
+	try := &tryBody{loops: g.loops, signals: map[int]bool{}}
+	g.line("{")
+	g.line("var caught%d *runtimeError", id)
+	if g.function != nil && g.function.DataType != intpr.Void {
+		types := []intpr.DataType{g.function.DataType}
+		if g.function.DataType.IsTuple() {
+			types = g.function.DataType.Type().Elements
+		}
+		for i, t := range types {
+			result := fmt.Sprintf("result%d_%d", id, i)
+			try.results = append(try.results, result)
+			g.line("var %s %s", result, goType(t))
+			g.line("_ = %s", result)
+		}
+	}
+	g.line("if signal%d := func() int {", id)
+	g.line("defer func() {")
+	g.line("if r := recover(); r != nil {")
+	g.line("caught%d = caught(r)", id)
+	g.line("}")
+	g.line("}()")
+	g.tries = append(g.tries, try)
+	err := g.block(s.Body.Statements)
+	g.tries = g.tries[:len(g.tries)-1]
+	if err != nil {
+		return err
+	}
+	g.line("return 0")
+	g.line("}(); signal%d != 0 {", id)
+	for _, signal := range []int{breakSignal, continueSignal, returnSignal} {
+		if try.signals[signal] {
+			g.line("if signal%d == %d {", id, signal)
+			g.leave(signal, strings.Join(try.results, ", "))
+			g.line("}")
+		}
+	}
+	g.line("}")
+	g.line("if caught%d != nil {", id)
+	g.extend()
+	if s.Slot >= 0 {
+		if !g.errorsUsed {
+			g.errorsUsed = true
+			g.structs = append(g.structs, intpr.ErrorType)
+		}
+		name := mangle(s.Var.Value)
+		g.line("%s := %s{f_message: caught%d.message, f_line: caught%d.line, f_column: caught%d.column}", name, goType(intpr.ErrorType), id, id, id)
+		g.line("_ = %s", name)
+		g.declare(s.Var.Value, intpr.ErrorType)
+	}
+	err = g.block(s.Catch.Statements)
+	g.shrink()
+	if err != nil {
+		return err
+	}
+	g.line("}")
+	g.line("}")
+	return nil
+}
+
+// spawn takes the function and evaluates the arguments in the spawning
+// task, like the interpreter, before starting the task that calls it.
+func (g *generator) spawn(s *intpr.Spawn) *errors.Error {
+	function := mangle(s.NameToken.Value)
+	if !g.isDefined(s.NameToken.Value) {
+		function = fmt.Sprintf("defined(%s, %s, %q)", function, position(s.NameToken), s.NameToken.Value)
+	}
+	names := []string{"task"}
+	values := []string{function}
+	for i, a := range s.Args {
+		value, err := g.expression(a)
+		if err != nil {
+			return err
+		}
+		names = append(names, fmt.Sprintf("arg%d", i))
+		values = append(values, value)
+	}
+	g.line("{")
+	g.line("%s := %s", strings.Join(names, ", "), strings.Join(values, ", "))
+	g.line("spawn(func() { task(%s) })", strings.Join(names[1:], ", "))
+	g.line("}")
+	return nil
+}
+
+// selectArm emits a select as an if chain on the arm chosen, like match.
+// The channels and the values to send are evaluated in order up front.
+func (g *generator) selectArm(s *intpr.Select) *errors.Error {
+	g.tmpCount++
+	id := g.tmpCount
+	g.line("{")
+	arms := []string{}
+	for i, arm := range s.Arms {
+		channel, err := g.expression(arm.Channel)
+		if err != nil {
+			return err
+		}
+		g.line("channel%d_%d := %s", id, i, channel)
+		if arm.Value == nil {
+			arms = append(arms, fmt.Sprintf("channel%d_%d.receiving()", id, i))
+			continue
+		}
+		value, err := g.expression(arm.Value)
+		if err != nil {
+			return err
+		}
+		g.line("value%d_%d := %s", id, i, value)
+		arms = append(arms, fmt.Sprintf("channel%d_%d.sending()", id, i))
+	}
+	g.line("arm%d := choose(%s, %t, %s)", id, position(s.Token), s.Default != nil, strings.Join(arms, ", "))
+	keyword := "if"
+	for i, arm := range s.Arms {
+		g.line("%s arm%d == %d {", keyword, id, i)
+		keyword = "} else if"
+		g.extend()
+		switch {
+		case arm.Value != nil:
+			g.line("channel%d_%d.put(value%d_%d, %s)", id, i, id, i, position(arm.Token))
+		case arm.Slot >= 0:
+			name := mangle(arm.Var.Value)
+			g.line("%s := channel%d_%d.take()", name, id, i)
+			g.line("_ = %s", name)
+			g.declare(arm.Var.Value, g.types.OptionalOf(arm.Channel.DataType.Type().Value))
+		default:
+			g.line("channel%d_%d.take()", id, i)
+		}
+		err := g.statements(arm.Block.Statements)
+		g.shrink()
+		if err != nil {
+			return err
+		}
+	}
+	if s.Default != nil {
+		g.line("} else {")
+		if err := g.block(s.Default.Statements); err != nil {
+			return err
+		}
+	}
+	g.line("}")
+	g.line("}")
+	return nil
+}
+
+// terminates reports whether the statements end in a return on every path,
+// in which case Go rejects a trailing return as unreachable.
+func terminates(statements []intpr.Statement) bool {
+	if len(statements) == 0 {
+		return false
+	}
+	switch s := statements[len(statements)-1].(type) {
+	case *intpr.Return:
+		return true
+	case *intpr.Conditional:
+		return s.Token.Type == tokens.IF && s.Else != nil && terminates(s.Then.Statements) && terminates(s.Else.Statements)
+	case *intpr.Match:
+		if !s.Exhaustive || s.Default != nil && !terminates(s.Default.Statements) {
+			return false
+		}
+		for _, arm := range s.Arms {
+			if !terminates(arm.Block.Statements) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func hasCall(e *intpr.Expression) bool {
+	if e == nil {
+		return false
+	}
+	return e.Args != nil || hasCall(e.Left) || hasCall(e.Right)
+}
+
+func (g *generator) call(name tokens.Token, args []*intpr.Expression) (string, *errors.Error) {
+	values := []string{}
+	for _, a := range args {
+		value, err := g.expression(a)
+		if err != nil {
+			return "", err
+		}
+		values = append(values, value)
+	}
+	if g.isUserDefined(name.Value) {
+		if !g.isDefined(name.Value) {
+			return fmt.Sprintf("defined(%s, %s, %q)(%s)", mangle(name.Value), position(name), name.Value, strings.Join(values, ", ")), nil
+		}
+		return fmt.Sprintf("%s(%s)", mangle(name.Value), strings.Join(values, ", ")), nil
+	}
+	if _, found := nativeSources[name.Value]; !found {
+		return "", &errors.Error{Message: fmt.Sprintf("go target does not support built-in function %s", name.Value), Type: errors.UnsupportedError, Token: name}
+	}
+	g.natives[name.Value] = true
+	values = append(values, position(name))
+	return fmt.Sprintf("native_%s(%s)", name.Value, strings.Join(values, ", ")), nil
+}
+
+func (g *generator) builtin(builtin intpr.Builtin, args []*intpr.Expression, token tokens.Token) (string, *errors.Error) {
+	values := []string{}
+	for _, a := range args {
+		value, err := g.expression(a)
+		if err != nil {
+			return "", err
+		}
+		values = append(values, value)
+	}
+	switch builtin {
+	case intpr.LenBuiltin:
+		return fmt.Sprintf("%s.len()", values[0]), nil
+	case intpr.HasBuiltin:
+		return fmt.Sprintf("%s.has(%s)", values[0], values[1]), nil
+	case intpr.SendBuiltin:
+		return fmt.Sprintf("%s.send(%s, %s)", values[0], values[1], position(token)), nil
+	case intpr.RecvBuiltin:
+		return fmt.Sprintf("%s.recv(%s)", values[0], position(token)), nil
+	case intpr.CloseBuiltin:
+		return fmt.Sprintf("%s.close(%s)", values[0], position(token)), nil
+	}
+	return fmt.Sprintf("%s.del(%s)", values[0], values[1]), nil
+}
+
+// convert returns a conversion between an enum and int. An int converted to
+// an enum is checked to name a variant.
+func (g *generator) convert(e *intpr.Expression) (string, *errors.Error) {
+	value, err := g.expression(e.Args[0])
+	if err != nil {
+		return "", err
+	}
+	info := e.DataType.Type()
+	if info == nil || e.Args[0].DataType == e.DataType {
+		return fmt.Sprintf("%s(%s)", goType(e.DataType), value), nil
+	}
+	return fmt.Sprintf("%s(variant(%s, %d, %q, %s))", goType(e.DataType), value, len(info.Variants), info.Name, position(e.Token)), nil
+}
+
+// orElse returns a ?? b as a closure, so that b is only evaluated when a is
+// none.
+func (g *generator) orElse(e *intpr.Expression) (string, *errors.Error) {
+	optional, err := g.expression(e.Left)
+	if err != nil {
+		return "", err
+	}
+	fallback, err := g.expression(e.Right)
+	if err != nil {
+		return "", err
+	}
+	g.tmpCount++
+	tmp := fmt.Sprintf("tmp%d", g.tmpCount)
+	value := tmp + ".value"
+	if e.DataType == e.Left.DataType {
+		value = tmp
+	}
+	return fmt.Sprintf("func() %s { if %s := %s; %s.ok { return %s }; return %s }()", goType(e.DataType), tmp, optional, tmp, value, fallback), nil
+}
+
+func (g *generator) expression(e *intpr.Expression) (string, *errors.Error) {
+	switch e.Token.Type {
+	case tokens.NUMBER:
+		return e.Token.Value, nil
+	case tokens.STRING:
+		return fmt.Sprintf("%q", e.Token.Value), nil
+	case tokens.TRUE:
+		return "true", nil
+	case tokens.FALSE:
+		return "false", nil
+	case tokens.VARIANT:
+		return fmt.Sprintf("%s(%d)", goType(e.DataType), e.Constant.Int), nil
+	case tokens.NONE:
+		return zeroValue(e.DataType), nil
+	case tokens.SOME:
+		value, err := g.expression(e.Left)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("some(%s)", value), nil
+	case tokens.IS:
+		optional, err := g.expression(e.Left)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("unwrap(%s, &%s)", optional, mangle(e.Right.Token.Value)), nil
+	case tokens.DOUBLE_QUESTION:
+		return g.orElse(e)
+	case tokens.CHAN:
+		capacity := "0"
+		if e.Left != nil {
+			var err *errors.Error
+			capacity, err = g.expression(e.Left)
+			if err != nil {
+				return "", err
+			}
+		}
+		return fmt.Sprintf("newChan[%s](%q, %s, %s)", goType(e.DataType.Type().Value), e.DataType.Type().Name, capacity, position(e.Token)), nil
+	case tokens.IDENTIFIER:
+		if e.Args == nil {
+			return mangle(e.Token.Value), nil
+		}
+		if e.Builtin == intpr.ConvertBuiltin {
+			return g.convert(e)
+		}
+		if e.Builtin != intpr.NoBuiltin {
+			return g.builtin(e.Builtin, e.Args, e.Token)
+		}
+		return g.call(e.Token, e.Args)
+	case tokens.DOT:
+		object, err := g.expression(e.Left)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s.%s", object, fieldName(e.Left.DataType.Type().Fields[e.Slot].Name)), nil
+	case tokens.COMMA:
+		// only returned, so the values can be listed
+		values := []string{}
+		for _, a := range e.Args {
+			value, err := g.expression(a)
+			if err != nil {
+				return "", err
+			}
+			values = append(values, value)
+		}
+		return strings.Join(values, ", "), nil
+	case tokens.LEFT_BRACKET:
+		object, err := g.expression(e.Left)
+		if err != nil {
+			return "", err
+		}
+		key, err := g.expression(e.Right)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s.get(%s, %s)", object, key, position(e.Token)), nil
+	case tokens.LEFT_BRACE:
+		if e.DataType.IsMap() {
+			// with evaluates the entries in order, like the interpreter
+			literal := zeroValue(e.DataType)
+			for i := 0; i < len(e.Args); i += 2 {
+				key, err := g.expression(e.Args[i])
+				if err != nil {
+					return "", err
+				}
+				value, err := g.expression(e.Args[i+1])
+				if err != nil {
+					return "", err
+				}
+				literal += fmt.Sprintf(".with(%s, %s)", key, value)
+			}
+			return literal, nil
+		}
+		if e.DataType.IsArray() {
+			values := []string{fmt.Sprintf("%q", e.DataType.Type().Name)}
+			for _, a := range e.Args {
+				value, err := g.expression(a)
+				if err != nil {
+					return "", err
+				}
+				values = append(values, value)
+			}
+			return fmt.Sprintf("newArray[%s](%s)", goType(e.DataType.Type().Value), strings.Join(values, ", ")), nil
+		}
+		fields := []string{}
+		for i, a := range e.Args {
+			if a == nil {
+				if field := e.DataType.Type().Fields[i]; hasMap(field.DataType) {
+					fields = append(fields, fmt.Sprintf("%s: %s", fieldName(field.Name), zeroValue(field.DataType)))
+				}
+				continue
+			}
+			value, err := g.expression(a)
+			if err != nil {
+				return "", err
+			}
+			fields = append(fields, fmt.Sprintf("%s: %s", fieldName(e.DataType.Type().Fields[i].Name), value))
+		}
+		return fmt.Sprintf("%s{%s}", goType(e.DataType), strings.Join(fields, ", ")), nil
+	case tokens.BANG:
+		operand, err := g.expression(e.Left)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("!(%s)", operand), nil
+	case tokens.NEGATE:
+		operand, err := g.expression(e.Left)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("-(%s)", operand), nil
+	case tokens.TILDE:
+		operand, err := g.expression(e.Left)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("^(%s)", operand), nil
+	}
+	left, err := g.expression(e.Left)
+	if err != nil {
+		return "", err
+	}
+	right, err := g.expression(e.Right)
+	if err != nil {
+		return "", err
+	}
+	switch e.Token.Type {
+	case tokens.SLASH:
+		return fmt.Sprintf("div(%s, %s, %s)", left, right, position(e.Token)), nil
+	case tokens.MODULO:
+		return fmt.Sprintf("mod(%s, %s, %s)", left, right, position(e.Token)), nil
+	case tokens.SHIFT_LEFT:
+		return fmt.Sprintf("shl(%s, %s, %s)", left, right, position(e.Token)), nil
+	case tokens.SHIFT_RIGHT:
+		return fmt.Sprintf("shr(%s, %s, %s)", left, right, position(e.Token)), nil
+	case tokens.AND:
+		return fmt.Sprintf("(%s && %s)", left, right), nil
+	case tokens.OR:
+		return fmt.Sprintf("(%s || %s)", left, right), nil
+	case tokens.PLUS, tokens.MINUS, tokens.STAR, tokens.AMPERSAND, tokens.PIPE, tokens.CARET, tokens.DOUBLE_EQUAL, tokens.NOT_EQUAL,
+		tokens.LESS, tokens.LESS_EQUAL, tokens.GREATER, tokens.GREATER_EQUAL:
+		return fmt.Sprintf("(%s %s %s)", left, e.Token.View(), right), nil
+	}
+	return "", &errors.Error{Message: fmt.Sprintf("go target does not support operator %s", e.Token.View()), Type: errors.UnsupportedError, Token: e.Token}
+}
+
+func (g *generator) writeRuntime(src *strings.Builder) {
+	src.WriteString("func printMemory() {\n")
+	src.WriteString("fmt.Println(\"Ints:\")\n")
+	for i, gl := range g.globals {
+		if gl.dataType == intpr.Int {
+			fmt.Fprintf(src, "if declared[%d] {\nfmt.Printf(\"%%s = %%d\\n\", %q, %s)\n}\n", i, gl.name, mangle(gl.name))
+		}
+	}
+	src.WriteString("fmt.Println(\"Bools:\")\n")
+	for i, gl := range g.globals {
+		if gl.dataType == intpr.Bool {
+			fmt.Fprintf(src, "if declared[%d] {\nfmt.Printf(\"%%s = %%t\\n\", %q, %s)\n}\n", i, gl.name, mangle(gl.name))
+		}
+	}
+	g.printSection(src, "Strings:", func(t intpr.DataType) bool { return t == intpr.String })
+	g.printSection(src, "Structs:", intpr.DataType.IsStruct)
+	g.printSection(src, "Maps:", intpr.DataType.IsMap)
+	g.printSection(src, "Arrays:", intpr.DataType.IsArray)
+	g.printSection(src, "Enums:", intpr.DataType.IsEnum)
+	g.printSection(src, "Optionals:", intpr.DataType.IsOptional)
+	g.printSection(src, "Channels:", intpr.DataType.IsChan)
+	src.WriteString("}\n\n")
+	for _, dataType := range g.structs {
+		writeStruct(src, dataType)
+	}
+	for _, dataType := range g.enums {
+		writeEnum(src, dataType)
+	}
+	src.WriteString(runtimeSource)
+	if g.concurrent {
+		src.WriteString(tasksSource)
+	}
+	names := []string{}
+	for name := range g.natives {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		src.WriteString(nativeSources[name])
+	}
+}
+
+// printSection prints the globals whose type matches. Like the interpreter,
+// the section is left out when there are no such globals.
+func (g *generator) printSection(src *strings.Builder, header string, matches func(intpr.DataType) bool) {
+	printed := false
+	for i, gl := range g.globals {
+		if !matches(gl.dataType) {
+			continue
+		}
+		if !printed {
+			fmt.Fprintf(src, "fmt.Println(%q)\n", header)
+			printed = true
+		}
+		fmt.Fprintf(src, "if declared[%d] {\nfmt.Printf(\"%%s = %%s\\n\", %q, show(%s))\n}\n", i, gl.name, mangle(gl.name))
+	}
+}
+
+// writeStruct declares the Go type of a struct, with a String method that
+// formats it like the interpreter does.
+func writeStruct(src *strings.Builder, dataType intpr.DataType) {
+	info := dataType.Type()
+	name := goType(dataType)
+	fmt.Fprintf(src, "type %s struct {\n", name)
+	for _, f := range info.Fields {
+		fmt.Fprintf(src, "%s %s\n", fieldName(f.Name), goType(f.DataType))
+	}
+	src.WriteString("}\n\n")
+	formats := []string{}
+	values := []string{}
+	for _, f := range info.Fields {
+		verb := "%v"
+		switch f.DataType {
+		case intpr.Int:
+			verb = "%d"
+		case intpr.Bool:
+			verb = "%t"
+		case intpr.String:
+			verb = "%q"
+		}
+		formats = append(formats, fmt.Sprintf("%s: %s", f.Name, verb))
+		values = append(values, ", v."+fieldName(f.Name))
+	}
+	fmt.Fprintf(src, "func (v %s) String() string {\nreturn fmt.Sprintf(%q%s)\n}\n\n", name, info.Name+"{"+strings.Join(formats, ", ")+"}", strings.Join(values, ""))
+}
+
+// writeEnum declares the Go type of an enum, with a String method that names
+// the variant like the interpreter does.
+func writeEnum(src *strings.Builder, dataType intpr.DataType) {
+	info := dataType.Type()
+	name := goType(dataType)
+	names := []string{}
+	for _, v := range info.Variants {
+		names = append(names, fmt.Sprintf("%q", info.Name+"."+v))
+	}
+	fmt.Fprintf(src, "type %s int\n\n", name)
+	fmt.Fprintf(src, "func (v %s) String() string {\nreturn [...]string{%s}[v]\n}\n\n", name, strings.Join(names, ", "))
+}
@@ -0,0 +1,46 @@
+package gogen
+
+import (
+	"simpl/errors"
+	"simpl/intpr"
+	"simpl/lexer"
+	"simpl/parser"
+	"simpl/tokens"
+	"testing"
+)
+
+// TestFunctionValues checks that a variable holding a function is rejected
+// at its statement, as Go source for it cannot be generated.
+func TestFunctionValues(t *testing.T) {
+	const source = "def h() int { return 1; }\nk := h;\n"
+	tokens, errs := lexer.Tokenize(source, "values.simpl", 1)
+	if len(errs) > 0 {
+		t.Fatalf("tokenize: %s", errs[0].Message)
+	}
+	parse := parser.New(tokens)
+	program, err := parse.Parse(false)
+	if err != nil {
+		t.Fatalf("parse: %s", err.Message)
+	}
+	_, err = Generate(program, "values.simpl")
+	if err == nil {
+		t.Fatal("generated Go source for k := h")
+	}
+	if err.Type != errors.UnsupportedError || err.Message != "go target does not support function types" || err.Token.Line != 2 || err.Token.Char != 1 {
+		t.Errorf("got %d:%d: %s, want the function type rejected at 2:1", err.Token.Line, err.Token.Char, err.Message)
+	}
+}
+
+// TestUnsupportedStatement checks that a statement the go target cannot
+// translate is reported at its position, even in a for header.
+func TestUnsupportedStatement(t *testing.T) {
+	position := tokens.Token{Type: tokens.BREAK, Line: 3, Char: 5}
+	loop := &intpr.For{Init: &intpr.Break{Token: position}, Condition: &intpr.Expression{Token: tokens.Token{Type: tokens.TRUE}, DataType: intpr.Bool, Constant: intpr.Value{Bool: true}}}
+	_, err := Generate(&intpr.Program{Statements: []intpr.Statement{loop}}, "header.simpl")
+	if err == nil {
+		t.Fatal("generated Go source for a break in a for header")
+	}
+	if err.Type != errors.UnsupportedError || err.Token.Line != 3 || err.Token.Char != 5 {
+		t.Errorf("got %d:%d: %s, want an unsupported feature at 3:5", err.Token.Line, err.Token.Char, err.Message)
+	}
+}
@@ -0,0 +1,657 @@
+package gogen
+
+// runtimeSource is appended to every generated program. Runtime errors are
+// printed in the same format as errors.Error.Print.
+const runtimeSource = `
+// runtimeError is raised by fail as a panic, which try statements recover
+// from and main reports.
+type runtimeError struct {
+	message  string
+	position string
+	line     int
+	column   int
+}
+
+func fail(position, message string) {
+	panic(newError(position, message))
+}
+
+func newError(position, message string) *runtimeError {
+	e := &runtimeError{message: message, position: position}
+	// the position ends in line:column
+	colons := 0
+	for i := len(position) - 1; i >= 0; i-- {
+		if position[i] == ':' {
+			colons++
+			if colons == 2 {
+				fmt.Sscanf(position[i+1:], "%d:%d", &e.line, &e.column)
+				break
+			}
+		}
+	}
+	return e
+}
+
+// caught returns the runtime error a panic was raised with, and panics
+// again for anything else.
+func caught(r any) *runtimeError {
+	e, ok := r.(*runtimeError)
+	if !ok {
+		panic(r)
+	}
+	return e
+}
+
+// defined returns the function f called name, failing when its definition
+// has not run yet.
+func defined[F any](f F, position, name string) F {
+	if reflect.ValueOf(f).IsNil() {
+		fail(position, fmt.Sprintf("function %s called before its definition", name))
+	}
+	return f
+}
+
+func report(r any) {
+	e := caught(r)
+	fmt.Printf("%s: runtime error: %s\n", e.position, e.message)
+	fmt.Println("Memory:")
+	printMemory()
+	os.Exit(64)
+}
+
+// show formats a value like the interpreter does when printing memory.
+func show(v any) string {
+	if s, ok := v.(string); ok {
+		return fmt.Sprintf("%q", s)
+	}
+	return fmt.Sprint(v)
+}
+
+// variant checks that an int converted to an enum names one of its count
+// variants.
+func variant(value, count int, name, position string) int {
+	if value < 0 || value >= count {
+		fail(position, fmt.Sprintf("%d is not a variant of enum %s", value, name))
+	}
+	return value
+}
+
+func div(a, b int, position string) int {
+	if b == 0 {
+		fail(position, "zero division not allowed")
+	}
+	return a / b
+}
+
+func mod(a, b int, position string) int {
+	if b == 0 {
+		fail(position, "zero division not allowed")
+	}
+	return a % b
+}
+
+func shl(a, b int, position string) int {
+	if b < 0 || b > 63 {
+		fail(position, "shift count must be between 0 and 63")
+	}
+	return a << b
+}
+
+func shr(a, b int, position string) int {
+	if b < 0 || b > 63 {
+		fail(position, "shift count must be between 0 and 63")
+	}
+	return a >> b
+}
+
+const minInt = -1 << 63
+
+func mulOk(a, b int) (int, bool) {
+	if a == 0 || b == 0 {
+		return 0, true
+	}
+	result := a * b
+	if result/b != a || (a == -1 && b == minInt) || (b == -1 && a == minInt) {
+		return result, false
+	}
+	return result, true
+}
+
+func intPow(a, n int, position string) (int, bool) {
+	if n < 0 {
+		fail(position, "pow: negative exponent")
+	}
+	result, ok := 1, true
+	for n > 0 {
+		if n&1 == 1 {
+			var fits bool
+			result, fits = mulOk(result, a)
+			ok = ok && fits
+		}
+		n >>= 1
+		if n > 0 {
+			var fits bool
+			a, fits = mulOk(a, a)
+			ok = ok && fits
+		}
+	}
+	return result, ok
+}
+
+// omap is a map that keeps its keys in insertion order, like the maps of
+// the interpreter. Values are stored behind pointers so that assignments can
+// update a struct inside a map in place.
+type omap[K comparable, V any] struct {
+	name   string
+	keys   []K
+	values map[K]*V
+}
+
+func newMap[K comparable, V any](name string) *omap[K, V] {
+	return &omap[K, V]{name: name, values: map[K]*V{}}
+}
+
+func (m *omap[K, V]) with(key K, value V) *omap[K, V] {
+	m.set(key, value)
+	return m
+}
+
+func (m *omap[K, V]) at(key K, position string) *V {
+	value, found := m.values[key]
+	if !found {
+		fail(position, fmt.Sprintf("key %v not in map", key))
+	}
+	return value
+}
+
+func (m *omap[K, V]) get(key K, position string) V {
+	return *m.at(key, position)
+}
+
+func (m *omap[K, V]) set(key K, value V) {
+	if element, found := m.values[key]; found {
+		*element = value
+		return
+	}
+	m.keys = append(m.keys, key)
+	m.values[key] = &value
+}
+
+func (m *omap[K, V]) has(key K) bool {
+	_, found := m.values[key]
+	return found
+}
+
+func (m *omap[K, V]) del(key K) {
+	if _, found := m.values[key]; !found {
+		return
+	}
+	delete(m.values, key)
+	for i, other := range m.keys {
+		if other == key {
+			m.keys = append(m.keys[:i], m.keys[i+1:]...)
+			break
+		}
+	}
+}
+
+// keyList returns a copy of the keys, so that a loop over them is not
+// affected by changes to the map.
+func (m *omap[K, V]) keyList() []K {
+	return append([]K(nil), m.keys...)
+}
+
+func (m *omap[K, V]) len() int {
+	return len(m.keys)
+}
+
+func (m *omap[K, V]) String() string {
+	entries := ""
+	for i, key := range m.keys {
+		if i > 0 {
+			entries += ", "
+		}
+		entries += fmt.Sprintf("%v: %s", key, show(*m.values[key]))
+	}
+	return m.name + "{" + entries + "}"
+}
+
+// optional is the value of an optional type, none unless ok is set.
+type optional[T any] struct {
+	ok    bool
+	value T
+}
+
+func some[T any](value T) optional[T] {
+	return optional[T]{ok: true, value: value}
+}
+
+// unwrap stores the value o holds in v, reporting whether it holds one.
+func unwrap[T any](o optional[T], v *T) bool {
+	if o.ok {
+		*v = o.value
+	}
+	return o.ok
+}
+
+func (o optional[T]) String() string {
+	if !o.ok {
+		return "none"
+	}
+	return show(o.value)
+}
+
+// array is a fixed length list of values, shared like maps.
+type array[V any] struct {
+	name   string
+	values []V
+}
+
+func newArray[V any](name string, values ...V) *array[V] {
+	return &array[V]{name: name, values: values}
+}
+
+func (a *array[V]) at(index int, position string) *V {
+	if index < 0 || index >= len(a.values) {
+		fail(position, fmt.Sprintf("index %d out of range for length %d", index, len(a.values)))
+	}
+	return &a.values[index]
+}
+
+func (a *array[V]) get(index int, position string) V {
+	return *a.at(index, position)
+}
+
+func (a *array[V]) len() int {
+	return len(a.values)
+}
+
+func (a *array[V]) String() string {
+	values := ""
+	for i, v := range a.values {
+		if i > 0 {
+			values += ", "
+		}
+		values += show(v)
+	}
+	return a.name + "{" + values + "}"
+}
+
+func euclid(x, y uint64) uint64 {
+	for y != 0 {
+		x, y = y, x%y
+	}
+	return x
+}
+
+// magnitude returns the absolute value of a, which fits in a uint64 even for
+// minInt.
+func magnitude(a int) uint64 {
+	if a < 0 {
+		return -uint64(a)
+	}
+	return uint64(a)
+}
+`
+
+// tasksSource is appended to programs that spawn tasks. It schedules them
+// like the interpreter: only the task holding the lock runs, until it
+// finishes or blocks on a channel.
+const tasksSource = `
+type scheduler struct {
+	lock    sync.Mutex
+	changed *sync.Cond
+	count   int
+	blocked int
+	last    int
+	failure *runtimeError
+	waiting string
+}
+
+var tasks *scheduler
+
+// running is the id of the task holding the lock, 0 for the main one.
+var running int
+
+func schedule() *scheduler {
+	if tasks == nil {
+		tasks = &scheduler{count: 1}
+		tasks.changed = sync.NewCond(&tasks.lock)
+		tasks.lock.Lock()
+	}
+	return tasks
+}
+
+func (t *scheduler) notify() {
+	t.blocked = 0
+	t.changed.Broadcast()
+}
+
+// spawn runs f as a new task. The first runtime error a task fails with is
+// kept for the others to fail with as soon as they wait.
+func spawn(f func()) {
+	t := schedule()
+	t.count++
+	t.last++
+	id := t.last
+	go func() {
+		t.lock.Lock()
+		running = id
+		defer func() {
+			if r := recover(); r != nil && t.failure == nil {
+				t.failure = caught(r)
+			}
+			t.count--
+			t.notify()
+			t.lock.Unlock()
+		}()
+		f()
+	}()
+}
+
+// wait blocks the running task until ready reports that it can go on,
+// failing when another task failed or every task is blocked.
+func wait(position string, ready func() bool) {
+	t := schedule()
+	self := running
+	for t.failure == nil && !ready() {
+		if t.blocked+1 == t.count {
+			at := position
+			if at == "" {
+				at = t.waiting
+			}
+			t.failure = newError(at, "all tasks are blocked")
+			t.notify()
+			break
+		}
+		if position != "" {
+			t.waiting = position
+		}
+		t.blocked++
+		t.changed.Wait()
+		running = self
+	}
+	if t.failure != nil {
+		panic(t.failure)
+	}
+}
+
+// join waits for the tasks to finish at the end of the program.
+func join() {
+	if tasks != nil {
+		wait("", func() bool { return tasks.count == 1 })
+	}
+}
+
+// owns fails when the running task changes a variable of another task.
+func owns(owner int, action, name, position string) {
+	if owner != running {
+		fail(position, fmt.Sprintf("cannot %s %s, which belongs to another task", action, name))
+	}
+}
+
+// channel is the value of a channel, shared like maps. values holds the
+// values sent and not received yet.
+type channel[V any] struct {
+	name      string
+	values    []V
+	capacity  int
+	closed    bool
+	receivers int
+}
+
+func newChan[V any](name string, capacity int, position string) *channel[V] {
+	if capacity < 0 {
+		fail(position, fmt.Sprintf("negative channel capacity %d", capacity))
+	}
+	return &channel[V]{name: name, capacity: capacity}
+}
+
+func (c *channel[V]) canSend() bool {
+	return c.closed || len(c.values) < max(c.capacity, c.receivers)
+}
+
+func (c *channel[V]) canRecv() bool {
+	return c.closed || len(c.values) > 0
+}
+
+func (c *channel[V]) send(value V, position string) {
+	wait(position, c.canSend)
+	c.put(value, position)
+}
+
+func (c *channel[V]) put(value V, position string) {
+	if c.closed {
+		fail(position, "send on closed channel")
+	}
+	c.values = append(c.values, value)
+	schedule().notify()
+}
+
+func (c *channel[V]) recv(position string) optional[V] {
+	c.receivers++
+	schedule().notify()
+	defer func() { c.receivers-- }()
+	wait(position, c.canRecv)
+	return c.take()
+}
+
+func (c *channel[V]) take() optional[V] {
+	if len(c.values) == 0 {
+		return optional[V]{}
+	}
+	value := c.values[0]
+	c.values = c.values[1:]
+	schedule().notify()
+	return some(value)
+}
+
+func (c *channel[V]) close(position string) {
+	if c.closed {
+		fail(position, "close of closed channel")
+	}
+	c.closed = true
+	schedule().notify()
+}
+
+func (c *channel[V]) String() string {
+	values := ""
+	for i, v := range c.values {
+		if i > 0 {
+			values += ", "
+		}
+		values += show(v)
+	}
+	if c.closed {
+		return c.name + "{" + values + "} closed"
+	}
+	return c.name + "{" + values + "}"
+}
+
+// selectArm is an arm of a select, receiving unless receivers is nil.
+type selectArm struct {
+	ready     func() bool
+	receivers *int
+}
+
+func (c *channel[V]) receiving() selectArm {
+	return selectArm{ready: c.canRecv, receivers: &c.receivers}
+}
+
+func (c *channel[V]) sending() selectArm {
+	return selectArm{ready: c.canSend}
+}
+
+// choose returns the first of arms that can go on. Without one, it waits for
+// one unless fallback is set, for which it returns -1.
+func choose(position string, fallback bool, arms ...selectArm) int {
+	chosen := -1
+	ready := func() bool {
+		for i, arm := range arms {
+			if arm.ready() {
+				chosen = i
+				return true
+			}
+		}
+		return false
+	}
+	if ready() || fallback {
+		return chosen
+	}
+	for _, arm := range arms {
+		if arm.receivers != nil {
+			*arm.receivers++
+		}
+	}
+	defer func() {
+		for _, arm := range arms {
+			if arm.receivers != nil {
+				*arm.receivers--
+			}
+		}
+	}()
+	schedule().notify()
+	wait(position, ready)
+	return chosen
+}
+`
+
+// nativeSources holds Go implementations of the built-in math functions,
+// mirroring intpr.MathModule. Every native takes the call position last.
+var nativeSources = map[string]string{
+	"abs": `
+func native_abs(x int, position string) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+`,
+	"min": `
+func native_min(a int, rest *array[int], position string) int {
+	for _, b := range rest.values {
+		if b < a {
+			a = b
+		}
+	}
+	return a
+}
+`,
+	"max": `
+func native_max(a int, rest *array[int], position string) int {
+	for _, b := range rest.values {
+		if b > a {
+			a = b
+		}
+	}
+	return a
+}
+`,
+	"pow": `
+func native_pow(a, n int, position string) int {
+	result, _ := intPow(a, n, position)
+	return result
+}
+`,
+	"sqrt": `
+func native_sqrt(x int, position string) int {
+	if x < 0 {
+		fail(position, "sqrt: negative argument")
+	}
+	lo, hi := 0, 3037000499
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if mid*mid <= x {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return lo
+}
+`,
+	"gcd": `
+func native_gcd(a, b int, position string) int {
+	result := euclid(magnitude(a), magnitude(b))
+	if result > 1<<63-1 {
+		fail(position, "integer overflow in gcd")
+	}
+	return int(result)
+}
+`,
+	"lcm": `
+func native_lcm(a, b int, position string) int {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	x, y := magnitude(a), magnitude(b)
+	factor := x / euclid(x, y)
+	result := factor * y
+	if result/y != factor || result > 1<<63-1 {
+		fail(position, "integer overflow in lcm")
+	}
+	return int(result)
+}
+`,
+	"clamp": `
+func native_clamp(x, lo, hi int, position string) int {
+	if lo > hi {
+		fail(position, "clamp: lower bound is greater than upper bound")
+	}
+	if x < lo {
+		return lo
+	}
+	if x > hi {
+		return hi
+	}
+	return x
+}
+`,
+	"checkedAbs": `
+func native_checkedAbs(x int, position string) int {
+	if x == minInt {
+		fail(position, "integer overflow in checkedAbs")
+	}
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+`,
+	"checkedAdd": `
+func native_checkedAdd(a, b int, position string) int {
+	result := a + b
+	if (result > a) != (b > 0) {
+		fail(position, "integer overflow in checkedAdd")
+	}
+	return result
+}
+`,
+	"checkedSub": `
+func native_checkedSub(a, b int, position string) int {
+	result := a - b
+	if (result < a) != (b > 0) {
+		fail(position, "integer overflow in checkedSub")
+	}
+	return result
+}
+`,
+	"checkedMul": `
+func native_checkedMul(a, b int, position string) int {
+	result, ok := mulOk(a, b)
+	if !ok {
+		fail(position, "integer overflow in checkedMul")
+	}
+	return result
+}
+`,
+	"checkedPow": `
+func native_checkedPow(a, n int, position string) int {
+	result, ok := intPow(a, n, position)
+	if !ok {
+		fail(position, "integer overflow in checkedPow")
+	}
+	return result
+}
+`,
+}
@@ -5,29 +5,23 @@ import (
 	"simpl/tokens"
 )
 
-type DataType int
-
-const (
-	Invalid DataType = iota
-	Bool
-	Int
-	Void
-	Func
+var (
+	Invalid = DataType{}
+	Bool    = builtin("bool")
+	Int     = builtin("int")
+	Void    = builtin("void")
+	Func    = builtin("func")
+	String  = builtin("string")
+	// None is the type of the none literal until the parser gives it the
+	// optional type expected where it is used
+	None = builtin("none")
 )
 
 func (t DataType) View() string {
-	switch t {
-	case Invalid:
+	if t.info == nil {
 		return "invalid"
-	case Bool:
-		return "bool"
-	case Int:
-		return "int"
-	case Void:
-		return "void"
-	default:
-		return "unknown"
 	}
+	return t.info.Name
 }
 
 type Statement interface {
@@ -35,23 +29,133 @@ type Statement interface {
 	Visualize()
 }
 
+// Position returns the token a statement starts at, to report errors about
+// the statement as a whole. The scope markers have none.
+func Position(stmt Statement) tokens.Token {
+	switch s := stmt.(type) {
+	case *Assignment:
+		return s.Var
+	case *Destructure:
+		return s.Vars[0]
+	case *VoidCall:
+		return s.NameToken
+	case *Conditional:
+		return s.Token
+	case *Match:
+		return s.Token
+	case *For:
+		return s.Token
+	case *ForIn:
+		return s.Token
+	case *Def:
+		return s.Token
+	case *Spawn:
+		return s.Token
+	case *Select:
+		return s.Token
+	case *Try:
+		return s.Token
+	case *Raise:
+		return s.Token
+	case *Return:
+		return s.Token
+	case *Break:
+		return s.Token
+	case *Continue:
+		return s.Token
+	case *StructDef:
+		return s.Token
+	case *EnumDef:
+		return s.Token
+	}
+	return tokens.Token{}
+}
+
 type Program struct {
 	Statements []Statement
+	// Variables is the layout of the global frame, set for the whole program
+	Variables []Variable
+	// Concurrent is set for the whole program when it uses tasks or
+	// channels
+	Concurrent bool
+	// Types holds the composite types of the program, set for the whole
+	// program
+	Types *Types
+	// Frame is set for a loop body that runs every iteration in a frame of
+	// its own, laid out as Variables, so that the tasks spawned by an
+	// iteration keep its variables while the next one runs
+	Frame bool
 }
 
+// Expression nodes for variables and calls refer to a slot Depth frames up
+// from the current one. Calls of generic built-ins have Builtin set instead
+// of a slot.
+//
+// Constant holds the value of NUMBER, TRUE, FALSE and STRING literals, and
+// the index of a VARIANT.
+//
+// A DOT node reads field Slot of the struct Left evaluates to.
+//
+// A LEFT_BRACKET node reads the element of map or array Left under key
+// Right.
+//
+// A LEFT_BRACE node is a literal. For a struct its Args are the fields in
+// order, nil for the ones left out; for a map they are keys and values in
+// turn; for an array they are the elements.
+//
+// A COMMA node returns its Args together, as a tuple.
+//
+// A SOME node wraps the value of Left into an optional, and an IS node
+// stores the value the optional Left holds into the variable Right.
+//
+// A CHAN node makes a channel with room for as many values as Left
+// evaluates to, an unbuffered one when Left is nil.
 type Expression struct {
 	DataType DataType
 	Args     []*Expression
 	Token    tokens.Token
 	Left     *Expression
 	Right    *Expression
-	Scope    int
+	Depth    int
+	Slot     int
+	Constant Value
+	Builtin  Builtin
+}
+
+// Builtin names a generic built-in function. They take arguments of more
+// than one type, so the parser checks their calls itself.
+type Builtin int
+
+const (
+	NoBuiltin Builtin = iota
+	LenBuiltin
+	HasBuiltin
+	DeleteBuiltin
+	// ConvertBuiltin turns an enum into an int or an int into an enum, the
+	// call being named after the type converted to
+	ConvertBuiltin
+	SendBuiltin
+	RecvBuiltin
+	CloseBuiltin
+)
+
+// Selector picks a part of a composite value on the left of an assignment:
+// the element under key Index of a map, or field Field of a struct when
+// Index is nil.
+type Selector struct {
+	Token tokens.Token
+	Field int
+	Index *Expression
 }
 
+// Assignment to a part of a struct or map variable has the way to that part
+// in Path and its type in DataType.
 type Assignment struct {
 	Statement
 	Explicit bool
-	VarScope int
+	Depth    int
+	Slot     int
+	Path     []Selector
 	DataType DataType
 	Operator tokens.Token
 	Var      tokens.Token
@@ -66,6 +170,23 @@ type Conditional struct {
 	Else      *Program
 }
 
+// Match runs the block of the first arm with a value equal to Subject, or
+// Default if there is none. The values are evaluated in order until one
+// matches. Exhaustive is set when some arm runs whatever the subject is.
+type Match struct {
+	Statement
+	Token      tokens.Token
+	Subject    *Expression
+	Arms       []MatchArm
+	Default    *Program
+	Exhaustive bool
+}
+
+type MatchArm struct {
+	Values []*Expression
+	Block  *Program
+}
+
 type For struct {
 	Statement
 	Token     tokens.Token
@@ -75,51 +196,174 @@ type For struct {
 	Block     *Program
 }
 
+// ForIn runs Block once for every int from Start up to but not including
+// End, for every key of the map Collection in insertion order, or for every
+// element of the array Collection. The bounds and the keys are taken once
+// before the first iteration, and the loop variable in Slot is set afresh at
+// the start of every iteration.
+type ForIn struct {
+	Statement
+	Token      tokens.Token
+	Var        tokens.Token
+	Slot       int
+	DataType   DataType
+	Start      *Expression
+	End        *Expression
+	Collection *Expression
+	Block      *Program
+}
+
 type Def struct {
 	Statement
-	Scope          int
+	Slot           int
 	DataType       DataType
 	Token          tokens.Token
 	NameToken      tokens.Token
 	Params         []DefParam
 	Body           *Program
 	ReturnBranches []*Expression
+	// Variables is the layout of the frame of a call, starting with the params
+	Variables []Variable
+	// TypeParams are set for a generic function, which is never called
+	// itself: each list of type arguments it is called with gets one of
+	// Instances, parsed again with the params standing for the arguments,
+	// and the def defines the instances in its place
+	TypeParams []DataType
+	Instances  []*Def
 }
 
 type DefParam struct {
 	NameToken tokens.Token
 	DataType  DataType
+	// Default is the constant passed when a call leaves the param out, nil
+	// for a param every call has to pass
+	Default *Expression
+	// Variadic is set for a last param that takes the remaining arguments
+	// of a call as an array, DataType is the array type
+	Variadic bool
 }
 
 type Function struct {
-	Scope    int
-	DataType DataType
-	Params   []DefParam
-	Body     *Program
-	Returns  []*Expression
+	DataType  DataType
+	Params    []DefParam
+	Body      *Program
+	Returns   []*Expression
+	Variables []Variable
+	Env       *Frame
+	Native    func(args []int) (int, *errors.Error)
+	// Checked replaces Native when memory checks for overflow
+	Checked func(args []int) (int, *errors.Error)
+}
+
+// Spawn starts a call of the function in Slot as a task of its own, which
+// runs while the spawning code goes on. The arguments are evaluated by the
+// spawning task.
+type Spawn struct {
+	Statement
+	Token     tokens.Token
+	NameToken tokens.Token
+	Depth     int
+	Slot      int
+	Args      []*Expression
+}
+
+// Select runs the block of the first of Arms that can receive from or send
+// to its channel, waiting until one can. With a Default, it runs that
+// instead of waiting.
+type Select struct {
+	Statement
+	Token   tokens.Token
+	Arms    []SelectArm
+	Default *Program
+}
+
+// SelectArm sends Value to Channel, or receives from it when Value is nil,
+// storing what it receives as an optional in Slot. Slot is -1 when the arm
+// does not name the value.
+type SelectArm struct {
+	Token   tokens.Token
+	Channel *Expression
+	Value   *Expression
+	Var     tokens.Token
+	Slot    int
+	Block   *Program
 }
 
 type Break struct {
 	Statement
+	Token tokens.Token
 }
 
 type Continue struct {
 	Statement
+	Token tokens.Token
+}
+
+// Destructure assigns the values returned by a function with several
+// results to variables, in order. Names of "_" are discarded and get a Slot
+// of -1.
+type Destructure struct {
+	Statement
+	Vars     []tokens.Token
+	Depths   []int
+	Slots    []int
+	Operator tokens.Token
+	Exp      *Expression
+}
+
+// Try runs Body and, if a runtime error comes out of it, Catch with the
+// error stored in Slot as an ErrorType struct. Slot is -1 when the catch
+// block does not name the error.
+type Try struct {
+	Statement
+	Token tokens.Token
+	Body  *Program
+	Var   tokens.Token
+	Slot  int
+	Catch *Program
+}
+
+// Raise raises a runtime error with the message Exp evaluates to.
+type Raise struct {
+	Statement
+	Token tokens.Token
+	Exp   *Expression
 }
 
 type Return struct {
 	Statement
+	Token    tokens.Token
 	DataType DataType
 	Id       int
 }
 
 type VoidCall struct {
 	Statement
-	Scope     int
+	Depth     int
+	Slot      int
+	Builtin   Builtin
 	NameToken tokens.Token
 	Args      []*Expression
 }
 
+// StructDef declares a struct type. The parser resolves uses of the type,
+// so it has nothing to do at runtime.
+type StructDef struct {
+	Statement
+	Token     tokens.Token
+	NameToken tokens.Token
+	DataType  DataType
+}
+
+// EnumDef declares an enum type. Like StructDef, it has nothing to do at
+// runtime.
+type EnumDef struct {
+	Statement
+	Token     tokens.Token
+	NameToken tokens.Token
+	DataType  DataType
+}
+
 type OpenScope struct {
 	Statement
 }
@@ -1,92 +1,369 @@
 package intpr
 
 import (
+	"fmt"
 	"simpl/errors"
 	"simpl/tokens"
-	"strconv"
 )
 
-func (e *Expression) evalInt(mem *Memory) (int, *errors.Error) {
-	if e.DataType != Int {
-		return 0, &errors.Error{Message: "Expected int", Type: errors.TypeError, Token: e.Token}
+func (e *Expression) eval(mem *Memory) (Value, *errors.Error) {
+	switch e.DataType {
+	case Int:
+		val, err := e.evalInt(mem)
+		return Value{Int: val}, err
+	case Bool:
+		val, err := e.evalBool(mem)
+		return Value{Bool: val}, err
+	}
+	if e.DataType == String || e.DataType.Type() != nil {
+		return e.evalRef(mem)
 	}
+	return Value{}, &errors.Error{Message: "unexpected expression type", Type: errors.RuntimeError, Token: e.Token}
+}
+
+// evalRef evaluates expressions of strings and composite types.
+func (e *Expression) evalRef(mem *Memory) (Value, *errors.Error) {
 	switch e.Token.Type {
-	case tokens.NUMBER:
-		val, err := strconv.Atoi(e.Token.Value)
+	case tokens.STRING, tokens.VARIANT:
+		return e.Constant, nil
+	case tokens.NONE:
+		return Value{}, nil
+	case tokens.SOME:
+		val, err := e.Left.eval(mem)
 		if err != nil {
-			return 0, &errors.Error{Message: "NaN", Type: errors.TypeError, Token: e.Token}
+			return Value{}, err
 		}
-		return val, nil
+		return Value{Ref: Copy(val)}, nil
+	case tokens.DOUBLE_QUESTION:
+		return e.orElse(mem)
+	case tokens.CHAN:
+		return e.makeChannel(mem)
 	case tokens.IDENTIFIER:
 		if e.Args == nil {
-			return mem.GetInt(e.Token, e.Scope)
+			return mem.Get(e.Depth, e.Slot), nil
 		}
-		fn, err := mem.GetFunc(e.Token, e.Scope)
-		if err != nil {
-			return 0, err
+		return e.call(mem)
+	case tokens.DOT:
+		return e.field(mem)
+	case tokens.LEFT_BRACKET:
+		return e.index(mem)
+	case tokens.COMMA:
+		values := make([]Value, len(e.Args))
+		for i, a := range e.Args {
+			val, err := a.eval(mem)
+			if err != nil {
+				return Value{}, err
+			}
+			values[i] = val
 		}
-		mem.Extend()
-		for i, p := range fn.Params {
-			switch p.DataType {
-			case Int:
-				val, err := e.Args[i].evalInt(mem)
-				if err != nil {
-					return 0, err
-				}
-				mem.SetInt(p.NameToken, val)
-			case Bool:
-				val, err := e.Args[i].evalBool(mem)
-				if err != nil {
-					return 0, err
-				}
-				mem.SetBool(p.NameToken, val)
-			default:
-				return 0, &errors.Error{Message: "unexpected argument type", Type: errors.RuntimeError, Token: p.NameToken}
+		return Value{Ref: &Tuple{Values: values}}, nil
+	}
+	if e.DataType.IsArray() {
+		values := make([]Value, len(e.Args))
+		for i, a := range e.Args {
+			val, err := a.eval(mem)
+			if err != nil {
+				return Value{}, err
 			}
+			values[i] = Copy(val)
 		}
-		var returnResult int
-		var returnErr *errors.Error
-		for _, s := range fn.Body.Statements {
-			err := s.Execute(mem)
+		return Value{Ref: &Array{Values: values}}, nil
+	}
+	if e.DataType.IsMap() {
+		m := NewMap()
+		for i := 0; i < len(e.Args); i += 2 {
+			key, err := e.Args[i].eval(mem)
 			if err != nil {
-				if err.Type == errors.Return {
-					exp := fn.Returns[err.MessageId]
-					returnResult, returnErr = exp.evalInt(mem)
-				}
-				break
+				return Value{}, err
+			}
+			value, err := e.Args[i+1].eval(mem)
+			if err != nil {
+				return Value{}, err
 			}
+			m.Set(key, Copy(value))
+		}
+		return Value{Ref: m}, nil
+	}
+	fields := make([]Value, len(e.Args))
+	for i, a := range e.Args {
+		if a == nil {
+			fields[i] = Zero(e.DataType.Type().Fields[i].DataType)
+			continue
+		}
+		val, err := a.eval(mem)
+		if err != nil {
+			return Value{}, err
 		}
-		mem.Shrink()
-		return returnResult, returnErr
+		fields[i] = Copy(val)
 	}
+	return Value{Ref: &Struct{Fields: fields}}, nil
+}
 
-	left, err := e.Left.evalInt(mem)
+// orElse evaluates a ?? b: the value a holds, or b when a is none. b is only
+// evaluated when it is needed, and is an optional itself when the result is.
+func (e *Expression) orElse(mem *Memory) (Value, *errors.Error) {
+	optional, err := e.Left.eval(mem)
 	if err != nil {
-		return 0, err
+		return Value{}, err
 	}
-	right, err := e.Right.evalInt(mem)
+	if optional.Ref == nil {
+		return e.Right.eval(mem)
+	}
+	if e.DataType == e.Left.DataType {
+		return optional, nil
+	}
+	return optional.Ref.(Value), nil
+}
+
+// makeChannel evaluates a CHAN node. The capacity of a channel cannot be
+// negative.
+func (e *Expression) makeChannel(mem *Memory) (Value, *errors.Error) {
+	capacity := 0
+	if e.Left != nil {
+		var err *errors.Error
+		capacity, err = e.Left.evalInt(mem)
+		if err != nil {
+			return Value{}, err
+		}
+	}
+	if capacity < 0 {
+		return Value{}, &errors.Error{Message: fmt.Sprintf("negative channel capacity %d", capacity), Type: errors.RuntimeError, Token: e.Token}
+	}
+	return Value{Ref: &Channel{Capacity: capacity}}, nil
+}
+
+// unwrap evaluates the condition x is some v, storing the value x holds in
+// v when there is one.
+func (e *Expression) unwrap(mem *Memory) (bool, *errors.Error) {
+	optional, err := e.Left.eval(mem)
+	if err != nil || optional.Ref == nil {
+		return false, err
+	}
+	mem.Set(e.Right.Slot, Copy(optional.Ref.(Value)))
+	return true, nil
+}
+
+func (e *Expression) field(mem *Memory) (Value, *errors.Error) {
+	val, err := e.Left.eval(mem)
 	if err != nil {
-		return 0, err
+		return Value{}, err
+	}
+	return val.Ref.(*Struct).Fields[e.Slot], nil
+}
+
+func (e *Expression) index(mem *Memory) (Value, *errors.Error) {
+	m, err := e.Left.eval(mem)
+	if err != nil {
+		return Value{}, err
 	}
+	key, err := e.Right.eval(mem)
+	if err != nil {
+		return Value{}, err
+	}
+	return lookup(m, e.Left.DataType, key, e.Token)
+}
+
+func lookup(m Value, dataType DataType, key Value, token tokens.Token) (Value, *errors.Error) {
+	if dataType.IsArray() {
+		element, err := m.Ref.(*Array).At(key.Int, token)
+		if err != nil {
+			return Value{}, err
+		}
+		return *element, nil
+	}
+	value, found := m.Ref.(*Map).Get(key)
+	if !found {
+		return Value{}, &errors.Error{Message: fmt.Sprintf("key %s not in map", Format(dataType.Type().Key, key)), Type: errors.RuntimeError, Token: token}
+	}
+	return value, nil
+}
+
+// callBuiltin runs a generic built-in. The ones for maps take a map first,
+// or an array for len, and the ones for channels a channel.
+func callBuiltin(builtin Builtin, args []*Expression, token tokens.Token, mem *Memory) (Value, *errors.Error) {
+	switch builtin {
+	case SendBuiltin, RecvBuiltin, CloseBuiltin:
+		return channelBuiltin(builtin, args, token, mem)
+	}
+	if v := args[0].Variable(); builtin == DeleteBuiltin && v != nil {
+		if err := mem.owns(v.Depth, v.Token, "delete from"); err != nil {
+			return Value{}, err
+		}
+	}
+	m, err := args[0].eval(mem)
+	if err != nil {
+		return Value{}, err
+	}
+	if builtin == LenBuiltin {
+		if array, ok := m.Ref.(*Array); ok {
+			return Value{Int: len(array.Values)}, nil
+		}
+		return Value{Int: m.Ref.(*Map).Len()}, nil
+	}
+	key, err := args[1].eval(mem)
+	if err != nil {
+		return Value{}, err
+	}
+	if builtin == DeleteBuiltin {
+		m.Ref.(*Map).Delete(key)
+		return Value{}, nil
+	}
+	_, found := m.Ref.(*Map).Get(key)
+	return Value{Bool: found}, nil
+}
 
+// Variable returns the variable e reads or selects a field or element of,
+// nil when e does not start from a variable.
+func (e *Expression) Variable() *Expression {
 	switch e.Token.Type {
-	case tokens.PLUS:
-		return left + right, nil
-	case tokens.MINUS:
-		return left - right, nil
-	case tokens.STAR:
-		return left * right, nil
-	case tokens.SLASH:
-		if right == 0 {
-			return 0, &errors.Error{Message: "zero division not allowed", Token: e.Token, Type: errors.RuntimeError}
+	case tokens.IDENTIFIER:
+		if e.Args == nil {
+			return e
 		}
-		return left / right, nil
-	default:
-		if right == 0 {
-			return 0, &errors.Error{Message: "zero division not allowed", Token: e.Token, Type: errors.RuntimeError}
+	case tokens.DOT, tokens.LEFT_BRACKET:
+		return e.Left.Variable()
+	}
+	return nil
+}
+
+func channelBuiltin(builtin Builtin, args []*Expression, token tokens.Token, mem *Memory) (Value, *errors.Error) {
+	c, err := args[0].eval(mem)
+	if err != nil {
+		return Value{}, err
+	}
+	channel := c.Ref.(*Channel)
+	switch builtin {
+	case RecvBuiltin:
+		return mem.recv(channel, token)
+	case CloseBuiltin:
+		return Value{}, mem.close(channel, token)
+	}
+	value, err := args[1].eval(mem)
+	if err != nil {
+		return Value{}, err
+	}
+	return Value{}, mem.send(channel, value, token)
+}
+
+// convert turns an int into an enum or an enum into an int. Both are held as
+// ints, so only the range of the enum needs checking.
+func (e *Expression) convert(mem *Memory) (Value, *errors.Error) {
+	val, err := e.Args[0].eval(mem)
+	if err != nil {
+		return Value{}, err
+	}
+	info := e.DataType.Type()
+	if info != nil && (val.Int < 0 || val.Int >= len(info.Variants)) {
+		return Value{}, &errors.Error{Message: fmt.Sprintf("%d is not a variant of enum %s", val.Int, info.Name), Type: errors.RuntimeError, Token: e.Token}
+	}
+	return Value{Int: val.Int}, nil
+}
+
+// call runs the called function and evaluates the returned expression in the
+// frame of the call.
+func (e *Expression) call(mem *Memory) (Value, *errors.Error) {
+	if e.Builtin == ConvertBuiltin {
+		return e.convert(mem)
+	}
+	if e.Builtin != NoBuiltin {
+		return callBuiltin(e.Builtin, e.Args, e.Token, mem)
+	}
+	fn, err := mem.GetFunc(e.Token, e.Depth, e.Slot)
+	if err != nil {
+		return Value{}, err
+	}
+	if fn.Native != nil {
+		val, err := callNative(fn, e.Args, e.Token, mem)
+		return Value{Int: val}, err
+	}
+	err = enter(fn, e.Args, mem)
+	if err != nil {
+		return Value{}, err
+	}
+	var returnResult Value
+	var returnErr *errors.Error
+	returned := false
+	for _, s := range fn.Body.Statements {
+		err := s.Execute(mem)
+		if err != nil {
+			if err.Type == errors.Return {
+				returnResult = mem.Frame.Result
+			} else {
+				returnErr = err
+			}
+			returned = true
+			break
+		}
+	}
+	mem.Pop()
+	if !returned {
+		// a function that runs off its end returns the zero value
+		returnResult = Zero(fn.DataType)
+	}
+	return returnResult, returnErr
+}
+
+// enter evaluates the arguments in the frame of the caller, then pushes the
+// frame of the call with the parameters in its first slots.
+func enter(fn *Function, args []*Expression, mem *Memory) *errors.Error {
+	frame := NewFrame(fn.Variables, fn.Env)
+	for i, a := range args {
+		val, err := a.eval(mem)
+		if err != nil {
+			return err
 		}
-		return left % right, nil
+		frame.Values[i] = Copy(val)
 	}
+	frame.Top = len(args)
+	frame.Function = fn
+	frame.Task = mem.Task
+	mem.Push(frame)
+	return nil
+}
+
+func (e *Expression) evalInt(mem *Memory) (int, *errors.Error) {
+	if e.DataType != Int {
+		return 0, &errors.Error{Message: "Expected int", Type: errors.TypeError, Token: e.Token}
+	}
+	switch e.Token.Type {
+	case tokens.NUMBER:
+		return e.Constant.Int, nil
+	case tokens.DOT:
+		val, err := e.field(mem)
+		return val.Int, err
+	case tokens.LEFT_BRACKET:
+		val, err := e.index(mem)
+		return val.Int, err
+	case tokens.IDENTIFIER:
+		if e.Args == nil {
+			return mem.GetInt(e.Depth, e.Slot), nil
+		}
+		val, err := e.call(mem)
+		return val.Int, err
+	case tokens.NEGATE:
+		value, err := e.Left.evalInt(mem)
+		if err != nil {
+			return 0, err
+		}
+		return arithmetic(e.Token, 0, value, mem.CheckOverflow)
+	case tokens.TILDE:
+		value, err := e.Left.evalInt(mem)
+		return ^value, err
+	case tokens.DOUBLE_QUESTION:
+		val, err := e.orElse(mem)
+		return val.Int, err
+	}
+
+	left, err := e.Left.evalInt(mem)
+	if err != nil {
+		return 0, err
+	}
+	right, err := e.Right.evalInt(mem)
+	if err != nil {
+		return 0, err
+	}
+
+	return arithmetic(e.Token, left, right, mem.CheckOverflow)
 }
 
 func (e *Expression) evalBool(mem *Memory) (bool, *errors.Error) {
@@ -98,55 +375,41 @@ func (e *Expression) evalBool(mem *Memory) (bool, *errors.Error) {
 		return true, nil
 	case tokens.FALSE:
 		return false, nil
+	case tokens.IS:
+		return e.unwrap(mem)
+	case tokens.DOUBLE_QUESTION:
+		val, err := e.orElse(mem)
+		return val.Bool, err
 	case tokens.BANG:
 		value, err := e.Left.evalBool(mem)
 		if err != nil {
 			return false, err
 		}
 		return !value, nil
+	case tokens.DOT:
+		val, err := e.field(mem)
+		return val.Bool, err
+	case tokens.LEFT_BRACKET:
+		val, err := e.index(mem)
+		return val.Bool, err
 	case tokens.IDENTIFIER:
 		if e.Args == nil {
-			return mem.GetBool(e.Token, e.Scope)
+			return mem.GetBool(e.Depth, e.Slot), nil
 		}
-		fn, err := mem.GetFunc(e.Token, e.Scope)
-		if err != nil {
-			return false, err
-		}
-		mem.Extend()
-		for i, p := range fn.Params {
-			switch p.DataType {
-			case Int:
-				val, err := e.Args[i].evalInt(mem)
-				if err != nil {
-					return false, err
-				}
-				mem.SetInt(p.NameToken, val)
-			case Bool:
-				val, err := e.Args[i].evalBool(mem)
-				if err != nil {
-					return false, err
-				}
-				mem.SetBool(p.NameToken, val)
-			default:
-				return false, &errors.Error{Message: "unexpected argument type", Type: errors.RuntimeError, Token: p.NameToken}
+		val, err := e.call(mem)
+		return val.Bool, err
+	case tokens.DOUBLE_EQUAL, tokens.NOT_EQUAL:
+		if e.Left.DataType != Int && e.Left.DataType != Bool {
+			left, err := e.Left.eval(mem)
+			if err != nil {
+				return false, err
 			}
-		}
-		var returnResult bool
-		var returnErr *errors.Error
-		for _, s := range fn.Body.Statements {
-			err := s.Execute(mem)
+			right, err := e.Right.eval(mem)
 			if err != nil {
-				if err.Type == errors.Return {
-					exp := fn.Returns[err.MessageId]
-					returnResult, returnErr = exp.evalBool(mem)
-				}
-				break
+				return false, err
 			}
-		}
-		mem.Shrink()
-		return returnResult, returnErr
-	case tokens.DOUBLE_EQUAL, tokens.NOT_EQUAL:
-		if e.Left.DataType == Bool {
+			return Equal(e.Left.DataType, left, right) == (e.Token.Type == tokens.DOUBLE_EQUAL), nil
+		} else if e.Left.DataType == Bool {
 			left, err := e.Left.evalBool(mem)
 			if err != nil {
 				return false, err
@@ -194,33 +457,82 @@ func (e *Expression) evalBool(mem *Memory) (bool, *errors.Error) {
 		}
 	}
 
+	// && and || only evaluate the right operand when the left one does not
+	// decide the result
 	left, err := e.Left.evalBool(mem)
 	if err != nil {
 		return false, err
 	}
-	right, err := e.Right.evalBool(mem)
-	if err != nil {
-		return false, err
+	if left == (e.Token.Type == tokens.OR) {
+		return left, nil
 	}
+	return e.Right.evalBool(mem)
+}
 
-	switch e.Token.Type {
-	case tokens.OR:
-		return left || right, nil
-	default:
-		return left && right, nil
+// Execute runs the statements of a program or block in the current frame.
+func (p *Program) Execute(mem *Memory) *errors.Error {
+	for _, stmt := range p.Statements {
+		err := stmt.Execute(mem)
+		if err != nil {
+			return err
+		}
 	}
+	return nil
+}
+
+// iterate runs the program as an iteration of a loop body, with value in
+// slot unless slot is negative. A body with a frame of its own pushes a new
+// one, which hands the value of a return statement over to the frame below.
+func (p *Program) iterate(mem *Memory, slot int, value Value) *errors.Error {
+	if !p.Frame {
+		if slot >= 0 {
+			mem.Set(slot, value)
+		}
+		return p.Execute(mem)
+	}
+	frame := NewFrame(p.Variables, mem.Frame)
+	frame.Function = mem.Frame.Function
+	frame.Task = mem.Task
+	mem.Push(frame)
+	if slot >= 0 {
+		mem.Set(slot, value)
+	}
+	err := p.Execute(mem)
+	mem.Pop()
+	if err != nil && err.Type == errors.Return {
+		mem.Frame.Result = frame.Result
+	}
+	return err
 }
 
 func (s *Assignment) Execute(mem *Memory) *errors.Error {
+	if !s.Explicit && s.Operator.Type != tokens.COLON_EQUAL {
+		if err := mem.owns(s.Depth, s.Var, "assign to"); err != nil {
+			return err
+		}
+	}
+	if s.Path != nil {
+		return s.executePath(mem)
+	}
+	if s.DataType == String || s.DataType.Type() != nil {
+		value, err := s.Exp.eval(mem)
+		if err != nil {
+			return err
+		}
+		if s.Explicit || s.Operator.Type == tokens.COLON_EQUAL {
+			mem.Set(s.Slot, Copy(value))
+		} else {
+			mem.Update(s.Depth, s.Slot, Copy(value))
+		}
+		return nil
+	}
 	switch s.DataType {
 	case Int:
 		switch s.Operator.Type {
 		case tokens.DOUBLE_PLUS:
-			mem.IncInt(s.Var, 1, s.VarScope)
-			return nil
+			return atOperator(mem.IncInt(s.Depth, s.Slot, 1), s.Operator)
 		case tokens.DOUBLE_MINUS:
-			mem.DecInt(s.Var, 1, s.VarScope)
-			return nil
+			return atOperator(mem.DecInt(s.Depth, s.Slot, 1), s.Operator)
 		}
 
 		value, err := s.Exp.evalInt(mem)
@@ -230,28 +542,34 @@ func (s *Assignment) Execute(mem *Memory) *errors.Error {
 		switch s.Operator.Type {
 		case tokens.EQUAL:
 			if s.Explicit {
-				mem.SetInt(s.Var, value)
+				mem.SetInt(s.Slot, value)
 			} else {
-				mem.UpdateInt(s.Var, value, s.VarScope)
+				mem.UpdateInt(s.Depth, s.Slot, value)
 			}
 		case tokens.PLUS_EQUAL:
-			mem.IncInt(s.Var, value, s.VarScope)
+			return atOperator(mem.IncInt(s.Depth, s.Slot, value), s.Operator)
 		case tokens.MINUS_EQUAL:
-			mem.DecInt(s.Var, value, s.VarScope)
+			return atOperator(mem.DecInt(s.Depth, s.Slot, value), s.Operator)
 		case tokens.STAR_EQUAL:
-			mem.MulInt(s.Var, value, s.VarScope)
+			return atOperator(mem.MulInt(s.Depth, s.Slot, value), s.Operator)
 		case tokens.SLASH_EQUAL:
 			if value == 0 {
 				return &errors.Error{Message: "zero division not allowed", Token: s.Operator, Type: errors.RuntimeError}
 			}
-			mem.DivInt(s.Var, value, s.VarScope)
+			return atOperator(mem.DivInt(s.Depth, s.Slot, value), s.Operator)
 		case tokens.MODULO_EQUAL:
 			if value == 0 {
 				return &errors.Error{Message: "zero division not allowed", Token: s.Operator, Type: errors.RuntimeError}
 			}
-			mem.ModInt(s.Var, value, s.VarScope)
+			mem.ModInt(s.Depth, s.Slot, value)
+		case tokens.AMPERSAND_EQUAL, tokens.PIPE_EQUAL, tokens.CARET_EQUAL, tokens.SHIFT_LEFT_EQUAL, tokens.SHIFT_RIGHT_EQUAL:
+			result, err := arithmetic(s.Operator, mem.GetInt(s.Depth, s.Slot), value, mem.CheckOverflow)
+			if err != nil {
+				return err
+			}
+			mem.UpdateInt(s.Depth, s.Slot, result)
 		case tokens.COLON_EQUAL:
-			mem.SetInt(s.Var, value)
+			mem.SetInt(s.Slot, value)
 		}
 	case Bool:
 		value, err := s.Exp.evalBool(mem)
@@ -261,17 +579,185 @@ func (s *Assignment) Execute(mem *Memory) *errors.Error {
 		switch s.Operator.Type {
 		case tokens.EQUAL:
 			if s.Explicit {
-				mem.SetBool(s.Var, value)
+				mem.SetBool(s.Slot, value)
 			} else {
-				mem.UpdateBool(s.Var, value, s.VarScope)
+				mem.UpdateBool(s.Depth, s.Slot, value)
 			}
 		case tokens.COLON_EQUAL:
-			mem.SetBool(s.Var, value)
+			mem.SetBool(s.Slot, value)
+		}
+	}
+	return nil
+}
+
+func (s *Destructure) Execute(mem *Memory) *errors.Error {
+	if s.Operator.Type != tokens.COLON_EQUAL {
+		for i, v := range s.Vars {
+			if s.Slots[i] < 0 {
+				continue
+			}
+			if err := mem.owns(s.Depths[i], v, "assign to"); err != nil {
+				return err
+			}
+		}
+	}
+	value, err := s.Exp.eval(mem)
+	if err != nil {
+		return err
+	}
+	for i, v := range value.Ref.(*Tuple).Values {
+		switch {
+		case s.Slots[i] < 0:
+		case s.Operator.Type == tokens.COLON_EQUAL:
+			mem.Set(s.Slots[i], Copy(v))
+		default:
+			mem.Update(s.Depths[i], s.Slots[i], Copy(v))
 		}
 	}
 	return nil
 }
 
+// executePath assigns to a part of a struct or map variable. The value is
+// evaluated before the variable is read, like for plain variables.
+func (s *Assignment) executePath(mem *Memory) *errors.Error {
+	var value Value
+	if s.Exp != nil {
+		var err *errors.Error
+		value, err = s.Exp.eval(mem)
+		if err != nil {
+			return err
+		}
+	}
+	target := mem.Get(s.Depth, s.Slot)
+	last := len(s.Path) - 1
+	for _, sel := range s.Path[:last] {
+		var err *errors.Error
+		target, err = sel.get(target, mem)
+		if err != nil {
+			return err
+		}
+	}
+	sel := s.Path[last]
+	if sel.Index == nil {
+		return apply(&target.Ref.(*Struct).Fields[sel.Field], s.Operator, value, mem.CheckOverflow)
+	}
+	key, err := sel.Index.eval(mem)
+	if err != nil {
+		return err
+	}
+	if array, ok := target.Ref.(*Array); ok {
+		element, err := array.At(key.Int, sel.Token)
+		if err != nil {
+			return err
+		}
+		return apply(element, s.Operator, value, mem.CheckOverflow)
+	}
+	m := target.Ref.(*Map)
+	if s.Operator.Type == tokens.EQUAL {
+		m.Set(key, Copy(value))
+		return nil
+	}
+	element, found := m.Get(key)
+	if !found {
+		return &errors.Error{Message: fmt.Sprintf("key %s not in map", Format(sel.Index.DataType, key)), Type: errors.RuntimeError, Token: sel.Token}
+	}
+	err = apply(&element, s.Operator, value, mem.CheckOverflow)
+	if err != nil {
+		return err
+	}
+	m.Set(key, element)
+	return nil
+}
+
+func (sel Selector) get(v Value, mem *Memory) (Value, *errors.Error) {
+	if sel.Index == nil {
+		return v.Ref.(*Struct).Fields[sel.Field], nil
+	}
+	key, err := sel.Index.eval(mem)
+	if err != nil {
+		return Value{}, err
+	}
+	if array, ok := v.Ref.(*Array); ok {
+		element, err := array.At(key.Int, sel.Token)
+		if err != nil {
+			return Value{}, err
+		}
+		return *element, nil
+	}
+	element, found := v.Ref.(*Map).Get(key)
+	if !found {
+		return Value{}, &errors.Error{Message: fmt.Sprintf("key %s not in map", Format(sel.Index.DataType, key)), Type: errors.RuntimeError, Token: sel.Token}
+	}
+	return element, nil
+}
+
+// apply performs an assignment operator on a part of a composite value.
+func apply(target *Value, operator tokens.Token, value Value, checked bool) *errors.Error {
+	if operator.Type == tokens.EQUAL {
+		*target = Copy(value)
+		return nil
+	}
+	if operator.Type == tokens.DOUBLE_PLUS || operator.Type == tokens.DOUBLE_MINUS {
+		value.Int = 1
+	}
+	result, err := arithmetic(operator, target.Int, value.Int, checked)
+	if err != nil {
+		return err
+	}
+	target.Int = result
+	return nil
+}
+
+// arithmetic applies a binary int operator, given either as the operator
+// itself, as its compound assignment or as ++ or --, which take 1 as right.
+// NEGATE takes 0 as left. Shifts by a count outside 0..63 are runtime errors,
+// and so are results that do not fit in an int when checked is set.
+func arithmetic(operator tokens.Token, left, right int, checked bool) (int, *errors.Error) {
+	result, exact := 0, true
+	switch operator.Type {
+	case tokens.PLUS, tokens.PLUS_EQUAL, tokens.DOUBLE_PLUS:
+		result, exact = AddOk(left, right)
+	case tokens.MINUS, tokens.MINUS_EQUAL, tokens.DOUBLE_MINUS, tokens.NEGATE:
+		result, exact = SubOk(left, right)
+	case tokens.STAR, tokens.STAR_EQUAL:
+		result, exact = MulOk(left, right)
+	case tokens.SLASH, tokens.SLASH_EQUAL, tokens.MODULO, tokens.MODULO_EQUAL:
+		if right == 0 {
+			return 0, &errors.Error{Message: "zero division not allowed", Token: operator, Type: errors.RuntimeError}
+		}
+		if operator.Type == tokens.MODULO || operator.Type == tokens.MODULO_EQUAL {
+			return left % right, nil
+		}
+		result, exact = DivOk(left, right)
+	case tokens.AMPERSAND, tokens.AMPERSAND_EQUAL:
+		return left & right, nil
+	case tokens.PIPE, tokens.PIPE_EQUAL:
+		return left | right, nil
+	case tokens.CARET, tokens.CARET_EQUAL:
+		return left ^ right, nil
+	case tokens.SHIFT_LEFT, tokens.SHIFT_LEFT_EQUAL, tokens.SHIFT_RIGHT, tokens.SHIFT_RIGHT_EQUAL:
+		if right < 0 || right > 63 {
+			return 0, &errors.Error{Message: "shift count must be between 0 and 63", Token: operator, Type: errors.RuntimeError}
+		}
+		if operator.Type == tokens.SHIFT_RIGHT || operator.Type == tokens.SHIFT_RIGHT_EQUAL {
+			return left >> right, nil
+		}
+		result, exact = ShlOk(left, right)
+	}
+	if !exact && checked {
+		return 0, &errors.Error{Message: "integer overflow", Token: operator, Type: errors.RuntimeError}
+	}
+	return result, nil
+}
+
+// atOperator attaches the position of the operator to an error from memory.
+func atOperator(err *errors.Error, operator tokens.Token) *errors.Error {
+	if err != nil {
+		err.Token = operator
+	}
+	return err
+}
+
 func (s *Conditional) Execute(mem *Memory) *errors.Error {
 	switch s.Token.Type {
 	case tokens.IF:
@@ -280,138 +766,194 @@ func (s *Conditional) Execute(mem *Memory) *errors.Error {
 			return err
 		}
 		if condition {
-            mem.Extend()
-			for _, stmt := range s.Then.Statements {
-				err := stmt.Execute(mem)
-				if err != nil {
-					return err
-				}
-			}
-            mem.Shrink()
+			return s.Then.Execute(mem)
 		} else if s.Else != nil {
-            mem.Extend()
-			for _, stmt := range s.Else.Statements {
-				err := stmt.Execute(mem)
-				if err != nil {
-					return err
-				}
-			}
-            mem.Shrink()
+			return s.Else.Execute(mem)
 		}
 	default:
-		then, _ := s.Condition.evalBool(mem)
-	WhileLoop:
+		// the else block runs when the loop does not, and the condition is
+		// evaluated once per check, as it may receive from a channel
+		entered := false
 		for {
 			condition, err := s.Condition.evalBool(mem)
 			if err != nil {
 				return err
 			}
-			if condition {
-				for _, stmt := range s.Then.Statements {
-                    mem.Extend()
-					err := stmt.Execute(mem)
-					if err != nil {
-						switch err.Type {
-						case errors.Break:
-							return nil
-						case errors.Continue:
-							continue WhileLoop
-						default:
-							return err
-						}
-					}
-                    mem.Shrink()
-				}
-			} else {
+			if !condition {
 				break
 			}
-
-		}
-		if !then && s.Else != nil {
-            mem.Extend()
-			for _, stmt := range s.Else.Statements {
-				stmt.Execute(mem)
+			entered = true
+			err = s.Then.iterate(mem, -1, Value{})
+			if err != nil && err.Type == errors.Break {
+				return nil
+			}
+			if err != nil && err.Type != errors.Continue {
+				return err
 			}
-            mem.Shrink()
+		}
+		if !entered && s.Else != nil {
+			return s.Else.Execute(mem)
 		}
 	}
 	return nil
 }
 
-func (s *For) Execute(mem *Memory) *errors.Error {
-	mem.Extend()
-	err := s.Init.Execute(mem)
+func (s *Match) Execute(mem *Memory) *errors.Error {
+	subject, err := s.Subject.eval(mem)
 	if err != nil {
 		return err
 	}
-	mem.Extend()
-	if s.Block == nil {
-		for {
-			condition, err := s.Condition.evalBool(mem)
+	for _, arm := range s.Arms {
+		for _, v := range arm.Values {
+			value, err := v.eval(mem)
 			if err != nil {
 				return err
 			}
-			if condition {
-				err := s.After.Execute(mem)
-				if err != nil {
-					return err
-				}
-			} else {
-				break
+			if Equal(s.Subject.DataType, subject, value) {
+				return arm.Block.Execute(mem)
 			}
 		}
-		mem.Shrink()
-		return nil
 	}
-ForLoop:
+	if s.Default != nil {
+		return s.Default.Execute(mem)
+	}
+	return nil
+}
+
+func (s *For) Execute(mem *Memory) *errors.Error {
+	err := s.Init.Execute(mem)
+	if err != nil {
+		return err
+	}
 	for {
 		condition, err := s.Condition.evalBool(mem)
 		if err != nil {
 			return err
 		}
-		if condition {
-			for _, stmt := range s.Block.Statements {
-				err := stmt.Execute(mem)
-				if err != nil {
-					switch err.Type {
-					case errors.Break:
-						break ForLoop
-					case errors.Continue:
-						err := s.After.Execute(mem)
-						if err != nil {
-							return err
-						}
-						continue ForLoop
-					}
-					return err
-				}
+		if !condition {
+			break
+		}
+		if s.Block != nil {
+			err := s.Block.iterate(mem, -1, Value{})
+			if err != nil && err.Type == errors.Break {
+				break
 			}
-			err := s.After.Execute(mem)
-			if err != nil {
+			if err != nil && err.Type != errors.Continue {
 				return err
 			}
-			continue
 		}
-		break
+		err = s.After.Execute(mem)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ForIn) Execute(mem *Memory) *errors.Error {
+	var keys []Value
+	var array *Array
+	start, count := 0, uint64(0)
+	if s.Collection != nil {
+		collection, err := s.Collection.eval(mem)
+		if err != nil {
+			return err
+		}
+		if a, ok := collection.Ref.(*Array); ok {
+			// arrays keep their length, the loop sees the elements as the
+			// body changes them
+			array = a
+			count = uint64(len(a.Values))
+		} else {
+			// changes to the map in the body don't affect the keys visited
+			keys = append(keys, collection.Ref.(*Map).Keys...)
+			count = uint64(len(keys))
+		}
+	} else {
+		var err *errors.Error
+		start, err = s.Start.evalInt(mem)
+		if err != nil {
+			return err
+		}
+		end, err := s.End.evalInt(mem)
+		if err != nil {
+			return err
+		}
+		// end - start overflows an int for ranges wider than half of the
+		// ints, but not a uint64, and start + i wraps around to the value
+		if end > start {
+			count = uint64(end) - uint64(start)
+		}
+	}
+	for i := uint64(0); i < count; i++ {
+		value := Value{Int: start + int(i)}
+		if array != nil {
+			value = Copy(array.Values[i])
+		} else if keys != nil {
+			value = keys[i]
+		}
+		err := s.Block.iterate(mem, s.Slot, value)
+		if err != nil && err.Type == errors.Break {
+			break
+		}
+		if err != nil && err.Type != errors.Continue {
+			return err
+		}
 	}
-	mem.Shrink()
-	mem.Shrink()
 	return nil
 }
 
 func (s *Def) Execute(mem *Memory) *errors.Error {
+	if s.TypeParams != nil {
+		for _, instance := range s.Instances {
+			instance.Execute(mem)
+		}
+		return nil
+	}
 	fun := Function{
-		Scope:    s.Scope,
-		Params:   s.Params,
-		DataType: s.DataType,
-		Body:     s.Body,
-		Returns:  s.ReturnBranches,
+		Params:    s.Params,
+		DataType:  s.DataType,
+		Body:      s.Body,
+		Returns:   s.ReturnBranches,
+		Variables: s.Variables,
+		Env:       mem.Frame,
 	}
-	mem.SetFunc(s.NameToken, &fun)
+	mem.SetFunc(s.Slot, &fun)
 	return nil
 }
 
+// Execute catches only runtime errors, so break, continue and return pass
+// through to the enclosing loop or call.
+func (s *Try) Execute(mem *Memory) *errors.Error {
+	err := s.Body.Execute(mem)
+	if err == nil || err.Type != errors.RuntimeError {
+		return err
+	}
+	if s.Slot >= 0 {
+		caught := &Struct{Fields: []Value{{Ref: err.Message}, {Int: err.Token.Line}, {Int: err.Token.Char}}}
+		mem.Set(s.Slot, Value{Ref: caught})
+	}
+	return s.Catch.Execute(mem)
+}
+
+func (s *Raise) Execute(mem *Memory) *errors.Error {
+	message, err := s.Exp.eval(mem)
+	if err != nil {
+		return err
+	}
+	return &errors.Error{Message: message.Ref.(string), Type: errors.RuntimeError, Token: s.Token}
+}
+
+// Execute evaluates the returned value before leaving the function, so that
+// a try around the return catches the errors it raises.
 func (s *Return) Execute(mem *Memory) *errors.Error {
+	if s.DataType != Void {
+		value, err := mem.Frame.Function.Returns[s.Id].eval(mem)
+		if err != nil {
+			return err
+		}
+		mem.Frame.Result = value
+	}
 	return &errors.Error{Type: errors.Return, MessageId: s.Id}
 }
 
@@ -424,51 +966,133 @@ func (s *Continue) Execute(mem *Memory) *errors.Error {
 }
 
 func (s *VoidCall) Execute(mem *Memory) *errors.Error {
-	fn, err := mem.GetFunc(s.NameToken, s.Scope)
+	if s.Builtin != NoBuiltin {
+		_, err := callBuiltin(s.Builtin, s.Args, s.NameToken, mem)
+		return err
+	}
+	fn, err := mem.GetFunc(s.NameToken, s.Depth, s.Slot)
 	if err != nil {
 		return err
 	}
+	if fn.Native != nil {
+		_, err := callNative(fn, s.Args, s.NameToken, mem)
+		return err
+	}
 	if fn.Body == nil {
 		return nil
 	}
-	mem.Extend()
+	err = enter(fn, s.Args, mem)
+	if err != nil {
+		return err
+	}
+	err = fn.Body.Execute(mem)
+	mem.Pop()
+	if err != nil && err.Type != errors.Return {
+		return err
+	}
+	return nil
+}
+
+func (s *Spawn) Execute(mem *Memory) *errors.Error {
+	fn, err := mem.GetFunc(s.NameToken, s.Depth, s.Slot)
+	if err != nil {
+		return err
+	}
+	args := make([]Value, len(s.Args))
 	for i, a := range s.Args {
-		switch a.DataType {
-		case Int:
-			val, err := a.evalInt(mem)
-			if err != nil {
-				return err
-			}
-			mem.SetInt(fn.Params[i].NameToken, val)
-		case Bool:
-			val, err := a.evalBool(mem)
+		val, err := a.eval(mem)
+		if err != nil {
+			return err
+		}
+		args[i] = Copy(val)
+	}
+	mem.spawn(fn, args)
+	return nil
+}
+
+// Execute evaluates the channels and the values to send of all the arms in
+// order, before choosing one.
+func (s *Select) Execute(mem *Memory) *errors.Error {
+	channels := make([]*Channel, len(s.Arms))
+	values := make([]Value, len(s.Arms))
+	for i, arm := range s.Arms {
+		c, err := arm.Channel.eval(mem)
+		if err != nil {
+			return err
+		}
+		channels[i] = c.Ref.(*Channel)
+		if arm.Value != nil {
+			values[i], err = arm.Value.eval(mem)
 			if err != nil {
 				return err
 			}
-			mem.SetBool(fn.Params[i].NameToken, val)
-		default:
-			return &errors.Error{Message: "invalid argument type", Type: errors.RuntimeError, Token: s.NameToken}
 		}
 	}
-	for _, s := range fn.Body.Statements {
-		err := s.Execute(mem)
+	chosen, err := mem.choose(s, channels)
+	if err != nil {
+		return err
+	}
+	if chosen < 0 {
+		return s.Default.Execute(mem)
+	}
+	arm := s.Arms[chosen]
+	if arm.Value != nil {
+		err = mem.put(channels[chosen], values[chosen], arm.Token)
 		if err != nil {
-			if err.Type == errors.Return {
-				break
-			}
 			return err
 		}
+	} else if value := mem.take(channels[chosen]); arm.Slot >= 0 {
+		mem.Set(arm.Slot, value)
 	}
-	mem.Shrink()
+	return arm.Block.Execute(mem)
+}
+
+// Blocks share the frame of the code around them, so entering and leaving a
+// scope has nothing to do at runtime.
+
+func (s *StructDef) Execute(mem *Memory) *errors.Error {
+	return nil
+}
+
+func (s *EnumDef) Execute(mem *Memory) *errors.Error {
 	return nil
 }
 
 func (s *OpenScope) Execute(mem *Memory) *errors.Error {
-	mem.Extend()
 	return nil
 }
 
 func (s *CloseScope) Execute(mem *Memory) *errors.Error {
-	mem.Shrink()
 	return nil
 }
+
+func callNative(fn *Function, args []*Expression, token tokens.Token, mem *Memory) (int, *errors.Error) {
+	values := []int{}
+	for i, a := range args {
+		if fn.Params[i].Variadic {
+			rest, err := a.eval(mem)
+			if err != nil {
+				return 0, err
+			}
+			for _, v := range rest.Ref.(*Array).Values {
+				values = append(values, v.Int)
+			}
+			continue
+		}
+		val, err := a.evalInt(mem)
+		if err != nil {
+			return 0, err
+		}
+		values = append(values, val)
+	}
+	native := fn.Native
+	if mem.CheckOverflow && fn.Checked != nil {
+		native = fn.Checked
+	}
+	result, err := native(values)
+	if err != nil {
+		err.Token = token
+		return 0, err
+	}
+	return result, nil
+}
@@ -0,0 +1,236 @@
+package intpr
+
+import (
+	"math"
+	"simpl/errors"
+	"simpl/tokens"
+	"slices"
+)
+
+// NativeFunction is a function implemented in Go that scripts can call like a
+// function declared with def. Errors returned by Call carry no token, the
+// caller attaches the position of the call site. Checked, if set, replaces
+// Call when memory checks for overflow. The arguments passed to a variadic
+// last param follow the others in args.
+type NativeFunction struct {
+	Name     string
+	Params   []DefParam
+	DataType DataType
+	Call     func(args []int) (int, *errors.Error)
+	Checked  func(args []int) (int, *errors.Error)
+}
+
+func intParams(names ...string) []DefParam {
+	params := []DefParam{}
+	for _, name := range names {
+		params = append(params, DefParam{NameToken: tokens.Token{Type: tokens.IDENTIFIER, Value: name}, DataType: Int})
+	}
+	return params
+}
+
+// variadic makes the last of params take the remaining arguments.
+func variadic(params []DefParam) []DefParam {
+	last := &params[len(params)-1]
+	last.DataType, last.Variadic = predeclared.ArrayOf(Int), true
+	return params
+}
+
+func overflowError(operation string) *errors.Error {
+	return &errors.Error{Message: "integer overflow in " + operation, Type: errors.RuntimeError}
+}
+
+// MathModule is the built-in math library, available in every program.
+var MathModule = []NativeFunction{
+	{Name: "abs", Params: intParams("x"), DataType: Int, Call: func(args []int) (int, *errors.Error) {
+		if args[0] < 0 {
+			return -args[0], nil
+		}
+		return args[0], nil
+	}, Checked: checkedAbs("abs")},
+	{Name: "min", Params: variadic(intParams("a", "rest")), DataType: Int, Call: func(args []int) (int, *errors.Error) {
+		return slices.Min(args), nil
+	}},
+	{Name: "max", Params: variadic(intParams("a", "rest")), DataType: Int, Call: func(args []int) (int, *errors.Error) {
+		return slices.Max(args), nil
+	}},
+	{Name: "pow", Params: intParams("a", "n"), DataType: Int, Call: func(args []int) (int, *errors.Error) {
+		result, _, err := intPow(args[0], args[1])
+		return result, err
+	}, Checked: checkedPow("pow")},
+	{Name: "sqrt", Params: intParams("x"), DataType: Int, Call: func(args []int) (int, *errors.Error) {
+		return intSqrt(args[0])
+	}},
+	{Name: "gcd", Params: intParams("a", "b"), DataType: Int, Call: func(args []int) (int, *errors.Error) {
+		result, ok := gcd(args[0], args[1])
+		if !ok {
+			return 0, overflowError("gcd")
+		}
+		return result, nil
+	}},
+	{Name: "lcm", Params: intParams("a", "b"), DataType: Int, Call: func(args []int) (int, *errors.Error) {
+		result, ok := lcm(args[0], args[1])
+		if !ok {
+			return 0, overflowError("lcm")
+		}
+		return result, nil
+	}},
+	{Name: "clamp", Params: intParams("x", "lo", "hi"), DataType: Int, Call: func(args []int) (int, *errors.Error) {
+		x, lo, hi := args[0], args[1], args[2]
+		if lo > hi {
+			return 0, &errors.Error{Message: "clamp: lower bound is greater than upper bound", Type: errors.RuntimeError}
+		}
+		return min(max(x, lo), hi), nil
+	}},
+	{Name: "checkedAbs", Params: intParams("x"), DataType: Int, Call: checkedAbs("checkedAbs")},
+	{Name: "checkedAdd", Params: intParams("a", "b"), DataType: Int, Call: func(args []int) (int, *errors.Error) {
+		result, ok := AddOk(args[0], args[1])
+		if !ok {
+			return 0, overflowError("checkedAdd")
+		}
+		return result, nil
+	}},
+	{Name: "checkedSub", Params: intParams("a", "b"), DataType: Int, Call: func(args []int) (int, *errors.Error) {
+		result, ok := SubOk(args[0], args[1])
+		if !ok {
+			return 0, overflowError("checkedSub")
+		}
+		return result, nil
+	}},
+	{Name: "checkedMul", Params: intParams("a", "b"), DataType: Int, Call: func(args []int) (int, *errors.Error) {
+		result, ok := MulOk(args[0], args[1])
+		if !ok {
+			return 0, overflowError("checkedMul")
+		}
+		return result, nil
+	}},
+	{Name: "checkedPow", Params: intParams("a", "n"), DataType: Int, Call: checkedPow("checkedPow")},
+}
+
+func checkedAbs(name string) func(args []int) (int, *errors.Error) {
+	return func(args []int) (int, *errors.Error) {
+		if args[0] == math.MinInt {
+			return 0, overflowError(name)
+		}
+		if args[0] < 0 {
+			return -args[0], nil
+		}
+		return args[0], nil
+	}
+}
+
+func checkedPow(name string) func(args []int) (int, *errors.Error) {
+	return func(args []int) (int, *errors.Error) {
+		result, ok, err := intPow(args[0], args[1])
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			return 0, overflowError(name)
+		}
+		return result, nil
+	}
+}
+
+// AddOk, SubOk, MulOk, DivOk and ShlOk return the result of the operation,
+// wrapped around like Go does, and whether it is exact.
+func AddOk(a, b int) (int, bool) {
+	result := a + b
+	return result, (result > a) == (b > 0)
+}
+
+func SubOk(a, b int) (int, bool) {
+	result := a - b
+	return result, (result < a) == (b > 0)
+}
+
+func DivOk(a, b int) (int, bool) {
+	return a / b, a != math.MinInt || b != -1
+}
+
+func ShlOk(a, b int) (int, bool) {
+	result := a << b
+	return result, result>>b == a
+}
+
+func MulOk(a, b int) (int, bool) {
+	if a == 0 || b == 0 {
+		return 0, true
+	}
+	result := a * b
+	if result/b != a || (a == -1 && b == math.MinInt) || (b == -1 && a == math.MinInt) {
+		return result, false
+	}
+	return result, true
+}
+
+// intPow returns a**n, wrapping on overflow. The second result reports
+// whether the computation stayed in range.
+func intPow(a, n int) (int, bool, *errors.Error) {
+	if n < 0 {
+		return 0, false, &errors.Error{Message: "pow: negative exponent", Type: errors.RuntimeError}
+	}
+	result, ok := 1, true
+	for n > 0 {
+		if n&1 == 1 {
+			var fits bool
+			result, fits = MulOk(result, a)
+			ok = ok && fits
+		}
+		n >>= 1
+		if n > 0 {
+			var fits bool
+			a, fits = MulOk(a, a)
+			ok = ok && fits
+		}
+	}
+	return result, ok, nil
+}
+
+func intSqrt(x int) (int, *errors.Error) {
+	if x < 0 {
+		return 0, &errors.Error{Message: "sqrt: negative argument", Type: errors.RuntimeError}
+	}
+	result := int(math.Sqrt(float64(x)))
+	for result*result > x {
+		result--
+	}
+	for (result+1)*(result+1) <= x && (result+1)*(result+1) > 0 {
+		result++
+	}
+	return result, nil
+}
+
+// gcd returns the greatest common divisor of a and b, and whether it fits in
+// an int, which it does not only for gcd(MinInt, 0) and gcd(MinInt, MinInt).
+func gcd(a, b int) (int, bool) {
+	result := euclid(magnitude(a), magnitude(b))
+	return int(result), result <= math.MaxInt
+}
+
+// lcm returns the least common multiple of a and b, and whether it fits in an
+// int.
+func lcm(a, b int) (int, bool) {
+	if a == 0 || b == 0 {
+		return 0, true
+	}
+	x, y := magnitude(a), magnitude(b)
+	factor := x / euclid(x, y)
+	result := factor * y
+	return int(result), result/y == factor && result <= math.MaxInt
+}
+
+func euclid(x, y uint64) uint64 {
+	for y != 0 {
+		x, y = y, x%y
+	}
+	return x
+}
+
+// magnitude returns the absolute value of a, which fits in a uint64 even for
+// MinInt.
+func magnitude(a int) uint64 {
+	if a < 0 {
+		return -uint64(a)
+	}
+	return uint64(a)
+}
@@ -8,202 +8,243 @@ import (
 
 // Memory
 
+// Value is the content of a slot. Which field is meaningful depends on the
+// type the parser resolved for the slot, composite values are held in Ref.
+type Value struct {
+	Int  int
+	Bool bool
+	Func *Function
+	Ref  any
+}
+
+// Variable describes what the parser placed in a slot of a frame. Scope is
+// the block nesting level inside the frame, 0 for the frame's top level.
+type Variable struct {
+	Name     string
+	DataType DataType
+	Scope    int
+}
+
+// Frame holds the slots of the top-level code or of a single function call.
+// Blocks do not get frames of their own, the parser gives every variable of a
+// frame a distinct slot. Parent is the frame the function was defined in and
+// is used to resolve variables of enclosing scopes.
+type Frame struct {
+	Values    []Value
+	Variables []Variable
+	Parent    *Frame
+	// Top is one past the highest slot declared so far
+	Top int
+	// Function is the function called, nil for the global frame, and Result
+	// the value its return statement evaluated
+	Function *Function
+	Result   Value
+	// Task is the id of the task that made the frame, 0 for the main one
+	Task int
+}
+
+func NewFrame(variables []Variable, parent *Frame) *Frame {
+	return &Frame{Values: make([]Value, len(variables)), Variables: variables, Parent: parent}
+}
+
 type Memory struct {
-	Size  int
-	Ints  []map[string]int
-	Bools []map[string]bool
-	Funcs []map[string]*Function
+	Frame  *Frame
+	Frames []*Frame
+	// CheckOverflow makes int arithmetic that does not fit in an int a
+	// runtime error, instead of wrapping around
+	CheckOverflow bool
+	// Task is the id of the task the memory belongs to. Every task has
+	// memory of its own, and they share tasks.
+	Task  int
+	tasks *scheduler
 }
 
-func NewMemory() *Memory {
-	return &Memory{Size: 1, Ints: []map[string]int{{}}, Bools: []map[string]bool{{}}, Funcs: []map[string]*Function{{}}}
+// BuiltinVariables is the layout of the frame holding the built-in functions,
+// which encloses the global frame.
+func BuiltinVariables() []Variable {
+	variables := []Variable{}
+	for _, native := range MathModule {
+		variables = append(variables, Variable{Name: native.Name, DataType: Func})
+	}
+	return variables
 }
 
-func (m *Memory) Extend() {
-	m.Ints = append(m.Ints, map[string]int{})
-	m.Bools = append(m.Bools, map[string]bool{})
-	m.Funcs = append(m.Funcs, map[string]*Function{})
-	m.Size++
+// NewMemory returns memory with a global frame laid out as globals, enclosed
+// by the frame of built-in functions.
+func NewMemory(globals []Variable) *Memory {
+	builtins := NewFrame(BuiltinVariables(), nil)
+	for i, native := range MathModule {
+		builtins.Values[i].Func = &Function{DataType: native.DataType, Params: native.Params, Native: native.Call, Checked: native.Checked}
+	}
+	builtins.Top = len(builtins.Values)
+	global := NewFrame(globals, builtins)
+	// functions defined before the first statement may read globals that
+	// are not declared yet
+	for i, v := range globals {
+		global.Values[i] = Zero(v.DataType)
+	}
+	return &Memory{Frame: global, Frames: []*Frame{global}}
 }
 
-func (m *Memory) Shrink() {
-	m.Size--
-	m.Ints = m.Ints[:m.Size]
-	m.Bools = m.Bools[:m.Size]
-	m.Funcs = m.Funcs[:m.Size]
+// Push makes frame the current frame, as on a function call.
+func (m *Memory) Push(frame *Frame) {
+	m.Frames = append(m.Frames, frame)
+	m.Frame = frame
 }
 
-func (m *Memory) GetBool(token tokens.Token, scope int) (bool, *errors.Error) {
-	if scope == -1 {
-		scope = m.Size - 1
-	}
-	for i := scope; i >= 0; i-- {
-		val, found := m.Bools[i][token.Value]
-		if found {
-			return val, nil
-		}
-	}
-	return false, &errors.Error{Message: "the variable used to be here, but the memory got resized incorrectly", Type: errors.RuntimeError, Token: token}
+// Pop returns to the frame that was current before the last Push.
+func (m *Memory) Pop() {
+	m.Frames = m.Frames[:len(m.Frames)-1]
+	m.Frame = m.Frames[len(m.Frames)-1]
 }
 
-func (m *Memory) GetInt(token tokens.Token, scope int) (int, *errors.Error) {
-	if scope == -1 {
-		scope = m.Size - 1
-	}
-	for i := scope; i >= 0; i-- {
-		val, found := m.Ints[i][token.Value]
-		if found {
-			return val, nil
-		}
+func (m *Memory) frame(depth int) *Frame {
+	frame := m.Frame
+	for ; depth > 0; depth-- {
+		frame = frame.Parent
 	}
-	return 0, &errors.Error{Message: "the variable used to be here, but the memory got resized incorrectly", Type: errors.RuntimeError, Token: token}
+	return frame
+}
 
+func (m *Memory) GetBool(depth, slot int) bool {
+	return m.frame(depth).Values[slot].Bool
 }
 
-func (m *Memory) GetFunc(token tokens.Token, scope int) (*Function, *errors.Error) {
-	if scope == -1 {
-		scope = m.Size - 1
+func (m *Memory) GetInt(depth, slot int) int {
+	return m.frame(depth).Values[slot].Int
+}
+
+func (m *Memory) Get(depth, slot int) Value {
+	return m.frame(depth).Values[slot]
+}
+
+func (m *Memory) GetFunc(token tokens.Token, depth, slot int) (*Function, *errors.Error) {
+	fn := m.frame(depth).Values[slot].Func
+	if fn == nil {
+		return nil, &errors.Error{Message: fmt.Sprintf("function %s called before its definition", token.Value), Type: errors.RuntimeError, Token: token}
 	}
-	for i := scope; i >= 0; i-- {
-		val, found := m.Funcs[i][token.Value]
-		if found {
-			return val, nil
-		}
+	return fn, nil
+}
+
+func (m *Memory) declare(slot int) *Value {
+	frame := m.Frame
+	if slot >= frame.Top {
+		frame.Top = slot + 1
 	}
-	return nil, &errors.Error{Message: "the variable used to be here, but the memory got resized incorrectly", Type: errors.RuntimeError, Token: token}
+	return &frame.Values[slot]
 }
 
-func (m *Memory) SetInt(token tokens.Token, value int) {
-	name := token.Value
-	m.Ints[len(m.Ints)-1][name] = value
+func (m *Memory) SetInt(slot int, value int) {
+	m.declare(slot).Int = value
 }
 
-func (m *Memory) SetBool(token tokens.Token, value bool) {
-	name := token.Value
-	m.Bools[len(m.Bools)-1][name] = value
+func (m *Memory) SetBool(slot int, value bool) {
+	m.declare(slot).Bool = value
 }
 
-func (m *Memory) SetFunc(token tokens.Token, function *Function) {
-	name := token.Value
-	m.Funcs[len(m.Funcs)-1][name] = function
+func (m *Memory) Set(slot int, value Value) {
+	*m.declare(slot) = value
 }
 
-func (m *Memory) UpdateInt(token tokens.Token, value int, scope int) {
-	name := token.Value
-	if scope == -1 {
-		scope = m.Size - 1
-	}
-	for i := scope; i >= 0; i-- {
-		_, found := m.Ints[i][name]
-		if found {
-			m.Ints[i][name] = value
-			break
-		}
-	}
+// SetFunc stores a function without moving Top, as functions are not
+// printed and the instances of generic functions take slots past the
+// variables declared after them.
+func (m *Memory) SetFunc(slot int, function *Function) {
+	m.Frame.Values[slot].Func = function
 }
 
-func (m *Memory) IncInt(token tokens.Token, value int, scope int) {
-	name := token.Value
-	if scope == -1 {
-		scope = m.Size - 1
-	}
-	for i := scope; i >= 0; i-- {
-		_, found := m.Ints[i][name]
-		if found {
-			m.Ints[i][name] += value
-			break
-		}
-	}
+func (m *Memory) UpdateInt(depth, slot int, value int) {
+	m.frame(depth).Values[slot].Int = value
 }
 
-func (m *Memory) DecInt(token tokens.Token, value int, scope int) {
-	if scope == -1 {
-		scope = m.Size - 1
-	}
-	name := token.Value
-	for i := scope; i >= 0; i-- {
-		_, found := m.Ints[i][name]
-		if found {
-			m.Ints[i][name] -= value
-			break
-		}
-	}
+// IncInt, DecInt, MulInt and DivInt update an int variable in place. When
+// overflow is checked and the result does not fit, they leave it unchanged
+// and return an error, which carries no token: the caller attaches the
+// operator.
+func (m *Memory) IncInt(depth, slot int, value int) *errors.Error {
+	return m.combine(depth, slot, value, AddOk)
 }
 
-func (m *Memory) MulInt(token tokens.Token, value int, scope int) {
-	name := token.Value
-	if scope == -1 {
-		scope = m.Size - 1
-	}
-	for i := scope; i >= 0; i-- {
-		_, found := m.Ints[i][name]
-		if found {
-			m.Ints[i][name] *= value
-			break
-		}
-	}
+func (m *Memory) DecInt(depth, slot int, value int) *errors.Error {
+	return m.combine(depth, slot, value, SubOk)
 }
 
-func (m *Memory) DivInt(token tokens.Token, value int, scope int) {
-	name := token.Value
-	if scope == -1 {
-		scope = m.Size - 1
-	}
-	for i := scope; i >= 0; i-- {
-		_, found := m.Ints[i][name]
-		if found {
-			m.Ints[i][name] /= value
-			break
-		}
-	}
+func (m *Memory) MulInt(depth, slot int, value int) *errors.Error {
+	return m.combine(depth, slot, value, MulOk)
 }
 
-func (m *Memory) ModInt(token tokens.Token, value int, scope int) {
-	name := token.Value
-	if scope == -1 {
-		scope = m.Size - 1
-	}
-	for i := scope; i >= 0; i-- {
-		_, found := m.Ints[i][name]
-		if found {
-			m.Ints[i][name] %= value
-			break
-		}
-	}
+func (m *Memory) DivInt(depth, slot int, value int) *errors.Error {
+	return m.combine(depth, slot, value, DivOk)
 }
 
-func (m *Memory) UpdateBool(token tokens.Token, value bool, scope int) {
-	name := token.Value
-	if scope == -1 {
-		scope = m.Size - 1
-	}
-	for i := scope; i >= 0; i-- {
-		_, found := m.Bools[i][name]
-		if found {
-			m.Bools[i][name] = value
-			break
-		}
+func (m *Memory) combine(depth, slot int, value int, operation func(a, b int) (int, bool)) *errors.Error {
+	target := &m.frame(depth).Values[slot].Int
+	result, ok := operation(*target, value)
+	if !ok && m.CheckOverflow {
+		return &errors.Error{Message: "integer overflow", Type: errors.RuntimeError}
 	}
+	*target = result
+	return nil
 }
 
+func (m *Memory) ModInt(depth, slot int, value int) {
+	m.frame(depth).Values[slot].Int %= value
+}
+
+func (m *Memory) UpdateBool(depth, slot int, value bool) {
+	m.frame(depth).Values[slot].Bool = value
+}
+
+func (m *Memory) Update(depth, slot int, value Value) {
+	m.frame(depth).Values[slot] = value
+}
+
+// Print shows the variables declared at the top level of the global frame
+// and of the frames of the calls in progress.
 func (m *Memory) Print() {
 	fmt.Println("Ints:")
-	for _, data := range m.Ints {
-		for k, v := range data {
-			fmt.Printf("%s = %d\n", k, v)
+	for _, frame := range m.Frames {
+		for i := 0; i < frame.Top; i++ {
+			v := frame.Variables[i]
+			if v.Scope == 0 && v.DataType == Int {
+				fmt.Printf("%s = %d\n", v.Name, frame.Values[i].Int)
+			}
 		}
 	}
 	fmt.Println("Bools:")
-	for _, data := range m.Bools {
-		for k, v := range data {
-			fmt.Printf("%s = %t\n", k, v)
+	for _, frame := range m.Frames {
+		for i := 0; i < frame.Top; i++ {
+			v := frame.Variables[i]
+			if v.Scope == 0 && v.DataType == Bool {
+				fmt.Printf("%s = %t\n", v.Name, frame.Values[i].Bool)
+			}
+		}
+	}
+	m.printSection("Strings:", func(t DataType) bool { return t == String })
+	m.printSection("Structs:", DataType.IsStruct)
+	m.printSection("Maps:", DataType.IsMap)
+	m.printSection("Arrays:", DataType.IsArray)
+	m.printSection("Enums:", DataType.IsEnum)
+	m.printSection("Optionals:", DataType.IsOptional)
+	m.printSection("Channels:", DataType.IsChan)
+}
+
+// printSection prints the variables whose type matches, under a header that
+// is left out when the program has no such variables.
+func (m *Memory) printSection(header string, matches func(DataType) bool) {
+	printed := false
+	for _, frame := range m.Frames {
+		for i, v := range frame.Variables {
+			if v.Scope != 0 || !matches(v.DataType) {
+				continue
+			}
+			if !printed {
+				fmt.Println(header)
+				printed = true
+			}
+			if i < frame.Top {
+				fmt.Printf("%s = %s\n", v.Name, Format(v.DataType, frame.Values[i]))
+			}
 		}
 	}
-	// fmt.Println("Functions:")
-	// for _, data := range m.Funcs {
-	//     for k, v := range data {
-	//         fmt.Printf("%s ", k)
-	//         v.Visualize()
-	//     }
-	// }
 }
@@ -0,0 +1,347 @@
+package intpr
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Snapshot is the state of memory: the global frame, then the frames of the
+// calls in progress. Variables are listed in slot order, so the same state
+// always gives the same snapshot. It marshals to JSON with encoding/json,
+// and RestoreMemory reads it back.
+type Snapshot struct {
+	Frames []FrameSnapshot `json:"frames"`
+}
+
+// FrameSnapshot holds the variables declared so far in a frame, in any of
+// its blocks, and its functions. Function is the name of the function the
+// frame is a call of, empty for the global frame. A frame keeps the slots of
+// blocks that have ended, so their variables are listed too, with the values
+// they had last and a Scope above 0.
+type FrameSnapshot struct {
+	Function  string             `json:"function,omitempty"`
+	Variables []VariableSnapshot `json:"variables"`
+}
+
+// VariableSnapshot is a variable with its type as scripts write it. Scope is
+// the block nesting level inside the frame, like for Variable. Value holds
+// ints, bools and strings as they are, an enum as the name of its variant,
+// none as nil, a struct as a map from field names to values, a map as a list
+// of MapEntry, an array as a list and a channel as a ChannelSnapshot. A
+// function has type func and its signature as value, nil until its
+// definition has run.
+type VariableSnapshot struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Scope int    `json:"scope"`
+	Value any    `json:"value"`
+}
+
+// MapEntry is a key of a map with its value, listed in insertion order.
+type MapEntry struct {
+	Key   any `json:"key"`
+	Value any `json:"value"`
+}
+
+// ChannelSnapshot holds the values sent to a channel and not received yet.
+type ChannelSnapshot struct {
+	Values   []any `json:"values"`
+	Capacity int   `json:"capacity"`
+	Closed   bool  `json:"closed"`
+}
+
+// Snapshot returns the state of the global frame and of the frames of the
+// calls in progress.
+func (m *Memory) Snapshot() Snapshot {
+	snapshot := Snapshot{Frames: []FrameSnapshot{}}
+	for _, frame := range m.Frames {
+		snapshot.Frames = append(snapshot.Frames, frame.snapshot())
+	}
+	return snapshot
+}
+
+func (f *Frame) snapshot() FrameSnapshot {
+	s := FrameSnapshot{Function: f.name(), Variables: []VariableSnapshot{}}
+	for i, v := range f.Variables {
+		// functions do not move Top, so they are listed wherever they are
+		if v.DataType == Func {
+			var signature any
+			if fn := f.Values[i].Func; fn != nil {
+				signature = fn.signature()
+			}
+			s.Variables = append(s.Variables, VariableSnapshot{Name: v.Name, Type: "func", Scope: v.Scope, Value: signature})
+		} else if i < f.Top {
+			s.Variables = append(s.Variables, VariableSnapshot{Name: v.Name, Type: v.DataType.View(), Scope: v.Scope, Value: encode(v.DataType, f.Values[i])})
+		}
+	}
+	return s
+}
+
+// name returns the name of the function the frame is a call of, which the
+// frame the function was defined in holds.
+func (f *Frame) name() string {
+	if f.Function == nil || f.Parent == nil {
+		return ""
+	}
+	for i, v := range f.Parent.Values {
+		if v.Func == f.Function {
+			return f.Parent.Variables[i].Name
+		}
+	}
+	return ""
+}
+
+// signature returns the params and the result type of the function, like
+// "(int a, int ...rest) bool".
+func (fn *Function) signature() string {
+	params := []string{}
+	for _, p := range fn.Params {
+		if p.Variadic {
+			params = append(params, fmt.Sprintf("%s ...%s", p.DataType.Type().Value.View(), p.NameToken.Value))
+		} else {
+			params = append(params, fmt.Sprintf("%s %s", p.DataType.View(), p.NameToken.Value))
+		}
+	}
+	signature := "(" + strings.Join(params, ", ") + ")"
+	if fn.DataType != Void {
+		signature += " " + fn.DataType.View()
+	}
+	return signature
+}
+
+// encode returns v in the form VariableSnapshot describes.
+func encode(t DataType, v Value) any {
+	switch t {
+	case Int:
+		return v.Int
+	case Bool:
+		return v.Bool
+	case String:
+		return v.Ref
+	}
+	info := t.Type()
+	if info == nil {
+		return nil
+	}
+	switch info.Kind {
+	case EnumKind:
+		return info.Variants[v.Int]
+	case OptionalKind:
+		if v.Ref == nil {
+			return nil
+		}
+		return encode(info.Value, v.Ref.(Value))
+	case MapKind:
+		m := v.Ref.(*Map)
+		entries := []MapEntry{}
+		for _, key := range m.Keys {
+			value, _ := m.Get(key)
+			entries = append(entries, MapEntry{Key: encode(info.Key, key), Value: encode(info.Value, value)})
+		}
+		return entries
+	case ArrayKind:
+		return encodeList(info.Value, v.Ref.(*Array).Values)
+	case ChanKind:
+		c := v.Ref.(*Channel)
+		return ChannelSnapshot{Values: encodeList(info.Value, c.Values), Capacity: c.Capacity, Closed: c.Closed}
+	case StructKind:
+		s := v.Ref.(*Struct)
+		fields := map[string]any{}
+		for i, f := range info.Fields {
+			fields[f.Name] = encode(f.DataType, s.Fields[i])
+		}
+		return fields
+	}
+	return nil
+}
+
+func encodeList(t DataType, values []Value) []any {
+	elements := []any{}
+	for _, v := range values {
+		elements = append(elements, encode(t, v))
+	}
+	return elements
+}
+
+// RestoreMemory returns memory with a global frame laid out as globals, like
+// NewMemory, holding the values of the global frame of a snapshot in JSON.
+// Variables are matched by name and scope, and must have the same type in
+// both. Functions are left to the definitions of the program, and values
+// shared by several variables come back as copies of their own. The frames
+// of calls in progress cannot be restored.
+func RestoreMemory(data []byte, globals []Variable) (*Memory, error) {
+	var snapshot Snapshot
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	// ints do not all fit in the float64 numbers are decoded as otherwise
+	decoder.UseNumber()
+	if err := decoder.Decode(&snapshot); err != nil {
+		return nil, err
+	}
+	if len(snapshot.Frames) != 1 {
+		return nil, fmt.Errorf("cannot restore %d frames, only the global one", len(snapshot.Frames))
+	}
+	memory := NewMemory(globals)
+	frame := memory.Frame
+	restored := make([]bool, len(globals))
+	for _, v := range snapshot.Frames[0].Variables {
+		if v.Type == "func" {
+			continue
+		}
+		slot := -1
+		for i, g := range globals {
+			if !restored[i] && g.Name == v.Name && g.Scope == v.Scope && g.DataType != Func {
+				slot = i
+				break
+			}
+		}
+		if slot < 0 {
+			return nil, fmt.Errorf("variable %s is not declared", v.Name)
+		}
+		dataType := globals[slot].DataType
+		if dataType.View() != v.Type {
+			return nil, fmt.Errorf("variable %s has type %s, not %s", v.Name, dataType.View(), v.Type)
+		}
+		value, err := decode(dataType, v.Value)
+		if err != nil {
+			return nil, fmt.Errorf("variable %s: %w", v.Name, err)
+		}
+		frame.Values[slot] = value
+		restored[slot] = true
+		frame.Top = max(frame.Top, slot+1)
+	}
+	// the slots the snapshot left out keep the zero values of NewMemory
+	return memory, nil
+}
+
+// decode returns the value of type t that data holds, as decoded from JSON
+// with numbers kept as json.Number.
+func decode(t DataType, data any) (Value, error) {
+	switch t {
+	case Int:
+		if n, ok := data.(json.Number); ok {
+			if i, err := n.Int64(); err == nil {
+				return Value{Int: int(i)}, nil
+			}
+		}
+		return Value{}, mismatch(t, data)
+	case Bool:
+		if b, ok := data.(bool); ok {
+			return Value{Bool: b}, nil
+		}
+		return Value{}, mismatch(t, data)
+	case String:
+		if s, ok := data.(string); ok {
+			return Value{Ref: s}, nil
+		}
+		return Value{}, mismatch(t, data)
+	}
+	info := t.Type()
+	if info == nil {
+		return Value{}, fmt.Errorf("cannot restore values of type %s", t.View())
+	}
+	switch info.Kind {
+	case EnumKind:
+		if name, ok := data.(string); ok {
+			if index := info.VariantIndex(name); index >= 0 {
+				return Value{Int: index}, nil
+			}
+		}
+		return Value{}, mismatch(t, data)
+	case OptionalKind:
+		if data == nil {
+			return Value{}, nil
+		}
+		value, err := decode(info.Value, data)
+		if err != nil {
+			return Value{}, err
+		}
+		return Value{Ref: value}, nil
+	case MapKind:
+		entries, ok := data.([]any)
+		if !ok {
+			return Value{}, mismatch(t, data)
+		}
+		m := NewMap()
+		for _, e := range entries {
+			entry, ok := e.(map[string]any)
+			if !ok {
+				return Value{}, mismatch(t, data)
+			}
+			key, err := decode(info.Key, entry["key"])
+			if err != nil {
+				return Value{}, err
+			}
+			value, err := decode(info.Value, entry["value"])
+			if err != nil {
+				return Value{}, err
+			}
+			m.Set(key, value)
+		}
+		return Value{Ref: m}, nil
+	case ArrayKind:
+		values, err := decodeList(t, info.Value, data)
+		if err != nil {
+			return Value{}, err
+		}
+		return Value{Ref: &Array{Values: values}}, nil
+	case ChanKind:
+		c, ok := data.(map[string]any)
+		if !ok {
+			return Value{}, mismatch(t, data)
+		}
+		values, err := decodeList(t, info.Value, c["values"])
+		if err != nil {
+			return Value{}, err
+		}
+		capacity, err := decode(Int, c["capacity"])
+		if err != nil {
+			return Value{}, err
+		}
+		closed, ok := c["closed"].(bool)
+		if !ok || capacity.Int < 0 {
+			return Value{}, mismatch(t, data)
+		}
+		return Value{Ref: &Channel{Values: values, Capacity: capacity.Int, Closed: closed}}, nil
+	case StructKind:
+		fields, ok := data.(map[string]any)
+		if !ok {
+			return Value{}, mismatch(t, data)
+		}
+		s := &Struct{Fields: make([]Value, len(info.Fields))}
+		for i, f := range info.Fields {
+			value, err := decode(f.DataType, fields[f.Name])
+			if err != nil {
+				return Value{}, fmt.Errorf("field %s: %w", f.Name, err)
+			}
+			s.Fields[i] = value
+		}
+		return Value{Ref: s}, nil
+	}
+	return Value{}, fmt.Errorf("cannot restore values of type %s", t.View())
+}
+
+// decodeList returns the elements of type element of a list in a value of
+// type t.
+func decodeList(t, element DataType, data any) ([]Value, error) {
+	elements, ok := data.([]any)
+	if !ok {
+		return nil, mismatch(t, data)
+	}
+	values := []Value{}
+	for _, e := range elements {
+		value, err := decode(element, e)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// mismatch reports data, shown as JSON, where a value of type t was expected.
+func mismatch(t DataType, data any) error {
+	got, _ := json.Marshal(data)
+	return fmt.Errorf("expected a value of type %s, got %s", t.View(), got)
+}
@@ -0,0 +1,221 @@
+package intpr
+
+import (
+	"fmt"
+	"simpl/errors"
+	"simpl/tokens"
+	"sync"
+)
+
+// scheduler is the state shared by the tasks of a program. Every task runs
+// on a goroutine of its own, but only the one holding lock runs: the others
+// wait for it to finish or to block on a channel, so tasks never touch memory
+// at the same time.
+type scheduler struct {
+	lock    sync.Mutex
+	changed *sync.Cond
+	// count is the number of tasks started and not finished, the main one
+	// included, and blocked the number of them waiting for a change since
+	// the last one. last is the id of the last task started.
+	count   int
+	blocked int
+	last    int
+	// failure is the first error a task failed with, which all the others
+	// fail with as soon as they wait
+	failure *errors.Error
+	// waiting is the position of the last operation a task blocked on
+	waiting tokens.Token
+}
+
+// Channel is the value of a channel. Like maps, channels are shared rather
+// than copied when they are stored. Values holds the values sent and not
+// received yet: up to Capacity of them, and for an unbuffered channel as
+// many as there are tasks waiting to receive.
+type Channel struct {
+	Values    []Value
+	Capacity  int
+	Closed    bool
+	receivers int
+}
+
+func (c *Channel) canSend() bool {
+	return c.Closed || len(c.Values) < max(c.Capacity, c.receivers)
+}
+
+func (c *Channel) canRecv() bool {
+	return c.Closed || len(c.Values) > 0
+}
+
+// schedule returns the scheduler of the tasks, starting it with the current
+// task as the only one on first use.
+func (m *Memory) schedule() *scheduler {
+	if m.tasks == nil {
+		m.tasks = &scheduler{count: 1}
+		m.tasks.changed = sync.NewCond(&m.tasks.lock)
+		m.tasks.lock.Lock()
+	}
+	return m.tasks
+}
+
+// notify wakes up the blocked tasks after a change, for them to check again
+// whether they can go on.
+func (t *scheduler) notify() {
+	t.blocked = 0
+	t.changed.Broadcast()
+}
+
+// spawn starts a task running the body of fn, with args as its params. The
+// task gets memory of its own, with fn.Env enclosing its frame like for any
+// call.
+func (m *Memory) spawn(fn *Function, args []Value) {
+	t := m.schedule()
+	t.count++
+	t.last++
+	frame := NewFrame(fn.Variables, fn.Env)
+	copy(frame.Values, args)
+	frame.Top = len(args)
+	frame.Function = fn
+	frame.Task = t.last
+	task := &Memory{Frame: frame, Frames: []*Frame{frame}, CheckOverflow: m.CheckOverflow, Task: t.last, tasks: t}
+	go func() {
+		t.lock.Lock()
+		err := fn.Body.Execute(task)
+		if err != nil && err.Type != errors.Return && t.failure == nil {
+			t.failure = err
+		}
+		t.count--
+		t.notify()
+		t.lock.Unlock()
+	}()
+}
+
+// wait blocks the current task until ready reports that it can go on. It
+// fails when another task failed, or when every task is blocked, which is
+// reported at token, or where the last other task blocked for a zero token.
+func (m *Memory) wait(token tokens.Token, ready func() bool) *errors.Error {
+	t := m.schedule()
+	for t.failure == nil && !ready() {
+		if t.blocked+1 == t.count {
+			at := token
+			if at == (tokens.Token{}) {
+				at = t.waiting
+			}
+			t.failure = &errors.Error{Message: "all tasks are blocked", Type: errors.RuntimeError, Token: at}
+			t.notify()
+			break
+		}
+		if token != (tokens.Token{}) {
+			t.waiting = token
+		}
+		t.blocked++
+		t.changed.Wait()
+	}
+	return t.failure
+}
+
+// Wait blocks until the tasks the program spawned have finished, and returns
+// the error a task failed with, if any.
+func (m *Memory) Wait() *errors.Error {
+	if m.tasks == nil {
+		return nil
+	}
+	t := m.tasks
+	return m.wait(tokens.Token{}, func() bool { return t.count == 1 })
+}
+
+// owns reports an error when the current task changes a variable depth
+// frames up that another task made, by assigning to it or to a part of it or
+// by deleting from the map it holds. Tasks may read the variables of the code
+// around their function, but changing them would race with the task they
+// belong to. Ownership goes with variables, not values: a map or an array
+// passed to a task is the task's to change, like a value sent to it.
+func (m *Memory) owns(depth int, name tokens.Token, action string) *errors.Error {
+	if depth == 0 || m.frame(depth).Task == m.Task {
+		return nil
+	}
+	return &errors.Error{Message: fmt.Sprintf("cannot %s %s, which belongs to another task", action, name.Value), Type: errors.RuntimeError, Token: name}
+}
+
+// send waits until c can take a value and adds value to it.
+func (m *Memory) send(c *Channel, value Value, token tokens.Token) *errors.Error {
+	if err := m.wait(token, c.canSend); err != nil {
+		return err
+	}
+	return m.put(c, value, token)
+}
+
+func (m *Memory) put(c *Channel, value Value, token tokens.Token) *errors.Error {
+	if c.Closed {
+		return &errors.Error{Message: "send on closed channel", Type: errors.RuntimeError, Token: token}
+	}
+	c.Values = append(c.Values, Copy(value))
+	m.schedule().notify()
+	return nil
+}
+
+// recv waits until c has a value or is closed, and returns the value as an
+// optional, none once c is closed and empty.
+func (m *Memory) recv(c *Channel, token tokens.Token) (Value, *errors.Error) {
+	c.receivers++
+	m.schedule().notify()
+	err := m.wait(token, c.canRecv)
+	c.receivers--
+	if err != nil {
+		return Value{}, err
+	}
+	return m.take(c), nil
+}
+
+func (m *Memory) take(c *Channel) Value {
+	if len(c.Values) == 0 {
+		return Value{}
+	}
+	value := c.Values[0]
+	c.Values = c.Values[1:]
+	m.schedule().notify()
+	return Value{Ref: value}
+}
+
+// close closes c, after which receiving from it gives the values left in
+// it and then none.
+func (m *Memory) close(c *Channel, token tokens.Token) *errors.Error {
+	if c.Closed {
+		return &errors.Error{Message: "close of closed channel", Type: errors.RuntimeError, Token: token}
+	}
+	c.Closed = true
+	m.schedule().notify()
+	return nil
+}
+
+// choose returns the first arm of s that can go on with its channel in
+// channels. Without one, it waits for one unless s has a default arm, for
+// which it returns -1.
+func (m *Memory) choose(s *Select, channels []*Channel) (int, *errors.Error) {
+	chosen := -1
+	ready := func() bool {
+		for i, arm := range s.Arms {
+			if arm.Value == nil && channels[i].canRecv() || arm.Value != nil && channels[i].canSend() {
+				chosen = i
+				return true
+			}
+		}
+		return false
+	}
+	if ready() || s.Default != nil {
+		return chosen, nil
+	}
+	// waiting to receive lets the tasks sending to unbuffered channels go on
+	for i, arm := range s.Arms {
+		if arm.Value == nil {
+			channels[i].receivers++
+		}
+	}
+	m.schedule().notify()
+	err := m.wait(s.Token, ready)
+	for i, arm := range s.Arms {
+		if arm.Value == nil {
+			channels[i].receivers--
+		}
+	}
+	return chosen, err
+}
@@ -0,0 +1,476 @@
+package intpr
+
+import (
+	"fmt"
+	"simpl/errors"
+	"simpl/tokens"
+	"strings"
+)
+
+// DataType is the type of a value. It refers to the description of the
+// type, so types compare with ==: the built-in types are shared by every
+// program, while the composite ones belong to the Types of the program that
+// made them.
+type DataType struct {
+	info *Type
+}
+
+// Kind tells apart the composite types, which are described by a Type.
+type Kind int
+
+const (
+	// BuiltinKind is the kind of the built-in types, which Type reports as
+	// nil
+	BuiltinKind Kind = iota
+	StructKind
+	MapKind
+	TupleKind
+	ArrayKind
+	ParamKind
+	EnumKind
+	OptionalKind
+	ChanKind
+)
+
+type Field struct {
+	Name     string
+	DataType DataType
+}
+
+type Type struct {
+	Kind   Kind
+	Name   string
+	Fields []Field
+	// Key and Value are the element types of a map, Value is also the
+	// element type of an array or a channel and the type of the value an
+	// optional holds
+	Key   DataType
+	Value DataType
+	// Elements are the types of the values of a tuple
+	Elements []DataType
+	// Variants are the names of the values of an enum, a value is held as
+	// its index here
+	Variants []string
+	// Comparable is set for a type param that only stands for types whose
+	// values can be compared with ==
+	Comparable bool
+	// id is the position of the type in the Types of its program, from 1
+	id int
+}
+
+func builtin(name string) DataType {
+	return DataType{&Type{Kind: BuiltinKind, Name: name}}
+}
+
+// Types holds the composite types of a program in the order they were made.
+// Every parse has a table of its own, so programs can be parsed at the same
+// time and the types of one are dropped with it.
+type Types struct {
+	list []*Type
+}
+
+// predeclared holds the composite types every program starts with. It is
+// only changed while the package is initialized.
+var predeclared = &Types{}
+
+// ErrorType is the struct a catch block receives the caught error as.
+var ErrorType = predeclared.NewStruct("error", []Field{{Name: "message", DataType: String}, {Name: "line", DataType: Int}, {Name: "column", DataType: Int}})
+
+// NewTypes returns the table of a new program, holding the predeclared
+// types.
+func NewTypes() *Types {
+	return &Types{list: append([]*Type{}, predeclared.list...)}
+}
+
+func (ts *Types) add(t *Type) DataType {
+	ts.list = append(ts.list, t)
+	t.id = len(ts.list)
+	return DataType{t}
+}
+
+// find returns the structural type matches picks out, Invalid if there is
+// none yet.
+func (ts *Types) find(matches func(t *Type) bool) DataType {
+	for _, t := range ts.list {
+		if matches(t) {
+			return DataType{t}
+		}
+	}
+	return Invalid
+}
+
+// NewStruct registers a struct type. Struct types are nominal, so every
+// declaration is a type of its own even if another one looks the same.
+func (ts *Types) NewStruct(name string, fields []Field) DataType {
+	return ts.add(&Type{Kind: StructKind, Name: name, Fields: fields})
+}
+
+// NewEnum registers an enum type. Like struct types, enum types are nominal.
+func (ts *Types) NewEnum(name string, variants []string) DataType {
+	return ts.add(&Type{Kind: EnumKind, Name: name, Variants: variants})
+}
+
+// MapOf returns the map type with the given key and value types. Map types
+// are structural, so the same element types always give the same type.
+func (ts *Types) MapOf(key, value DataType) DataType {
+	if t := ts.find(func(t *Type) bool { return t.Kind == MapKind && t.Key == key && t.Value == value }); t != Invalid {
+		return t
+	}
+	name := fmt.Sprintf("map[%s]%s", key.View(), value.View())
+	return ts.add(&Type{Kind: MapKind, Name: name, Key: key, Value: value})
+}
+
+// ArrayOf returns the array type with the given element type. Like map
+// types, array types are structural.
+func (ts *Types) ArrayOf(element DataType) DataType {
+	if t := ts.find(func(t *Type) bool { return t.Kind == ArrayKind && t.Value == element }); t != Invalid {
+		return t
+	}
+	return ts.add(&Type{Kind: ArrayKind, Name: "[]" + element.View(), Value: element})
+}
+
+// ChanOf returns the type of the channels carrying values of the given
+// type. Like map types, channel types are structural.
+func (ts *Types) ChanOf(element DataType) DataType {
+	if t := ts.find(func(t *Type) bool { return t.Kind == ChanKind && t.Value == element }); t != Invalid {
+		return t
+	}
+	return ts.add(&Type{Kind: ChanKind, Name: "chan[" + element.View() + "]", Value: element})
+}
+
+// OptionalOf returns the type of the values that are either a value of the
+// given type or none. Like map types, optional types are structural, and an
+// optional of an optional is the optional itself. A value of an optional
+// type has a nil Ref for none, and the Value it holds as Ref otherwise.
+func (ts *Types) OptionalOf(value DataType) DataType {
+	if value.IsOptional() {
+		return value
+	}
+	if t := ts.find(func(t *Type) bool { return t.Kind == OptionalKind && t.Value == value }); t != Invalid {
+		return t
+	}
+	return ts.add(&Type{Kind: OptionalKind, Name: value.View() + "?", Value: value})
+}
+
+// TupleOf returns the type of the values returned together by a function
+// with several results. Like map types, tuple types are structural.
+func (ts *Types) TupleOf(elements []DataType) DataType {
+	names := []string{}
+	for _, e := range elements {
+		names = append(names, e.View())
+	}
+	name := "(" + strings.Join(names, ", ") + ")"
+	if t := ts.find(func(t *Type) bool { return t.Kind == TupleKind && t.Name == name }); t != Invalid {
+		return t
+	}
+	return ts.add(&Type{Kind: TupleKind, Name: name, Elements: elements})
+}
+
+// TypeParam registers a type param of a generic function. Like struct types,
+// every type param is a type of its own.
+func (ts *Types) TypeParam(name string, comparable bool) DataType {
+	return ts.add(&Type{Kind: ParamKind, Name: name, Comparable: comparable})
+}
+
+// Type returns the description of a composite type, nil for built-in types.
+func (t DataType) Type() *Type {
+	if t.info == nil || t.info.Kind == BuiltinKind {
+		return nil
+	}
+	return t.info
+}
+
+// ID returns the position of a composite type in the Types of its program,
+// which tells apart types of the same name. It is 0 for built-in types.
+func (t DataType) ID() int {
+	if info := t.Type(); info != nil {
+		return info.id
+	}
+	return 0
+}
+
+func (t DataType) IsStruct() bool {
+	info := t.Type()
+	return info != nil && info.Kind == StructKind
+}
+
+func (t DataType) IsMap() bool {
+	info := t.Type()
+	return info != nil && info.Kind == MapKind
+}
+
+func (t DataType) IsArray() bool {
+	info := t.Type()
+	return info != nil && info.Kind == ArrayKind
+}
+
+func (t DataType) IsTuple() bool {
+	info := t.Type()
+	return info != nil && info.Kind == TupleKind
+}
+
+func (t DataType) IsParam() bool {
+	info := t.Type()
+	return info != nil && info.Kind == ParamKind
+}
+
+func (t DataType) IsOptional() bool {
+	info := t.Type()
+	return info != nil && info.Kind == OptionalKind
+}
+
+func (t DataType) IsChan() bool {
+	info := t.Type()
+	return info != nil && info.Kind == ChanKind
+}
+
+func (t DataType) IsEnum() bool {
+	info := t.Type()
+	return info != nil && info.Kind == EnumKind
+}
+
+// VariantIndex returns the position of the variant called name, -1 if there
+// is no such variant.
+func (t *Type) VariantIndex(name string) int {
+	for i, v := range t.Variants {
+		if v == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// FieldIndex returns the position of the field called name, -1 if there is
+// no such field.
+func (t *Type) FieldIndex(name string) int {
+	for i, f := range t.Fields {
+		if f.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Struct is the value of a struct. Structs have value semantics: they are
+// copied whenever they are stored, so a Struct is never shared by two slots.
+type Struct struct {
+	Fields []Value
+}
+
+// Tuple holds the values returned together by a function. Tuples only live
+// between a return and the destructuring of the call, so they are never
+// copied.
+type Tuple struct {
+	Values []Value
+}
+
+// mapKey is the part of a Value that can be a map key.
+type mapKey struct {
+	Int  int
+	Bool bool
+}
+
+// Map is the value of a map. Unlike structs, maps are shared rather than
+// copied when they are stored. Keys keeps the keys in insertion order.
+type Map struct {
+	Keys   []Value
+	values map[mapKey]Value
+}
+
+func NewMap() *Map {
+	return &Map{values: map[mapKey]Value{}}
+}
+
+func (m *Map) Get(key Value) (Value, bool) {
+	value, found := m.values[mapKey{key.Int, key.Bool}]
+	return value, found
+}
+
+// Set stores value under key. A new key goes after all the others, while
+// replacing the value of a key keeps its position.
+func (m *Map) Set(key, value Value) {
+	k := mapKey{key.Int, key.Bool}
+	if _, found := m.values[k]; !found {
+		m.Keys = append(m.Keys, key)
+	}
+	m.values[k] = value
+}
+
+func (m *Map) Delete(key Value) {
+	k := mapKey{key.Int, key.Bool}
+	if _, found := m.values[k]; !found {
+		return
+	}
+	delete(m.values, k)
+	for i, other := range m.Keys {
+		if (mapKey{other.Int, other.Bool}) == k {
+			m.Keys = append(m.Keys[:i], m.Keys[i+1:]...)
+			break
+		}
+	}
+}
+
+func (m *Map) Len() int {
+	return len(m.Keys)
+}
+
+// Array is the value of an array. Like maps, arrays are shared rather than
+// copied when they are stored. Their length is fixed when they are made.
+type Array struct {
+	Values []Value
+}
+
+// At returns the element at index, or an error at token when the index is
+// out of range.
+func (a *Array) At(index int, token tokens.Token) (*Value, *errors.Error) {
+	if index < 0 || index >= len(a.Values) {
+		return nil, &errors.Error{Message: fmt.Sprintf("index %d out of range for length %d", index, len(a.Values)), Type: errors.RuntimeError, Token: token}
+	}
+	return &a.Values[index], nil
+}
+
+// Zero returns the value a variable of type t holds before it is assigned.
+func Zero(t DataType) Value {
+	if t == String {
+		return Value{Ref: ""}
+	}
+	info := t.Type()
+	if info == nil || info.Kind == EnumKind || info.Kind == OptionalKind {
+		// an enum starts out as its first variant, an optional as none
+		return Value{}
+	}
+	if info.Kind == MapKind {
+		return Value{Ref: NewMap()}
+	}
+	if info.Kind == ArrayKind {
+		return Value{Ref: &Array{}}
+	}
+	if info.Kind == ChanKind {
+		return Value{Ref: &Channel{}}
+	}
+	if info.Kind == TupleKind {
+		values := make([]Value, len(info.Elements))
+		for i, e := range info.Elements {
+			values[i] = Zero(e)
+		}
+		return Value{Ref: &Tuple{Values: values}}
+	}
+	fields := make([]Value, len(info.Fields))
+	for i, f := range info.Fields {
+		fields[i] = Zero(f.DataType)
+	}
+	return Value{Ref: &Struct{Fields: fields}}
+}
+
+// Copy returns a value that shares no struct with v. Maps, arrays and
+// channels inside v are shared.
+func Copy(v Value) Value {
+	if some, ok := v.Ref.(Value); ok {
+		return Value{Ref: Copy(some)}
+	}
+	s, ok := v.Ref.(*Struct)
+	if !ok {
+		return v
+	}
+	fields := make([]Value, len(s.Fields))
+	for i, f := range s.Fields {
+		fields[i] = Copy(f)
+	}
+	return Value{Ref: &Struct{Fields: fields}}
+}
+
+// Equal compares two values of type t, structs field by field.
+func Equal(t DataType, a, b Value) bool {
+	switch t {
+	case Int:
+		return a.Int == b.Int
+	case Bool:
+		return a.Bool == b.Bool
+	case String:
+		return a.Ref == b.Ref
+	}
+	info := t.Type()
+	if info == nil {
+		return false
+	}
+	if info.Kind == EnumKind {
+		return a.Int == b.Int
+	}
+	if info.Kind == OptionalKind {
+		if a.Ref == nil || b.Ref == nil {
+			return a.Ref == b.Ref
+		}
+		return Equal(info.Value, a.Ref.(Value), b.Ref.(Value))
+	}
+	if info.Kind == MapKind || info.Kind == ArrayKind || info.Kind == ChanKind {
+		// a map, an array or a channel is only equal to itself
+		return a.Ref == b.Ref
+	}
+	left, right := a.Ref.(*Struct), b.Ref.(*Struct)
+	for i, f := range info.Fields {
+		if !Equal(f.DataType, left.Fields[i], right.Fields[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Format returns v the way it is shown when printing memory.
+func Format(t DataType, v Value) string {
+	switch t {
+	case Int:
+		return fmt.Sprintf("%d", v.Int)
+	case Bool:
+		return fmt.Sprintf("%t", v.Bool)
+	case String:
+		return fmt.Sprintf("%q", v.Ref)
+	}
+	info := t.Type()
+	if info == nil {
+		return "?"
+	}
+	if info.Kind == EnumKind {
+		return info.Name + "." + info.Variants[v.Int]
+	}
+	if info.Kind == OptionalKind {
+		if v.Ref == nil {
+			return "none"
+		}
+		return Format(info.Value, v.Ref.(Value))
+	}
+	if info.Kind == MapKind {
+		m := v.Ref.(*Map)
+		entries := []string{}
+		for _, key := range m.Keys {
+			value, _ := m.Get(key)
+			entries = append(entries, fmt.Sprintf("%s: %s", Format(info.Key, key), Format(info.Value, value)))
+		}
+		return fmt.Sprintf("%s{%s}", info.Name, strings.Join(entries, ", "))
+	}
+	if info.Kind == ArrayKind {
+		elements := []string{}
+		for _, element := range v.Ref.(*Array).Values {
+			elements = append(elements, Format(info.Value, element))
+		}
+		return fmt.Sprintf("%s{%s}", info.Name, strings.Join(elements, ", "))
+	}
+	if info.Kind == ChanKind {
+		// a channel shows the values sent to it and not received yet
+		c := v.Ref.(*Channel)
+		elements := []string{}
+		for _, element := range c.Values {
+			elements = append(elements, Format(info.Value, element))
+		}
+		closed := ""
+		if c.Closed {
+			closed = " closed"
+		}
+		return fmt.Sprintf("%s{%s}%s", info.Name, strings.Join(elements, ", "), closed)
+	}
+	s := v.Ref.(*Struct)
+	fields := []string{}
+	for i, f := range info.Fields {
+		fields = append(fields, fmt.Sprintf("%s: %s", f.Name, Format(f.DataType, s.Fields[i])))
+	}
+	return fmt.Sprintf("%s{%s}", info.Name, strings.Join(fields, ", "))
+}
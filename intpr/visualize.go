@@ -2,6 +2,7 @@ package intpr
 
 import (
 	"fmt"
+	"strings"
 )
 
 func (e *Expression) Visualize() {
@@ -33,14 +34,7 @@ func (e *Expression) Visualize() {
 			if n == nil {
 				fmt.Print(" ")
 			} else {
-				dType := ""
-				switch n.DataType {
-				case Int:
-					dType = "int"
-				default:
-					dType = "bool"
-				}
-				fmt.Printf("%s: %s", n.Token.View(), dType)
+				fmt.Printf("%s: %s", n.Token.View(), n.DataType.View())
 			}
 			for j := 0; j < tab; j++ {
 				fmt.Print(" ")
@@ -95,7 +89,7 @@ func (s *Assignment) Visualize() {
 	default:
 		fmt.Print("unknown ")
 	}
-	fmt.Println(s.Operator.View(), "SCOPE", s.VarScope)
+	fmt.Println(s.Operator.View(), "DEPTH", s.Depth, "SLOT", s.Slot)
 	s.Exp.Visualize()
 }
 
@@ -116,6 +110,36 @@ func (s *Conditional) Visualize() {
 	}
 }
 
+func (s *Destructure) Visualize() {
+	names := []string{}
+	for _, v := range s.Vars {
+		names = append(names, v.Value)
+	}
+	fmt.Printf("Destructure %s %s, SLOTS: %v\n", strings.Join(names, ", "), s.Operator.View(), s.Slots)
+	s.Exp.Visualize()
+}
+
+func (s *Match) Visualize() {
+	fmt.Println("match:")
+	s.Subject.Visualize()
+	for _, arm := range s.Arms {
+		fmt.Println("case:")
+		for _, v := range arm.Values {
+			v.Visualize()
+		}
+		for _, stmt := range arm.Block.Statements {
+			stmt.Visualize()
+		}
+	}
+	if s.Default != nil {
+		fmt.Println("default:")
+		for _, stmt := range s.Default.Statements {
+			stmt.Visualize()
+		}
+	}
+	fmt.Println("matchEnd")
+}
+
 func (s *For) Visualize() {
 	fmt.Println("For statemt")
 	fmt.Println("Init:")
@@ -134,7 +158,13 @@ func (s *For) Visualize() {
 }
 
 func (s *Def) Visualize() {
-	fmt.Printf("def %s %s, scope: %d\n", s.NameToken.Value, s.DataType.View(), s.Scope)
+	if s.TypeParams != nil {
+		for _, instance := range s.Instances {
+			instance.Visualize()
+		}
+		return
+	}
+	fmt.Printf("def %s %s, slot: %d\n", s.NameToken.Value, s.DataType.View(), s.Slot)
 	fmt.Print("params: ")
 	paramsLen := len(s.Params)
 	for i, p := range s.Params {
@@ -192,6 +222,21 @@ func (s *VoidCall) Visualize() {
 	fmt.Println("voidcallEnd")
 }
 
+func (s *EnumDef) Visualize() {
+	fmt.Printf("enum %s { %s }\n", s.NameToken.Value, strings.Join(s.DataType.Type().Variants, ", "))
+}
+
+func (s *StructDef) Visualize() {
+	fmt.Printf("struct %s {", s.NameToken.Value)
+	for i, f := range s.DataType.Type().Fields {
+		if i > 0 {
+			fmt.Print(",")
+		}
+		fmt.Printf(" %s %s", f.DataType.View(), f.Name)
+	}
+	fmt.Println(" }")
+}
+
 func (s *OpenScope) Visualize() {
 	fmt.Println("{")
 }
@@ -199,3 +244,70 @@ func (s *OpenScope) Visualize() {
 func (s *CloseScope) Visualize() {
 	fmt.Println("}")
 }
+
+func (s *ForIn) Visualize() {
+	fmt.Printf("ForIn statement %s, slot: %d\n", s.Var.Value, s.Slot)
+	if s.Collection != nil {
+		fmt.Println("Collection:")
+		s.Collection.Visualize()
+	} else {
+		fmt.Println("Start:")
+		s.Start.Visualize()
+		fmt.Println("End:")
+		s.End.Visualize()
+	}
+	fmt.Println("Block:")
+	for _, stmt := range s.Block.Statements {
+		stmt.Visualize()
+	}
+	fmt.Println("ForInEnd")
+}
+
+func (s *Try) Visualize() {
+	fmt.Println("try:")
+	for _, stmt := range s.Body.Statements {
+		stmt.Visualize()
+	}
+	fmt.Printf("catch %s, slot: %d\n", s.Var.Value, s.Slot)
+	for _, stmt := range s.Catch.Statements {
+		stmt.Visualize()
+	}
+	fmt.Println("tryEnd")
+}
+
+func (s *Raise) Visualize() {
+	fmt.Println("raise:")
+	s.Exp.Visualize()
+}
+
+func (s *Spawn) Visualize() {
+	fmt.Printf("spawn %s()\n", s.NameToken.Value)
+	fmt.Println("Arguments:")
+	for _, a := range s.Args {
+		a.Visualize()
+	}
+	fmt.Println("spawnEnd")
+}
+
+func (s *Select) Visualize() {
+	fmt.Println("select:")
+	for _, arm := range s.Arms {
+		if arm.Value != nil {
+			fmt.Println("send:")
+		} else {
+			fmt.Printf("recv %s, slot: %d\n", arm.Var.Value, arm.Slot)
+		}
+		arm.Channel.Visualize()
+		arm.Value.Visualize()
+		for _, stmt := range arm.Block.Statements {
+			stmt.Visualize()
+		}
+	}
+	if s.Default != nil {
+		fmt.Println("default:")
+		for _, stmt := range s.Default.Statements {
+			stmt.Visualize()
+		}
+	}
+	fmt.Println("selectEnd")
+}
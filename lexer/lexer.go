@@ -17,6 +17,9 @@ var singleChars = map[byte]tokens.TokenType{
 	'}': tokens.RIGHT_BRACE,
 	'(': tokens.LEFT_PAREN,
 	')': tokens.RIGHT_PAREN,
+	'[': tokens.LEFT_BRACKET,
+	']': tokens.RIGHT_BRACKET,
+	'~': tokens.TILDE,
 }
 
 func Tokenize(source string, filename string, line int) ([]tokens.Token, []errors.Error) {
@@ -64,13 +67,9 @@ func Tokenize(source string, filename string, line int) ([]tokens.Token, []error
 			} else if next == '-' {
 				token = tokens.NewToken(tokens.DOUBLE_MINUS, "", filename, line, start-lineStart+1)
 				start += 2
-			} else if isDigit(next) {
-				var newStart int
-				token, newStart = readNumber(&source, filename, line, start, lineStart)
-				start = newStart
 			} else {
-				start++
 				token = tokens.NewToken(tokens.MINUS, "", filename, line, start-lineStart+1)
+				start++
 			}
 			result = append(result, token)
 		case '*':
@@ -112,6 +111,29 @@ func Tokenize(source string, filename string, line int) ([]tokens.Token, []error
 				start++
 			}
 			result = append(result, token)
+		case '"':
+			token, newStart, ok := readString(&source, filename, line, start, lineStart)
+			if !ok {
+				errs = append(errs, errors.Error{Message: "unterminated string", Token: token, Type: errors.SyntaxError})
+			}
+			result = append(result, token)
+			start = newStart
+		case '.':
+			if peek(&source, start+1) == '.' && peek(&source, start+2) == '.' {
+				token := tokens.NewToken(tokens.ELLIPSIS, "", filename, line, start-lineStart+1)
+				result = append(result, token)
+				start += 3
+				continue
+			}
+			if peek(&source, start+1) == '.' {
+				token := tokens.NewToken(tokens.DOUBLE_DOT, "", filename, line, start-lineStart+1)
+				result = append(result, token)
+				start += 2
+				continue
+			}
+			token := tokens.NewToken(tokens.DOT, "", filename, line, start-lineStart+1)
+			result = append(result, token)
+			start++
 		case ':':
 			if peek(&source, start+1) == '=' {
 				token := tokens.NewToken(tokens.COLON_EQUAL, "", filename, line, start-lineStart+1)
@@ -119,15 +141,27 @@ func Tokenize(source string, filename string, line int) ([]tokens.Token, []error
 				start += 2
 				continue
 			}
-			token := tokens.NewToken(tokens.UNPERMITTED, source[start:start+1], filename, line, start-lineStart+1)
+			token := tokens.NewToken(tokens.COLON, "", filename, line, start-lineStart+1)
+			result = append(result, token)
+			start++
+		case '?':
+			if peek(&source, start+1) == '?' {
+				token := tokens.NewToken(tokens.DOUBLE_QUESTION, "", filename, line, start-lineStart+1)
+				result = append(result, token)
+				start += 2
+				continue
+			}
+			token := tokens.NewToken(tokens.QUESTION, "", filename, line, start-lineStart+1)
 			result = append(result, token)
-			errs = append(errs, errors.Error{Message: "unpermitted character", Token: token, Type: errors.SyntaxError})
 			start++
 		case '=':
 			var token tokens.Token
 			if peek(&source, start+1) == '=' {
 				token = tokens.NewToken(tokens.DOUBLE_EQUAL, "", filename, line, start-lineStart+1)
 				start += 2
+			} else if peek(&source, start+1) == '>' {
+				token = tokens.NewToken(tokens.ARROW, "", filename, line, start-lineStart+1)
+				start += 2
 			} else {
 				token = tokens.NewToken(tokens.EQUAL, "", filename, line, start-lineStart+1)
 				start++
@@ -135,7 +169,13 @@ func Tokenize(source string, filename string, line int) ([]tokens.Token, []error
 			result = append(result, token)
 		case '>':
 			var token tokens.Token
-			if peek(&source, start+1) == '=' {
+			if peek(&source, start+1) == '>' && peek(&source, start+2) == '=' {
+				token = tokens.NewToken(tokens.SHIFT_RIGHT_EQUAL, "", filename, line, start-lineStart+1)
+				start += 3
+			} else if peek(&source, start+1) == '>' {
+				token = tokens.NewToken(tokens.SHIFT_RIGHT, "", filename, line, start-lineStart+1)
+				start += 2
+			} else if peek(&source, start+1) == '=' {
 				token = tokens.NewToken(tokens.GREATER_EQUAL, "", filename, line, start-lineStart+1)
 				start += 2
 			} else {
@@ -145,7 +185,13 @@ func Tokenize(source string, filename string, line int) ([]tokens.Token, []error
 			result = append(result, token)
 		case '<':
 			var token tokens.Token
-			if peek(&source, start+1) == '=' {
+			if peek(&source, start+1) == '<' && peek(&source, start+2) == '=' {
+				token = tokens.NewToken(tokens.SHIFT_LEFT_EQUAL, "", filename, line, start-lineStart+1)
+				start += 3
+			} else if peek(&source, start+1) == '<' {
+				token = tokens.NewToken(tokens.SHIFT_LEFT, "", filename, line, start-lineStart+1)
+				start += 2
+			} else if peek(&source, start+1) == '=' {
 				token = tokens.NewToken(tokens.LESS_EQUAL, "", filename, line, start-lineStart+1)
 				start += 2
 			} else {
@@ -164,25 +210,41 @@ func Tokenize(source string, filename string, line int) ([]tokens.Token, []error
 			}
 			result = append(result, token)
 		case '|':
+			var token tokens.Token
 			if peek(&source, start+1) == '|' {
-				token := tokens.NewToken(tokens.OR, "", filename, line, start-lineStart+1)
-				result = append(result, token)
+				token = tokens.NewToken(tokens.OR, "", filename, line, start-lineStart+1)
 				start += 2
-				continue
+			} else if peek(&source, start+1) == '=' {
+				token = tokens.NewToken(tokens.PIPE_EQUAL, "", filename, line, start-lineStart+1)
+				start += 2
+			} else {
+				token = tokens.NewToken(tokens.PIPE, "", filename, line, start-lineStart+1)
+				start++
 			}
-			token := tokens.NewToken(tokens.UNPERMITTED, source[start:start+1], filename, line, start-lineStart+1)
 			result = append(result, token)
-			errs = append(errs, errors.Error{Message: "unpermitted character", Token: token, Type: errors.SyntaxError})
 		case '&':
+			var token tokens.Token
 			if peek(&source, start+1) == '&' {
-				token := tokens.NewToken(tokens.AND, "", filename, line, start-lineStart+1)
-				result = append(result, token)
+				token = tokens.NewToken(tokens.AND, "", filename, line, start-lineStart+1)
 				start += 2
-				continue
+			} else if peek(&source, start+1) == '=' {
+				token = tokens.NewToken(tokens.AMPERSAND_EQUAL, "", filename, line, start-lineStart+1)
+				start += 2
+			} else {
+				token = tokens.NewToken(tokens.AMPERSAND, "", filename, line, start-lineStart+1)
+				start++
+			}
+			result = append(result, token)
+		case '^':
+			var token tokens.Token
+			if peek(&source, start+1) == '=' {
+				token = tokens.NewToken(tokens.CARET_EQUAL, "", filename, line, start-lineStart+1)
+				start += 2
+			} else {
+				token = tokens.NewToken(tokens.CARET, "", filename, line, start-lineStart+1)
+				start++
 			}
-			token := tokens.NewToken(tokens.UNPERMITTED, source[start:start+1], filename, line, start-lineStart+1)
 			result = append(result, token)
-			errs = append(errs, errors.Error{Message: "unpermitted character", Token: token, Type: errors.SyntaxError})
 		default:
 			if singleChars[c] != 0 {
 				token := tokens.NewToken(singleChars[c], "", filename, line, start-lineStart+1)
@@ -209,6 +271,10 @@ func Tokenize(source string, filename string, line int) ([]tokens.Token, []error
 					token = tokens.NewToken(tokens.ELSE, "", filename, line, start-lineStart+1)
 				case "for":
 					token = tokens.NewToken(tokens.FOR, "", filename, line, start-lineStart+1)
+				case "in":
+					token = tokens.NewToken(tokens.IN, "", filename, line, start-lineStart+1)
+				case "match":
+					token = tokens.NewToken(tokens.MATCH, "", filename, line, start-lineStart+1)
 				case "break":
 					token = tokens.NewToken(tokens.BREAK, "", filename, line, start-lineStart+1)
 				case "continue":
@@ -217,10 +283,38 @@ func Tokenize(source string, filename string, line int) ([]tokens.Token, []error
 					token = tokens.NewToken(tokens.INT_TYPE, "", filename, line, start-lineStart+1)
 				case "bool":
 					token = tokens.NewToken(tokens.BOOL_TYPE, "", filename, line, start-lineStart+1)
+				case "map":
+					token = tokens.NewToken(tokens.MAP, "", filename, line, start-lineStart+1)
+				case "chan":
+					token = tokens.NewToken(tokens.CHAN, "", filename, line, start-lineStart+1)
 				case "def":
 					token = tokens.NewToken(tokens.DEF, "", filename, line, start-lineStart+1)
 				case "return":
 					token = tokens.NewToken(tokens.RETURN, "", filename, line, start-lineStart+1)
+				case "const":
+					token = tokens.NewToken(tokens.CONST, "", filename, line, start-lineStart+1)
+				case "struct":
+					token = tokens.NewToken(tokens.STRUCT, "", filename, line, start-lineStart+1)
+				case "none":
+					token = tokens.NewToken(tokens.NONE, "", filename, line, start-lineStart+1)
+				case "some":
+					token = tokens.NewToken(tokens.SOME, "", filename, line, start-lineStart+1)
+				case "is":
+					token = tokens.NewToken(tokens.IS, "", filename, line, start-lineStart+1)
+				case "enum":
+					token = tokens.NewToken(tokens.ENUM, "", filename, line, start-lineStart+1)
+				case "string":
+					token = tokens.NewToken(tokens.STRING_TYPE, "", filename, line, start-lineStart+1)
+				case "try":
+					token = tokens.NewToken(tokens.TRY, "", filename, line, start-lineStart+1)
+				case "catch":
+					token = tokens.NewToken(tokens.CATCH, "", filename, line, start-lineStart+1)
+				case "raise":
+					token = tokens.NewToken(tokens.RAISE, "", filename, line, start-lineStart+1)
+				case "spawn":
+					token = tokens.NewToken(tokens.SPAWN, "", filename, line, start-lineStart+1)
+				case "select":
+					token = tokens.NewToken(tokens.SELECT, "", filename, line, start-lineStart+1)
 				default:
 					token = tokens.NewToken(tokens.IDENTIFIER, source[start:end], filename, line, start-lineStart+1)
 				}
@@ -274,6 +368,32 @@ func readNumber(source *string, filename string, line, start int, lineStart int)
 	return token, end
 }
 
+// readString reads a string literal ending on the same line. The value of
+// the token is the text between the quotes, with \", \\ and \n unescaped.
+func readString(source *string, filename string, line, start int, lineStart int) (tokens.Token, int, bool) {
+	value := []byte{}
+	end := start + 1
+	for end < len(*source) && (*source)[end] != '"' && (*source)[end] != '\n' {
+		c := (*source)[end]
+		if c == '\\' && end+1 < len(*source) {
+			end++
+			switch (*source)[end] {
+			case 'n':
+				c = '\n'
+			default:
+				c = (*source)[end]
+			}
+		}
+		value = append(value, c)
+		end++
+	}
+	token := tokens.NewToken(tokens.STRING, string(value), filename, line, start-lineStart+1)
+	if end >= len(*source) || (*source)[end] != '"' {
+		return token, end, false
+	}
+	return token, end + 1, true
+}
+
 func readAlphaNumeric(source *string, start int) int {
 	end := start + 1
 	for {
@@ -1,70 +1,169 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
 	"fmt"
 	"os"
+	"simpl/errors"
+	"simpl/gogen"
 	"simpl/intpr"
 	"simpl/lexer"
+	"simpl/optimizer"
 	"simpl/parser"
+	"simpl/watgen"
 	"time"
 )
 
 func main() {
-	execute := true
 	args := os.Args[1:]
-	if len(args) != 1 {
-		fmt.Println("Usage: simpl [script]")
+	if len(args) > 0 && args[0] == "build" {
+		build(args[1:])
+		return
+	}
+	flags := flag.NewFlagSet("simpl", flag.ExitOnError)
+	overflow := flags.String("overflow", "wrap", "int overflow behaviour: wrap around, or trap with a runtime error")
+	snapshot := flags.String("snapshot", "", "file to write the memory to as JSON when the script ends")
+	flags.Parse(args)
+	if flags.NArg() != 1 || *overflow != "wrap" && *overflow != "trap" {
+		fmt.Println("Usage: simpl [--overflow=wrap|trap] [--snapshot=file] [script]")
+		fmt.Println("       simpl build --target=go|wat [-o output] [script]")
 		os.Exit(64)
 	}
-	filename := args[0]
+	run(flags.Arg(0), *overflow == "trap", *snapshot)
+}
+
+// compile parses, type-checks and optimizes the script, printing any errors.
+// checkOverflow reports overflow in constant expressions, for programs run
+// with overflow checks.
+func compile(filename string, checkOverflow bool) (*intpr.Program, bool) {
 	source, err := os.ReadFile(filename)
 	if err != nil {
 		fmt.Println("File not found")
-		os.Exit(64)
+		return nil, false
 	}
-	startTime := time.Now()
 	tokens, errs := lexer.Tokenize(string(source), filename, 1)
 	if len(errs) > 0 {
 		for _, e := range errs {
 			e.Print()
 		}
-		return
+		return nil, false
 	}
-	memory := intpr.NewMemory()
-
 	parseSource := parser.New(tokens)
 	program, error := parseSource.Parse(false)
 	if error != nil {
 		error.Print()
+		return nil, false
+	}
+	if len(parseSource.Errors) > 0 {
+		for _, e := range parseSource.Errors {
+			e.Print()
+		}
+		return nil, false
+	}
+	if errs := optimizer.Fold(program, checkOverflow); len(errs) > 0 {
+		for _, e := range errs {
+			e.Print()
+		}
+		return nil, false
+	}
+	return program, true
+}
+
+func run(filename string, checkOverflow bool, snapshot string) {
+	execute := true
+	startTime := time.Now()
+	program, ok := compile(filename, checkOverflow)
+	if !ok {
 		os.Exit(64)
-		return
 	}
 	elapsed := time.Since(startTime)
 	fmt.Println("Time elapsed for parsing:", elapsed)
-	if execute {
-		if len(parseSource.Errors) > 0 {
-			for _, e := range parseSource.Errors {
-				e.Print()
-			}
-			os.Exit(64)
-		}
-		start := time.Now()
-		for _, stmt := range program.Statements {
-			err := stmt.Execute(memory)
-			if err != nil {
-				err.Print()
-				fmt.Println("Memory:")
-				memory.Print()
-				os.Exit(64)
-			}
-		}
-		elapsed := time.Since(start)
-		fmt.Println("Elapsed:", elapsed)
-		fmt.Println("Results:")
-		memory.Print()
-	} else {
+	if !execute {
 		for _, stmt := range program.Statements {
 			stmt.Visualize()
 		}
+		return
+	}
+	memory := intpr.NewMemory(program.Variables)
+	memory.CheckOverflow = checkOverflow
+	start := time.Now()
+	for _, stmt := range program.Statements {
+		err := stmt.Execute(memory)
+		if err != nil {
+			err.Print()
+			fmt.Println("Memory:")
+			memory.Print()
+			writeSnapshot(memory, snapshot)
+			os.Exit(64)
+		}
+	}
+	// the script ends once the tasks it spawned have finished
+	if err := memory.Wait(); err != nil {
+		err.Print()
+		fmt.Println("Memory:")
+		memory.Print()
+		writeSnapshot(memory, snapshot)
+		os.Exit(64)
+	}
+	elapsed = time.Since(start)
+	fmt.Println("Elapsed:", elapsed)
+	fmt.Println("Results:")
+	memory.Print()
+	writeSnapshot(memory, snapshot)
+}
+
+// writeSnapshot writes the memory as JSON to filename, unless it is empty.
+func writeSnapshot(memory *intpr.Memory, filename string) {
+	if filename == "" {
+		return
+	}
+	data, err := json.MarshalIndent(memory.Snapshot(), "", "  ")
+	if err == nil {
+		err = os.WriteFile(filename, append(data, '\n'), 0644)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(64)
+	}
+}
+
+func build(args []string) {
+	flags := flag.NewFlagSet("build", flag.ExitOnError)
+	target := flags.String("target", "go", "code generation target: go or wat")
+	output := flags.String("o", "", "output file, standard output if empty")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Println("Usage: simpl build --target=go|wat [-o output] [script]")
+		os.Exit(64)
+	}
+	filename := flags.Arg(0)
+	// the generated programs wrap around on overflow
+	program, ok := compile(filename, false)
+	if !ok {
+		os.Exit(64)
+	}
+	var source []byte
+	var err *errors.Error
+	switch *target {
+	case "go":
+		source, err = gogen.Generate(program, filename)
+	case "wat":
+		source, err = watgen.Generate(program)
+	default:
+		fmt.Printf("unknown target %s\n", *target)
+		os.Exit(64)
+	}
+	if err != nil {
+		err.Print()
+		os.Exit(64)
+	}
+	if *output == "" {
+		os.Stdout.Write(source)
+		return
+	}
+	if err := os.WriteFile(*output, source, 0644); err != nil {
+		fmt.Println(err)
+		os.Exit(64)
 	}
 }
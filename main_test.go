@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"simpl/errors"
+	"simpl/gogen"
+	"simpl/intpr"
+	"simpl/lexer"
+	"simpl/optimizer"
+	"simpl/parser"
+	"simpl/tokens"
+	"testing"
+)
+
+// load parses the files as one program, in order, keeping the positions of
+// every file.
+func load(t *testing.T, filenames ...string) *intpr.Program {
+	t.Helper()
+	all := []tokens.Token{}
+	for _, filename := range filenames {
+		source, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file, errs := lexer.Tokenize(string(source), filename, 1)
+		if len(errs) > 0 {
+			t.Fatal(describe(&errs[0]))
+		}
+		if len(all) > 0 {
+			// only the last file ends the program
+			all = all[:len(all)-1]
+		}
+		all = append(all, file...)
+	}
+	source := parser.New(all)
+	program, err := source.Parse(false)
+	if err == nil && len(source.Errors) > 0 {
+		err = source.Errors[0]
+	}
+	if err == nil {
+		if errs := optimizer.Fold(program, false); len(errs) > 0 {
+			err = errs[0]
+		}
+	}
+	if err != nil {
+		t.Fatal(describe(err))
+	}
+	return program
+}
+
+// parse parses and folds source, returning the errors of the parser or,
+// when there are none, of the optimizer.
+func parse(t testing.TB, source string, checkOverflow bool) (*intpr.Program, []*errors.Error) {
+	t.Helper()
+	tokens, errs := lexer.Tokenize(source, "source.simpl", 1)
+	if len(errs) > 0 {
+		t.Fatal(describe(&errs[0]))
+	}
+	p := parser.New(tokens)
+	program, err := p.Parse(false)
+	if err == nil && len(p.Errors) > 0 {
+		err = p.Errors[0]
+	}
+	if err != nil {
+		t.Fatal(describe(err))
+	}
+	return program, optimizer.Fold(program, checkOverflow)
+}
+
+// execute runs source, returning its memory and the error it stopped with.
+func execute(t *testing.T, source string, checkOverflow bool) (*intpr.Memory, *errors.Error) {
+	t.Helper()
+	program, errs := parse(t, source, checkOverflow)
+	if len(errs) > 0 {
+		t.Fatal(describe(errs[0]))
+	}
+	memory := intpr.NewMemory(program.Variables)
+	memory.CheckOverflow = checkOverflow
+	for _, stmt := range program.Statements {
+		if err := stmt.Execute(memory); err != nil {
+			return memory, err
+		}
+	}
+	return memory, nil
+}
+
+func describe(err *errors.Error) string {
+	return fmt.Sprintf("%s:%d:%d: %s", err.Token.Filename, err.Token.Line, err.Token.Char, err.Message)
+}
+
+// global returns the value of the global variable called name.
+func global(t testing.TB, memory *intpr.Memory, name string) any {
+	t.Helper()
+	for _, v := range memory.Snapshot().Frames[0].Variables {
+		if v.Name == name && v.Scope == 0 {
+			return v.Value
+		}
+	}
+	t.Fatalf("no variable %s", name)
+	return nil
+}
+
+var failuresLine = regexp.MustCompile(`(?m)^failures = (\d+)$`)
+
+// TestSuites runs the regression suites in tests, after the checks of
+// tests/prelude.simpl, with the interpreter and with the go target.
+func TestSuites(t *testing.T) {
+	suites, err := filepath.Glob("tests/*.simpl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, suite := range suites {
+		if suite == filepath.Join("tests", "prelude.simpl") {
+			continue
+		}
+		suite := suite
+		t.Run(filepath.Base(suite), func(t *testing.T) {
+			t.Parallel()
+			t.Run("interpreter", func(t *testing.T) {
+				program := load(t, "tests/prelude.simpl", suite)
+				memory := intpr.NewMemory(program.Variables)
+				for _, stmt := range program.Statements {
+					if err := stmt.Execute(memory); err != nil {
+						t.Fatal(describe(err))
+					}
+				}
+				if err := memory.Wait(); err != nil {
+					t.Fatal(describe(err))
+				}
+				if failures := global(t, memory, "failures"); failures != 0 {
+					t.Errorf("failures = %v, last one %v", failures, global(t, memory, "lastFailure"))
+				}
+			})
+			t.Run("go", func(t *testing.T) {
+				goTool, err := exec.LookPath("go")
+				if err != nil {
+					t.Skip("go tool not found")
+				}
+				program := load(t, "tests/prelude.simpl", suite)
+				source, genErr := gogen.Generate(program, suite)
+				if genErr != nil {
+					t.Fatal(describe(genErr))
+				}
+				output := filepath.Join(t.TempDir(), "main.go")
+				if err := os.WriteFile(output, source, 0644); err != nil {
+					t.Fatal(err)
+				}
+				result, err := exec.Command(goTool, "run", output).CombinedOutput()
+				if err != nil {
+					t.Fatalf("%v\n%s", err, result)
+				}
+				match := failuresLine.FindSubmatch(result)
+				if match == nil || string(match[1]) != "0" {
+					t.Errorf("the program did not end with failures = 0:\n%s", result)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,304 @@
+// Package optimizer rewrites type-checked programs into equivalent ones that
+// are cheaper to execute.
+package optimizer
+
+import (
+	"simpl/errors"
+	"simpl/intpr"
+	"simpl/tokens"
+	"strconv"
+)
+
+type folder struct {
+	errors        []*errors.Error
+	checkOverflow bool
+}
+
+// Fold evaluates constant subexpressions, simplifies double negations and
+// drops branches of conditionals whose condition is constant. Folded nodes
+// keep the position of the operator they replace. Division by zero in a
+// constant expression is reported instead of being left for runtime, and so
+// is overflow when checkOverflow is set, as for memory that checks it, except
+// in the branches and operands that are dropped as never running.
+func Fold(program *intpr.Program, checkOverflow bool) []*errors.Error {
+	f := folder{checkOverflow: checkOverflow}
+	program.Statements = f.statements(program.Statements)
+	return f.errors
+}
+
+// FoldExpression folds e in place like Fold does. Errors in constant
+// expressions are left for Fold to report.
+func FoldExpression(e *intpr.Expression) {
+	f := folder{}
+	f.expression(e)
+}
+
+func (f *folder) statements(statements []intpr.Statement) []intpr.Statement {
+	result := []intpr.Statement{}
+	for _, stmt := range statements {
+		result = append(result, f.statement(stmt)...)
+	}
+	return result
+}
+
+func (f *folder) block(program *intpr.Program) {
+	if program != nil {
+		program.Statements = f.statements(program.Statements)
+	}
+}
+
+// inScope keeps the scope of a block whose conditional was removed, so the
+// variables declared in it stay local to it.
+func inScope(program *intpr.Program) []intpr.Statement {
+	if program == nil {
+		return nil
+	}
+	result := []intpr.Statement{&intpr.OpenScope{}}
+	result = append(result, program.Statements...)
+	return append(result, &intpr.CloseScope{})
+}
+
+func (f *folder) statement(stmt intpr.Statement) []intpr.Statement {
+	switch s := stmt.(type) {
+	case *intpr.Assignment:
+		f.expression(s.Exp)
+		for _, sel := range s.Path {
+			f.expression(sel.Index)
+		}
+	case *intpr.Destructure:
+		f.expression(s.Exp)
+	case *intpr.VoidCall:
+		for _, a := range s.Args {
+			f.expression(a)
+		}
+	case *intpr.Conditional:
+		// the branch the condition drops never runs, so its errors are not
+		// reported
+		f.expression(s.Condition)
+		condition, constant := boolValue(s.Condition)
+		switch {
+		case !constant:
+		case s.Token.Type == tokens.IF && condition:
+			f.block(s.Then)
+			return inScope(s.Then)
+		case s.Token.Type == tokens.IF || !condition:
+			// a while loop that never runs only executes its else block
+			f.block(s.Else)
+			return inScope(s.Else)
+		}
+		f.block(s.Then)
+		f.block(s.Else)
+	case *intpr.For:
+		f.statement(s.Init)
+		f.expression(s.Condition)
+		f.statement(s.After)
+		f.block(s.Block)
+	case *intpr.Match:
+		f.expression(s.Subject)
+		for _, arm := range s.Arms {
+			for _, v := range arm.Values {
+				f.expression(v)
+			}
+			f.block(arm.Block)
+		}
+		f.block(s.Default)
+	case *intpr.ForIn:
+		f.expression(s.Start)
+		f.expression(s.End)
+		f.expression(s.Collection)
+		f.block(s.Block)
+	case *intpr.Try:
+		f.block(s.Body)
+		f.block(s.Catch)
+	case *intpr.Raise:
+		f.expression(s.Exp)
+	case *intpr.Spawn:
+		for _, a := range s.Args {
+			f.expression(a)
+		}
+	case *intpr.Select:
+		for _, arm := range s.Arms {
+			f.expression(arm.Channel)
+			f.expression(arm.Value)
+			f.block(arm.Block)
+		}
+		f.block(s.Default)
+	case *intpr.Def:
+		// the instances of a generic function repeat the errors of its body
+		for _, instance := range s.Instances {
+			errs := len(f.errors)
+			f.statement(instance)
+			f.errors = f.errors[:errs]
+		}
+		for _, exp := range s.ReturnBranches {
+			f.expression(exp)
+		}
+		f.block(s.Body)
+	}
+	return []intpr.Statement{stmt}
+}
+
+func intValue(e *intpr.Expression) (int, bool) {
+	if e.Token.Type != tokens.NUMBER {
+		return 0, false
+	}
+	return e.Constant.Int, true
+}
+
+func boolValue(e *intpr.Expression) (bool, bool) {
+	switch e.Token.Type {
+	case tokens.TRUE, tokens.FALSE:
+		return e.Constant.Bool, true
+	}
+	return false, false
+}
+
+func setInt(e *intpr.Expression, value int) {
+	token := e.Token
+	token.Type = tokens.NUMBER
+	token.Value = strconv.Itoa(value)
+	*e = intpr.Expression{Token: token, DataType: intpr.Int, Constant: intpr.Value{Int: value}}
+}
+
+// setExact folds e into the result of an int operation, or reports that it
+// overflows when overflow is checked.
+func (f *folder) setExact(e *intpr.Expression, value int, exact bool) {
+	if !exact && f.checkOverflow {
+		f.errors = append(f.errors, &errors.Error{Message: "integer overflow in constant expression", Type: errors.ArithmeticError, Token: e.Token})
+		return
+	}
+	setInt(e, value)
+}
+
+func setBool(e *intpr.Expression, value bool) {
+	token := e.Token
+	token.Type = tokens.FALSE
+	if value {
+		token.Type = tokens.TRUE
+	}
+	token.Value = ""
+	*e = intpr.Expression{Token: token, DataType: intpr.Bool, Constant: intpr.Value{Bool: value}}
+}
+
+// expression folds e in place, so references held elsewhere, like the
+// return branches of a function, see the folded tree.
+func (f *folder) expression(e *intpr.Expression) {
+	if e == nil {
+		return
+	}
+	if e.Token.Type == tokens.AND || e.Token.Type == tokens.OR {
+		f.logical(e)
+		return
+	}
+	for _, a := range e.Args {
+		f.expression(a)
+	}
+	f.expression(e.Left)
+	f.expression(e.Right)
+
+	if e.Token.Type == tokens.BANG {
+		if value, ok := boolValue(e.Left); ok {
+			setBool(e, !value)
+		} else if e.Left.Token.Type == tokens.BANG {
+			*e = *e.Left.Left
+		}
+		return
+	}
+	if e.Token.Type == tokens.NEGATE || e.Token.Type == tokens.TILDE {
+		if value, ok := intValue(e.Left); ok && e.Token.Type == tokens.NEGATE {
+			negated, exact := intpr.SubOk(0, value)
+			f.setExact(e, negated, exact)
+		} else if ok {
+			setInt(e, ^value)
+		}
+		return
+	}
+	if e.Left == nil || e.Right == nil {
+		return
+	}
+	if left, ok := intValue(e.Left); ok {
+		right, ok := intValue(e.Right)
+		if !ok {
+			return
+		}
+		switch e.Token.Type {
+		case tokens.PLUS:
+			value, exact := intpr.AddOk(left, right)
+			f.setExact(e, value, exact)
+		case tokens.MINUS:
+			value, exact := intpr.SubOk(left, right)
+			f.setExact(e, value, exact)
+		case tokens.STAR:
+			value, exact := intpr.MulOk(left, right)
+			f.setExact(e, value, exact)
+		case tokens.SLASH, tokens.MODULO:
+			if right == 0 {
+				f.errors = append(f.errors, &errors.Error{Message: "zero division in constant expression", Type: errors.ArithmeticError, Token: e.Token})
+				return
+			}
+			if e.Token.Type == tokens.SLASH {
+				value, exact := intpr.DivOk(left, right)
+				f.setExact(e, value, exact)
+			} else {
+				setInt(e, left%right)
+			}
+		case tokens.AMPERSAND:
+			setInt(e, left&right)
+		case tokens.PIPE:
+			setInt(e, left|right)
+		case tokens.CARET:
+			setInt(e, left^right)
+		case tokens.SHIFT_LEFT, tokens.SHIFT_RIGHT:
+			if right < 0 || right > 63 {
+				f.errors = append(f.errors, &errors.Error{Message: "shift count out of range in constant expression", Type: errors.ArithmeticError, Token: e.Token})
+				return
+			}
+			if e.Token.Type == tokens.SHIFT_LEFT {
+				value, exact := intpr.ShlOk(left, right)
+				f.setExact(e, value, exact)
+			} else {
+				setInt(e, left>>right)
+			}
+		case tokens.LESS:
+			setBool(e, left < right)
+		case tokens.LESS_EQUAL:
+			setBool(e, left <= right)
+		case tokens.GREATER:
+			setBool(e, left > right)
+		case tokens.GREATER_EQUAL:
+			setBool(e, left >= right)
+		case tokens.DOUBLE_EQUAL:
+			setBool(e, left == right)
+		case tokens.NOT_EQUAL:
+			setBool(e, left != right)
+		}
+		return
+	}
+	if left, ok := boolValue(e.Left); ok {
+		right, ok := boolValue(e.Right)
+		if !ok {
+			return
+		}
+		switch e.Token.Type {
+		case tokens.DOUBLE_EQUAL:
+			setBool(e, left == right)
+		case tokens.NOT_EQUAL:
+			setBool(e, left != right)
+		}
+	}
+}
+
+// logical folds a && or ||. The right operand only runs when the left one
+// does not decide, so it is neither folded nor checked when it does.
+func (f *folder) logical(e *intpr.Expression) {
+	f.expression(e.Left)
+	left, ok := boolValue(e.Left)
+	if ok && left == (e.Token.Type == tokens.OR) {
+		setBool(e, left)
+		return
+	}
+	f.expression(e.Right)
+	if ok {
+		*e = *e.Right
+	}
+}
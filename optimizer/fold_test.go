@@ -0,0 +1,93 @@
+package optimizer_test
+
+import (
+	"fmt"
+	"simpl/errors"
+	"simpl/intpr"
+	"simpl/lexer"
+	"simpl/optimizer"
+	"simpl/parser"
+	"simpl/tokens"
+	"slices"
+	"testing"
+)
+
+// fold parses source and folds it, returning the folded program and the
+// errors of folding.
+func fold(t *testing.T, source string, checkOverflow bool) (*intpr.Program, []*errors.Error) {
+	t.Helper()
+	tokens, errs := lexer.Tokenize(source, "source.simpl", 1)
+	if len(errs) > 0 {
+		t.Fatalf("tokenize: %s", errs[0].Message)
+	}
+	parse := parser.New(tokens)
+	program, err := parse.Parse(false)
+	if err == nil && len(parse.Errors) > 0 {
+		err = parse.Errors[0]
+	}
+	if err != nil {
+		t.Fatalf("parse %q: %s", source, err.Message)
+	}
+	return program, optimizer.Fold(program, checkOverflow)
+}
+
+// TestConstantErrors checks that the operations on constants that fail are
+// arithmetic errors, unless they are in a branch or an operand that never
+// runs.
+func TestConstantErrors(t *testing.T) {
+	cases := []struct {
+		name, source, message string
+	}{
+		{"division", "x := 1 / 0;", "zero division in constant expression"},
+		{"remainder", "x := 1 % 0;", "zero division in constant expression"},
+		{"shift", "x := 1 << 64;", "shift count out of range in constant expression"},
+		{"overflow", "x := 9223372036854775807 + 1;", "integer overflow in constant expression"},
+		{"taken branch", "if true { x := 1 / 0; }", "zero division in constant expression"},
+		{"deciding operand", "b := true && 1 / 0 == 0;", "zero division in constant expression"},
+		{"dropped branch", "if false { x := 1 / 0; }", ""},
+		{"dropped else", "if 1 < 2 { x := 1; } else { x := 1 << 64; }", ""},
+		{"loop that never runs", "while false { x := 9223372036854775807 + 1; }", ""},
+		{"dropped and operand", "b := false && 1 / 0 == 0;", ""},
+		{"dropped or operand", "b := true || 1 % 0 == 0;", ""},
+	}
+	for _, c := range cases {
+		_, errs := fold(t, c.source, true)
+		if c.message == "" {
+			if len(errs) > 0 {
+				t.Errorf("%s: got %q, want no error", c.name, errs[0].Message)
+			}
+			continue
+		}
+		if len(errs) != 1 || errs[0].Type != errors.ArithmeticError || errs[0].Message != c.message {
+			t.Errorf("%s: got %v, want an arithmetic error %q", c.name, errs, c.message)
+		}
+	}
+}
+
+// TestFold checks that constant expressions become literals and that a
+// conditional with a constant condition is replaced by the block that runs,
+// between the markers of a scope of its own.
+func TestFold(t *testing.T) {
+	const source = "x := 2 + 3 * 4;\nif 1 > 2 { y := 1; } else { y := 2; }\nwhile false { z := 1; }\nb := false || !!(x > 1);\n"
+	program, errs := fold(t, source, false)
+	if len(errs) > 0 {
+		t.Fatal(errs[0].Message)
+	}
+	got := []string{}
+	for _, stmt := range program.Statements {
+		got = append(got, fmt.Sprintf("%T", stmt))
+	}
+	want := []string{"*intpr.Assignment", "*intpr.OpenScope", "*intpr.Assignment", "*intpr.CloseScope", "*intpr.Assignment"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("got statements %v, want %v", got, want)
+	}
+	if x := program.Statements[0].(*intpr.Assignment).Exp; x.Token.Type != tokens.NUMBER || x.Constant.Int != 14 {
+		t.Errorf("x := 2 + 3 * 4 folded to %s, want the literal 14", x.Token.View())
+	}
+	if y := program.Statements[2].(*intpr.Assignment); y.Exp.Constant.Int != 2 {
+		t.Errorf("kept y := %v, want the else branch", y.Exp.Constant.Int)
+	}
+	if b := program.Statements[4].(*intpr.Assignment).Exp; b.Token.Type != tokens.GREATER {
+		t.Errorf("false || !!(x > 1) folded to %s, want x > 1", b.Token.View())
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"simpl/errors"
+	"testing"
+)
+
+// bounds declares the extreme ints for the overflow cases, on line 1.
+const bounds = "big := 9223372036854775807; small := -big - 1; minusOne := -1;\n"
+
+// TestOverflowTrap checks that every operation on ints that overflows is a
+// runtime error with --overflow=trap, and wraps around otherwise.
+func TestOverflowTrap(t *testing.T) {
+	cases := []struct {
+		name, statements, message string
+		wrapped                   int
+	}{
+		{"add", "x := big + 1;", "integer overflow", -9223372036854775808},
+		{"subtract", "x := small - 1;", "integer overflow", 9223372036854775807},
+		{"multiply", "x := big * 2;", "integer overflow", -2},
+		{"divide", "x := small / minusOne;", "integer overflow", -9223372036854775808},
+		{"shift", "x := big << 1;", "integer overflow", -2},
+		{"negate", "x := -small;", "integer overflow", -9223372036854775808},
+		{"increment", "x := big; x++;", "integer overflow", -9223372036854775808},
+		{"multiply assign", "x := big; x *= 2;", "integer overflow", -2},
+		{"pow", "x := pow(2, 63);", "integer overflow in pow", -9223372036854775808},
+		{"abs", "x := abs(small);", "integer overflow in abs", -9223372036854775808},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := execute(t, bounds+c.statements, true)
+			if err == nil {
+				t.Fatalf("%s did not trap", c.statements)
+			}
+			if err.Type != errors.RuntimeError || err.Message != c.message || err.Token.Line != 2 {
+				t.Errorf("%s gave %s, want a runtime error %q on line 2", c.statements, describe(err), c.message)
+			}
+			memory, err := execute(t, bounds+c.statements, false)
+			if err != nil {
+				t.Fatalf("%s without checks: %s", c.statements, describe(err))
+			}
+			if x := global(t, memory, "x"); x != c.wrapped {
+				t.Errorf("%s without checks gave x = %v, want %d", c.statements, x, c.wrapped)
+			}
+		})
+	}
+}
+
+// TestConstantOverflow checks that a constant expression that overflows is
+// a compile error when overflow is checked, and wraps around otherwise.
+func TestConstantOverflow(t *testing.T) {
+	const source = "const int BIG = 9223372036854775807;\nx := BIG + 1;\n"
+	_, errs := parse(t, source, true)
+	if len(errs) != 1 {
+		t.Fatalf("got %d errors, want 1", len(errs))
+	}
+	if err := errs[0]; err.Type != errors.ArithmeticError || err.Message != "integer overflow in constant expression" || err.Token.Line != 2 {
+		t.Errorf("got %s, want an arithmetic error for the overflow in constant expression on line 2", describe(err))
+	}
+	memory, err := execute(t, source, false)
+	if err != nil {
+		t.Fatal(describe(err))
+	}
+	if x := global(t, memory, "x"); x != -9223372036854775808 {
+		t.Errorf("x = %v, want it wrapped around to the smallest int", x)
+	}
+}
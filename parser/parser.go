@@ -2,9 +2,14 @@ package parser
 
 import (
 	"fmt"
+	"maps"
 	"simpl/errors"
 	"simpl/intpr"
+	"simpl/optimizer"
 	sTokens "simpl/tokens"
+	"slices"
+	"strconv"
+	"strings"
 )
 
 var permittedInfixes map[sTokens.TokenType]bool = map[sTokens.TokenType]bool{
@@ -14,6 +19,12 @@ var permittedInfixes map[sTokens.TokenType]bool = map[sTokens.TokenType]bool{
 	sTokens.SLASH:  true,
 	sTokens.MODULO: true,
 
+	sTokens.AMPERSAND:   true,
+	sTokens.PIPE:        true,
+	sTokens.CARET:       true,
+	sTokens.SHIFT_LEFT:  true,
+	sTokens.SHIFT_RIGHT: true,
+
 	sTokens.OR:           true,
 	sTokens.AND:          true,
 	sTokens.DOUBLE_EQUAL: true,
@@ -23,30 +34,116 @@ var permittedInfixes map[sTokens.TokenType]bool = map[sTokens.TokenType]bool{
 	sTokens.GREATER_EQUAL: true,
 	sTokens.LESS:          true,
 	sTokens.LESS_EQUAL:    true,
+
+	sTokens.DOUBLE_QUESTION: true,
+}
+
+// Var is a variable known to the parser: its type and the slot it occupies
+// in the frame it was declared in.
+type Var struct {
+	DataType intpr.DataType
+	Slot     int
+	// Value is the initializer of a constant, which uses inline, and nil
+	// for a variable
+	Value *intpr.Expression
 }
 
+// Cache tracks the variables and functions visible while parsing. Every
+// block opens a level, and the levels of the top-level code and of each
+// function body are grouped into frames, whose slots are laid out here.
 type Cache struct {
 	size  int
-	vars  []map[string]intpr.DataType
+	vars  []map[string]Var
 	funcs []map[string]FuncCache
+	types []map[string]intpr.DataType
+	// frames holds the index of the frame each level belongs to
+	frames []int
+	// layouts and bases hold the slots and the first level of each open frame
+	layouts []*[]intpr.Variable
+	bases   []int
 }
 
 func NewCache() *Cache {
-	return &Cache{vars: []map[string]intpr.DataType{{}}, funcs: []map[string]FuncCache{{}}, size: 1}
+	return &Cache{vars: []map[string]Var{{}}, funcs: []map[string]FuncCache{{}}, types: []map[string]intpr.DataType{{}}, size: 1, frames: []int{0}, layouts: []*[]intpr.Variable{{}}, bases: []int{0}}
+}
+
+// snapshot returns a copy of the cache that declarations made later in the
+// open levels do not reach. The copy shares the frames, so the slots it lays
+// out are taken in them.
+func (c *Cache) snapshot() *Cache {
+	copied := &Cache{
+		size:    c.size,
+		frames:  append([]int{}, c.frames...),
+		layouts: append([]*[]intpr.Variable{}, c.layouts...),
+		bases:   append([]int{}, c.bases...),
+	}
+	for i := 0; i < c.size; i++ {
+		copied.vars = append(copied.vars, maps.Clone(c.vars[i]))
+		copied.funcs = append(copied.funcs, maps.Clone(c.funcs[i]))
+		copied.types = append(copied.types, maps.Clone(c.types[i]))
+	}
+	return copied
 }
 
 type FuncCache struct {
 	NameToken      sTokens.Token
 	DataType       intpr.DataType
 	Params         []intpr.DefParam
-	Returns        bool
 	ReturnBranches []*intpr.Expression
-	LocalScope     *Cache
+	Native         bool
+	// TypeParams and Generic are set for a generic function
+	TypeParams []intpr.DataType
+	Generic    *generic
+	// Ahead is set for a function of a block declared ahead of its def, until
+	// the def is parsed. Calls from Caller, the function the block is in,
+	// would run before the def does.
+	Ahead  bool
+	Caller *FuncCache
+}
+
+// generic tracks the instances of a generic function. An instance is parsed
+// from the def with the type params standing for its type arguments, in the
+// scope the def sees, once the def itself has been parsed.
+type generic struct {
+	name string
+	// layout and scope place the slots of the instances beside the function
+	layout *[]intpr.Variable
+	scope  int
+	// def is set once the def is parsed, along with its first token, the
+	// number of blocks open around it and the scope it sees. failed is set
+	// when its body has errors, which its instances would repeat.
+	def       *intpr.Def
+	start     int
+	blocks    int
+	cache     *Cache
+	failed    bool
+	instances map[string]*intpr.Def
+	queue     []instance
+}
+
+// instance is an instance of a generic function waiting for its def to be
+// parsed, and the call that needed it.
+type instance struct {
+	def      *intpr.Def
+	typeArgs []intpr.DataType
+	token    sTokens.Token
+}
+
+// maxInstanceDepth limits how deeply parsing an instance may lead to parsing
+// others, which a function calling itself with ever larger types would do
+// forever.
+const maxInstanceDepth = 64
+
+func (c *Cache) newGeneric(name string) *generic {
+	frame := len(c.layouts) - 1
+	return &generic{name: name, layout: c.layouts[frame], scope: c.size - 1 - c.bases[frame], instances: map[string]*intpr.Def{}}
 }
 
 func (c *Cache) Extend() {
-	c.vars = append(c.vars, map[string]intpr.DataType{})
+	c.vars = append(c.vars, map[string]Var{})
 	c.funcs = append(c.funcs, map[string]FuncCache{})
+	c.types = append(c.types, map[string]intpr.DataType{})
+	c.frames = append(c.frames, len(c.layouts)-1)
 	c.size++
 }
 
@@ -54,16 +151,42 @@ func (c *Cache) Shrink() {
 	c.size--
 	c.vars = c.vars[:c.size]
 	c.funcs = c.funcs[:c.size]
+	c.types = c.types[:c.size]
+	c.frames = c.frames[:c.size]
+}
+
+// ExtendFrame opens a level that starts a new frame, as for a function body.
+func (c *Cache) ExtendFrame() {
+	c.layouts = append(c.layouts, &[]intpr.Variable{})
+	c.bases = append(c.bases, c.size)
+	c.Extend()
+}
+
+// ShrinkFrame closes the level opened by ExtendFrame and returns the layout
+// of the frame.
+func (c *Cache) ShrinkFrame() []intpr.Variable {
+	c.Shrink()
+	layout := *c.layouts[len(c.layouts)-1]
+	c.layouts = c.layouts[:len(c.layouts)-1]
+	c.bases = c.bases[:len(c.bases)-1]
+	return layout
+}
+
+// Layout returns the slots of the current frame declared so far.
+func (c *Cache) Layout() []intpr.Variable {
+	return *c.layouts[len(c.layouts)-1]
 }
 
-func (c *Cache) GetVarType(name string) (intpr.DataType, int, bool) {
+// Resolve finds the innermost variable called name, along with how many
+// frames up from the current one it lives.
+func (c *Cache) Resolve(name string) (Var, int, bool) {
 	for i := c.size - 1; i >= 0; i-- {
-		val, found := c.vars[i][name]
+		v, found := c.vars[i][name]
 		if found {
-			return val, i, true
+			return v, len(c.layouts) - 1 - c.frames[i], true
 		}
 	}
-	return intpr.Invalid, -1, false
+	return Var{DataType: intpr.Invalid}, 0, false
 }
 
 func (c *Cache) GetFuncCache(name string) *FuncCache {
@@ -76,14 +199,44 @@ func (c *Cache) GetFuncCache(name string) *FuncCache {
 	return nil
 }
 
-func (c *Cache) SetVarType(name string, dataType intpr.DataType) {
-	c.vars[c.size-1][name] = dataType
+// SetVarType declares name in the current level. Slots are never reused
+// within a frame, so a variable keeps its slot for the whole call.
+func (c *Cache) SetVarType(name string, dataType intpr.DataType) Var {
+	frame := len(c.layouts) - 1
+	layout := c.layouts[frame]
+	v := Var{DataType: dataType, Slot: len(*layout)}
+	*layout = append(*layout, intpr.Variable{Name: name, DataType: dataType, Scope: c.size - 1 - c.bases[frame]})
+	c.vars[c.size-1][name] = v
+	return v
+}
+
+// SetConst marks name, declared in the current level, as a constant.
+func (c *Cache) SetConst(name string, value *intpr.Expression) {
+	v := c.vars[c.size-1][name]
+	v.Value = value
+	c.vars[c.size-1][name] = v
 }
 
 func (c *Cache) SetFuncCache(name string, cache FuncCache) {
 	c.funcs[c.size-1][name] = cache
 }
 
+// GetType finds the innermost type declared as name. Type names live apart
+// from variables, so a variable may share its name with a type.
+func (c *Cache) GetType(name string) (intpr.DataType, bool) {
+	for i := c.size - 1; i >= 0; i-- {
+		dataType, found := c.types[i][name]
+		if found {
+			return dataType, true
+		}
+	}
+	return intpr.Invalid, false
+}
+
+func (c *Cache) SetType(name string, dataType intpr.DataType) {
+	c.types[c.size-1][name] = dataType
+}
+
 type ParseSource struct {
 	Errors          []*errors.Error
 	cache           *Cache
@@ -91,17 +244,59 @@ type ParseSource struct {
 	scope           int
 	current         int
 	currentFunction *FuncCache
+	// declared holds the slots of the functions declared ahead of their
+	// definitions, by the position of their def
+	declared map[int]int
+	// instancing counts the instances of generic functions being parsed
+	instancing int
+	// concurrent is set once the program uses tasks or channels
+	concurrent bool
+	// types holds the composite types the program makes
+	types *intpr.Types
 }
 
 type FunctionCall struct {
 	Identifier sTokens.Token
 	Args       []*intpr.Expression
+	Depth      int
+	Slot       int
+	// Builtin is set for calls of generic built-ins. DataType is the type of
+	// the result, Invalid when the function is unknown.
+	Builtin  intpr.Builtin
+	DataType intpr.DataType
+	Native   bool
+}
+
+// builtins are the generic built-in functions. They are only called when no
+// variable of the same name is in scope.
+var builtins = map[string]intpr.Builtin{
+	"len":    intpr.LenBuiltin,
+	"has":    intpr.HasBuiltin,
+	"delete": intpr.DeleteBuiltin,
+	"send":   intpr.SendBuiltin,
+	"recv":   intpr.RecvBuiltin,
+	"close":  intpr.CloseBuiltin,
 }
 
 func New(tokens []sTokens.Token) ParseSource {
+	cache := NewCache()
+	for _, native := range intpr.MathModule {
+		cache.SetVarType(native.Name, intpr.Func)
+		cache.SetFuncCache(native.Name, FuncCache{
+			NameToken: sTokens.Token{Type: sTokens.IDENTIFIER, Value: native.Name},
+			DataType:  native.DataType,
+			Params:    native.Params,
+			Native:    true,
+		})
+	}
+	cache.SetType("error", intpr.ErrorType)
+	// built-ins live in a frame enclosing the globals, so scripts can shadow them
+	cache.ExtendFrame()
 	return ParseSource{
-		cache:  NewCache(),
-		tokens: tokens,
+		cache:    cache,
+		tokens:   tokens,
+		declared: map[int]int{},
+		types:    intpr.NewTypes(),
 	}
 }
 
@@ -110,6 +305,7 @@ func (s *ParseSource) Parse(inLoop bool) (*intpr.Program, *errors.Error) {
 
 	sourceSize := len(s.tokens) - 1
 	scopeStarts := []sTokens.Token{}
+	pending := s.declareFunctions()
 
 MainLoop:
 	for s.current < sourceSize {
@@ -134,7 +330,7 @@ MainLoop:
 			}
 			s.current++
 			break MainLoop
-		case sTokens.BOOL_TYPE, sTokens.INT_TYPE, sTokens.IDENTIFIER:
+		case sTokens.BOOL_TYPE, sTokens.INT_TYPE, sTokens.STRING_TYPE, sTokens.MAP, sTokens.CHAN, sTokens.LEFT_BRACKET, sTokens.IDENTIFIER:
 			stmt, err := s.parseOneliner(sTokens.SEMICOLON)
 			if err != nil {
 				return nil, err
@@ -144,6 +340,17 @@ MainLoop:
 			}
 			s.current += 2
 			statements = append(statements, stmt)
+		case sTokens.CONST:
+			stmt, err := s.parseConst()
+			if err != nil {
+				return nil, err
+			}
+			if s.tokens[s.current+1].Type != sTokens.SEMICOLON {
+				return nil, &errors.Error{Message: "statements must end in semicolon", Type: errors.SyntaxError, Token: s.tokens[s.current+1]}
+			}
+			s.current += 2
+			statements = append(statements, stmt)
+			pending = s.declare(pending)
 		case sTokens.IF, sTokens.WHILE:
 			var stmt intpr.Conditional
 			s.current++
@@ -152,12 +359,29 @@ MainLoop:
 				return nil, err
 			}
 			s.scope++
-			s.current += 2
 			s.cache.Extend()
+			if s.tokens[s.current+1].Type == sTokens.IS {
+				condition, err = s.parseUnwrap(condition)
+				if err != nil {
+					return nil, err
+				}
+			} else if condition.DataType != intpr.Bool && condition.DataType != intpr.Invalid {
+				s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("%s condition must be bool, got %s", token.View(), condition.DataType.View()), Type: errors.TypeError, Token: condition.Token})
+			}
+			s.current += 2
+			// the value a while condition binds is shared by the iterations
+			frame := token.Type == sTokens.WHILE && s.loopFrame()
+			if frame {
+				s.cache.ExtendFrame()
+			}
 			thenBlock, err := s.Parse(inLoop || token.Type == sTokens.WHILE)
 			if err != nil {
 				return nil, err
 			}
+			if frame {
+				thenBlock.Variables = s.cache.ShrinkFrame()
+				thenBlock.Frame = true
+			}
 			s.scope--
 			s.cache.Shrink()
 			stmt.Token = token
@@ -177,7 +401,21 @@ MainLoop:
 				stmt.Else = elseBlock
 			}
 			statements = append(statements, &stmt)
+		case sTokens.MATCH:
+			stmt, err := s.parseMatch(inLoop)
+			if err != nil {
+				return nil, err
+			}
+			statements = append(statements, stmt)
 		case sTokens.FOR:
+			if s.tokens[s.current+1].Type == sTokens.IDENTIFIER && s.tokens[s.current+2].Type == sTokens.IN {
+				stmt, err := s.parseForIn()
+				if err != nil {
+					return nil, err
+				}
+				statements = append(statements, stmt)
+				continue
+			}
 			s.current++
 			s.scope++
 			s.cache.Extend()
@@ -197,15 +435,25 @@ MainLoop:
 			}
 			s.current += 2
 			s.scope++
-			s.cache.Extend()
+			frame := s.loopFrame()
+			if frame {
+				s.cache.ExtendFrame()
+			} else {
+				s.cache.Extend()
+			}
 			block, err := s.Parse(true)
 			if err != nil {
 				return nil, err
 			}
+			if frame {
+				block.Variables = s.cache.ShrinkFrame()
+				block.Frame = true
+			} else {
+				s.cache.Shrink()
+			}
 			statements = append(statements, &intpr.For{Init: init, Condition: condition, After: after, Block: block, Token: token})
 			s.scope -= 2
 			s.cache.Shrink()
-			s.cache.Shrink()
 		case sTokens.BREAK:
 			if s.tokens[s.current+1].Type != sTokens.SEMICOLON {
 				return nil, &errors.Error{Message: "statements must end in semicolon", Type: errors.SyntaxError, Token: s.tokens[s.current+1]}
@@ -214,7 +462,7 @@ MainLoop:
 				s.Errors = append(s.Errors, &errors.Error{Message: "break outside of loop body", Type: errors.SyntaxError, Token: token})
 			}
 			s.current += 2
-			statements = append(statements, &intpr.Break{})
+			statements = append(statements, &intpr.Break{Token: token})
 		case sTokens.CONTINUE:
 			if s.tokens[s.current+1].Type != sTokens.SEMICOLON {
 				return nil, &errors.Error{Message: "statements must end in semicolon", Type: errors.SyntaxError, Token: s.tokens[s.current+1]}
@@ -223,105 +471,15 @@ MainLoop:
 				s.Errors = append(s.Errors, &errors.Error{Message: "continue outside of loop body", Type: errors.SyntaxError, Token: token})
 			}
 			s.current += 2
-			statements = append(statements, &intpr.Continue{})
+			statements = append(statements, &intpr.Continue{Token: token})
 		case sTokens.DEF:
-			if s.currentFunction != nil {
-				return nil, &errors.Error{Message: "nested functions are not allowed", Type: errors.SyntaxError, Token: token}
-			}
-			stmt := intpr.Def{Scope: s.scope}
-			name := s.tokens[s.current+1]
-			if name.Type != sTokens.IDENTIFIER {
-				return nil, &errors.Error{Message: fmt.Sprintf("expected function name, got %s", name.View()), Type: errors.SyntaxError, Token: name}
-			}
-			stmt.NameToken = name
-			openParen := s.tokens[s.current+2]
-			if openParen.Type != sTokens.LEFT_PAREN {
-				return nil, &errors.Error{Message: fmt.Sprintf("expected function parameters, got %s", openParen.View()), Type: errors.SyntaxError, Token: openParen}
-			}
-			s.current += 3
-			stmt.Params = []intpr.DefParam{}
-			if s.tokens[s.current].Type != sTokens.RIGHT_PAREN {
-			ParamsLoop:
-				for {
-					param := intpr.DefParam{}
-					paramType := s.tokens[s.current]
-					switch paramType.Type {
-					case sTokens.INT_TYPE:
-						param.DataType = intpr.Int
-					case sTokens.BOOL_TYPE:
-						param.DataType = intpr.Bool
-					default:
-						return nil, &errors.Error{Message: fmt.Sprintf("expected parameter type, got %s", paramType.View()), Type: errors.SyntaxError, Token: paramType}
-					}
-					s.current++
-					paramName := s.tokens[s.current]
-					if paramName.Type != sTokens.IDENTIFIER {
-						return nil, &errors.Error{Message: fmt.Sprintf("expected function name, got %s", paramType.View()), Type: errors.SyntaxError, Token: paramName}
-					}
-					param.NameToken = paramName
-					s.current++
-					delimitter := s.tokens[s.current]
-					stmt.Params = append(stmt.Params, param)
-					switch delimitter.Type {
-					case sTokens.COMMA:
-						s.current++
-					case sTokens.RIGHT_PAREN:
-						break ParamsLoop
-					default:
-						return nil, &errors.Error{Message: fmt.Sprintf("expected ',' or ')', got %s", delimitter.View()), Type: errors.SyntaxError, Token: delimitter}
-					}
-				}
-
-			}
-			s.current++
-			nextToken := s.tokens[s.current]
-			switch nextToken.Type {
-			case sTokens.INT_TYPE:
-				stmt.DataType = intpr.Int
-				s.current++
-			case sTokens.BOOL_TYPE:
-				stmt.DataType = intpr.Bool
-				s.current++
-			case sTokens.LEFT_BRACE:
-				stmt.DataType = intpr.Void
-			default:
-				return nil, &errors.Error{Message: fmt.Sprintf("expected return type, got %s", nextToken.View()), Type: errors.SyntaxError, Token: nextToken}
-			}
-			fnCache := FuncCache{
-				NameToken:  name,
-				DataType:   stmt.DataType,
-				Params:     stmt.Params,
-				LocalScope: NewCache(),
-			}
-			dataType, defined := s.cache.vars[s.cache.size-1][stmt.NameToken.Value]
-			if defined {
-				s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("variable reassignment not allowed: %s of type %s is defined earlier in the same scope", stmt.NameToken.Value, dataType.View()), Type: errors.ReferenceError, Token: stmt.NameToken})
-			} else {
-				s.cache.SetVarType(stmt.NameToken.Value, intpr.Func)
-				s.cache.SetFuncCache(stmt.NameToken.Value, fnCache)
-			}
-			if s.tokens[s.current].Type != sTokens.LEFT_BRACE {
-				return nil, &errors.Error{Message: fmt.Sprintf("expected function body, got %s", s.tokens[s.current].View()), Type: errors.SyntaxError, Token: s.tokens[s.current]}
-			}
-			s.currentFunction = &fnCache
-			s.current++
-			s.scope++
-			s.cache.Extend()
-			body, err := s.Parse(false)
+			stmt, err := s.parseDef(nil, nil)
 			if err != nil {
 				return nil, err
 			}
-			s.scope--
-            s.cache.Shrink()
-			if stmt.DataType != intpr.Void && !s.currentFunction.Returns {
-				s.Errors = append(s.Errors, &errors.Error{Message: "missing return", Type: errors.TypeError, Token: token})
-			}
-			stmt.Body = body
-			stmt.ReturnBranches = s.currentFunction.ReturnBranches
-			s.currentFunction = nil
-			statements = append(statements, &stmt)
+			statements = append(statements, stmt)
 		case sTokens.RETURN:
-			stmt := intpr.Return{}
+			stmt := intpr.Return{Token: token}
 			s.current++
 			nextToken := s.tokens[s.current]
 			switch nextToken.Type {
@@ -332,24 +490,73 @@ MainLoop:
 				}
 				s.current++
 			default:
-				exp, err := s.parseExpression(sTokens.Precedences[sTokens.EOF], sTokens.SEMICOLON)
+				exp, err := s.parseResults()
 				if err != nil {
 					return nil, err
 				}
 				s.current += 2
+				if s.currentFunction != nil {
+					exp = s.coerceResults(exp, s.currentFunction.DataType)
+				}
 				if s.currentFunction != nil && exp.DataType != s.currentFunction.DataType {
 					s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("wrong return type for function %s: expected %s, got %s", s.currentFunction.NameToken.Value, s.currentFunction.DataType.View(), exp.DataType.View()), Type: errors.TypeError, Token: nextToken})
 				}
 				stmt.DataType = exp.DataType
-				stmt.Id = len(s.currentFunction.ReturnBranches)
-				s.currentFunction.ReturnBranches = append(s.currentFunction.ReturnBranches, exp)
+				if s.currentFunction != nil {
+					stmt.Id = len(s.currentFunction.ReturnBranches)
+					s.currentFunction.ReturnBranches = append(s.currentFunction.ReturnBranches, exp)
+				}
 			}
 			statements = append(statements, &stmt)
 			if s.currentFunction == nil {
 				s.Errors = append(s.Errors, &errors.Error{Message: "return outside of function body", Type: errors.SyntaxError, Token: token})
-			} else {
-				s.currentFunction.Returns = true
 			}
+		case sTokens.TRY:
+			stmt, err := s.parseTry(inLoop)
+			if err != nil {
+				return nil, err
+			}
+			statements = append(statements, stmt)
+		case sTokens.SPAWN:
+			stmt, err := s.parseSpawn()
+			if err != nil {
+				return nil, err
+			}
+			statements = append(statements, stmt)
+		case sTokens.SELECT:
+			stmt, err := s.parseSelect(inLoop)
+			if err != nil {
+				return nil, err
+			}
+			statements = append(statements, stmt)
+		case sTokens.RAISE:
+			s.current++
+			exp, err := s.parseExpression(sTokens.Precedences[sTokens.EOF], sTokens.SEMICOLON)
+			if err != nil {
+				return nil, err
+			}
+			if exp.DataType != intpr.String && exp.DataType != intpr.Invalid {
+				s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("raise expects a string, got %s", exp.DataType.View()), Type: errors.TypeError, Token: exp.Token})
+			}
+			if s.tokens[s.current+1].Type != sTokens.SEMICOLON {
+				return nil, &errors.Error{Message: "statements must end in semicolon", Type: errors.SyntaxError, Token: s.tokens[s.current+1]}
+			}
+			s.current += 2
+			statements = append(statements, &intpr.Raise{Token: token, Exp: exp})
+		case sTokens.STRUCT:
+			stmt, err := s.parseStruct()
+			if err != nil {
+				return nil, err
+			}
+			statements = append(statements, stmt)
+			pending = s.declare(pending)
+		case sTokens.ENUM:
+			stmt, err := s.parseEnum()
+			if err != nil {
+				return nil, err
+			}
+			statements = append(statements, stmt)
+			pending = s.declare(pending)
 		case sTokens.EOF:
 			if s.scope != 0 {
 				brace := scopeStarts[0]
@@ -361,186 +568,1218 @@ MainLoop:
 		}
 	}
 
-	return &intpr.Program{Statements: statements}, nil
+	program := &intpr.Program{Statements: statements}
+	if s.scope == 0 {
+		// top-level functions only close over globals, so they can all be
+		// defined before the first statement runs
+		program.Statements = definitionsFirst(statements)
+		program.Variables = s.cache.Layout()
+		program.Concurrent = s.concurrent
+		program.Types = s.types
+	}
+	return program, nil
+}
+
+// definitionsFirst moves the function definitions among statements that are
+// outside of any block ahead of the other statements, keeping the order of
+// both. The functions of a block may close over its variables, so they stay.
+func definitionsFirst(statements []intpr.Statement) []intpr.Statement {
+	defs, rest := []intpr.Statement{}, []intpr.Statement{}
+	depth := 0
+	for _, stmt := range statements {
+		switch stmt.(type) {
+		case *intpr.OpenScope:
+			depth++
+		case *intpr.CloseScope:
+			depth--
+		case *intpr.Def:
+			if depth == 0 {
+				defs = append(defs, stmt)
+				continue
+			}
+		}
+		rest = append(rest, stmt)
+	}
+	return append(defs, rest...)
 }
 
-func (s *ParseSource) parseOneliner(endToken sTokens.TokenType) (intpr.Statement, *errors.Error) {
+// parseDef parses the function defined at the current def. For an instance
+// of a generic function it fills in instance, with the type params standing
+// for typeArgs, instead of declaring the function.
+func (s *ParseSource) parseDef(instance *intpr.Def, typeArgs []intpr.DataType) (*intpr.Def, *errors.Error) {
 	token := s.tokens[s.current]
-	scope := s.scope
-	if s.currentFunction != nil {
-		scope = -1
+	start := s.current
+	slot, declared := s.declared[s.current]
+	stmt, err := s.parseSignature(typeArgs)
+	if err != nil {
+		return nil, err
 	}
-	if token.Type == sTokens.IDENTIFIER && s.tokens[s.current+1].Type == sTokens.LEFT_PAREN {
-		fnCall, err := s.parseFunctionCall()
-		if err != nil {
-			return nil, err
-		}
-		fnCache := s.cache.GetFuncCache(fnCall.Identifier.Value)
-		if fnCache != nil && fnCache.DataType != intpr.Void {
-			s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("%s is not a void function", fnCall.Identifier.Value), Type: errors.ReferenceError, Token: fnCall.Identifier})
-		}
-		return &intpr.VoidCall{
-			NameToken: fnCall.Identifier,
-			Args:      fnCall.Args,
-			Scope:     scope,
-		}, nil
+	typeParams := stmt.TypeParams
+	fnCache := FuncCache{
+		NameToken:  stmt.NameToken,
+		DataType:   stmt.DataType,
+		Params:     stmt.Params,
+		TypeParams: typeParams,
 	}
-
-	stmt := intpr.Assignment{}
-	if token.Type != sTokens.IDENTIFIER {
-		stmt.Explicit = true
-		switch token.Type {
-		case sTokens.INT_TYPE:
-			stmt.DataType = intpr.Int
+	def := &stmt
+	var g *generic
+	if instance != nil {
+		stmt.Slot = instance.Slot
+		stmt.NameToken.Value = instance.NameToken.Value
+		stmt.TypeParams = nil
+		*instance = stmt
+		def = instance
+	} else {
+		v, defined := s.cache.vars[s.cache.size-1][stmt.NameToken.Value]
+		switch {
+		case declared:
+			stmt.Slot = slot
+			declaredCache := s.cache.funcs[s.cache.size-1][stmt.NameToken.Value]
+			g = declaredCache.Generic
+			declaredCache.Ahead, declaredCache.Caller = false, nil
+			s.cache.SetFuncCache(stmt.NameToken.Value, declaredCache)
+		case defined:
+			s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("variable reassignment not allowed: %s of type %s is defined earlier in the same scope", stmt.NameToken.Value, v.DataType.View()), Type: errors.ReferenceError, Token: stmt.NameToken})
 		default:
-			stmt.DataType = intpr.Bool
-		}
-		varToken := s.tokens[s.current+1]
-		if varToken.Type != sTokens.IDENTIFIER {
-			return nil, &errors.Error{Message: fmt.Sprintf("expected variable name, got %s", varToken.View()), Type: errors.SyntaxError, Token: varToken}
-		}
-		stmt.Var = varToken
-		operator := s.tokens[s.current+2]
-		if operator.Type != sTokens.EQUAL {
-			return nil, &errors.Error{Message: fmt.Sprintf("expected assignment operator '=', got %s", operator.View()), Type: errors.SyntaxError, Token: operator}
-		}
-		stmt.Operator = operator
-		s.current += 3
-		exp, err := s.parseExpression(sTokens.Precedences[sTokens.EOF], endToken)
-		if err != nil {
-			return nil, err
+			if typeParams != nil {
+				g = s.cache.newGeneric(stmt.NameToken.Value)
+				fnCache.Generic = g
+			}
+			stmt.Slot = s.cache.SetVarType(stmt.NameToken.Value, intpr.Func).Slot
+			s.cache.SetFuncCache(stmt.NameToken.Value, fnCache)
 		}
-		stmt.Exp = exp
-		if exp.DataType != stmt.DataType && exp.DataType != intpr.Invalid {
-			s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("assigning wrong type: expected %s, got %s", stmt.DataType.View(), exp.DataType.View()), Type: errors.TypeError, Token: operator})
+		if g != nil {
+			g.start, g.blocks, g.cache = start, s.scope, s.cache.snapshot()
 		}
-		s.cache.SetVarType(stmt.Var.Value, stmt.DataType)
-		return &stmt, nil
 	}
-	operator := s.tokens[s.current+1]
-	switch operator.Type {
-	case sTokens.COLON_EQUAL, sTokens.EQUAL, sTokens.PLUS_EQUAL, sTokens.MINUS_EQUAL, sTokens.STAR_EQUAL, sTokens.SLASH_EQUAL, sTokens.MODULO_EQUAL:
-		s.current += 2
-		exp, err := s.parseExpression(sTokens.Precedences[sTokens.EOF], endToken)
-		if err != nil {
-			return nil, err
+	if s.tokens[s.current].Type != sTokens.LEFT_BRACE {
+		return nil, &errors.Error{Message: fmt.Sprintf("expected function body, got %s", s.tokens[s.current].View()), Type: errors.SyntaxError, Token: s.tokens[s.current]}
+	}
+	outer := s.currentFunction
+	s.currentFunction = &fnCache
+	s.current++
+	s.scope++
+	// the params take the first slots of the frame of a call
+	s.cache.ExtendFrame()
+	s.bindTypeParams(typeParams, typeArgs)
+	for _, p := range stmt.Params {
+		s.cache.SetVarType(p.NameToken.Value, p.DataType)
+	}
+	errs := len(s.Errors)
+	body, err := s.Parse(false)
+	if err != nil {
+		return nil, err
+	}
+	s.scope--
+	def.Variables = s.cache.ShrinkFrame()
+	if def.DataType != intpr.Void && !terminates(body.Statements) {
+		s.Errors = append(s.Errors, &errors.Error{Message: "missing return", Type: errors.TypeError, Token: token})
+	}
+	def.Body = body
+	def.ReturnBranches = s.currentFunction.ReturnBranches
+	s.currentFunction = outer
+	if g != nil {
+		g.def, g.failed = def, len(s.Errors) > errs
+		for _, queued := range g.queue {
+			def.Instances = append(def.Instances, queued.def)
+			s.parseInstance(g, queued)
 		}
-		stmt.Var = token
-		stmt.Operator = operator
-		stmt.Exp = exp
+		g.queue = nil
+	}
+	return def, nil
+}
 
-		switch operator.Type {
-		case sTokens.COLON_EQUAL:
-			if s.currentFunction != nil {
-				stmt.VarScope = -1
-				defined := false
-				_, _, defined = s.currentFunction.LocalScope.GetVarType(token.Value)
-				if defined {
-					s.Errors = append(s.Errors, &errors.Error{Message: "variable reassignment not allowed", Type: errors.ReferenceError, Token: token})
-				} else {
-					for _, p := range s.currentFunction.Params {
-						if p.NameToken.Value == token.Value {
-							s.Errors = append(s.Errors, &errors.Error{Message: "variable reassignment not allowed", Type: errors.ReferenceError, Token: token})
-							defined = true
-						}
-					}
-					if !defined {
-						s.currentFunction.LocalScope.SetVarType(token.Value, exp.DataType)
-						stmt.DataType = exp.DataType
-					}
-				}
-			} else {
-				stmt.VarScope = s.scope
-				_, defined := s.cache.vars[s.cache.size-1][token.Value]
-				if defined {
-					s.Errors = append(s.Errors, &errors.Error{Message: "variable reassignment not allowed", Type: errors.ReferenceError, Token: token})
-				} else {
-					s.cache.SetVarType(token.Value, exp.DataType)
-					stmt.DataType = exp.DataType
-				}
+// parseInstance parses an instance of a generic function at its def, in the
+// scope the def sees.
+func (s *ParseSource) parseInstance(g *generic, queued instance) {
+	if g.failed {
+		return
+	}
+	if s.instancing == maxInstanceDepth {
+		s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("instances of function %s nest too deeply", g.name), Type: errors.TypeError, Token: queued.token})
+		return
+	}
+	cache, current, scope, function, declared := s.cache, s.current, s.scope, s.currentFunction, s.declared
+	s.cache, s.current, s.scope, s.currentFunction, s.declared = g.cache.snapshot(), g.start, g.blocks, nil, map[int]int{}
+	s.instancing++
+	if _, err := s.parseDef(queued.def, queued.typeArgs); err != nil {
+		s.Errors = append(s.Errors, err)
+	}
+	s.instancing--
+	s.cache, s.current, s.scope, s.currentFunction, s.declared = cache, current, scope, function, declared
+}
+
+// terminates reports whether statements always end in a return or a raise,
+// as the body of a function with a result must. An if needs an else and a
+// match needs to be exhaustive for every way through them to end so; loops
+// may run no iteration and never count.
+func terminates(statements []intpr.Statement) bool {
+	for _, stmt := range statements {
+		switch s := stmt.(type) {
+		case *intpr.Return, *intpr.Raise:
+			return true
+		case *intpr.Conditional:
+			if s.Token.Type == sTokens.IF && s.Else != nil && terminates(s.Then.Statements) && terminates(s.Else.Statements) {
+				return true
 			}
-		default:
-			var defined bool
-			var dataType intpr.DataType
-			scope := s.scope
-			if s.currentFunction != nil {
-				scope = -1
-				for _, a := range s.currentFunction.Params {
-					if a.NameToken.Value == token.Value {
-						defined = true
-						dataType = a.DataType
-						break
-					}
-				}
-				if !defined {
-					dataType, _, defined = s.currentFunction.LocalScope.GetVarType(token.Value)
-				}
+		case *intpr.Match:
+			blocks := []*intpr.Program{s.Default}
+			for _, arm := range s.Arms {
+				blocks = append(blocks, arm.Block)
 			}
-			if !defined {
-				dataType, scope, defined = s.cache.GetVarType(token.Value)
+			if s.Exhaustive && allTerminate(blocks) {
+				return true
 			}
-			if !defined {
-				s.Errors = append(s.Errors, &errors.Error{Message: "undefined variable", Type: errors.ReferenceError, Token: token})
-			} else if dataType != exp.DataType && exp.DataType != intpr.Invalid {
-				s.Errors = append(s.Errors, &errors.Error{Message: "assigning wrong type", Type: errors.TypeError, Token: token})
-			} else {
-				stmt.DataType = exp.DataType
-				stmt.VarScope = scope
+		case *intpr.Try:
+			if terminates(s.Body.Statements) && terminates(s.Catch.Statements) {
+				return true
 			}
-		}
-	case sTokens.DOUBLE_PLUS, sTokens.DOUBLE_MINUS:
-		if s.tokens[s.current+2].Type != endToken {
-			return nil, &errors.Error{Message: fmt.Sprintf("expected %s after the statement, got %s", sTokens.Representations[endToken], s.tokens[s.current+2].View()), Type: errors.SyntaxError, Token: s.tokens[s.current+2]}
-		}
-		stmt.Var = token
-		stmt.Operator = operator
-		var dataType intpr.DataType
-		var scope int
-		var defined bool
-		if s.currentFunction != nil {
-			scope = -1
-			dataType, _, defined = s.currentFunction.LocalScope.GetVarType(token.Value)
-			if !defined {
-				for _, p := range s.currentFunction.Params {
-					if p.NameToken.Value == token.Value {
-						dataType = p.DataType
-						defined = true
-						break
-					}
-				}
+		case *intpr.Select:
+			// some arm runs, as a select without a _ arm waits for one
+			blocks := []*intpr.Program{s.Default}
+			for _, arm := range s.Arms {
+				blocks = append(blocks, arm.Block)
+			}
+			if allTerminate(blocks) {
+				return true
 			}
 		}
-		if !defined {
-			dataType, scope, defined = s.cache.GetVarType(token.Value)
+	}
+	return false
+}
+
+// allTerminate reports whether every block that is not nil terminates.
+func allTerminate(blocks []*intpr.Program) bool {
+	for _, block := range blocks {
+		if block != nil && !terminates(block.Statements) {
+			return false
 		}
-		if !defined {
-			s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("variable %s undefined", token.Value), Type: errors.ReferenceError, Token: token})
-		} else if dataType != intpr.Int {
-			operation := ""
-			if token.Type == sTokens.DOUBLE_PLUS {
-				operation = "increment"
-			} else {
-				operation = "decrement"
-			}
-			s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("cannot %s a non-numerical value", operation), Type: errors.TypeError, Token: operator})
+	}
+	return true
+}
+
+// instantiate returns the instance of a generic function for the type
+// arguments of a call, parsing it when the def has been parsed already.
+func (s *ParseSource) instantiate(g *generic, token sTokens.Token, typeArgs []intpr.DataType) *intpr.Def {
+	key := fmt.Sprint(typeArgs)
+	if def, found := g.instances[key]; found {
+		return def
+	}
+	views := []string{}
+	for _, t := range typeArgs {
+		views = append(views, t.View())
+	}
+	name := fmt.Sprintf("%s[%s]", g.name, strings.Join(views, ", "))
+	for _, other := range g.instances {
+		// struct types declared in different scopes may share a name
+		if other.NameToken.Value == name {
+			name = fmt.Sprintf("%s#%d", name, len(g.instances))
+			break
 		}
-		stmt.DataType = intpr.Int
-		stmt.VarScope = scope
-		s.current++
-	default:
-		return nil, &errors.Error{Message: fmt.Sprintf("expected assignment operator, got %s", operator.View()), Type: errors.SyntaxError, Token: operator}
 	}
-	return &stmt, nil
+	*g.layout = append(*g.layout, intpr.Variable{Name: name, DataType: intpr.Func, Scope: g.scope})
+	def := &intpr.Def{Slot: len(*g.layout) - 1, NameToken: sTokens.Token{Type: sTokens.IDENTIFIER, Value: name}}
+	g.instances[key] = def
+	queued := instance{def: def, typeArgs: typeArgs, token: token}
+	if g.def == nil {
+		g.queue = append(g.queue, queued)
+		return def
+	}
+	g.def.Instances = append(g.def.Instances, def)
+	s.parseInstance(g, queued)
+	return def
 }
 
-func (s *ParseSource) parseExpression(precedence int, endToken sTokens.TokenType) (*intpr.Expression, *errors.Error) {
-	left, err := s.parsePrefix()
+// parseTry parses try { } catch (name) { }, where the name of the error may
+// be left out along with the parentheses, leaving s.current past the closing
+// brace.
+func (s *ParseSource) parseTry(inLoop bool) (*intpr.Try, *errors.Error) {
+	stmt := &intpr.Try{Token: s.tokens[s.current], Slot: -1}
+	if s.tokens[s.current+1].Type != sTokens.LEFT_BRACE {
+		return nil, &errors.Error{Message: fmt.Sprintf("expected try block, got %s", s.tokens[s.current+1].View()), Type: errors.SyntaxError, Token: s.tokens[s.current+1]}
+	}
+	s.current += 2
+	s.scope++
+	s.cache.Extend()
+	body, err := s.Parse(inLoop)
 	if err != nil {
 		return nil, err
 	}
-	for {
-		if s.tokens[s.current+1].Type == sTokens.EOF {
-			return nil, &errors.Error{Message: "expected ;", Token: s.tokens[s.current], Type: errors.SyntaxError}
+	s.scope--
+	s.cache.Shrink()
+	stmt.Body = body
+	if s.tokens[s.current].Type != sTokens.CATCH {
+		return nil, &errors.Error{Message: fmt.Sprintf("expected catch, got %s", s.tokens[s.current].View()), Type: errors.SyntaxError, Token: s.tokens[s.current]}
+	}
+	s.current++
+	if s.tokens[s.current].Type == sTokens.LEFT_PAREN {
+		name := s.tokens[s.current+1]
+		if name.Type != sTokens.IDENTIFIER {
+			return nil, &errors.Error{Message: fmt.Sprintf("expected error name, got %s", name.View()), Type: errors.SyntaxError, Token: name}
+		}
+		if s.tokens[s.current+2].Type != sTokens.RIGHT_PAREN {
+			return nil, &errors.Error{Message: fmt.Sprintf("expected ), got %s", s.tokens[s.current+2].View()), Type: errors.SyntaxError, Token: s.tokens[s.current+2]}
+		}
+		stmt.Var = name
+		s.current += 3
+	}
+	if s.tokens[s.current].Type != sTokens.LEFT_BRACE {
+		return nil, &errors.Error{Message: fmt.Sprintf("expected catch block, got %s", s.tokens[s.current].View()), Type: errors.SyntaxError, Token: s.tokens[s.current]}
+	}
+	s.current++
+	s.scope++
+	s.cache.Extend()
+	if stmt.Var.Type == sTokens.IDENTIFIER {
+		stmt.Slot = s.cache.SetVarType(stmt.Var.Value, intpr.ErrorType).Slot
+	}
+	catch, err := s.Parse(inLoop)
+	if err != nil {
+		return nil, err
+	}
+	s.scope--
+	s.cache.Shrink()
+	stmt.Catch = catch
+	return stmt, nil
+}
+
+// parseMatch parses match subject { values => { } ... _ => { } }, leaving
+// s.current past the closing brace.
+func (s *ParseSource) parseMatch(inLoop bool) (*intpr.Match, *errors.Error) {
+	stmt := &intpr.Match{Token: s.tokens[s.current]}
+	s.current++
+	subject, err := s.parseExpression(sTokens.Precedences[sTokens.RIGHT_PAREN], sTokens.LEFT_BRACE)
+	if err != nil {
+		return nil, err
+	}
+	if subject.DataType != intpr.Int && subject.DataType != intpr.Bool && !subject.DataType.IsEnum() && subject.DataType != intpr.Invalid {
+		s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("cannot match on %s: expected int, bool or enum", subject.DataType.View()), Type: errors.TypeError, Token: subject.Token})
+	}
+	stmt.Subject = subject
+	if s.tokens[s.current+1].Type != sTokens.LEFT_BRACE {
+		return nil, &errors.Error{Message: fmt.Sprintf("expected match arms, got %s", s.tokens[s.current+1].View()), Type: errors.SyntaxError, Token: s.tokens[s.current+1]}
+	}
+	s.current += 2
+	// seen holds the constant cases, to find duplicates and to tell whether
+	// a bool or enum match covers all values
+	seen := map[intpr.Value]bool{}
+	for s.tokens[s.current].Type != sTokens.RIGHT_BRACE {
+		token := s.tokens[s.current]
+		if token.Type == sTokens.EOF {
+			return nil, &errors.Error{Message: "match not closed", Type: errors.SyntaxError, Token: stmt.Token}
+		}
+		isDefault := token.Type == sTokens.IDENTIFIER && token.Value == "_" && s.tokens[s.current+1].Type == sTokens.ARROW
+		arm := intpr.MatchArm{}
+		if isDefault {
+			if stmt.Default != nil {
+				s.Errors = append(s.Errors, &errors.Error{Message: "duplicate default arm", Type: errors.SyntaxError, Token: token})
+			}
+			s.current++
+		} else {
+			if stmt.Default != nil {
+				s.Errors = append(s.Errors, &errors.Error{Message: "the default arm must be the last one", Type: errors.SyntaxError, Token: token})
+			}
+			for {
+				// a case naming a constant has the position of the constant
+				start := s.tokens[s.current]
+				value, err := s.parseExpression(sTokens.Precedences[sTokens.RIGHT_PAREN], sTokens.ARROW)
+				if err != nil {
+					return nil, err
+				}
+				if value.DataType != subject.DataType && value.DataType != intpr.Invalid && subject.DataType != intpr.Invalid {
+					s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("wrong case type: expected %s, got %s", subject.DataType.View(), value.DataType.View()), Type: errors.TypeError, Token: value.Token})
+				} else if constant, ok := caseConstant(value); ok {
+					if seen[constant.Constant] {
+						s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("duplicate case %s", constant.Token.View()), Type: errors.TypeError, Token: start})
+					}
+					seen[constant.Constant] = true
+				}
+				arm.Values = append(arm.Values, value)
+				s.current++
+				if s.tokens[s.current].Type != sTokens.COMMA {
+					break
+				}
+				s.current++
+			}
+		}
+		if s.tokens[s.current].Type != sTokens.ARROW {
+			return nil, &errors.Error{Message: fmt.Sprintf("expected =>, got %s", s.tokens[s.current].View()), Type: errors.SyntaxError, Token: s.tokens[s.current]}
+		}
+		if s.tokens[s.current+1].Type != sTokens.LEFT_BRACE {
+			return nil, &errors.Error{Message: fmt.Sprintf("expected arm body, got %s", s.tokens[s.current+1].View()), Type: errors.SyntaxError, Token: s.tokens[s.current+1]}
+		}
+		s.current += 2
+		s.scope++
+		s.cache.Extend()
+		block, err := s.Parse(inLoop)
+		if err != nil {
+			return nil, err
+		}
+		s.scope--
+		s.cache.Shrink()
+		if isDefault {
+			stmt.Default = block
+		} else {
+			arm.Block = block
+			stmt.Arms = append(stmt.Arms, arm)
+		}
+	}
+	s.current++
+	stmt.Exhaustive = stmt.Default != nil || subject.DataType == intpr.Bool && seen[intpr.Value{Bool: true}] && seen[intpr.Value{Bool: false}]
+	if subject.DataType == intpr.Bool && !stmt.Exhaustive {
+		s.Errors = append(s.Errors, &errors.Error{Message: "match on bool must cover true and false or have a default arm", Type: errors.TypeError, Token: stmt.Token})
+	}
+	if subject.DataType.IsEnum() && !stmt.Exhaustive {
+		missing := []string{}
+		for i, v := range subject.DataType.Type().Variants {
+			if !seen[intpr.Value{Int: i}] {
+				missing = append(missing, v)
+			}
+		}
+		stmt.Exhaustive = len(missing) == 0
+		if !stmt.Exhaustive {
+			s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("match on %s must cover %s or have a default arm", subject.DataType.View(), strings.Join(missing, ", ")), Type: errors.TypeError, Token: stmt.Token})
+		}
+	}
+	return stmt, nil
+}
+
+// parseUnwrap parses the rest of the condition subject is some name, with
+// s.current at the end of subject, leaving it at the name. It runs in the
+// scope of the block the condition guards, where name holds the value of the
+// optional.
+func (s *ParseSource) parseUnwrap(subject *intpr.Expression) (*intpr.Expression, *errors.Error) {
+	token := s.tokens[s.current+1]
+	if s.tokens[s.current+2].Type != sTokens.SOME {
+		return nil, &errors.Error{Message: fmt.Sprintf("expected some, got %s", s.tokens[s.current+2].View()), Type: errors.SyntaxError, Token: s.tokens[s.current+2]}
+	}
+	name := s.tokens[s.current+3]
+	if name.Type != sTokens.IDENTIFIER {
+		return nil, &errors.Error{Message: fmt.Sprintf("expected variable name, got %s", name.View()), Type: errors.SyntaxError, Token: name}
+	}
+	s.current += 3
+	if s.tokens[s.current+1].Type != sTokens.LEFT_BRACE {
+		return nil, &errors.Error{Message: fmt.Sprintf("expected {, got %s", s.tokens[s.current+1].View()), Type: errors.SyntaxError, Token: s.tokens[s.current+1]}
+	}
+	dataType := intpr.Invalid
+	if subject.DataType.IsOptional() {
+		dataType = subject.DataType.Type().Value
+	} else if subject.DataType != intpr.Invalid {
+		s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("cannot unwrap %s: expected an optional", subject.DataType.View()), Type: errors.TypeError, Token: token})
+	}
+	bound := &intpr.Expression{Token: name, DataType: dataType, Slot: s.cache.SetVarType(name.Value, dataType).Slot}
+	return &intpr.Expression{Token: token, DataType: intpr.Bool, Left: subject, Right: bound}, nil
+}
+
+// parseSpawn parses spawn name(args); leaving s.current past the semicolon.
+func (s *ParseSource) parseSpawn() (*intpr.Spawn, *errors.Error) {
+	token := s.tokens[s.current]
+	s.current++
+	name := s.tokens[s.current]
+	if name.Type != sTokens.IDENTIFIER || s.tokens[s.current+1].Type != sTokens.LEFT_PAREN {
+		return nil, &errors.Error{Message: fmt.Sprintf("expected function call, got %s", name.View()), Type: errors.SyntaxError, Token: name}
+	}
+	fnCall, err := s.parseFunctionCall()
+	if err != nil {
+		return nil, err
+	}
+	if fnCall.Builtin != intpr.NoBuiltin || fnCall.Native {
+		s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("cannot spawn built-in function %s", name.Value), Type: errors.ReferenceError, Token: name})
+	}
+	if s.tokens[s.current+1].Type != sTokens.SEMICOLON {
+		return nil, &errors.Error{Message: "statements must end in semicolon", Type: errors.SyntaxError, Token: s.tokens[s.current+1]}
+	}
+	s.current += 2
+	s.concurrent = true
+	return &intpr.Spawn{Token: token, NameToken: fnCall.Identifier, Depth: fnCall.Depth, Slot: fnCall.Slot, Args: fnCall.Args}, nil
+}
+
+// parseSelect parses select { name := recv(c) => { } send(c, v) => { } ... _ => { } },
+// where the name of a received value may be left out, leaving s.current past
+// the closing brace.
+func (s *ParseSource) parseSelect(inLoop bool) (*intpr.Select, *errors.Error) {
+	stmt := &intpr.Select{Token: s.tokens[s.current]}
+	if s.tokens[s.current+1].Type != sTokens.LEFT_BRACE {
+		return nil, &errors.Error{Message: fmt.Sprintf("expected select arms, got %s", s.tokens[s.current+1].View()), Type: errors.SyntaxError, Token: s.tokens[s.current+1]}
+	}
+	s.current += 2
+	s.concurrent = true
+	for s.tokens[s.current].Type != sTokens.RIGHT_BRACE {
+		token := s.tokens[s.current]
+		if token.Type == sTokens.EOF {
+			return nil, &errors.Error{Message: "select not closed", Type: errors.SyntaxError, Token: stmt.Token}
+		}
+		isDefault := token.Type == sTokens.IDENTIFIER && token.Value == "_" && s.tokens[s.current+1].Type == sTokens.ARROW
+		arm := intpr.SelectArm{Slot: -1}
+		received := intpr.Invalid
+		if isDefault {
+			if stmt.Default != nil {
+				s.Errors = append(s.Errors, &errors.Error{Message: "duplicate default arm", Type: errors.SyntaxError, Token: token})
+			}
+			s.current++
+		} else {
+			if stmt.Default != nil {
+				s.Errors = append(s.Errors, &errors.Error{Message: "the default arm must be the last one", Type: errors.SyntaxError, Token: token})
+			}
+			if token.Type == sTokens.IDENTIFIER && s.tokens[s.current+1].Type == sTokens.COLON_EQUAL {
+				arm.Var = token
+				s.current += 2
+			}
+			name := s.tokens[s.current]
+			if name.Type != sTokens.IDENTIFIER || s.tokens[s.current+1].Type != sTokens.LEFT_PAREN {
+				return nil, &errors.Error{Message: fmt.Sprintf("expected recv or send, got %s", name.View()), Type: errors.SyntaxError, Token: name}
+			}
+			fnCall, err := s.parseFunctionCall()
+			if err != nil {
+				return nil, err
+			}
+			arm.Token = fnCall.Identifier
+			switch {
+			case fnCall.Builtin == intpr.RecvBuiltin && len(fnCall.Args) == 1:
+				arm.Channel = fnCall.Args[0]
+				received = fnCall.DataType
+			case fnCall.Builtin == intpr.SendBuiltin && len(fnCall.Args) == 2:
+				arm.Channel, arm.Value = fnCall.Args[0], fnCall.Args[1]
+				if arm.Var.Type == sTokens.IDENTIFIER {
+					s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("send has no value to store in %s", arm.Var.Value), Type: errors.TypeError, Token: arm.Var})
+					arm.Var = sTokens.Token{}
+				}
+			case fnCall.Builtin != intpr.RecvBuiltin && fnCall.Builtin != intpr.SendBuiltin:
+				s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("select arms must call recv or send, got %s", name.Value), Type: errors.SyntaxError, Token: name})
+			}
+			s.current++
+		}
+		if s.tokens[s.current].Type != sTokens.ARROW {
+			return nil, &errors.Error{Message: fmt.Sprintf("expected =>, got %s", s.tokens[s.current].View()), Type: errors.SyntaxError, Token: s.tokens[s.current]}
+		}
+		if s.tokens[s.current+1].Type != sTokens.LEFT_BRACE {
+			return nil, &errors.Error{Message: fmt.Sprintf("expected arm body, got %s", s.tokens[s.current+1].View()), Type: errors.SyntaxError, Token: s.tokens[s.current+1]}
+		}
+		s.current += 2
+		s.scope++
+		s.cache.Extend()
+		if arm.Var.Type == sTokens.IDENTIFIER {
+			arm.Slot = s.cache.SetVarType(arm.Var.Value, received).Slot
+		}
+		block, err := s.Parse(inLoop)
+		if err != nil {
+			return nil, err
+		}
+		s.scope--
+		s.cache.Shrink()
+		if isDefault {
+			stmt.Default = block
+		} else if arm.Channel != nil {
+			arm.Block = block
+			stmt.Arms = append(stmt.Arms, arm)
+		}
+	}
+	s.current++
+	if len(stmt.Arms) == 0 && len(s.Errors) == 0 {
+		s.Errors = append(s.Errors, &errors.Error{Message: "select needs a recv or send arm", Type: errors.SyntaxError, Token: stmt.Token})
+	}
+	return stmt, nil
+}
+
+// caseConstant returns the literal a case that is a constant expression
+// folds to. Cases are compared by value, so 1 + 1 and 2 are the same case.
+func caseConstant(e *intpr.Expression) (*intpr.Expression, bool) {
+	if !isConstant(e) {
+		return nil, false
+	}
+	folded := inline(e)
+	optimizer.FoldExpression(folded)
+	switch folded.Token.Type {
+	case sTokens.NUMBER, sTokens.TRUE, sTokens.FALSE, sTokens.VARIANT:
+		return folded, true
+	}
+	return nil, false
+}
+
+// parseForIn parses for name in start..end { } and for name in collection { },
+// leaving s.current past the closing brace.
+func (s *ParseSource) parseForIn() (*intpr.ForIn, *errors.Error) {
+	stmt := &intpr.ForIn{Token: s.tokens[s.current], Var: s.tokens[s.current+1]}
+	s.current += 3
+	start, err := s.parseExpression(sTokens.Precedences[sTokens.RIGHT_PAREN], sTokens.LEFT_BRACE)
+	if err != nil {
+		return nil, err
+	}
+	if s.tokens[s.current+1].Type == sTokens.DOUBLE_DOT {
+		s.current += 2
+		end, err := s.parseExpression(sTokens.Precedences[sTokens.RIGHT_PAREN], sTokens.LEFT_BRACE)
+		if err != nil {
+			return nil, err
+		}
+		for _, bound := range []*intpr.Expression{start, end} {
+			if bound.DataType != intpr.Int && bound.DataType != intpr.Invalid {
+				s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("range bounds must be int, got %s", bound.DataType.View()), Type: errors.TypeError, Token: bound.Token})
+			}
+		}
+		stmt.Start = start
+		stmt.End = end
+		stmt.DataType = intpr.Int
+	} else {
+		stmt.Collection = start
+		if start.DataType.IsMap() {
+			stmt.DataType = start.DataType.Type().Key
+		} else if start.DataType.IsArray() {
+			stmt.DataType = start.DataType.Type().Value
+		} else {
+			stmt.DataType = intpr.Invalid
+			if start.DataType != intpr.Invalid {
+				s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("cannot iterate over %s", start.DataType.View()), Type: errors.TypeError, Token: start.Token})
+			}
+		}
+	}
+	if s.tokens[s.current+1].Type != sTokens.LEFT_BRACE {
+		return nil, &errors.Error{Message: fmt.Sprintf("expected loop body, got %s", s.tokens[s.current+1].View()), Type: errors.SyntaxError, Token: s.tokens[s.current+1]}
+	}
+	s.current += 2
+	// the loop variable lives in a level of its own around the body, and
+	// in the frame of the body when it has one
+	frame := s.loopFrame()
+	s.scope++
+	if frame {
+		s.cache.ExtendFrame()
+	} else {
+		s.cache.Extend()
+	}
+	stmt.Slot = s.cache.SetVarType(stmt.Var.Value, stmt.DataType).Slot
+	s.scope++
+	s.cache.Extend()
+	block, err := s.Parse(true)
+	if err != nil {
+		return nil, err
+	}
+	s.scope -= 2
+	s.cache.Shrink()
+	if frame {
+		block.Variables = s.cache.ShrinkFrame()
+		block.Frame = true
+	} else {
+		s.cache.Shrink()
+	}
+	stmt.Block = block
+	return stmt, nil
+}
+
+// loopFrame reports whether the loop body starting at s.current defines a
+// function. Such a body gets a frame of its own for every iteration, as a
+// task spawned from the function may outlive the iteration.
+func (s *ParseSource) loopFrame() bool {
+	depth := 0
+	for _, token := range s.tokens[s.current:] {
+		switch token.Type {
+		case sTokens.LEFT_BRACE:
+			depth++
+		case sTokens.RIGHT_BRACE:
+			if depth == 0 {
+				return false
+			}
+			depth--
+		case sTokens.DEF:
+			return true
+		}
+	}
+	return false
+}
+
+// parseResultTypes parses the result types of a function in parentheses,
+// leaving s.current at the closing one. Several results make a tuple.
+func (s *ParseSource) parseResultTypes() (intpr.DataType, *errors.Error) {
+	elements := []intpr.DataType{}
+	for {
+		s.current++
+		dataType, err := s.parseType("return type")
+		if err != nil {
+			return intpr.Invalid, err
+		}
+		elements = append(elements, dataType)
+		s.current++
+		delimiter := s.tokens[s.current]
+		if delimiter.Type == sTokens.RIGHT_PAREN {
+			break
+		}
+		if delimiter.Type != sTokens.COMMA {
+			return intpr.Invalid, &errors.Error{Message: fmt.Sprintf("expected ',' or ')', got %s", delimiter.View()), Type: errors.SyntaxError, Token: delimiter}
+		}
+	}
+	if len(elements) == 1 {
+		return elements[0], nil
+	}
+	return s.types.TupleOf(elements), nil
+}
+
+// parseResults parses the values of a return statement, leaving s.current at
+// the last token before the semicolon. Several values make a tuple.
+func (s *ParseSource) parseResults() (*intpr.Expression, *errors.Error) {
+	exp, err := s.parseExpression(sTokens.Precedences[sTokens.RIGHT_PAREN], sTokens.SEMICOLON)
+	if err != nil {
+		return nil, err
+	}
+	if s.tokens[s.current+1].Type == sTokens.COMMA {
+		tuple := &intpr.Expression{Token: s.tokens[s.current+1], Args: []*intpr.Expression{exp}}
+		for s.tokens[s.current+1].Type == sTokens.COMMA {
+			s.current += 2
+			exp, err := s.parseExpression(sTokens.Precedences[sTokens.RIGHT_PAREN], sTokens.SEMICOLON)
+			if err != nil {
+				return nil, err
+			}
+			tuple.Args = append(tuple.Args, exp)
+		}
+		elements := []intpr.DataType{}
+		for _, a := range tuple.Args {
+			if a.DataType.IsTuple() {
+				s.Errors = append(s.Errors, &errors.Error{Message: "a function with several results can't be returned with other values", Type: errors.TypeError, Token: a.Token})
+			}
+			elements = append(elements, a.DataType)
+		}
+		tuple.DataType = s.types.TupleOf(elements)
+		exp = tuple
+	}
+	if s.tokens[s.current+1].Type != sTokens.SEMICOLON {
+		return nil, &errors.Error{Message: "statements must end in semicolon", Type: errors.SyntaxError, Token: s.tokens[s.current+1]}
+	}
+	return exp, nil
+}
+
+// parseDestructure parses a, b := call and a, b = call, leaving s.current at
+// the last token of the call.
+func (s *ParseSource) parseDestructure(endToken sTokens.TokenType) (*intpr.Destructure, *errors.Error) {
+	stmt := &intpr.Destructure{}
+	for {
+		name := s.tokens[s.current]
+		if name.Type != sTokens.IDENTIFIER {
+			return nil, &errors.Error{Message: fmt.Sprintf("expected variable name, got %s", name.View()), Type: errors.SyntaxError, Token: name}
+		}
+		stmt.Vars = append(stmt.Vars, name)
+		s.current++
+		if s.tokens[s.current].Type != sTokens.COMMA {
+			break
+		}
+		s.current++
+	}
+	operator := s.tokens[s.current]
+	if operator.Type != sTokens.COLON_EQUAL && operator.Type != sTokens.EQUAL {
+		return nil, &errors.Error{Message: fmt.Sprintf("expected := or =, got %s", operator.View()), Type: errors.SyntaxError, Token: operator}
+	}
+	stmt.Operator = operator
+	s.current++
+	exp, err := s.parseExpression(sTokens.Precedences[sTokens.EOF], endToken)
+	if err != nil {
+		return nil, err
+	}
+	stmt.Exp = exp
+	elements := make([]intpr.DataType, len(stmt.Vars))
+	for i := range elements {
+		elements[i] = intpr.Invalid
+	}
+	if exp.DataType.IsTuple() {
+		if tuple := exp.DataType.Type().Elements; len(tuple) == len(stmt.Vars) {
+			elements = tuple
+		} else {
+			s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("assignment mismatch: %d variables but %d values", len(stmt.Vars), len(tuple)), Type: errors.TypeError, Token: operator})
+		}
+	} else if exp.DataType != intpr.Invalid {
+		s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("assignment mismatch: %d variables but 1 value", len(stmt.Vars)), Type: errors.TypeError, Token: operator})
+	}
+	seen := map[string]bool{}
+	for i, name := range stmt.Vars {
+		stmt.Depths = append(stmt.Depths, 0)
+		stmt.Slots = append(stmt.Slots, -1)
+		if name.Value == "_" {
+			continue
+		}
+		if seen[name.Value] {
+			s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("%s repeated on the left side", name.Value), Type: errors.ReferenceError, Token: name})
+			continue
+		}
+		seen[name.Value] = true
+		if operator.Type == sTokens.COLON_EQUAL {
+			if _, defined := s.cache.vars[s.cache.size-1][name.Value]; defined {
+				s.Errors = append(s.Errors, &errors.Error{Message: "variable reassignment not allowed", Type: errors.ReferenceError, Token: name})
+				continue
+			}
+			stmt.Slots[i] = s.cache.SetVarType(name.Value, elements[i]).Slot
+			continue
+		}
+		v, depth, defined := s.cache.Resolve(name.Value)
+		if !defined {
+			s.Errors = append(s.Errors, &errors.Error{Message: "undefined variable", Type: errors.ReferenceError, Token: name})
+		} else if v.Value != nil {
+			s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("cannot assign to constant %s", name.Value), Type: errors.ReferenceError, Token: name})
+		} else if v.DataType == intpr.Func {
+			s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("cannot assign to function %s", name.Value), Type: errors.TypeError, Token: name})
+		} else if v.DataType != elements[i] && elements[i] != intpr.Invalid {
+			s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("assigning wrong type to %s: expected %s, got %s", name.Value, v.DataType.View(), elements[i].View()), Type: errors.TypeError, Token: name})
+		} else {
+			stmt.Depths[i] = depth
+			stmt.Slots[i] = v.Slot
+		}
+	}
+	return stmt, nil
+}
+
+// parseConst parses const type NAME = value, leaving s.current at the last
+// token of the value. The value must be a constant expression, which every
+// use of the constant is replaced with.
+func (s *ParseSource) parseConst() (intpr.Statement, *errors.Error) {
+	s.current++
+	token := s.tokens[s.current]
+	if token.Type == sTokens.IDENTIFIER && s.tokens[s.current+1].Type != sTokens.IDENTIFIER {
+		return nil, &errors.Error{Message: "a constant needs a type: const type NAME = value", Type: errors.SyntaxError, Token: token}
+	}
+	stmt, err := s.parseOneliner(sTokens.SEMICOLON)
+	if err != nil {
+		return nil, err
+	}
+	assignment := stmt.(*intpr.Assignment)
+	switch {
+	case assignment.DataType != intpr.Int && assignment.DataType != intpr.Bool && assignment.DataType != intpr.String:
+		s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("invalid constant type %s", assignment.DataType.View()), Type: errors.TypeError, Token: assignment.Var})
+	case !isConstant(assignment.Exp):
+		s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("%s is not a constant expression", assignment.Var.Value), Type: errors.TypeError, Token: assignment.Operator})
+	default:
+		s.cache.SetConst(assignment.Var.Value, assignment.Exp)
+	}
+	return assignment, nil
+}
+
+// isConstant reports whether the expression is made of literals and
+// operators only. Constants are already replaced by their values.
+func isConstant(e *intpr.Expression) bool {
+	switch e.Token.Type {
+	case sTokens.NUMBER, sTokens.TRUE, sTokens.FALSE, sTokens.STRING, sTokens.VARIANT, sTokens.NONE:
+		return true
+	case sTokens.IDENTIFIER, sTokens.DOT, sTokens.LEFT_BRACKET, sTokens.LEFT_BRACE, sTokens.COMMA:
+		return false
+	}
+	return isConstant(e.Left) && (e.Right == nil || isConstant(e.Right))
+}
+
+// inline returns a copy of the value of a constant, so that folding one use
+// leaves the others alone.
+func inline(e *intpr.Expression) *intpr.Expression {
+	if e == nil {
+		return nil
+	}
+	copied := *e
+	copied.Left = inline(e.Left)
+	copied.Right = inline(e.Right)
+	return &copied
+}
+
+// parseType returns the type whose name starts at s.current, leaving
+// s.current at the last token of the name. what describes the expected type
+// in the error for a token that names no type. A ? after the name makes the
+// type optional.
+func (s *ParseSource) parseType(what string) (intpr.DataType, *errors.Error) {
+	dataType, err := s.parseTypeName(what)
+	if err != nil || s.tokens[s.current+1].Type != sTokens.QUESTION {
+		return dataType, err
+	}
+	s.current++
+	return s.types.OptionalOf(dataType), nil
+}
+
+func (s *ParseSource) parseTypeName(what string) (intpr.DataType, *errors.Error) {
+	token := s.tokens[s.current]
+	switch token.Type {
+	case sTokens.MAP:
+		if s.tokens[s.current+1].Type != sTokens.LEFT_BRACKET {
+			return intpr.Invalid, &errors.Error{Message: fmt.Sprintf("expected [, got %s", s.tokens[s.current+1].View()), Type: errors.SyntaxError, Token: s.tokens[s.current+1]}
+		}
+		s.current += 2
+		key, err := s.parseType("map key type")
+		if err != nil {
+			return intpr.Invalid, err
+		}
+		if key != intpr.Int && key != intpr.Bool && !key.IsEnum() {
+			return intpr.Invalid, &errors.Error{Message: fmt.Sprintf("invalid map key type %s", key.View()), Type: errors.TypeError, Token: s.tokens[s.current]}
+		}
+		if s.tokens[s.current+1].Type != sTokens.RIGHT_BRACKET {
+			return intpr.Invalid, &errors.Error{Message: fmt.Sprintf("expected ], got %s", s.tokens[s.current+1].View()), Type: errors.SyntaxError, Token: s.tokens[s.current+1]}
+		}
+		s.current += 2
+		value, err := s.parseType("map value type")
+		if err != nil {
+			return intpr.Invalid, err
+		}
+		return s.types.MapOf(key, value), nil
+	case sTokens.CHAN:
+		if s.tokens[s.current+1].Type != sTokens.LEFT_BRACKET {
+			return intpr.Invalid, &errors.Error{Message: fmt.Sprintf("expected [, got %s", s.tokens[s.current+1].View()), Type: errors.SyntaxError, Token: s.tokens[s.current+1]}
+		}
+		s.current += 2
+		element, err := s.parseType("channel element type")
+		if err != nil {
+			return intpr.Invalid, err
+		}
+		// recv tells a closed channel by returning none
+		if element.IsOptional() {
+			return intpr.Invalid, &errors.Error{Message: fmt.Sprintf("invalid channel element type %s", element.View()), Type: errors.TypeError, Token: s.tokens[s.current]}
+		}
+		if s.tokens[s.current+1].Type != sTokens.RIGHT_BRACKET {
+			return intpr.Invalid, &errors.Error{Message: fmt.Sprintf("expected ], got %s", s.tokens[s.current+1].View()), Type: errors.SyntaxError, Token: s.tokens[s.current+1]}
+		}
+		s.current++
+		s.concurrent = true
+		return s.types.ChanOf(element), nil
+	case sTokens.LEFT_BRACKET:
+		if s.tokens[s.current+1].Type != sTokens.RIGHT_BRACKET {
+			return intpr.Invalid, &errors.Error{Message: fmt.Sprintf("expected ], got %s", s.tokens[s.current+1].View()), Type: errors.SyntaxError, Token: s.tokens[s.current+1]}
+		}
+		s.current += 2
+		element, err := s.parseType("array element type")
+		if err != nil {
+			return intpr.Invalid, err
+		}
+		return s.types.ArrayOf(element), nil
+	case sTokens.INT_TYPE:
+		return intpr.Int, nil
+	case sTokens.BOOL_TYPE:
+		return intpr.Bool, nil
+	case sTokens.STRING_TYPE:
+		return intpr.String, nil
+	case sTokens.IDENTIFIER:
+		dataType, found := s.cache.GetType(token.Value)
+		if found {
+			return dataType, nil
+		}
+		return intpr.Invalid, &errors.Error{Message: fmt.Sprintf("unknown type %s", token.Value), Type: errors.ReferenceError, Token: token}
+	}
+	return intpr.Invalid, &errors.Error{Message: fmt.Sprintf("expected %s, got %s", what, token.View()), Type: errors.SyntaxError, Token: token}
+}
+
+func (s *ParseSource) parseStruct() (*intpr.StructDef, *errors.Error) {
+	token := s.tokens[s.current]
+	name := s.tokens[s.current+1]
+	if name.Type != sTokens.IDENTIFIER {
+		return nil, &errors.Error{Message: fmt.Sprintf("expected struct name, got %s", name.View()), Type: errors.SyntaxError, Token: name}
+	}
+	if s.tokens[s.current+2].Type != sTokens.LEFT_BRACE {
+		return nil, &errors.Error{Message: fmt.Sprintf("expected struct fields, got %s", s.tokens[s.current+2].View()), Type: errors.SyntaxError, Token: s.tokens[s.current+2]}
+	}
+	s.current += 3
+	fields := []intpr.Field{}
+	for s.tokens[s.current].Type != sTokens.RIGHT_BRACE {
+		dataType, err := s.parseType("field type")
+		if err != nil {
+			return nil, err
+		}
+		fieldName := s.tokens[s.current+1]
+		if fieldName.Type != sTokens.IDENTIFIER {
+			return nil, &errors.Error{Message: fmt.Sprintf("expected field name, got %s", fieldName.View()), Type: errors.SyntaxError, Token: fieldName}
+		}
+		if s.tokens[s.current+2].Type != sTokens.SEMICOLON {
+			return nil, &errors.Error{Message: "fields must end in semicolon", Type: errors.SyntaxError, Token: s.tokens[s.current+2]}
+		}
+		for _, f := range fields {
+			if f.Name == fieldName.Value {
+				s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("duplicate field %s", fieldName.Value), Type: errors.ReferenceError, Token: fieldName})
+			}
+		}
+		fields = append(fields, intpr.Field{Name: fieldName.Value, DataType: dataType})
+		s.current += 3
+	}
+	s.current++
+	if _, defined := s.cache.types[s.cache.size-1][name.Value]; defined {
+		s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("type %s is already declared in the same scope", name.Value), Type: errors.ReferenceError, Token: name})
+	}
+	stmt := &intpr.StructDef{Token: token, NameToken: name, DataType: s.types.NewStruct(name.Value, fields)}
+	s.cache.SetType(name.Value, stmt.DataType)
+	return stmt, nil
+}
+
+// parseEnum parses enum Name { Variant, ... }, leaving s.current past the
+// closing brace.
+func (s *ParseSource) parseEnum() (*intpr.EnumDef, *errors.Error) {
+	token := s.tokens[s.current]
+	name := s.tokens[s.current+1]
+	if name.Type != sTokens.IDENTIFIER {
+		return nil, &errors.Error{Message: fmt.Sprintf("expected enum name, got %s", name.View()), Type: errors.SyntaxError, Token: name}
+	}
+	if s.tokens[s.current+2].Type != sTokens.LEFT_BRACE {
+		return nil, &errors.Error{Message: fmt.Sprintf("expected enum variants, got %s", s.tokens[s.current+2].View()), Type: errors.SyntaxError, Token: s.tokens[s.current+2]}
+	}
+	s.current += 3
+	variants := []string{}
+	for s.tokens[s.current].Type != sTokens.RIGHT_BRACE {
+		variant := s.tokens[s.current]
+		if variant.Type != sTokens.IDENTIFIER {
+			return nil, &errors.Error{Message: fmt.Sprintf("expected variant name, got %s", variant.View()), Type: errors.SyntaxError, Token: variant}
+		}
+		if slices.Contains(variants, variant.Value) {
+			s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("duplicate variant %s", variant.Value), Type: errors.ReferenceError, Token: variant})
+		}
+		variants = append(variants, variant.Value)
+		s.current++
+		if s.tokens[s.current].Type == sTokens.COMMA {
+			s.current++
+		} else if s.tokens[s.current].Type != sTokens.RIGHT_BRACE {
+			return nil, &errors.Error{Message: fmt.Sprintf("expected , or }, got %s", s.tokens[s.current].View()), Type: errors.SyntaxError, Token: s.tokens[s.current]}
+		}
+	}
+	if len(variants) == 0 {
+		s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("enum %s has no variants", name.Value), Type: errors.TypeError, Token: name})
+	}
+	s.current++
+	if _, defined := s.cache.types[s.cache.size-1][name.Value]; defined {
+		s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("type %s is already declared in the same scope", name.Value), Type: errors.ReferenceError, Token: name})
+	}
+	stmt := &intpr.EnumDef{Token: token, NameToken: name, DataType: s.types.NewEnum(name.Value, variants)}
+	s.cache.SetType(name.Value, stmt.DataType)
+	return stmt, nil
+}
+
+// parseVariant parses Enum.Variant, the current token being the name of the
+// enum, leaving s.current at the variant.
+func (s *ParseSource) parseVariant(dataType intpr.DataType) *intpr.Expression {
+	token := s.tokens[s.current]
+	variant := s.tokens[s.current+2]
+	s.current += 2
+	if variant.Type != sTokens.IDENTIFIER {
+		s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("expected variant name, got %s", variant.View()), Type: errors.SyntaxError, Token: variant})
+		return &intpr.Expression{Token: token, DataType: intpr.Invalid}
+	}
+	index := dataType.Type().VariantIndex(variant.Value)
+	if index < 0 {
+		s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("enum %s has no variant %s", token.Value, variant.Value), Type: errors.ReferenceError, Token: variant})
+		return &intpr.Expression{Token: variant, DataType: intpr.Invalid}
+	}
+	token.Type = sTokens.VARIANT
+	token.Value = token.Value + "." + variant.Value
+	return &intpr.Expression{Token: token, DataType: dataType, Constant: intpr.Value{Int: index}}
+}
+
+// parseConversion parses int(e) or Enum(e), the current token being the type
+// converted to, leaving s.current at the closing paren. Only enums convert,
+// to and from int.
+func (s *ParseSource) parseConversion(dataType intpr.DataType) (*intpr.Expression, *errors.Error) {
+	token := s.tokens[s.current]
+	token.Type = sTokens.IDENTIFIER
+	token.Value = dataType.View()
+	s.current++
+	arg, err := s.parseParens()
+	if err != nil {
+		return nil, err
+	}
+	from := arg.DataType
+	valid := from == intpr.Invalid || from == dataType || from == intpr.Int && dataType.IsEnum() || from.IsEnum() && dataType == intpr.Int
+	if !valid {
+		s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("cannot convert %s to %s", from.View(), dataType.View()), Type: errors.TypeError, Token: token})
+	}
+	return &intpr.Expression{Token: token, DataType: dataType, Args: []*intpr.Expression{arg}, Builtin: intpr.ConvertBuiltin}, nil
+}
+
+// field looks up the field called name of a struct type, recording an error
+// if there is none. It returns -1 and an invalid type on failure.
+func (s *ParseSource) field(dataType intpr.DataType, name sTokens.Token) (int, intpr.DataType) {
+	if dataType == intpr.Invalid {
+		return -1, intpr.Invalid
+	}
+	if !dataType.IsStruct() {
+		s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("%s has no fields", dataType.View()), Type: errors.TypeError, Token: name})
+		return -1, intpr.Invalid
+	}
+	info := dataType.Type()
+	index := info.FieldIndex(name.Value)
+	if index < 0 {
+		s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("%s has no field %s", info.Name, name.Value), Type: errors.ReferenceError, Token: name})
+		return -1, intpr.Invalid
+	}
+	return index, info.Fields[index].DataType
+}
+
+func (s *ParseSource) parseOneliner(endToken sTokens.TokenType) (intpr.Statement, *errors.Error) {
+	token := s.tokens[s.current]
+	if token.Type == sTokens.IDENTIFIER && s.tokens[s.current+1].Type == sTokens.LEFT_PAREN {
+		fnCall, err := s.parseFunctionCall()
+		if err != nil {
+			return nil, err
+		}
+		if fnCall.Builtin == intpr.NoBuiltin && fnCall.DataType != intpr.Void && fnCall.DataType != intpr.Invalid && !fnCall.Native {
+			s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("%s is not a void function", token.Value), Type: errors.ReferenceError, Token: token})
+		}
+		return &intpr.VoidCall{
+			NameToken: fnCall.Identifier,
+			Args:      fnCall.Args,
+			Depth:     fnCall.Depth,
+			Slot:      fnCall.Slot,
+			Builtin:   fnCall.Builtin,
+		}, nil
+	}
+
+	if token.Type == sTokens.IDENTIFIER && s.tokens[s.current+1].Type == sTokens.COMMA {
+		return s.parseDestructure(endToken)
+	}
+
+	stmt := intpr.Assignment{}
+	if next := s.tokens[s.current+1].Type; token.Type != sTokens.IDENTIFIER || next == sTokens.IDENTIFIER || next == sTokens.QUESTION {
+		stmt.Explicit = true
+		dataType, err := s.parseType("type")
+		if err != nil {
+			return nil, err
+		}
+		stmt.DataType = dataType
+		varToken := s.tokens[s.current+1]
+		if varToken.Type != sTokens.IDENTIFIER {
+			return nil, &errors.Error{Message: fmt.Sprintf("expected variable name, got %s", varToken.View()), Type: errors.SyntaxError, Token: varToken}
+		}
+		stmt.Var = varToken
+		operator := s.tokens[s.current+2]
+		if operator.Type != sTokens.EQUAL {
+			return nil, &errors.Error{Message: fmt.Sprintf("expected assignment operator '=', got %s", operator.View()), Type: errors.SyntaxError, Token: operator}
+		}
+		stmt.Operator = operator
+		s.current += 3
+		exp, err := s.parseExpression(sTokens.Precedences[sTokens.EOF], endToken)
+		if err != nil {
+			return nil, err
+		}
+		exp = coerce(exp, stmt.DataType)
+		stmt.Exp = exp
+		if exp.DataType != stmt.DataType && exp.DataType != intpr.Invalid {
+			s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("assigning wrong type: expected %s, got %s", stmt.DataType.View(), exp.DataType.View()), Type: errors.TypeError, Token: operator})
+		}
+		if _, defined := s.cache.vars[s.cache.size-1][stmt.Var.Value]; defined {
+			s.Errors = append(s.Errors, &errors.Error{Message: "variable reassignment not allowed", Type: errors.ReferenceError, Token: stmt.Var})
+			return &stmt, nil
+		}
+		stmt.Slot = s.cache.SetVarType(stmt.Var.Value, stmt.DataType).Slot
+		return &stmt, nil
+	}
+	// a path leaves s.current at its last token, so the operator follows it
+	// like it follows a variable
+	var path []intpr.Selector
+	pathType := intpr.Invalid
+	if next := s.tokens[s.current+1].Type; next == sTokens.DOT || next == sTokens.LEFT_BRACKET {
+		v, _, _ := s.cache.Resolve(token.Value)
+		pathType = v.DataType
+	}
+	for {
+		next := s.tokens[s.current+1]
+		if next.Type == sTokens.DOT {
+			s.current += 2
+			name := s.tokens[s.current]
+			if name.Type != sTokens.IDENTIFIER {
+				return nil, &errors.Error{Message: fmt.Sprintf("expected field name, got %s", name.View()), Type: errors.SyntaxError, Token: name}
+			}
+			var index int
+			index, pathType = s.field(pathType, name)
+			path = append(path, intpr.Selector{Token: name, Field: index})
+		} else if next.Type == sTokens.LEFT_BRACKET {
+			key, dataType, err := s.parseIndex(pathType)
+			if err != nil {
+				return nil, err
+			}
+			pathType = dataType
+			path = append(path, intpr.Selector{Token: next, Index: key})
+		} else {
+			break
+		}
+	}
+	operator := s.tokens[s.current+1]
+	if path != nil && operator.Type == sTokens.COLON_EQUAL {
+		return nil, &errors.Error{Message: "cannot declare a field or map element, use = to assign it", Type: errors.SyntaxError, Token: operator}
+	}
+	switch operator.Type {
+	case sTokens.COLON_EQUAL, sTokens.EQUAL, sTokens.PLUS_EQUAL, sTokens.MINUS_EQUAL, sTokens.STAR_EQUAL, sTokens.SLASH_EQUAL, sTokens.MODULO_EQUAL,
+		sTokens.AMPERSAND_EQUAL, sTokens.PIPE_EQUAL, sTokens.CARET_EQUAL, sTokens.SHIFT_LEFT_EQUAL, sTokens.SHIFT_RIGHT_EQUAL:
+		s.current += 2
+		exp, err := s.parseExpression(sTokens.Precedences[sTokens.EOF], endToken)
+		if err != nil {
+			return nil, err
+		}
+		stmt.Var = token
+		stmt.Operator = operator
+		stmt.Exp = exp
+
+		switch operator.Type {
+		case sTokens.COLON_EQUAL:
+			_, defined := s.cache.vars[s.cache.size-1][token.Value]
+			if defined {
+				s.Errors = append(s.Errors, &errors.Error{Message: "variable reassignment not allowed", Type: errors.ReferenceError, Token: token})
+			} else {
+				if exp.DataType.IsTuple() {
+					s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("assignment mismatch: 1 variable but %d values", len(exp.DataType.Type().Elements)), Type: errors.TypeError, Token: operator})
+				}
+				if exp.DataType == intpr.None {
+					s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("cannot infer the type of %s from none, declare it with an optional type", token.Value), Type: errors.TypeError, Token: operator})
+				}
+				stmt.Slot = s.cache.SetVarType(token.Value, exp.DataType).Slot
+				stmt.DataType = exp.DataType
+			}
+		default:
+			v, depth, defined := s.cache.Resolve(token.Value)
+			dataType := v.DataType
+			if path != nil {
+				dataType = pathType
+			}
+			if operator.Type == sTokens.EQUAL {
+				exp = coerce(exp, dataType)
+				stmt.Exp = exp
+			}
+			if !defined {
+				s.Errors = append(s.Errors, &errors.Error{Message: "undefined variable", Type: errors.ReferenceError, Token: token})
+			} else if v.Value != nil {
+				s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("cannot assign to constant %s", token.Value), Type: errors.ReferenceError, Token: token})
+			} else if dataType == intpr.Invalid {
+				// the field path is wrong, which is already reported
+			} else if dataType != exp.DataType && exp.DataType != intpr.Invalid {
+				s.Errors = append(s.Errors, &errors.Error{Message: "assigning wrong type", Type: errors.TypeError, Token: token})
+			} else if operator.Type != sTokens.EQUAL && dataType != intpr.Int {
+				s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("invalid operation %s for type %s", operator.View(), dataType.View()), Type: errors.TypeError, Token: operator})
+			} else {
+				stmt.DataType = exp.DataType
+				stmt.Depth = depth
+				stmt.Slot = v.Slot
+				stmt.Path = path
+			}
+		}
+	case sTokens.DOUBLE_PLUS, sTokens.DOUBLE_MINUS:
+		if s.tokens[s.current+2].Type != endToken {
+			return nil, &errors.Error{Message: fmt.Sprintf("expected %s after the statement, got %s", sTokens.Representations[endToken], s.tokens[s.current+2].View()), Type: errors.SyntaxError, Token: s.tokens[s.current+2]}
+		}
+		stmt.Var = token
+		stmt.Operator = operator
+		v, depth, defined := s.cache.Resolve(token.Value)
+		dataType := v.DataType
+		if path != nil {
+			dataType = pathType
+		}
+		if !defined {
+			s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("variable %s undefined", token.Value), Type: errors.ReferenceError, Token: token})
+		} else if v.Value != nil {
+			s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("cannot assign to constant %s", token.Value), Type: errors.ReferenceError, Token: token})
+		} else if dataType != intpr.Int && dataType != intpr.Invalid {
+			operation := ""
+			if token.Type == sTokens.DOUBLE_PLUS {
+				operation = "increment"
+			} else {
+				operation = "decrement"
+			}
+			s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("cannot %s a non-numerical value", operation), Type: errors.TypeError, Token: operator})
+		}
+		stmt.DataType = intpr.Int
+		stmt.Depth = depth
+		stmt.Slot = v.Slot
+		stmt.Path = path
+		s.current++
+	default:
+		return nil, &errors.Error{Message: fmt.Sprintf("expected assignment operator, got %s", operator.View()), Type: errors.SyntaxError, Token: operator}
+	}
+	return &stmt, nil
+}
+
+func (s *ParseSource) parseExpression(precedence int, endToken sTokens.TokenType) (*intpr.Expression, *errors.Error) {
+	left, err := s.parsePrefix()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if s.tokens[s.current+1].Type == sTokens.EOF {
+			return nil, &errors.Error{Message: "expected ;", Token: s.tokens[s.current], Type: errors.SyntaxError}
 		}
 		if s.tokens[s.current+1].Type == endToken || precedence >= sTokens.Precedences[s.tokens[s.current+1].Type] {
 			break
@@ -550,19 +1789,20 @@ func (s *ParseSource) parseExpression(precedence int, endToken sTokens.TokenType
 		if !permittedInfixes[token.Type] {
 			return nil, &errors.Error{Message: fmt.Sprintf("invalid operator %s", token.View()), Token: token, Type: errors.SyntaxError}
 		}
-		scope := s.scope
-		if s.currentFunction != nil {
-			scope = -1
-		}
-		nextLeft := &intpr.Expression{Token: token, Scope: scope}
+		nextLeft := &intpr.Expression{Token: token}
 		prec := sTokens.Precedences[token.Type]
+		if token.Type == sTokens.DOUBLE_QUESTION {
+			// lets the right operand take the next ?? itself
+			prec--
+		}
 		s.current++
 		right, err := s.parseExpression(prec, endToken)
 		if err != nil {
 			return nil, err
 		}
 		switch token.Type {
-		case sTokens.STAR, sTokens.SLASH, sTokens.PLUS, sTokens.MINUS, sTokens.MODULO:
+		case sTokens.STAR, sTokens.SLASH, sTokens.PLUS, sTokens.MINUS, sTokens.MODULO,
+			sTokens.AMPERSAND, sTokens.PIPE, sTokens.CARET, sTokens.SHIFT_LEFT, sTokens.SHIFT_RIGHT:
 			nextLeft.DataType = intpr.Int
 			if left.DataType != intpr.Int && left.DataType != intpr.Invalid || right.DataType != intpr.Int && right.DataType != intpr.Invalid {
 				s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("invalid operation %s for types %s, %s", token.View(), left.DataType.View(), right.DataType.View()), Type: errors.TypeError, Token: token})
@@ -578,10 +1818,37 @@ func (s *ParseSource) parseExpression(precedence int, endToken sTokens.TokenType
 			if left.DataType != intpr.Bool && left.DataType != intpr.Invalid || right.DataType != intpr.Bool && right.DataType != intpr.Invalid {
 				s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("invalid operation %s for types %s, %s: expected bool and bool", token.View(), left.DataType.View(), right.DataType.View()), Type: errors.TypeError, Token: token})
 			}
+		case sTokens.DOUBLE_QUESTION:
+			nextLeft.DataType = intpr.Invalid
+			if left.DataType.IsOptional() {
+				if right.DataType == intpr.None {
+					right = coerce(right, left.DataType)
+				}
+				if right.DataType == left.DataType || right.DataType == left.DataType.Type().Value {
+					nextLeft.DataType = right.DataType
+				} else if right.DataType != intpr.Invalid {
+					s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("invalid operation ?? for types %s, %s: expected %s or %s", left.DataType.View(), right.DataType.View(), left.DataType.Type().Value.View(), left.DataType.View()), Type: errors.TypeError, Token: token})
+				}
+			} else if left.DataType != intpr.Invalid {
+				s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("invalid operation ?? for type %s: expected an optional", left.DataType.View()), Type: errors.TypeError, Token: token})
+			}
 		case sTokens.NOT_EQUAL, sTokens.DOUBLE_EQUAL:
 			nextLeft.DataType = intpr.Bool
-			if left.DataType != right.DataType && left.DataType != intpr.Invalid && right.DataType != intpr.Invalid || left.DataType == intpr.Func || right.DataType == intpr.Func {
+			// none and plain values compare with optionals as optionals
+			right = coerce(right, left.DataType)
+			left = coerce(left, right.DataType)
+			if left.DataType == intpr.None {
+				s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("invalid operation %s for types none, %s: expected an optional", token.View(), right.DataType.View()), Type: errors.TypeError, Token: token})
+			} else if left.DataType != right.DataType && left.DataType != intpr.Invalid && right.DataType != intpr.Invalid || left.DataType == intpr.Func || right.DataType == intpr.Func {
 				s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("invalid operation %s for types %s, %s: expected same type", token.View(), left.DataType.View(), right.DataType.View()), Type: errors.TypeError, Token: token})
+			} else if left.DataType.IsMap() {
+				s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("invalid operation %s for type %s: maps cannot be compared", token.View(), left.DataType.View()), Type: errors.TypeError, Token: token})
+			} else if left.DataType.IsArray() {
+				s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("invalid operation %s for type %s: arrays cannot be compared", token.View(), left.DataType.View()), Type: errors.TypeError, Token: token})
+			} else if left.DataType.IsParam() && !left.DataType.Type().Comparable {
+				s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("invalid operation %s for type %s: type parameter %s is not comparable", token.View(), left.DataType.View(), left.DataType.View()), Type: errors.TypeError, Token: token})
+			} else if left.DataType.IsTuple() {
+				s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("invalid operation %s for type %s: multiple values cannot be compared", token.View(), left.DataType.View()), Type: errors.TypeError, Token: token})
 			}
 		}
 		nextLeft.Left = left
@@ -592,71 +1859,360 @@ func (s *ParseSource) parseExpression(precedence int, endToken sTokens.TokenType
 	return left, nil
 }
 
-func (s *ParseSource) parsePrefix() (*intpr.Expression, *errors.Error) {
+func (s *ParseSource) parsePrefix() (*intpr.Expression, *errors.Error) {
+	token := s.tokens[s.current]
+	switch token.Type {
+	case sTokens.BANG:
+		node := &intpr.Expression{Token: token, DataType: intpr.Bool}
+		s.current++
+		expression, err := s.parsePrefix()
+		if err != nil {
+			return nil, err
+		}
+		if expression.DataType != intpr.Bool && expression.DataType != intpr.Invalid {
+			s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("invalid operation ! for type %s: expected bool", expression.DataType.View()), Type: errors.TypeError, Token: token})
+		}
+		node.Left = expression
+		return node, nil
+	case sTokens.MINUS, sTokens.PLUS:
+		s.current++
+		if next := s.tokens[s.current]; token.Type == sTokens.MINUS && next.Type == sTokens.NUMBER {
+			// a negative literal stays a literal, which also allows the
+			// smallest int
+			value, err := strconv.Atoi("-" + next.Value)
+			if err != nil {
+				s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("invalid integer -%s", next.Value), Type: errors.TypeError, Token: token})
+			}
+			token.Type = sTokens.NUMBER
+			token.Value = "-" + next.Value
+			return &intpr.Expression{Token: token, DataType: intpr.Int, Constant: intpr.Value{Int: value}}, nil
+		}
+		expression, err := s.parsePrefix()
+		if err != nil {
+			return nil, err
+		}
+		if expression.DataType != intpr.Int && expression.DataType != intpr.Invalid {
+			s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("invalid operation %s for type %s: expected int", token.View(), expression.DataType.View()), Type: errors.TypeError, Token: token})
+		}
+		if token.Type == sTokens.PLUS {
+			return expression, nil
+		}
+		token.Type = sTokens.NEGATE
+		return &intpr.Expression{Token: token, DataType: intpr.Int, Left: expression}, nil
+	case sTokens.TILDE:
+		s.current++
+		expression, err := s.parsePrefix()
+		if err != nil {
+			return nil, err
+		}
+		if expression.DataType != intpr.Int && expression.DataType != intpr.Invalid {
+			s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("invalid operation ~ for type %s: expected int", expression.DataType.View()), Type: errors.TypeError, Token: token})
+		}
+		return &intpr.Expression{Token: token, DataType: intpr.Int, Left: expression}, nil
+	case sTokens.NUMBER:
+		value, err := strconv.Atoi(token.Value)
+		if err != nil {
+			s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("invalid integer %s", token.Value), Type: errors.TypeError, Token: token})
+		}
+		return &intpr.Expression{Token: token, DataType: intpr.Int, Constant: intpr.Value{Int: value}}, nil
+	case sTokens.TRUE, sTokens.FALSE:
+		return &intpr.Expression{Token: token, DataType: intpr.Bool, Constant: intpr.Value{Bool: token.Type == sTokens.TRUE}}, nil
+	case sTokens.NONE:
+		return &intpr.Expression{Token: token, DataType: intpr.None}, nil
+	case sTokens.STRING:
+		return &intpr.Expression{Token: token, DataType: intpr.String, Constant: intpr.Value{Ref: token.Value}}, nil
+	case sTokens.INT_TYPE:
+		if s.tokens[s.current+1].Type != sTokens.LEFT_PAREN {
+			return nil, &errors.Error{Message: fmt.Sprintf("unexpected %s", token.View()), Token: token, Type: errors.SyntaxError}
+		}
+		conversion, err := s.parseConversion(intpr.Int)
+		if err != nil {
+			return nil, err
+		}
+		return s.parsePostfix(conversion)
+	case sTokens.IDENTIFIER:
+		if next := s.tokens[s.current+1].Type; next == sTokens.DOT || next == sTokens.LEFT_PAREN {
+			// a variable or function hides an enum of the same name
+			_, _, defined := s.cache.Resolve(token.Value)
+			if dataType, found := s.cache.GetType(token.Value); found && dataType.IsEnum() && !defined {
+				if next == sTokens.DOT {
+					return s.parsePostfix(s.parseVariant(dataType))
+				}
+				conversion, err := s.parseConversion(dataType)
+				if err != nil {
+					return nil, err
+				}
+				return s.parsePostfix(conversion)
+			}
+		}
+		if s.tokens[s.current+1].Type == sTokens.LEFT_BRACE {
+			if dataType, found := s.cache.GetType(token.Value); found {
+				literal, err := s.parseStructLiteral(dataType)
+				if err != nil {
+					return nil, err
+				}
+				return s.parsePostfix(literal)
+			}
+		}
+		if s.tokens[s.current+1].Type == sTokens.LEFT_PAREN {
+			fnCall, err := s.parseFunctionCall()
+			if err != nil {
+				return nil, err
+			}
+			if fnCall.DataType == intpr.Void {
+				s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("function %s does not return a value", token.Value), Type: errors.TypeError, Token: token})
+			}
+			return s.parsePostfix(&intpr.Expression{Token: fnCall.Identifier, DataType: fnCall.DataType, Args: fnCall.Args, Depth: fnCall.Depth, Slot: fnCall.Slot, Builtin: fnCall.Builtin})
+		}
+		v, depth, defined := s.cache.Resolve(token.Value)
+		if !defined {
+			s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("variable %s undefined", token.Value), Type: errors.ReferenceError, Token: token})
+		}
+		if v.Value != nil {
+			return s.parsePostfix(inline(v.Value))
+		}
+		return s.parsePostfix(&intpr.Expression{Token: token, DataType: v.DataType, Depth: depth, Slot: v.Slot})
+	case sTokens.MAP:
+		literal, err := s.parseMapLiteral()
+		if err != nil {
+			return nil, err
+		}
+		return s.parsePostfix(literal)
+	case sTokens.CHAN:
+		literal, err := s.parseChanLiteral()
+		if err != nil {
+			return nil, err
+		}
+		return s.parsePostfix(literal)
+	case sTokens.LEFT_BRACKET:
+		literal, err := s.parseArrayLiteral()
+		if err != nil {
+			return nil, err
+		}
+		return s.parsePostfix(literal)
+	case sTokens.LEFT_PAREN:
+		node, err := s.parseParens()
+		if err != nil {
+			return nil, err
+		}
+		return s.parsePostfix(node)
+	default:
+		return nil, &errors.Error{Message: fmt.Sprintf("unexpected %s", token.View()), Token: token, Type: errors.SyntaxError}
+	}
+}
+
+// parseStructLiteral parses Name{field: value, ...} with s.current at the
+// name, leaving it at the closing brace.
+func (s *ParseSource) parseStructLiteral(dataType intpr.DataType) (*intpr.Expression, *errors.Error) {
+	s.current++
+	node := &intpr.Expression{Token: s.tokens[s.current], DataType: dataType, Args: make([]*intpr.Expression, len(dataType.Type().Fields))}
+	for s.tokens[s.current+1].Type != sTokens.RIGHT_BRACE {
+		name := s.tokens[s.current+1]
+		if name.Type != sTokens.IDENTIFIER {
+			return nil, &errors.Error{Message: fmt.Sprintf("expected field name, got %s", name.View()), Type: errors.SyntaxError, Token: name}
+		}
+		colon := s.tokens[s.current+2]
+		if colon.Type != sTokens.COLON {
+			return nil, &errors.Error{Message: fmt.Sprintf("expected ':', got %s", colon.View()), Type: errors.SyntaxError, Token: colon}
+		}
+		s.current += 3
+		value, err := s.parseExpression(sTokens.Precedences[sTokens.RIGHT_PAREN], sTokens.COMMA)
+		if err != nil {
+			return nil, err
+		}
+		index, fieldType := s.field(dataType, name)
+		if index >= 0 {
+			value = coerce(value, fieldType)
+			if node.Args[index] != nil {
+				s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("duplicate field %s", name.Value), Type: errors.ReferenceError, Token: name})
+			} else if value.DataType != fieldType && value.DataType != intpr.Invalid {
+				s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("wrong type for field %s: expected %s, got %s", name.Value, fieldType.View(), value.DataType.View()), Type: errors.TypeError, Token: name})
+			}
+			node.Args[index] = value
+		}
+		next := s.tokens[s.current+1]
+		if next.Type == sTokens.COMMA {
+			s.current++
+		} else if next.Type != sTokens.RIGHT_BRACE {
+			return nil, &errors.Error{Message: fmt.Sprintf("expected ',' or '}', got %s", next.View()), Type: errors.SyntaxError, Token: next}
+		}
+	}
+	s.current++
+	return node, nil
+}
+
+// parseMapLiteral parses map[K]V{key: value, ...} with s.current at the map
+// keyword, leaving it at the closing brace.
+func (s *ParseSource) parseMapLiteral() (*intpr.Expression, *errors.Error) {
+	dataType, err := s.parseType("map type")
+	if err != nil {
+		return nil, err
+	}
+	brace := s.tokens[s.current+1]
+	if brace.Type != sTokens.LEFT_BRACE {
+		return nil, &errors.Error{Message: fmt.Sprintf("expected map entries, got %s", brace.View()), Type: errors.SyntaxError, Token: brace}
+	}
+	s.current++
+	info := dataType.Type()
+	node := &intpr.Expression{Token: brace, DataType: dataType, Args: []*intpr.Expression{}}
+	for s.tokens[s.current+1].Type != sTokens.RIGHT_BRACE {
+		s.current++
+		key, err := s.parseExpression(sTokens.Precedences[sTokens.RIGHT_PAREN], sTokens.COLON)
+		if err != nil {
+			return nil, err
+		}
+		colon := s.tokens[s.current+1]
+		if colon.Type != sTokens.COLON {
+			return nil, &errors.Error{Message: fmt.Sprintf("expected ':', got %s", colon.View()), Type: errors.SyntaxError, Token: colon}
+		}
+		s.current += 2
+		value, err := s.parseExpression(sTokens.Precedences[sTokens.RIGHT_PAREN], sTokens.COMMA)
+		if err != nil {
+			return nil, err
+		}
+		if key.DataType != info.Key && key.DataType != intpr.Invalid {
+			s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("wrong key type in map literal: expected %s, got %s", info.Key.View(), key.DataType.View()), Type: errors.TypeError, Token: key.Token})
+		}
+		value = coerce(value, info.Value)
+		if value.DataType != info.Value && value.DataType != intpr.Invalid {
+			s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("wrong value type in map literal: expected %s, got %s", info.Value.View(), value.DataType.View()), Type: errors.TypeError, Token: value.Token})
+		}
+		node.Args = append(node.Args, key, value)
+		next := s.tokens[s.current+1]
+		if next.Type == sTokens.COMMA {
+			s.current++
+		} else if next.Type != sTokens.RIGHT_BRACE {
+			return nil, &errors.Error{Message: fmt.Sprintf("expected ',' or '}', got %s", next.View()), Type: errors.SyntaxError, Token: next}
+		}
+	}
+	s.current++
+	return node, nil
+}
+
+// parseChanLiteral parses chan[type](capacity) with s.current at the chan
+// keyword, leaving it at the closing parenthesis. The capacity may be left
+// out for an unbuffered channel.
+func (s *ParseSource) parseChanLiteral() (*intpr.Expression, *errors.Error) {
 	token := s.tokens[s.current]
-	switch token.Type {
-	case sTokens.BANG:
-		scope := s.scope
-		if s.currentFunction != nil {
-			scope = -1
-		}
-		node := &intpr.Expression{Token: token, DataType: intpr.Bool, Scope: scope}
+	dataType, err := s.parseType("channel type")
+	if err != nil {
+		return nil, err
+	}
+	paren := s.tokens[s.current+1]
+	if paren.Type != sTokens.LEFT_PAREN {
+		return nil, &errors.Error{Message: fmt.Sprintf("expected (, got %s", paren.View()), Type: errors.SyntaxError, Token: paren}
+	}
+	node := &intpr.Expression{Token: token, DataType: dataType}
+	s.current++
+	if s.tokens[s.current+1].Type == sTokens.RIGHT_PAREN {
 		s.current++
-		expression, err := s.parsePrefix()
+		return node, nil
+	}
+	capacity, err := s.parseParens()
+	if err != nil {
+		return nil, err
+	}
+	if capacity.DataType != intpr.Int && capacity.DataType != intpr.Invalid {
+		s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("channel capacity must be int, got %s", capacity.DataType.View()), Type: errors.TypeError, Token: capacity.Token})
+	}
+	node.Left = capacity
+	return node, nil
+}
+
+// parseArrayLiteral parses []type{element, ...} with s.current at the
+// opening bracket, leaving it at the closing brace.
+func (s *ParseSource) parseArrayLiteral() (*intpr.Expression, *errors.Error) {
+	dataType, err := s.parseType("array type")
+	if err != nil {
+		return nil, err
+	}
+	brace := s.tokens[s.current+1]
+	if brace.Type != sTokens.LEFT_BRACE {
+		return nil, &errors.Error{Message: fmt.Sprintf("expected array elements, got %s", brace.View()), Type: errors.SyntaxError, Token: brace}
+	}
+	s.current++
+	element := dataType.Type().Value
+	node := &intpr.Expression{Token: brace, DataType: dataType, Args: []*intpr.Expression{}}
+	for s.tokens[s.current+1].Type != sTokens.RIGHT_BRACE {
+		s.current++
+		value, err := s.parseExpression(sTokens.Precedences[sTokens.RIGHT_PAREN], sTokens.COMMA)
 		if err != nil {
 			return nil, err
 		}
-		node.Left = expression
-		return node, nil
-	case sTokens.NUMBER:
-		return &intpr.Expression{Token: token, DataType: intpr.Int, Scope: s.scope}, nil
-	case sTokens.TRUE, sTokens.FALSE:
-		return &intpr.Expression{Token: token, DataType: intpr.Bool, Scope: s.scope}, nil
-	case sTokens.IDENTIFIER:
-		if s.tokens[s.current+1].Type == sTokens.LEFT_PAREN {
-			fnCall, err := s.parseFunctionCall()
+		value = coerce(value, element)
+		if value.DataType != element && value.DataType != intpr.Invalid {
+			s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("wrong element type in array literal: expected %s, got %s", element.View(), value.DataType.View()), Type: errors.TypeError, Token: value.Token})
+		}
+		node.Args = append(node.Args, value)
+		next := s.tokens[s.current+1]
+		if next.Type == sTokens.COMMA {
+			s.current++
+		} else if next.Type != sTokens.RIGHT_BRACE {
+			return nil, &errors.Error{Message: fmt.Sprintf("expected ',' or '}', got %s", next.View()), Type: errors.SyntaxError, Token: next}
+		}
+	}
+	s.current++
+	return node, nil
+}
+
+// parsePostfix parses the field reads and map indexing following an operand.
+func (s *ParseSource) parsePostfix(node *intpr.Expression) (*intpr.Expression, *errors.Error) {
+	for {
+		next := s.tokens[s.current+1]
+		switch next.Type {
+		case sTokens.DOT:
+			name := s.tokens[s.current+2]
+			if name.Type != sTokens.IDENTIFIER {
+				return nil, &errors.Error{Message: fmt.Sprintf("expected field name, got %s", name.View()), Type: errors.SyntaxError, Token: name}
+			}
+			s.current += 2
+			index, dataType := s.field(node.DataType, name)
+			node = &intpr.Expression{Token: next, DataType: dataType, Left: node, Slot: index}
+		case sTokens.LEFT_BRACKET:
+			key, dataType, err := s.parseIndex(node.DataType)
 			if err != nil {
 				return nil, err
 			}
-			fnCache := s.cache.GetFuncCache(fnCall.Identifier.Value)
-			if fnCache == nil {
-				return &intpr.Expression{Token: token, DataType: intpr.Invalid, Args: fnCall.Args, Scope: s.scope}, nil
-			}
-			if fnCache.DataType == intpr.Void {
-				s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("function %s does not return a value", token.Value), Type: errors.TypeError, Token: token})
-			}
-			return &intpr.Expression{Token: token, DataType: fnCache.DataType, Args: fnCall.Args, Scope: s.scope}, nil
-		}
-		var dataType intpr.DataType
-		var defined bool
-		scope := s.scope
-		if s.currentFunction != nil {
-			for _, a := range s.currentFunction.Params {
-				if a.NameToken.Value == token.Value {
-					defined = true
-					dataType = a.DataType
-					scope = -1
-					break
-				}
-			}
-			if !defined {
-				dataType, _, defined = s.currentFunction.LocalScope.GetVarType(token.Value)
-			}
-		}
-		if !defined {
-			dataType, scope, defined = s.cache.GetVarType(token.Value)
-		} else {
-			scope = -1
+			node = &intpr.Expression{Token: next, DataType: dataType, Left: node, Right: key}
+		default:
+			return node, nil
 		}
-		if !defined {
-			s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("variable %s undefined", token.Value), Type: errors.ReferenceError, Token: token})
+	}
+}
+
+// parseIndex parses [key] following a value of type dataType, with s.current
+// at the token before the bracket, leaving it at the closing bracket. It
+// returns the key and the type of the element.
+func (s *ParseSource) parseIndex(dataType intpr.DataType) (*intpr.Expression, intpr.DataType, *errors.Error) {
+	bracket := s.tokens[s.current+1]
+	s.current += 2
+	key, err := s.parseExpression(0, sTokens.RIGHT_BRACKET)
+	if err != nil {
+		return nil, intpr.Invalid, err
+	}
+	closing := s.tokens[s.current+1]
+	if closing.Type != sTokens.RIGHT_BRACKET {
+		return nil, intpr.Invalid, &errors.Error{Message: fmt.Sprintf("expected ], got %s", closing.View()), Type: errors.SyntaxError, Token: closing}
+	}
+	s.current++
+	if dataType == intpr.Invalid {
+		return key, intpr.Invalid, nil
+	}
+	if dataType.IsArray() {
+		if key.DataType != intpr.Int && key.DataType != intpr.Invalid {
+			s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("wrong index type for %s: expected int, got %s", dataType.View(), key.DataType.View()), Type: errors.TypeError, Token: bracket})
 		}
-		return &intpr.Expression{Token: token, DataType: dataType, Scope: scope}, nil
-	case sTokens.LEFT_PAREN:
-		return s.parseParens()
-	default:
-		return nil, &errors.Error{Message: fmt.Sprintf("unexpected %s", token.View()), Token: token, Type: errors.SyntaxError}
+		return key, dataType.Type().Value, nil
+	}
+	if !dataType.IsMap() {
+		s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("cannot index %s", dataType.View()), Type: errors.TypeError, Token: bracket})
+		return key, intpr.Invalid, nil
 	}
+	info := dataType.Type()
+	if key.DataType != info.Key && key.DataType != intpr.Invalid {
+		s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("wrong key type for %s: expected %s, got %s", dataType.View(), info.Key.View(), key.DataType.View()), Type: errors.TypeError, Token: bracket})
+	}
+	return key, info.Value, nil
 }
 
 func (s *ParseSource) parseParens() (*intpr.Expression, *errors.Error) {
@@ -674,17 +2230,250 @@ func (s *ParseSource) parseParens() (*intpr.Expression, *errors.Error) {
 	return node, nil
 }
 
+// declareFunctions declares the functions defined directly in the block that
+// starts at the current token, so that they can call each other whatever
+// their order. It returns the defs whose signatures could not be parsed yet,
+// as they may name a struct or a constant declared further down.
+func (s *ParseSource) declareFunctions() []int {
+	defs := []int{}
+	depth := 0
+	for i := s.current; i < len(s.tokens)-1 && depth >= 0; i++ {
+		switch s.tokens[i].Type {
+		case sTokens.LEFT_BRACE:
+			depth++
+		case sTokens.RIGHT_BRACE:
+			depth--
+		case sTokens.DEF:
+			if depth == 0 {
+				defs = append(defs, i)
+			}
+		}
+	}
+	return s.declare(defs)
+}
+
+// declare declares the functions defined at defs that are not parsed yet and
+// returns the ones whose signatures fail to parse. Their errors are reported
+// when the parser reaches them.
+func (s *ParseSource) declare(defs []int) []int {
+	pending := []int{}
+	current, errs := s.current, len(s.Errors)
+	for _, i := range defs {
+		if i < current {
+			continue
+		}
+		s.current = i
+		stmt, err := s.parseSignature(nil)
+		if err != nil || len(s.Errors) > errs {
+			s.Errors = s.Errors[:errs]
+			pending = append(pending, i)
+			continue
+		}
+		if _, defined := s.cache.vars[s.cache.size-1][stmt.NameToken.Value]; defined {
+			continue
+		}
+		fnCache := FuncCache{NameToken: stmt.NameToken, DataType: stmt.DataType, Params: stmt.Params, TypeParams: stmt.TypeParams}
+		// top-level functions are defined before the first statement runs
+		if s.scope > 0 {
+			fnCache.Ahead, fnCache.Caller = true, s.currentFunction
+		}
+		if stmt.TypeParams != nil {
+			fnCache.Generic = s.cache.newGeneric(stmt.NameToken.Value)
+		}
+		s.declared[i] = s.cache.SetVarType(stmt.NameToken.Value, intpr.Func).Slot
+		s.cache.SetFuncCache(stmt.NameToken.Value, fnCache)
+	}
+	s.current = current
+	return pending
+}
+
+// parseSignature parses the name, type params, params and return type of the
+// function defined at the current def, leaving the current token after them.
+// typeArgs are the types the type params stand for in an instance.
+func (s *ParseSource) parseSignature(typeArgs []intpr.DataType) (intpr.Def, *errors.Error) {
+	stmt := intpr.Def{}
+	name := s.tokens[s.current+1]
+	if name.Type != sTokens.IDENTIFIER {
+		return stmt, &errors.Error{Message: fmt.Sprintf("expected function name, got %s", name.View()), Type: errors.SyntaxError, Token: name}
+	}
+	stmt.NameToken = name
+	s.current += 2
+	if s.tokens[s.current].Type == sTokens.LEFT_BRACKET {
+		typeParams, err := s.parseTypeParams()
+		if err != nil {
+			return stmt, err
+		}
+		stmt.TypeParams = typeParams
+		// the body binds the type params again in its own level
+		s.cache.Extend()
+		defer s.cache.Shrink()
+		s.bindTypeParams(typeParams, typeArgs)
+	}
+	openParen := s.tokens[s.current]
+	if openParen.Type != sTokens.LEFT_PAREN {
+		return stmt, &errors.Error{Message: fmt.Sprintf("expected function parameters, got %s", openParen.View()), Type: errors.SyntaxError, Token: openParen}
+	}
+	s.current++
+	stmt.Params = []intpr.DefParam{}
+	if s.tokens[s.current].Type != sTokens.RIGHT_PAREN {
+	ParamsLoop:
+		for {
+			param := intpr.DefParam{}
+			dataType, err := s.parseType("parameter type")
+			if err != nil {
+				return stmt, err
+			}
+			param.DataType = dataType
+			s.current++
+			if s.tokens[s.current].Type == sTokens.ELLIPSIS {
+				param.Variadic = true
+				param.DataType = s.types.ArrayOf(dataType)
+				s.current++
+			}
+			paramName := s.tokens[s.current]
+			if paramName.Type != sTokens.IDENTIFIER {
+				return stmt, &errors.Error{Message: fmt.Sprintf("expected function name, got %s", paramName.View()), Type: errors.SyntaxError, Token: paramName}
+			}
+			param.NameToken = paramName
+			if slices.ContainsFunc(stmt.Params, func(p intpr.DefParam) bool { return p.NameToken.Value == paramName.Value }) {
+				return stmt, &errors.Error{Message: fmt.Sprintf("parameter %s is declared twice", paramName.Value), Type: errors.ReferenceError, Token: paramName}
+			}
+			s.current++
+			if s.tokens[s.current].Type == sTokens.EQUAL {
+				s.current++
+				exp, err := s.parseExpression(sTokens.Precedences[sTokens.RIGHT_PAREN], sTokens.COMMA)
+				if err != nil {
+					return stmt, err
+				}
+				exp = coerce(exp, dataType)
+				switch {
+				case param.Variadic:
+					s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("variadic parameter %s cannot have a default value", paramName.Value), Type: errors.SyntaxError, Token: exp.Token})
+				case exp.DataType != dataType && exp.DataType != intpr.Invalid:
+					s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("wrong type for default value of %s: expected %s, got %s", paramName.Value, dataType.View(), exp.DataType.View()), Type: errors.TypeError, Token: exp.Token})
+				case !isConstant(exp):
+					s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("default value of %s is not a constant expression", paramName.Value), Type: errors.TypeError, Token: exp.Token})
+				}
+				if !param.Variadic {
+					param.Default = exp
+				}
+				s.current++
+			} else if !param.Variadic && len(stmt.Params) > 0 && stmt.Params[len(stmt.Params)-1].Default != nil {
+				s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("parameter %s needs a default value, as it follows one with a default", paramName.Value), Type: errors.SyntaxError, Token: paramName})
+			}
+			delimitter := s.tokens[s.current]
+			stmt.Params = append(stmt.Params, param)
+			switch delimitter.Type {
+			case sTokens.COMMA:
+				if param.Variadic {
+					s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("variadic parameter %s must be the last one", paramName.Value), Type: errors.SyntaxError, Token: paramName})
+				}
+				s.current++
+			case sTokens.RIGHT_PAREN:
+				break ParamsLoop
+			default:
+				return stmt, &errors.Error{Message: fmt.Sprintf("expected ',' or ')', got %s", delimitter.View()), Type: errors.SyntaxError, Token: delimitter}
+			}
+		}
+
+	}
+	s.current++
+	nextToken := s.tokens[s.current]
+	switch nextToken.Type {
+	case sTokens.INT_TYPE, sTokens.BOOL_TYPE, sTokens.IDENTIFIER, sTokens.STRING_TYPE, sTokens.MAP, sTokens.LEFT_BRACKET:
+		dataType, err := s.parseType("return type")
+		if err != nil {
+			return stmt, err
+		}
+		stmt.DataType = dataType
+		s.current++
+	case sTokens.LEFT_PAREN:
+		dataType, err := s.parseResultTypes()
+		if err != nil {
+			return stmt, err
+		}
+		stmt.DataType = dataType
+		s.current++
+	case sTokens.LEFT_BRACE:
+		stmt.DataType = intpr.Void
+	default:
+		return stmt, &errors.Error{Message: fmt.Sprintf("expected return type, got %s", nextToken.View()), Type: errors.SyntaxError, Token: nextToken}
+	}
+	return stmt, nil
+}
+
+// parseTypeParams parses the type params of a generic function, as in
+// [K comparable, V any], leaving the current token after the ].
+func (s *ParseSource) parseTypeParams() ([]intpr.DataType, *errors.Error) {
+	typeParams := []intpr.DataType{}
+	names := map[string]bool{}
+	for {
+		s.current++
+		name := s.tokens[s.current]
+		if name.Type != sTokens.IDENTIFIER {
+			return nil, &errors.Error{Message: fmt.Sprintf("expected type parameter name, got %s", name.View()), Type: errors.SyntaxError, Token: name}
+		}
+		constraint := s.tokens[s.current+1]
+		if constraint.Type != sTokens.IDENTIFIER || constraint.Value != "any" && constraint.Value != "comparable" {
+			return nil, &errors.Error{Message: fmt.Sprintf("expected constraint any or comparable, got %s", constraint.View()), Type: errors.SyntaxError, Token: constraint}
+		}
+		if names[name.Value] {
+			s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("type parameter %s is declared twice", name.Value), Type: errors.ReferenceError, Token: name})
+		}
+		names[name.Value] = true
+		typeParams = append(typeParams, s.types.TypeParam(name.Value, constraint.Value == "comparable"))
+		s.current += 2
+		switch delimiter := s.tokens[s.current]; delimiter.Type {
+		case sTokens.COMMA:
+		case sTokens.RIGHT_BRACKET:
+			s.current++
+			return typeParams, nil
+		default:
+			return nil, &errors.Error{Message: fmt.Sprintf("expected ',' or ']', got %s", delimiter.View()), Type: errors.SyntaxError, Token: delimiter}
+		}
+	}
+}
+
+// bindTypeParams declares the type params in the current level, standing for
+// typeArgs in an instance and for themselves otherwise.
+func (s *ParseSource) bindTypeParams(typeParams, typeArgs []intpr.DataType) {
+	for i, p := range typeParams {
+		dataType := p
+		if typeArgs != nil {
+			dataType = typeArgs[i]
+		}
+		s.cache.SetType(p.Type().Name, dataType)
+	}
+}
+
 func (s *ParseSource) parseFunctionCall() (*FunctionCall, *errors.Error) {
 	identifier := s.tokens[s.current]
 	s.current += 2
 	args := []*intpr.Expression{}
+	// names holds the name of each named argument, the ellipsis of a spread
+	// one, and an empty token for the other positional ones
+	names := []sTokens.Token{}
+	named := false
 	if s.tokens[s.current].Type != sTokens.RIGHT_PAREN {
 		for {
+			name := sTokens.Token{}
+			if s.tokens[s.current].Type == sTokens.IDENTIFIER && s.tokens[s.current+1].Type == sTokens.COLON {
+				name = s.tokens[s.current]
+				named = true
+				s.current += 2
+			} else if named {
+				s.Errors = append(s.Errors, &errors.Error{Message: "positional argument after named argument", Type: errors.SyntaxError, Token: s.tokens[s.current]})
+			}
+			if name.Type != sTokens.IDENTIFIER && s.tokens[s.current].Type == sTokens.ELLIPSIS {
+				name = s.tokens[s.current]
+				s.current++
+			}
 			exp, err := s.parseExpression(sTokens.Precedences[sTokens.RIGHT_PAREN], sTokens.COMMA)
 			if err != nil {
 				return nil, err
 			}
 			args = append(args, exp)
+			names = append(names, name)
 			if s.tokens[s.current+1].Type == sTokens.COMMA {
 				s.current += 2
 				continue
@@ -694,26 +2483,434 @@ func (s *ParseSource) parseFunctionCall() (*FunctionCall, *errors.Error) {
 			}
 		}
 	}
-	dataType, _, defined := s.cache.GetVarType(identifier.Value)
+	v, depth, defined := s.cache.Resolve(identifier.Value)
+	dataType := v.DataType
+	if builtin, found := builtins[identifier.Value]; found && !defined {
+		for _, name := range names {
+			if name.Type == sTokens.IDENTIFIER {
+				s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("function %s does not take named arguments", identifier.Value), Type: errors.ReferenceError, Token: identifier})
+				break
+			}
+			if name.Type == sTokens.ELLIPSIS {
+				s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("function %s has no variadic parameter", identifier.Value), Type: errors.ReferenceError, Token: name})
+				break
+			}
+		}
+		return &FunctionCall{Identifier: identifier, Args: args, Builtin: builtin, DataType: s.checkBuiltin(identifier, builtin, args)}, nil
+	}
+	call := &FunctionCall{Identifier: identifier, Args: args, Depth: depth, Slot: v.Slot, DataType: intpr.Invalid}
 	if !defined {
 		s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("function %s not defined", identifier.Value), Type: errors.ReferenceError, Token: identifier})
-	} else if dataType != intpr.Func {
+		return call, nil
+	}
+	if dataType != intpr.Func {
 		s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("%s is not a function", identifier.Value), Type: errors.ReferenceError, Token: identifier})
-	} else {
-		fnCache := s.cache.GetFuncCache(identifier.Value)
-		if fnCache == nil {
-			s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("function %s is not defined, this shoudn't have happened", identifier.Value), Type: errors.ReferenceError, Token: identifier})
-		} else if len(fnCache.Params) != len(args) {
-			s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("wrong number of arguments for function %s", identifier.Value), Type: errors.ReferenceError, Token: identifier})
-		} else {
-			for i := 0; i < len(args); i++ {
-				param := fnCache.Params[i]
-				if param.DataType != args[i].DataType {
-					s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("wrong type for parameter %s for function %s: expected %s, got %s", identifier.Value, identifier.Value, param.DataType.View(), args[i].DataType.View()), Type: errors.ReferenceError, Token: identifier})
+		return call, nil
+	}
+	fnCache := s.cache.GetFuncCache(identifier.Value)
+	if fnCache == nil {
+		s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("function %s is not defined, this shoudn't have happened", identifier.Value), Type: errors.ReferenceError, Token: identifier})
+		return call, nil
+	}
+	if fnCache.Ahead && fnCache.Caller == s.currentFunction {
+		s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("function %s called before its definition", identifier.Value), Type: errors.ReferenceError, Token: identifier})
+	}
+	call.Native = fnCache.Native
+	params, result := fnCache.Params, fnCache.DataType
+	var typeArgs []intpr.DataType
+	if fnCache.TypeParams != nil {
+		typeArgs = s.infer(identifier, fnCache, args, names)
+		if typeArgs == nil {
+			return call, nil
+		}
+		params = make([]intpr.DefParam, len(fnCache.Params))
+		for i, p := range fnCache.Params {
+			p.DataType = s.substitute(p.DataType, fnCache.TypeParams, typeArgs)
+			params[i] = p
+		}
+		result = s.substitute(result, fnCache.TypeParams, typeArgs)
+	}
+	call.DataType = result
+	if arranged, ok := s.arrange(identifier, params, args, names); ok {
+		call.Args = arranged
+		for i, arg := range arranged {
+			param := params[i]
+			arg = coerce(arg, param.DataType)
+			arranged[i] = arg
+			if param.DataType != arg.DataType {
+				s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("wrong type for parameter %s for function %s: expected %s, got %s", param.NameToken.Value, identifier.Value, param.DataType.View(), arg.DataType.View()), Type: errors.ReferenceError, Token: identifier})
+			}
+		}
+	}
+	// calls in the body of a generic function may leave the type params
+	// open, that body only gets checked
+	if typeArgs != nil && !slices.ContainsFunc(typeArgs, abstract) {
+		instance := s.instantiate(fnCache.Generic, identifier, typeArgs)
+		call.Identifier.Value = instance.NameToken.Value
+		call.Slot = instance.Slot
+	}
+	return call, nil
+}
+
+// infer returns the type arguments of a call of a generic function, found by
+// matching the types of the params with the types of the arguments passed to
+// them. A type param keeps the type of the first argument that binds it, a
+// later argument of another type fails the checks of the call.
+func (s *ParseSource) infer(identifier sTokens.Token, fnCache *FuncCache, args []*intpr.Expression, names []sTokens.Token) []intpr.DataType {
+	bindings := map[intpr.DataType]intpr.DataType{}
+	for _, p := range fnCache.TypeParams {
+		bindings[p] = intpr.Invalid
+	}
+	params := fnCache.Params
+	variadic := -1
+	if len(params) > 0 && params[len(params)-1].Variadic {
+		variadic = len(params) - 1
+	}
+	invalid := false
+	for i, arg := range args {
+		param := intpr.Invalid
+		switch {
+		case names[i].Type == sTokens.IDENTIFIER:
+			for _, p := range params {
+				if p.NameToken.Value == names[i].Value {
+					param = p.DataType
+				}
+			}
+		case variadic >= 0 && i >= variadic:
+			param = params[variadic].DataType
+			if names[i].Type != sTokens.ELLIPSIS {
+				param = param.Type().Value
+			}
+		case i < len(params):
+			param = params[i].DataType
+		}
+		invalid = invalid || arg.DataType == intpr.Invalid
+		bind(param, arg.DataType, bindings)
+	}
+	typeArgs := []intpr.DataType{}
+	for _, p := range fnCache.TypeParams {
+		info, arg := p.Type(), bindings[p]
+		if arg == intpr.Invalid {
+			// an argument with errors of its own may be what left it open
+			if !invalid {
+				s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("cannot infer type parameter %s of function %s", info.Name, identifier.Value), Type: errors.TypeError, Token: identifier})
+			}
+			return nil
+		}
+		if info.Comparable && !isComparable(arg) {
+			s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("type %s does not satisfy comparable for type parameter %s of function %s", arg.View(), info.Name, identifier.Value), Type: errors.TypeError, Token: identifier})
+			return nil
+		}
+		typeArgs = append(typeArgs, arg)
+	}
+	return typeArgs
+}
+
+// bind matches the type of a param with the type of its argument, binding
+// the type params in bindings that are still open.
+func bind(param, arg intpr.DataType, bindings map[intpr.DataType]intpr.DataType) {
+	info := param.Type()
+	if info == nil || arg == intpr.Invalid {
+		return
+	}
+	switch info.Kind {
+	case intpr.ParamKind:
+		if bound, found := bindings[param]; found && bound == intpr.Invalid && arg != intpr.None {
+			bindings[param] = arg
+		}
+	case intpr.OptionalKind:
+		// a plain value passed to an optional param binds its value type
+		if arg.IsOptional() {
+			arg = arg.Type().Value
+		}
+		bind(info.Value, arg, bindings)
+	case intpr.ArrayKind:
+		if arg.IsArray() {
+			bind(info.Value, arg.Type().Value, bindings)
+		}
+	case intpr.ChanKind:
+		if arg.IsChan() {
+			bind(info.Value, arg.Type().Value, bindings)
+		}
+	case intpr.MapKind:
+		if arg.IsMap() {
+			bind(info.Key, arg.Type().Key, bindings)
+			bind(info.Value, arg.Type().Value, bindings)
+		}
+	}
+}
+
+// substitute replaces the type params in t with their type arguments.
+func (s *ParseSource) substitute(t intpr.DataType, typeParams, typeArgs []intpr.DataType) intpr.DataType {
+	info := t.Type()
+	if info == nil {
+		return t
+	}
+	switch info.Kind {
+	case intpr.ParamKind:
+		if i := slices.Index(typeParams, t); i >= 0 {
+			return typeArgs[i]
+		}
+	case intpr.ArrayKind:
+		return s.types.ArrayOf(s.substitute(info.Value, typeParams, typeArgs))
+	case intpr.OptionalKind:
+		return s.types.OptionalOf(s.substitute(info.Value, typeParams, typeArgs))
+	case intpr.ChanKind:
+		return s.types.ChanOf(s.substitute(info.Value, typeParams, typeArgs))
+	case intpr.MapKind:
+		return s.types.MapOf(s.substitute(info.Key, typeParams, typeArgs), s.substitute(info.Value, typeParams, typeArgs))
+	case intpr.TupleKind:
+		elements := []intpr.DataType{}
+		for _, e := range info.Elements {
+			elements = append(elements, s.substitute(e, typeParams, typeArgs))
+		}
+		return s.types.TupleOf(elements)
+	}
+	return t
+}
+
+// abstract reports whether t is a type param or made of one.
+func abstract(t intpr.DataType) bool {
+	info := t.Type()
+	if info == nil {
+		return false
+	}
+	switch info.Kind {
+	case intpr.ParamKind:
+		return true
+	case intpr.ArrayKind, intpr.OptionalKind, intpr.ChanKind:
+		return abstract(info.Value)
+	case intpr.MapKind:
+		return abstract(info.Key) || abstract(info.Value)
+	}
+	return false
+}
+
+// isComparable reports whether values of t can be compared with ==.
+func isComparable(t intpr.DataType) bool {
+	if t.IsParam() {
+		return t.Type().Comparable
+	}
+	if t.IsOptional() {
+		return isComparable(t.Type().Value)
+	}
+	return t == intpr.Int || t == intpr.Bool || t == intpr.String || t.IsStruct() || t.IsEnum()
+}
+
+// coerce returns exp as a value of type want where want is an optional: a
+// value of the type it holds gets wrapped, and none gets the optional type.
+// Anything else is returned as it is, for the caller to check.
+func coerce(exp *intpr.Expression, want intpr.DataType) *intpr.Expression {
+	if !want.IsOptional() {
+		return exp
+	}
+	if exp.DataType == intpr.None {
+		none := *exp
+		none.DataType = want
+		return &none
+	}
+	if exp.DataType != want.Type().Value {
+		return exp
+	}
+	token := exp.Token
+	token.Type = sTokens.SOME
+	token.Value = ""
+	return &intpr.Expression{Token: token, DataType: want, Left: exp}
+}
+
+// coerceResults coerces the values returned by a function, which has a tuple
+// type when it returns several of them.
+func (s *ParseSource) coerceResults(exp *intpr.Expression, want intpr.DataType) *intpr.Expression {
+	if exp.Token.Type != sTokens.COMMA || !want.IsTuple() || len(exp.Args) != len(want.Type().Elements) {
+		return coerce(exp, want)
+	}
+	results := *exp
+	results.Args = make([]*intpr.Expression, len(exp.Args))
+	elements := []intpr.DataType{}
+	for i, a := range exp.Args {
+		results.Args[i] = coerce(a, want.Type().Elements[i])
+		elements = append(elements, results.Args[i].DataType)
+	}
+	results.DataType = s.types.TupleOf(elements)
+	return &results
+}
+
+// arrange orders the arguments of a call like the params of the function:
+// named arguments go to the params of their names, the remaining positional
+// arguments make the array of a variadic param, and the params left out get
+// their default values. Arguments are evaluated in the order of the params.
+func (s *ParseSource) arrange(identifier sTokens.Token, params []intpr.DefParam, args []*intpr.Expression, names []sTokens.Token) ([]*intpr.Expression, bool) {
+	arranged := make([]*intpr.Expression, len(params))
+	ok := true
+	variadic := -1
+	if len(params) > 0 && params[len(params)-1].Variadic {
+		variadic = len(params) - 1
+	}
+	var rest []*intpr.Expression
+	for i, arg := range args {
+		index := i
+		token := identifier
+		if names[i].Type == sTokens.IDENTIFIER {
+			token = names[i]
+			index = -1
+			for j, p := range params {
+				if p.NameToken.Value == token.Value {
+					index = j
 				}
 			}
+			if index < 0 {
+				s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("function %s has no parameter %s", identifier.Value, token.Value), Type: errors.ReferenceError, Token: token})
+				ok = false
+				continue
+			}
+			if index == variadic {
+				s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("variadic parameter %s cannot be passed by name", token.Value), Type: errors.ReferenceError, Token: token})
+				ok = false
+				continue
+			}
+		} else if variadic >= 0 && i >= variadic {
+			rest = append(rest, arg)
+			continue
+		} else if names[i].Type == sTokens.ELLIPSIS && variadic >= 0 {
+			s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("spread argument for parameter %s of function %s: only the variadic parameter %s takes a spread", params[i].NameToken.Value, identifier.Value, params[variadic].NameToken.Value), Type: errors.ReferenceError, Token: names[i]})
+			ok = false
+			continue
+		} else if names[i].Type == sTokens.ELLIPSIS {
+			s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("function %s has no variadic parameter", identifier.Value), Type: errors.ReferenceError, Token: names[i]})
+			ok = false
+			continue
+		} else if i >= len(params) {
+			s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("wrong number of arguments for function %s", identifier.Value), Type: errors.ReferenceError, Token: identifier})
+			return nil, false
+		}
+		if arranged[index] != nil {
+			s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("parameter %s of function %s is passed more than once", params[index].NameToken.Value, identifier.Value), Type: errors.ReferenceError, Token: token})
+			ok = false
+			continue
+		}
+		arranged[index] = arg
+	}
+	if variadic >= 0 {
+		// named arguments follow the positional ones, so the rest are in a row
+		var spread []sTokens.Token
+		if len(rest) > 0 {
+			spread = names[variadic : variadic+len(rest)]
+		}
+		arranged[variadic] = s.variadic(identifier, params[variadic], rest, spread)
+	}
+	for i, p := range params {
+		if arranged[i] != nil {
+			continue
+		}
+		if p.Default == nil {
+			if ok {
+				s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("missing argument %s for function %s", p.NameToken.Value, identifier.Value), Type: errors.ReferenceError, Token: identifier})
+			}
+			ok = false
+			continue
+		}
+		arranged[i] = inline(p.Default)
+	}
+	return arranged, ok
+}
+
+// variadic returns the array passed to a variadic param: a spread argument
+// as it is, or an array literal of the other arguments.
+func (s *ParseSource) variadic(identifier sTokens.Token, param intpr.DefParam, rest []*intpr.Expression, names []sTokens.Token) *intpr.Expression {
+	for i, name := range names {
+		if name.Type != sTokens.ELLIPSIS {
+			continue
+		}
+		if i > 0 || len(rest) > 1 {
+			s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("a spread argument must be the only one passed to variadic parameter %s", param.NameToken.Value), Type: errors.ReferenceError, Token: name})
+		}
+		return rest[i]
+	}
+	element := param.DataType.Type().Value
+	for i, arg := range rest {
+		arg = coerce(arg, element)
+		rest[i] = arg
+		if arg.DataType != element && arg.DataType != intpr.Invalid {
+			s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("wrong type for parameter %s for function %s: expected %s, got %s", param.NameToken.Value, identifier.Value, element.View(), arg.DataType.View()), Type: errors.ReferenceError, Token: arg.Token})
+		}
+	}
+	brace := identifier
+	brace.Type = sTokens.LEFT_BRACE
+	brace.Value = ""
+	return &intpr.Expression{Token: brace, DataType: param.DataType, Args: rest}
+}
+
+// checkBuiltin checks the arguments of a call of a generic built-in and
+// returns the type of its result.
+func (s *ParseSource) checkBuiltin(identifier sTokens.Token, builtin intpr.Builtin, args []*intpr.Expression) intpr.DataType {
+	result := intpr.Void
+	count := 2
+	switch builtin {
+	case intpr.LenBuiltin:
+		result = intpr.Int
+		count = 1
+	case intpr.HasBuiltin:
+		result = intpr.Bool
+	case intpr.SendBuiltin, intpr.RecvBuiltin, intpr.CloseBuiltin:
+		return s.checkChannelBuiltin(identifier, builtin, args)
+	}
+	if len(args) != count {
+		s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("wrong number of arguments for function %s", identifier.Value), Type: errors.ReferenceError, Token: identifier})
+		return result
+	}
+	dataType := args[0].DataType
+	if dataType == intpr.Invalid {
+		return result
+	}
+	if builtin == intpr.LenBuiltin && !dataType.IsMap() {
+		if !dataType.IsArray() {
+			s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("len expects a map or an array, got %s", dataType.View()), Type: errors.TypeError, Token: identifier})
 		}
+		return result
+	}
+	if !dataType.IsMap() {
+		s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("%s expects a map, got %s", identifier.Value, dataType.View()), Type: errors.TypeError, Token: identifier})
+		return result
+	}
+	key := dataType.Type().Key
+	if count == 2 && args[1].DataType != key && args[1].DataType != intpr.Invalid {
+		s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("wrong key type for %s: expected %s, got %s", identifier.Value, key.View(), args[1].DataType.View()), Type: errors.TypeError, Token: identifier})
 	}
+	return result
+}
 
-	return &FunctionCall{Identifier: identifier, Args: args}, nil
+// checkChannelBuiltin checks a call of send, recv or close. recv returns an
+// optional, which is none once the channel is closed and empty.
+func (s *ParseSource) checkChannelBuiltin(identifier sTokens.Token, builtin intpr.Builtin, args []*intpr.Expression) intpr.DataType {
+	result := intpr.Void
+	if builtin == intpr.RecvBuiltin {
+		result = intpr.Invalid
+	}
+	count := 1
+	if builtin == intpr.SendBuiltin {
+		count = 2
+	}
+	if len(args) != count {
+		s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("wrong number of arguments for function %s", identifier.Value), Type: errors.ReferenceError, Token: identifier})
+		return result
+	}
+	dataType := args[0].DataType
+	if dataType == intpr.Invalid {
+		return result
+	}
+	if !dataType.IsChan() {
+		s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("%s expects a channel, got %s", identifier.Value, dataType.View()), Type: errors.TypeError, Token: identifier})
+		return result
+	}
+	element := dataType.Type().Value
+	switch builtin {
+	case intpr.RecvBuiltin:
+		return s.types.OptionalOf(element)
+	case intpr.SendBuiltin:
+		args[1] = coerce(args[1], element)
+		if args[1].DataType != element && args[1].DataType != intpr.Invalid {
+			s.Errors = append(s.Errors, &errors.Error{Message: fmt.Sprintf("wrong value type for send: expected %s, got %s", element.View(), args[1].DataType.View()), Type: errors.TypeError, Token: identifier})
+		}
+	}
+	return result
 }
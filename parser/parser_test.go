@@ -0,0 +1,297 @@
+package parser
+
+import (
+	"fmt"
+	"simpl/lexer"
+	"slices"
+	"sync"
+	"testing"
+)
+
+const typesSource = `
+struct Point { int x; int y; }
+enum Color { Red, Green }
+def pair[T any](T a, T b) []T {
+    return []T{a, b};
+}
+points := map[int]Point{1: Point{x: 1, y: 2}};
+colors := []Color{Color.Red, Color.Green};
+maybe := pair(1, 2)[0] == 1;
+int? found = none;
+`
+
+// TestParseConcurrently parses programs at the same time, which only works
+// when every parse keeps the types it makes to itself.
+func TestParseConcurrently(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tokens, errs := lexer.Tokenize(typesSource, "types.simpl", 1)
+			if len(errs) > 0 {
+				t.Errorf("tokenize: %s", errs[0].Message)
+				return
+			}
+			source := New(tokens)
+			program, err := source.Parse(false)
+			if err != nil {
+				t.Errorf("parse: %s", err.Message)
+				return
+			}
+			if len(source.Errors) > 0 {
+				t.Errorf("parse: %s", source.Errors[0].Message)
+			}
+			if program.Types == nil {
+				t.Errorf("program has no types")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// TestDuplicateCases checks that match cases are compared by the values of
+// their constant expressions.
+func TestDuplicateCases(t *testing.T) {
+	const source = `const int TWO = 2;
+x := 2;
+match x {
+    1 + 1 => {}
+    2 => {}
+    TWO, -(-3) => {}
+    3 => {}
+    x + 1 => {}
+}
+b := true;
+match b {
+    !false => {}
+    false => {}
+}
+`
+	want := []string{"5:5: duplicate case 2", "6:5: duplicate case 2", "7:5: duplicate case 3"}
+	if got := parseErrors(t, source); !slices.Equal(got, want) {
+		t.Errorf("got errors %q, want %q", got, want)
+	}
+}
+
+// parseErrors returns the errors of parsing source as line:column: message.
+func parseErrors(t *testing.T, source string) []string {
+	t.Helper()
+	tokens, errs := lexer.Tokenize(source, "source.simpl", 1)
+	if len(errs) > 0 {
+		t.Fatalf("tokenize: %s", errs[0].Message)
+	}
+	parse := New(tokens)
+	got := []string{}
+	if _, err := parse.Parse(false); err != nil {
+		got = append(got, fmt.Sprintf("%d:%d: %s", err.Token.Line, err.Token.Char, err.Message))
+	}
+	for _, err := range parse.Errors {
+		got = append(got, fmt.Sprintf("%d:%d: %s", err.Token.Line, err.Token.Char, err.Message))
+	}
+	return got
+}
+
+// TestMissingReturn checks that a function with a result must end in a
+// return on every way through its body.
+func TestMissingReturn(t *testing.T) {
+	cases := []struct {
+		name, body string
+		missing    bool
+	}{
+		{"return", "return 1;", false},
+		{"raise", `raise "no result";`, false},
+		{"if", "if n > 0 { return 1; }", true},
+		{"if else", "if n > 0 { return 1; } else { return 2; }", false},
+		{"nested if", "if n > 0 { return 1; } else { if n < 0 { return 2; } }", true},
+		{"loop", "while n > 0 { return 1; }", true},
+		{"match without _", "match n { 1 => { return 1; } }", true},
+		{"match with _", "match n { 1 => { return 1; } _ => { return 2; } }", false},
+		{"match with an arm falling through", "match n { 1 => { return 1; } _ => {} }", true},
+		{"match on every bool", "match n > 0 { true => { return 1; } false => { return 2; } }", false},
+		{"match on every variant", "match Color(n) { Color.Red => { return 1; } Color.Blue => { return 2; } }", false},
+		{"try", "try { return 1; } catch { return 2; }", false},
+		{"try without a return in catch", "try { return 1; } catch {}", true},
+		{"block", "{ return 1; }", false},
+	}
+	for _, c := range cases {
+		source := fmt.Sprintf("enum Color { Red, Blue }\ndef f(int n) int {\n    %s\n}\n", c.body)
+		var want []string
+		if c.missing {
+			want = []string{"2:1: missing return"}
+		}
+		if got := parseErrors(t, source); !slices.Equal(got, want) {
+			t.Errorf("%s: got errors %q, want %q", c.name, got, want)
+		}
+	}
+}
+
+// TestStructErrors checks the errors of struct declarations, literals and
+// field assignments.
+func TestStructErrors(t *testing.T) {
+	cases := []struct {
+		name, source, want string
+	}{
+		{"duplicate field", "struct P { int x; int x; }", "1:23: duplicate field x"},
+		{"type declared twice", "struct P { int x; }\nstruct P { int y; }", "2:8: type P is already declared in the same scope"},
+		{"unknown field in literal", "struct P { int x; }\np := P{y: 1};", "2:8: P has no field y"},
+		{"field given twice", "struct P { int x; }\np := P{x: 1, x: 2};", "2:14: duplicate field x"},
+		{"wrong field type in literal", "struct P { int x; }\np := P{x: true};", "2:8: wrong type for field x: expected int, got bool"},
+		{"unknown field assigned", "struct P { int x; }\np := P{};\np.z = 1;", "3:3: P has no field z"},
+		{"field declared", "struct P { int x; }\np := P{};\np.x := 1;", "3:5: cannot declare a field or map element, use = to assign it"},
+		{"wrong type assigned", "struct P { int x; }\np := P{};\np.x = false;", "3:1: assigning wrong type"},
+		{"field of an int", "x := 1;\nx.y = 2;", "2:3: int has no fields"},
+	}
+	for _, c := range cases {
+		if got := parseErrors(t, c.source); !slices.Equal(got, []string{c.want}) {
+			t.Errorf("%s: got errors %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+// TestMapErrors checks the errors of map types, literals and the built-ins
+// on maps.
+func TestMapErrors(t *testing.T) {
+	cases := []struct {
+		name, source, want string
+	}{
+		{"string keys", "m := map[string]int{};", "1:10: invalid map key type string"},
+		{"wrong value in literal", "m := map[int]int{1: true};", "1:21: wrong value type in map literal: expected int, got bool"},
+		{"wrong key assigned", "m := map[int]int{};\nm[true] = 1;", "2:2: wrong key type for map[int]int: expected int, got bool"},
+		{"wrong key for has", "m := map[int]int{};\nb := has(m, true);", "2:6: wrong key type for has: expected int, got bool"},
+		{"delete from an int", "x := 1;\ndelete(x, 1);", "2:1: delete expects a map, got int"},
+		{"len of an int", "x := 1;\nn := len(x);", "2:6: len expects a map or an array, got int"},
+		{"compared", "m := map[int]int{};\nb := m == m;", "2:8: invalid operation == for type map[int]int: maps cannot be compared"},
+	}
+	for _, c := range cases {
+		if got := parseErrors(t, c.source); !slices.Equal(got, []string{c.want}) {
+			t.Errorf("%s: got errors %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+// TestDestructureErrors checks that destructuring needs as many variables as
+// values, of the types of the values.
+func TestDestructureErrors(t *testing.T) {
+	const pair = "def f() (int, bool) { return 1, true; }\n"
+	cases := []struct {
+		name, source, want string
+	}{
+		{"too many variables", "a, b, c := f();", "2:9: assignment mismatch: 3 variables but 2 values"},
+		{"one variable", "a := f();", "2:3: assignment mismatch: 1 variable but 2 values"},
+		{"not a tuple", "x := 1;\na, b := x;", "3:6: assignment mismatch: 2 variables but 1 value"},
+		{"wrong type", "int a = 0;\nint b = 0;\na, b = f();", "4:4: assigning wrong type to b: expected int, got bool"},
+		{"repeated variable", "a, a := f();", "2:4: a repeated on the left side"},
+		{"declared again", "a := 0;\na, b := f();", "3:1: variable reassignment not allowed"},
+	}
+	for _, c := range cases {
+		if got := parseErrors(t, pair+c.source); !slices.Equal(got, []string{c.want}) {
+			t.Errorf("%s: got errors %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+// TestTryErrors checks that the catch variable is an error local to the catch
+// block and that raise takes a string.
+func TestTryErrors(t *testing.T) {
+	cases := []struct {
+		name, source, want string
+	}{
+		{"variable outside catch", "try { x := 1; } catch (err) {}\ns := err.message;", "2:6: variable err undefined"},
+		{"unknown field", "try { x := 1; } catch (err) {\n    n := err.code;\n}", "2:14: error has no field code"},
+		{"raise an int", "raise 5;", "1:7: raise expects a string, got int"},
+	}
+	for _, c := range cases {
+		if got := parseErrors(t, c.source); !slices.Equal(got, []string{c.want}) {
+			t.Errorf("%s: got errors %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+// TestConstantErrors checks that a constant cannot be assigned to in any way
+// and that its value must be a constant expression.
+func TestConstantErrors(t *testing.T) {
+	cases := []struct {
+		name, source, want string
+	}{
+		{"assigned", "const int A = 1;\nA = 2;", "2:1: cannot assign to constant A"},
+		{"compound assigned", "const int A = 1;\nA += 2;", "2:1: cannot assign to constant A"},
+		{"incremented", "const int A = 1;\nA++;", "2:1: cannot assign to constant A"},
+		{"destructured into", "def f() (int, int) { return 1, 2; }\nconst int A = 1;\nint b = 0;\nA, b = f();", "4:1: cannot assign to constant A"},
+		{"declared again", "const int A = 1;\nconst int A = 2;", "2:11: variable reassignment not allowed"},
+		{"declared again as a variable", "const int A = 1;\nA := 2;", "2:1: variable reassignment not allowed"},
+		{"from a variable", "x := 1;\nconst int A = x;", "2:13: A is not a constant expression"},
+		{"from a call", "def f() int { return 1; }\nconst int A = f();", "2:13: A is not a constant expression"},
+		{"wrong type", "const int A = true;", "1:13: assigning wrong type: expected int, got bool"},
+		{"map type", "const map[int]int M = map[int]int{};", "1:19: invalid constant type map[int]int"},
+		{"no type", "const A = 1;", "1:7: a constant needs a type: const type NAME = value"},
+	}
+	for _, c := range cases {
+		if got := parseErrors(t, c.source); !slices.Equal(got, []string{c.want}) {
+			t.Errorf("%s: got errors %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+// TestSpreadErrors checks that a spread argument is only accepted for a
+// variadic param, and that the error names the param it landed on.
+func TestSpreadErrors(t *testing.T) {
+	cases := []struct {
+		name, source, want string
+	}{
+		{"built-in", "arr := []int{1, 2};\nm := max(...arr);", "2:10: spread argument for parameter a of function max: only the variadic parameter rest takes a spread"},
+		{"before the variadic param", "def f(int a, int ...rest) int { return a; }\narr := []int{1};\nk := f(...arr);", "3:8: spread argument for parameter a of function f: only the variadic parameter rest takes a spread"},
+		{"no variadic param", "def g(int a) int { return a; }\narr := []int{1};\nk := g(...arr);", "3:8: function g has no variadic parameter"},
+	}
+	for _, c := range cases {
+		if got := parseErrors(t, c.source); !slices.Equal(got, []string{c.want}) {
+			t.Errorf("%s: got errors %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+// TestParamErrors checks the mistakes in params and named arguments, each of
+// which is reported once.
+func TestParamErrors(t *testing.T) {
+	cases := []struct {
+		name, source, want string
+	}{
+		{"declared twice", "def f(int a, int a) int { return a; }\nx := f(1, 2);", "1:18: parameter a is declared twice"},
+		{"declared twice with another type", "def f(int a = 1, bool a) int { return 1; }\nx := f(a: 2);", "1:23: parameter a is declared twice"},
+		{"declared twice as variadic", "def f(int a, int ...a) int { return a; }\nx := f(1, 2);", "1:21: parameter a is declared twice"},
+		{"passed twice", "def f(int a = 1) int { return a; }\nx := f(a: 1, a: 2);", "2:14: parameter a of function f is passed more than once"},
+		{"passed by position and name", "def f(int a = 1) int { return a; }\nx := f(1, a: 2);", "2:11: parameter a of function f is passed more than once"},
+		{"no default after a default", "def f(int a = 1, int b) {}", "1:22: parameter b needs a default value, as it follows one with a default"},
+	}
+	for _, c := range cases {
+		if got := parseErrors(t, c.source); !slices.Equal(got, []string{c.want}) {
+			t.Errorf("%s: got errors %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+// TestCallBeforeDefinition checks that a function of a block cannot be called
+// above its def by the function the block is in, while top-level functions and
+// the functions a sibling calls can.
+func TestCallBeforeDefinition(t *testing.T) {
+	cases := []struct {
+		name, source, want string
+	}{
+		{"in a function", "def g() int {\n    x := h();\n    def h() int { return 1; }\n    return x;\n}", "2:10: function h called before its definition"},
+		{"in an inner block", "def g() {\n    if true {\n        h();\n    }\n    def h() {}\n}", "3:9: function h called before its definition"},
+		{"in a top-level block", "if true {\n    h();\n    def h() {}\n}", "2:5: function h called before its definition"},
+		{"at top level", "x := h();\ndef h() int { return 1; }", ""},
+		{"from a sibling", "def g() int {\n    def a() int { return h(); }\n    def h() int { return 1; }\n    return a();\n}", ""},
+		{"below the def", "def g() int {\n    def h() int { return 1; }\n    return h();\n}", ""},
+	}
+	for _, c := range cases {
+		got := parseErrors(t, c.source)
+		want := []string{}
+		if c.want != "" {
+			want = append(want, c.want)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("%s: got errors %q, want %q", c.name, got, want)
+		}
+	}
+}
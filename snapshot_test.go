@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"simpl/intpr"
+	"strings"
+	"testing"
+)
+
+const snapshotSource = `struct Point { int x; int y; }
+enum Color { Red, Green, Blue }
+origin := Point{x: 1, y: -2};
+seen := map[int]bool{3: true, 1: false};
+color := Color.Blue;
+int? present = 5;
+int? missing = none;
+large := 9007199254740993;
+{
+    int x = 7;
+}
+`
+
+// TestSnapshotRoundTrip checks that a snapshot restored from its JSON gives
+// the same snapshot again.
+func TestSnapshotRoundTrip(t *testing.T) {
+	program, errs := parse(t, snapshotSource, false)
+	if len(errs) > 0 {
+		t.Fatal(describe(errs[0]))
+	}
+	memory, err := execute(t, snapshotSource, false)
+	if err != nil {
+		t.Fatal(describe(err))
+	}
+	data, jsonErr := json.Marshal(memory.Snapshot())
+	if jsonErr != nil {
+		t.Fatal(jsonErr)
+	}
+	restored, restoreErr := intpr.RestoreMemory(data, program.Variables)
+	if restoreErr != nil {
+		t.Fatal(restoreErr)
+	}
+	again, jsonErr := json.Marshal(restored.Snapshot())
+	if jsonErr != nil {
+		t.Fatal(jsonErr)
+	}
+	if !bytes.Equal(data, again) {
+		t.Errorf("the restored memory gave another snapshot:\n%s\nwant\n%s", again, data)
+	}
+	if large := global(t, restored, "large"); large != 9007199254740993 {
+		t.Errorf("large = %v, want 9007199254740993", large)
+	}
+	// the variables of the block that ended are listed as well
+	found := false
+	for _, v := range restored.Snapshot().Frames[0].Variables {
+		found = found || v.Name == "x" && v.Scope == 1 && v.Value == 7
+	}
+	if !found {
+		t.Errorf("x of scope 1 is not listed with its last value 7")
+	}
+}
+
+// TestRestoreMismatch checks that a snapshot whose types do not match the
+// program is rejected.
+func TestRestoreMismatch(t *testing.T) {
+	program, errs := parse(t, snapshotSource, false)
+	if len(errs) > 0 {
+		t.Fatal(describe(errs[0]))
+	}
+	cases := []struct{ name, data, message string }{
+		{"type", `{"frames": [{"variables": [{"name": "large", "type": "string", "scope": 0, "value": "9"}]}]}`, "variable large has type int, not string"},
+		{"value", `{"frames": [{"variables": [{"name": "color", "type": "Color", "scope": 0, "value": "Purple"}]}]}`, `expected a value of type Color, got "Purple"`},
+		{"field", `{"frames": [{"variables": [{"name": "origin", "type": "Point", "scope": 0, "value": {"x": 1, "y": true}}]}]}`, "field y: expected a value of type int, got true"},
+	}
+	for _, c := range cases {
+		_, err := intpr.RestoreMemory([]byte(c.data), program.Variables)
+		if err == nil || !strings.Contains(err.Error(), c.message) {
+			t.Errorf("%s: got error %v, want %q", c.name, err, c.message)
+		}
+	}
+}
@@ -15,6 +15,13 @@ const (
 	EQUAL
 	MODULO
 
+	AMPERSAND
+	PIPE
+	CARET
+	TILDE
+	SHIFT_LEFT
+	SHIFT_RIGHT
+
 	DOUBLE_PLUS
 	DOUBLE_MINUS
 
@@ -24,14 +31,29 @@ const (
 	SLASH_EQUAL
 	MODULO_EQUAL
 
+	AMPERSAND_EQUAL
+	PIPE_EQUAL
+	CARET_EQUAL
+	SHIFT_LEFT_EQUAL
+	SHIFT_RIGHT_EQUAL
+
 	COLON_EQUAL
 	SEMICOLON
+	COLON
+	DOT
+	DOUBLE_DOT
+	ELLIPSIS
+	ARROW
+	QUESTION
+	DOUBLE_QUESTION
 
 	IDENTIFIER
 	NUMBER
+	STRING
 
 	TRUE
 	FALSE
+	NONE
 
 	DOUBLE_EQUAL
 	NOT_EQUAL
@@ -41,6 +63,16 @@ const (
 	GREATER_EQUAL
 
 	BANG
+	// NEGATE is a MINUS the parser found in front of an operand. The lexer
+	// never produces it.
+	NEGATE
+	// VARIANT is a variant of an enum, as in Color.Red. The lexer never
+	// produces it either.
+	VARIANT
+	// SOME is the keyword of x is some v, and also the node the parser wraps
+	// a value in where an optional is expected
+	SOME
+	IS
 	OR
 	AND
 
@@ -48,19 +80,34 @@ const (
 	ELSE
 	WHILE
 	FOR
+	IN
 	BREAK
 	CONTINUE
+	MATCH
 
 	LEFT_BRACE
 	RIGHT_BRACE
 	LEFT_PAREN
 	RIGHT_PAREN
+	LEFT_BRACKET
+	RIGHT_BRACKET
 
 	INT_TYPE
 	BOOL_TYPE
+	STRING_TYPE
+	MAP
+	CHAN
 
 	DEF
 	RETURN
+	CONST
+	STRUCT
+	ENUM
+	TRY
+	CATCH
+	RAISE
+	SPAWN
+	SELECT
 )
 
 var Representations map[TokenType]string = map[TokenType]string{
@@ -71,6 +118,13 @@ var Representations map[TokenType]string = map[TokenType]string{
 	SLASH:  "/",
 	MODULO: "%",
 
+	AMPERSAND:   "&",
+	PIPE:        "|",
+	CARET:       "^",
+	TILDE:       "~",
+	SHIFT_LEFT:  "<<",
+	SHIFT_RIGHT: ">>",
+
 	DOUBLE_PLUS:  "++",
 	DOUBLE_MINUS: "--",
 
@@ -80,6 +134,12 @@ var Representations map[TokenType]string = map[TokenType]string{
 	SLASH_EQUAL:  "/=",
 	MODULO_EQUAL: "%=",
 
+	AMPERSAND_EQUAL:   "&=",
+	PIPE_EQUAL:        "|=",
+	CARET_EQUAL:       "^=",
+	SHIFT_LEFT_EQUAL:  "<<=",
+	SHIFT_RIGHT_EQUAL: ">>=",
+
 	EQUAL:       "=",
 	COLON_EQUAL: ":=",
 
@@ -90,56 +150,105 @@ var Representations map[TokenType]string = map[TokenType]string{
 	LESS_EQUAL:    "<=",
 	GREATER_EQUAL: ">=",
 
-	LEFT_BRACE:  "{",
-	RIGHT_BRACE: "}",
-	LEFT_PAREN:  "(",
-	RIGHT_PAREN: ")",
+	LEFT_BRACE:    "{",
+	RIGHT_BRACE:   "}",
+	LEFT_PAREN:    "(",
+	RIGHT_PAREN:   ")",
+	LEFT_BRACKET:  "[",
+	RIGHT_BRACKET: "]",
 
 	BANG:     "!",
+	NEGATE:   "-",
 	TRUE:     "true",
 	FALSE:    "false",
+	NONE:     "none",
+	SOME:     "some",
+	IS:       "is",
 	OR:       "OR",
 	AND:      "AND",
 	IF:       "if",
 	ELSE:     "else",
 	WHILE:    "while",
 	FOR:      "for",
+	IN:       "in",
 	BREAK:    "break",
 	CONTINUE: "continue",
+	MATCH:    "match",
 
-	INT_TYPE:  "int",
-	BOOL_TYPE: "bool",
+	INT_TYPE:    "int",
+	BOOL_TYPE:   "bool",
+	STRING_TYPE: "string",
+	MAP:         "map",
+	CHAN:        "chan",
 
 	DEF:    "def",
 	RETURN: "return",
+	CONST:  "const",
 
-	SEMICOLON: ";",
-	EOF:       "EOF",
-}
+	STRUCT: "struct",
+	ENUM:   "enum",
 
-var Precedences map[TokenType]int = map[TokenType]int{
-	EOF: -1,
-
-	NUMBER:     1,
-	IDENTIFIER: 1,
-	TRUE:       1,
-	FALSE:      1,
+	TRY:   "try",
+	CATCH: "catch",
+	RAISE: "raise",
 
-	LESS:         2,
-	GREATER:      2,
-	DOUBLE_EQUAL: 2,
-	NOT_EQUAL:    2,
+	SPAWN:  "spawn",
+	SELECT: "select",
 
-	PLUS:   3,
-	MINUS:  3,
-	STAR:   4,
-	SLASH:  4,
-	MODULO: 5,
+	SEMICOLON:  ";",
+	COLON:      ":",
+	DOT:        ".",
+	DOUBLE_DOT: "..",
+	ELLIPSIS:   "...",
+	ARROW:      "=>",
+	EOF:        "EOF",
 
-	OR:  6,
-	AND: 7,
+	QUESTION:        "?",
+	DOUBLE_QUESTION: "??",
+}
 
-	BANG: 8,
+// Precedences holds how tightly each binary operator binds, from || up to
+// the multiplicative operators:
+//
+//	1  ||
+//	2  &&
+//	3  ==  !=  <  <=  >  >=
+//	4  ??
+//	5  +  -  |  ^
+//	6  *  /  %  &  <<  >>
+//
+// All of them but ?? are left associative, so a - b - c is (a - b) - c while
+// a ?? b ?? c is a ?? (b ?? c). The prefix operators !, -, + and ~ bind
+// tighter than any of them and apply to the operand right after them, so
+// -a * b is (-a) * b and !a == b is (!a) == b.
+var Precedences map[TokenType]int = map[TokenType]int{
+	EOF: -1,
+	// is ends the expression before it, as only conditions go on with it
+	IS: -1,
+
+	OR:  1,
+	AND: 2,
+
+	DOUBLE_EQUAL:  3,
+	NOT_EQUAL:     3,
+	LESS:          3,
+	LESS_EQUAL:    3,
+	GREATER:       3,
+	GREATER_EQUAL: 3,
+
+	DOUBLE_QUESTION: 4,
+
+	PLUS:  5,
+	MINUS: 5,
+	PIPE:  5,
+	CARET: 5,
+
+	STAR:        6,
+	SLASH:       6,
+	MODULO:      6,
+	AMPERSAND:   6,
+	SHIFT_LEFT:  6,
+	SHIFT_RIGHT: 6,
 }
 
 type Token struct {
@@ -0,0 +1,257 @@
+package watgen
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	zeroDivision = "zero division not allowed"
+	shiftCount   = "shift count must be between 0 and 63"
+)
+
+// messages are placed in the data segment in this order.
+var messages = []string{
+	zeroDivision,
+	"pow: negative exponent",
+	"sqrt: negative argument",
+	"clamp: lower bound is greater than upper bound",
+	"integer overflow in checkedAbs",
+	"integer overflow in checkedAdd",
+	"integer overflow in checkedSub",
+	"integer overflow in checkedMul",
+	"integer overflow in checkedPow",
+	"integer overflow in gcd",
+	"integer overflow in lcm",
+	shiftCount,
+}
+
+var messageOffsets = func() map[string]int {
+	offsets := map[string]int{}
+	offset := 0
+	for _, message := range messages {
+		offsets[message] = offset
+		offset += len(message)
+	}
+	return offsets
+}()
+
+// messagesEnd is the offset following the fixed messages.
+var messagesEnd = func() int {
+	end := 0
+	for _, message := range messages {
+		end += len(message)
+	}
+	return end
+}()
+
+// fail returns the instructions reporting message at the position held by
+// the $line and $col parameters of the enclosing function.
+func fail(message string) string {
+	return fmt.Sprintf("(call $fail (i32.const %d) (i32.const %d) (local.get $line) (local.get $col))", messageOffsets[message], len(message))
+}
+
+var runtimeSource = strings.NewReplacer("FAIL_ZERO_DIVISION", fail(zeroDivision), "FAIL_SHIFT_COUNT", fail(shiftCount)).Replace(`  (func $fail (param $message i32) (param $length i32) (param $line i32) (param $col i32)
+    (call $runtime_error (local.get $message) (local.get $length) (local.get $line) (local.get $col))
+    (unreachable)
+  )
+  (func $div (param $a i64) (param $b i64) (param $line i32) (param $col i32) (result i64)
+    (if (i64.eqz (local.get $b))
+      (then FAIL_ZERO_DIVISION))
+    ;; i64.div_s traps on overflow, while Go wraps around
+    (if (i64.eq (local.get $b) (i64.const -1))
+      (then (return (i64.sub (i64.const 0) (local.get $a)))))
+    (i64.div_s (local.get $a) (local.get $b))
+  )
+  (func $mod (param $a i64) (param $b i64) (param $line i32) (param $col i32) (result i64)
+    (if (i64.eqz (local.get $b))
+      (then FAIL_ZERO_DIVISION))
+    (i64.rem_s (local.get $a) (local.get $b))
+  )
+  (func $shl (param $a i64) (param $b i64) (param $line i32) (param $col i32) (result i64)
+    ;; unsigned, so negative counts are out of range too; i64.shl would wrap them
+    (if (i64.gt_u (local.get $b) (i64.const 63))
+      (then FAIL_SHIFT_COUNT))
+    (i64.shl (local.get $a) (local.get $b))
+  )
+  (func $shr (param $a i64) (param $b i64) (param $line i32) (param $col i32) (result i64)
+    (if (i64.gt_u (local.get $b) (i64.const 63))
+      (then FAIL_SHIFT_COUNT))
+    (i64.shr_s (local.get $a) (local.get $b))
+  )
+  (func $mul_overflows (param $a i64) (param $b i64) (result i32)
+    (if (i64.eqz (local.get $a))
+      (then (return (i32.const 0))))
+    (if (i64.eq (local.get $a) (i64.const -1))
+      (then (return (i64.eq (local.get $b) (i64.const -9223372036854775808)))))
+    (i64.ne (i64.div_s (i64.mul (local.get $a) (local.get $b)) (local.get $a)) (local.get $b))
+  )
+  ;; $magnitude is the absolute value as unsigned, where that of the
+  ;; smallest int fits
+  (func $magnitude (param $a i64) (result i64)
+    (if (result i64) (i64.lt_s (local.get $a) (i64.const 0))
+      (then (i64.sub (i64.const 0) (local.get $a)))
+      (else (local.get $a)))
+  )
+  (func $gcd (param $a i64) (param $b i64) (result i64)
+    (local $t i64)
+    (local.set $a (call $magnitude (local.get $a)))
+    (local.set $b (call $magnitude (local.get $b)))
+    (block $done
+      (loop $next
+        (br_if $done (i64.eqz (local.get $b)))
+        (local.set $t (i64.rem_u (local.get $a) (local.get $b)))
+        (local.set $a (local.get $b))
+        (local.set $b (local.get $t))
+        (br $next)
+      )
+    )
+    (local.get $a)
+  )
+`)
+
+const nativeParams = "(param $line i32) (param $col i32) (result i64)"
+
+// nativeSources holds WAT implementations of the built-in math functions,
+// mirroring intpr.MathModule. Every native takes the call position last.
+var nativeSources = map[string]string{
+	"abs": `  (func $native_abs (param $x i64) ` + nativeParams + `
+    (if (result i64) (i64.lt_s (local.get $x) (i64.const 0))
+      (then (i64.sub (i64.const 0) (local.get $x)))
+      (else (local.get $x)))
+  )
+`,
+	"min": `  (func $native_min (param $a i64) (param $b i64) ` + nativeParams + `
+    (select (local.get $a) (local.get $b) (i64.lt_s (local.get $a) (local.get $b)))
+  )
+`,
+	"max": `  (func $native_max (param $a i64) (param $b i64) ` + nativeParams + `
+    (select (local.get $a) (local.get $b) (i64.gt_s (local.get $a) (local.get $b)))
+  )
+`,
+	"pow": `  (func $native_pow (param $a i64) (param $n i64) ` + nativeParams + `
+    (local $result i64)
+    (if (i64.lt_s (local.get $n) (i64.const 0))
+      (then ` + fail("pow: negative exponent") + `))
+    (local.set $result (i64.const 1))
+    (block $done
+      (loop $next
+        (br_if $done (i64.eqz (local.get $n)))
+        (if (i32.wrap_i64 (i64.and (local.get $n) (i64.const 1)))
+          (then (local.set $result (i64.mul (local.get $result) (local.get $a)))))
+        (local.set $n (i64.shr_s (local.get $n) (i64.const 1)))
+        (local.set $a (i64.mul (local.get $a) (local.get $a)))
+        (br $next)
+      )
+    )
+    (local.get $result)
+  )
+`,
+	"sqrt": `  (func $native_sqrt (param $x i64) ` + nativeParams + `
+    (local $lo i64)
+    (local $hi i64)
+    (local $mid i64)
+    (if (i64.lt_s (local.get $x) (i64.const 0))
+      (then ` + fail("sqrt: negative argument") + `))
+    (local.set $hi (i64.const 3037000499))
+    (block $done
+      (loop $next
+        (br_if $done (i64.ge_s (local.get $lo) (local.get $hi)))
+        (local.set $mid (i64.div_s (i64.add (i64.add (local.get $lo) (local.get $hi)) (i64.const 1)) (i64.const 2)))
+        (if (i64.le_s (i64.mul (local.get $mid) (local.get $mid)) (local.get $x))
+          (then (local.set $lo (local.get $mid)))
+          (else (local.set $hi (i64.sub (local.get $mid) (i64.const 1)))))
+        (br $next)
+      )
+    )
+    (local.get $lo)
+  )
+`,
+	"gcd": `  (func $native_gcd (param $a i64) (param $b i64) ` + nativeParams + `
+    (local $result i64)
+    (local.set $result (call $gcd (local.get $a) (local.get $b)))
+    (if (i64.lt_s (local.get $result) (i64.const 0))
+      (then ` + fail("integer overflow in gcd") + `))
+    (local.get $result)
+  )
+`,
+	"lcm": `  (func $native_lcm (param $a i64) (param $b i64) ` + nativeParams + `
+    (local $factor i64)
+    (local $result i64)
+    (if (i32.or (i64.eqz (local.get $a)) (i64.eqz (local.get $b)))
+      (then (return (i64.const 0))))
+    (local.set $factor (i64.div_u (call $magnitude (local.get $a)) (call $gcd (local.get $a) (local.get $b))))
+    (local.set $b (call $magnitude (local.get $b)))
+    (local.set $result (i64.mul (local.get $factor) (local.get $b)))
+    (if (i32.or (i64.ne (i64.div_u (local.get $result) (local.get $b)) (local.get $factor)) (i64.lt_s (local.get $result) (i64.const 0)))
+      (then ` + fail("integer overflow in lcm") + `))
+    (local.get $result)
+  )
+`,
+	"clamp": `  (func $native_clamp (param $x i64) (param $lo i64) (param $hi i64) ` + nativeParams + `
+    (if (i64.gt_s (local.get $lo) (local.get $hi))
+      (then ` + fail("clamp: lower bound is greater than upper bound") + `))
+    (if (i64.lt_s (local.get $x) (local.get $lo))
+      (then (return (local.get $lo))))
+    (if (i64.gt_s (local.get $x) (local.get $hi))
+      (then (return (local.get $hi))))
+    (local.get $x)
+  )
+`,
+	"checkedAbs": `  (func $native_checkedAbs (param $x i64) ` + nativeParams + `
+    (if (i64.eq (local.get $x) (i64.const -9223372036854775808))
+      (then ` + fail("integer overflow in checkedAbs") + `))
+    (if (result i64) (i64.lt_s (local.get $x) (i64.const 0))
+      (then (i64.sub (i64.const 0) (local.get $x)))
+      (else (local.get $x)))
+  )
+`,
+	"checkedAdd": `  (func $native_checkedAdd (param $a i64) (param $b i64) ` + nativeParams + `
+    (local $result i64)
+    (local.set $result (i64.add (local.get $a) (local.get $b)))
+    (if (i32.ne (i64.gt_s (local.get $result) (local.get $a)) (i64.gt_s (local.get $b) (i64.const 0)))
+      (then ` + fail("integer overflow in checkedAdd") + `))
+    (local.get $result)
+  )
+`,
+	"checkedSub": `  (func $native_checkedSub (param $a i64) (param $b i64) ` + nativeParams + `
+    (local $result i64)
+    (local.set $result (i64.sub (local.get $a) (local.get $b)))
+    (if (i32.ne (i64.lt_s (local.get $result) (local.get $a)) (i64.gt_s (local.get $b) (i64.const 0)))
+      (then ` + fail("integer overflow in checkedSub") + `))
+    (local.get $result)
+  )
+`,
+	"checkedMul": `  (func $native_checkedMul (param $a i64) (param $b i64) ` + nativeParams + `
+    (if (call $mul_overflows (local.get $a) (local.get $b))
+      (then ` + fail("integer overflow in checkedMul") + `))
+    (i64.mul (local.get $a) (local.get $b))
+  )
+`,
+	"checkedPow": `  (func $native_checkedPow (param $a i64) (param $n i64) ` + nativeParams + `
+    (local $result i64)
+    (local $overflow i32)
+    (if (i64.lt_s (local.get $n) (i64.const 0))
+      (then ` + fail("pow: negative exponent") + `))
+    (local.set $result (i64.const 1))
+    (block $done
+      (loop $next
+        (br_if $done (i64.eqz (local.get $n)))
+        (if (i32.wrap_i64 (i64.and (local.get $n) (i64.const 1)))
+          (then
+            (local.set $overflow (i32.or (local.get $overflow) (call $mul_overflows (local.get $result) (local.get $a))))
+            (local.set $result (i64.mul (local.get $result) (local.get $a)))))
+        (local.set $n (i64.shr_s (local.get $n) (i64.const 1)))
+        (if (i64.ne (local.get $n) (i64.const 0))
+          (then
+            (local.set $overflow (i32.or (local.get $overflow) (call $mul_overflows (local.get $a) (local.get $a))))
+            (local.set $a (i64.mul (local.get $a) (local.get $a)))))
+        (br $next)
+      )
+    )
+    (if (local.get $overflow)
+      (then ` + fail("integer overflow in checkedPow") + `))
+    (local.get $result)
+  )
+`,
+}
@@ -0,0 +1,120 @@
+(module
+  (import "env" "runtime_error" (func $runtime_error (param i32 i32 i32 i32)))
+  (memory (export "memory") 1)
+  (data (i32.const 0) "zero division not allowed")
+  (data (i32.const 25) "pow: negative exponent")
+  (data (i32.const 47) "sqrt: negative argument")
+  (data (i32.const 70) "clamp: lower bound is greater than upper bound")
+  (data (i32.const 116) "integer overflow in checkedAbs")
+  (data (i32.const 146) "integer overflow in checkedAdd")
+  (data (i32.const 176) "integer overflow in checkedSub")
+  (data (i32.const 206) "integer overflow in checkedMul")
+  (data (i32.const 236) "integer overflow in checkedPow")
+  (data (i32.const 266) "integer overflow in gcd")
+  (data (i32.const 289) "integer overflow in lcm")
+  (data (i32.const 312) "shift count must be between 0 and 63")
+  (global $g_a (export "a") (mut i64) (i64.const 0))
+  (global $g_b (export "b") (mut i64) (i64.const 0))
+  (global $g_flag (export "flag") (mut i32) (i32.const 0))
+  (func $fail (param $message i32) (param $length i32) (param $line i32) (param $col i32)
+    (call $runtime_error (local.get $message) (local.get $length) (local.get $line) (local.get $col))
+    (unreachable)
+  )
+  (func $div (param $a i64) (param $b i64) (param $line i32) (param $col i32) (result i64)
+    (if (i64.eqz (local.get $b))
+      (then (call $fail (i32.const 0) (i32.const 25) (local.get $line) (local.get $col))))
+    ;; i64.div_s traps on overflow, while Go wraps around
+    (if (i64.eq (local.get $b) (i64.const -1))
+      (then (return (i64.sub (i64.const 0) (local.get $a)))))
+    (i64.div_s (local.get $a) (local.get $b))
+  )
+  (func $mod (param $a i64) (param $b i64) (param $line i32) (param $col i32) (result i64)
+    (if (i64.eqz (local.get $b))
+      (then (call $fail (i32.const 0) (i32.const 25) (local.get $line) (local.get $col))))
+    (i64.rem_s (local.get $a) (local.get $b))
+  )
+  (func $shl (param $a i64) (param $b i64) (param $line i32) (param $col i32) (result i64)
+    ;; unsigned, so negative counts are out of range too; i64.shl would wrap them
+    (if (i64.gt_u (local.get $b) (i64.const 63))
+      (then (call $fail (i32.const 312) (i32.const 36) (local.get $line) (local.get $col))))
+    (i64.shl (local.get $a) (local.get $b))
+  )
+  (func $shr (param $a i64) (param $b i64) (param $line i32) (param $col i32) (result i64)
+    (if (i64.gt_u (local.get $b) (i64.const 63))
+      (then (call $fail (i32.const 312) (i32.const 36) (local.get $line) (local.get $col))))
+    (i64.shr_s (local.get $a) (local.get $b))
+  )
+  (func $mul_overflows (param $a i64) (param $b i64) (result i32)
+    (if (i64.eqz (local.get $a))
+      (then (return (i32.const 0))))
+    (if (i64.eq (local.get $a) (i64.const -1))
+      (then (return (i64.eq (local.get $b) (i64.const -9223372036854775808)))))
+    (i64.ne (i64.div_s (i64.mul (local.get $a) (local.get $b)) (local.get $a)) (local.get $b))
+  )
+  ;; $magnitude is the absolute value as unsigned, where that of the
+  ;; smallest int fits
+  (func $magnitude (param $a i64) (result i64)
+    (if (result i64) (i64.lt_s (local.get $a) (i64.const 0))
+      (then (i64.sub (i64.const 0) (local.get $a)))
+      (else (local.get $a)))
+  )
+  (func $gcd (param $a i64) (param $b i64) (result i64)
+    (local $t i64)
+    (local.set $a (call $magnitude (local.get $a)))
+    (local.set $b (call $magnitude (local.get $b)))
+    (block $done
+      (loop $next
+        (br_if $done (i64.eqz (local.get $b)))
+        (local.set $t (i64.rem_u (local.get $a) (local.get $b)))
+        (local.set $a (local.get $b))
+        (local.set $b (local.get $t))
+        (br $next)
+      )
+    )
+    (local.get $a)
+  )
+  (func $f_size (param $p_n i64) (result i64)
+    (local $l_result i64)
+    (local $match i64)
+    (local.set $l_result (i64.const 0))
+    (local.set $match (local.get $p_n))
+    (if (if (result i32) (i64.eq (local.get $match) (i64.const 0)) (then (i32.const 1)) (else (i64.eq (local.get $match) (i64.const 1))))
+      (then
+        (local.set $l_result (i64.const 10))
+      )
+      (else
+        (if (i64.eq (local.get $match) (i64.const 2))
+          (then
+            (local.set $l_result (i64.const 20))
+          )
+          (else
+            (local.set $l_result (i64.const 30))
+          )
+        )
+      )
+    )
+    (return (local.get $l_result))
+    (i64.const 0)
+  )
+  (func $main (export "main")
+    (local $match_1 i32)
+    (global.set $g_a (call $f_size (i64.const 1)))
+    (global.set $g_b (call $f_size (i64.const 7)))
+    (global.set $g_flag (i64.lt_s (global.get $g_a) (global.get $g_b)))
+    (local.set $match_1 (global.get $g_flag))
+    (if (i32.eq (local.get $match_1) (i32.const 1))
+      (then
+        (global.set $g_a (i64.add (global.get $g_a) (i64.const 1)))
+      )
+      (else
+        (if (i32.eq (local.get $match_1) (i32.const 0))
+          (then
+            (global.set $g_b (i64.add (global.get $g_b) (i64.const 1)))
+          )
+          (else
+          )
+        )
+      )
+    )
+  )
+)
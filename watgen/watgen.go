@@ -0,0 +1,1012 @@
+// Package watgen translates a type-checked simpl program into a WebAssembly
+// module in text format.
+//
+// int values are i64 and bool values are i32. Variables of the top-level code
+// become globals, the top-level globals are exported under their own names
+// and the top-level code itself is exported as "main". Runtime errors call
+// the imported function env.runtime_error with the address and length of the
+// message in the exported memory and the source line and column, then trap.
+package watgen
+
+import (
+	"fmt"
+	"simpl/errors"
+	"simpl/intpr"
+	"simpl/tokens"
+	"sort"
+	"strings"
+)
+
+type binding struct {
+	name     string
+	global   bool
+	function bool
+	dataType intpr.DataType
+	// pending is set for a function whose definition has not been reached
+	pending bool
+}
+
+type function struct {
+	name   string
+	export string
+	params []string
+	result string
+	locals []string
+	body   strings.Builder
+	indent int
+	def    *intpr.Def
+}
+
+type loop struct {
+	breakLabel    string
+	continueLabel string
+}
+
+type generator struct {
+	scopes  []map[string]binding
+	funcs   []*function
+	current *function
+	globals []string
+	loops   []loop
+	// used counts the identifiers handed out for each name, taken holds them
+	used    map[string]int
+	taken   map[string]bool
+	natives map[string]bool
+	// guards holds the globals flagging that the definition of a function
+	// ran, for the functions called before their definitions
+	guards map[string]string
+	// data holds the messages placed after the fixed ones
+	data []string
+}
+
+// Generate returns the WAT source of the program.
+func Generate(program *intpr.Program) ([]byte, *errors.Error) {
+	g := generator{
+		scopes:  []map[string]binding{{}},
+		used:    map[string]int{},
+		taken:   map[string]bool{},
+		natives: map[string]bool{},
+		guards:  map[string]string{},
+	}
+	main := &function{name: "$main", export: "main", indent: 2}
+	g.current = main
+	g.declareGlobals(program.Statements)
+	if err := g.statements(program.Statements); err != nil {
+		return nil, err
+	}
+	g.funcs = append(g.funcs, main)
+	return g.module(), nil
+}
+
+func (g *generator) module() []byte {
+	var out strings.Builder
+	out.WriteString("(module\n")
+	out.WriteString("  (import \"env\" \"runtime_error\" (func $runtime_error (param i32 i32 i32 i32)))\n")
+	out.WriteString("  (memory (export \"memory\") 1)\n")
+	for _, message := range messages {
+		fmt.Fprintf(&out, "  (data (i32.const %d) %q)\n", messageOffsets[message], message)
+	}
+	offset := messagesEnd
+	for _, message := range g.data {
+		fmt.Fprintf(&out, "  (data (i32.const %d) %q)\n", offset, message)
+		offset += len(message)
+	}
+	for _, global := range g.globals {
+		fmt.Fprintf(&out, "  %s\n", global)
+	}
+	out.WriteString(runtimeSource)
+	names := []string{}
+	for name := range g.natives {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		out.WriteString(nativeSources[name])
+	}
+	for _, fn := range g.funcs {
+		fmt.Fprintf(&out, "  (func %s", fn.name)
+		if fn.export != "" {
+			fmt.Fprintf(&out, " (export %q)", fn.export)
+		}
+		for _, p := range fn.params {
+			fmt.Fprintf(&out, " %s", p)
+		}
+		if fn.result != "" {
+			fmt.Fprintf(&out, " (result %s)", fn.result)
+		}
+		out.WriteString("\n")
+		for _, l := range fn.locals {
+			fmt.Fprintf(&out, "    %s\n", l)
+		}
+		out.WriteString(fn.body.String())
+		out.WriteString("  )\n")
+	}
+	out.WriteString(")\n")
+	return []byte(out.String())
+}
+
+func (g *generator) emit(format string, args ...any) {
+	fn := g.current
+	fn.body.WriteString(strings.Repeat("  ", fn.indent))
+	fmt.Fprintf(&fn.body, format, args...)
+	fn.body.WriteString("\n")
+}
+
+func (g *generator) open(format string, args ...any) {
+	g.emit(format, args...)
+	g.current.indent++
+}
+
+func (g *generator) close() {
+	g.current.indent--
+	g.emit(")")
+}
+
+func (g *generator) extend() {
+	g.scopes = append(g.scopes, map[string]binding{})
+}
+
+func (g *generator) shrink() {
+	g.scopes = g.scopes[:len(g.scopes)-1]
+}
+
+func (g *generator) lookup(name string) (binding, bool) {
+	for i := len(g.scopes) - 1; i >= 0; i-- {
+		b, found := g.scopes[i][name]
+		if found {
+			return b, true
+		}
+	}
+	return binding{}, false
+}
+
+// unique returns a WAT identifier for name that has not been handed out yet.
+// The suffix of a name declared again may spell another name, as x_1 does
+// for the second x, so suffixes are tried until one is free.
+func (g *generator) unique(name string) string {
+	for {
+		count := g.used[name]
+		g.used[name] = count + 1
+		id := "$" + name
+		if count > 0 {
+			id = fmt.Sprintf("$%s_%d", name, count)
+		}
+		if !g.taken[id] {
+			g.taken[id] = true
+			return id
+		}
+	}
+}
+
+func (g *generator) inFunction() bool {
+	return g.current.def != nil
+}
+
+// valType returns the wasm types of the values of a type, which are several
+// for the results of a function returning a tuple.
+func valType(dataType intpr.DataType) string {
+	if dataType.IsTuple() {
+		types := []string{}
+		for _, e := range dataType.Type().Elements {
+			types = append(types, valType(e))
+		}
+		return strings.Join(types, " ")
+	}
+	if dataType == intpr.Int {
+		return "i64"
+	}
+	return "i32"
+}
+
+func zero(dataType intpr.DataType) string {
+	if dataType.IsTuple() {
+		values := []string{}
+		for _, e := range dataType.Type().Elements {
+			values = append(values, zero(e))
+		}
+		return strings.Join(values, " ")
+	}
+	return fmt.Sprintf("(%s.const 0)", valType(dataType))
+}
+
+func (g *generator) declare(name string, dataType intpr.DataType, top bool) binding {
+	b := binding{dataType: dataType}
+	if g.inFunction() {
+		b.name = g.unique("l_" + name)
+		g.current.locals = append(g.current.locals, fmt.Sprintf("(local %s %s)", b.name, valType(dataType)))
+	} else {
+		b.global = true
+		b.name = g.unique("g_" + name)
+		export := ""
+		if top && name != "main" && name != "memory" {
+			export = fmt.Sprintf(" (export %q)", name)
+		}
+		g.globals = append(g.globals, fmt.Sprintf("(global %s%s (mut %s) %s)", b.name, export, valType(dataType), zero(dataType)))
+	}
+	g.scopes[len(g.scopes)-1][name] = b
+	return b
+}
+
+// variable binds a declared variable, unless it is a global that
+// declareGlobals bound already.
+func (g *generator) variable(name string, dataType intpr.DataType) binding {
+	if len(g.scopes) == 1 && !g.inFunction() {
+		if b, found := g.scopes[0][name]; found && !b.function {
+			return b
+		}
+	}
+	return g.declare(name, dataType, len(g.scopes) == 1)
+}
+
+func (g *generator) get(b binding) string {
+	if b.global {
+		return fmt.Sprintf("(global.get %s)", b.name)
+	}
+	return fmt.Sprintf("(local.get %s)", b.name)
+}
+
+func (g *generator) set(b binding, value string) {
+	if b.global {
+		g.emit("(global.set %s %s)", b.name, value)
+	} else {
+		g.emit("(local.set %s %s)", b.name, value)
+	}
+}
+
+func (g *generator) temp() string {
+	fn := g.current
+	for _, l := range fn.locals {
+		if strings.HasPrefix(l, "(local $tmp ") {
+			return "$tmp"
+		}
+	}
+	fn.locals = append(fn.locals, "(local $tmp i64)")
+	return "$tmp"
+}
+
+func (g *generator) block(statements []intpr.Statement) *errors.Error {
+	g.extend()
+	defer g.shrink()
+	return g.statements(statements)
+}
+
+// statements emits the statements of a block. The functions it defines are
+// bound first, so that they can call each other whatever their order.
+func (g *generator) statements(statements []intpr.Statement) *errors.Error {
+	g.declareFunctions(statements)
+	for i, stmt := range statements {
+		if err := g.statement(stmt); err != nil {
+			return err
+		}
+		if _, open := stmt.(*intpr.OpenScope); open {
+			g.declareFunctions(statements[i+1:])
+		}
+	}
+	return nil
+}
+
+// declareFunctions binds the functions defined in statements up to the end
+// of the current scope.
+func (g *generator) declareFunctions(statements []intpr.Statement) {
+	depth := 0
+	for _, stmt := range statements {
+		switch s := stmt.(type) {
+		case *intpr.OpenScope:
+			depth++
+		case *intpr.CloseScope:
+			if depth == 0 {
+				return
+			}
+			depth--
+		case *intpr.Def:
+			if depth == 0 {
+				g.declareFunction(s)
+			}
+		}
+	}
+}
+
+// declareGlobals binds the variables the top-level code declares outside of
+// blocks. The top-level functions come first and may read any of them.
+func (g *generator) declareGlobals(statements []intpr.Statement) {
+	depth := 0
+	for _, stmt := range statements {
+		switch s := stmt.(type) {
+		case *intpr.OpenScope:
+			depth++
+		case *intpr.CloseScope:
+			depth--
+		case *intpr.Assignment:
+			if depth == 0 && (s.Operator.Type == tokens.COLON_EQUAL || s.Explicit) {
+				g.declare(s.Var.Value, s.DataType, true)
+			}
+		case *intpr.Destructure:
+			if depth == 0 && s.Operator.Type == tokens.COLON_EQUAL {
+				for i, v := range s.Vars {
+					if s.Slots[i] >= 0 {
+						g.declare(v.Value, s.Exp.DataType.Type().Elements[i], true)
+					}
+				}
+			}
+		}
+	}
+}
+
+// declareFunction binds a function, or the instances of a generic one, whose
+// names hold their type arguments, as in max[int].
+func (g *generator) declareFunction(s *intpr.Def) {
+	if s.TypeParams != nil {
+		for _, instance := range s.Instances {
+			g.declareFunction(instance)
+		}
+		return
+	}
+	name := strings.NewReplacer("[", "_", "]", "", ", ", "_", "#", "_").Replace(s.NameToken.Value)
+	// top-level functions are all defined before the first statement runs
+	pending := len(g.scopes) > 1
+	g.scopes[len(g.scopes)-1][s.NameToken.Value] = binding{name: g.unique("f_" + name), function: true, dataType: s.DataType, pending: pending}
+}
+
+// message returns the offset of text in the data segment, placing it after
+// the fixed messages the first time it is used.
+func (g *generator) message(text string) int {
+	if offset, found := messageOffsets[text]; found {
+		return offset
+	}
+	offset := messagesEnd
+	for _, message := range g.data {
+		if message == text {
+			return offset
+		}
+		offset += len(message)
+	}
+	g.data = append(g.data, text)
+	return offset
+}
+
+func (g *generator) statement(stmt intpr.Statement) *errors.Error {
+	switch s := stmt.(type) {
+	case *intpr.Assignment:
+		return g.assignment(s)
+	case *intpr.Destructure:
+		return g.destructure(s)
+	case *intpr.OpenScope:
+		g.extend()
+	case *intpr.CloseScope:
+		g.shrink()
+	case *intpr.Conditional:
+		return g.conditional(s)
+	case *intpr.For:
+		return g.forLoop(s)
+	case *intpr.ForIn:
+		return g.forIn(s)
+	case *intpr.Match:
+		return g.match(s)
+	case *intpr.Def:
+		return g.def(s)
+	case *intpr.Return:
+		def := g.current.def
+		if def == nil || def.DataType == intpr.Void {
+			g.emit("(return)")
+			return nil
+		}
+		exp, err := g.expression(def.ReturnBranches[s.Id])
+		if err != nil {
+			return err
+		}
+		g.emit("(return %s)", exp)
+	case *intpr.Break:
+		g.emit("(br %s)", g.loops[len(g.loops)-1].breakLabel)
+	case *intpr.Continue:
+		g.emit("(br %s)", g.loops[len(g.loops)-1].continueLabel)
+	case *intpr.VoidCall:
+		call, dataType, err := g.call(s.NameToken, s.Args)
+		if err != nil {
+			return err
+		}
+		if dataType == intpr.Void {
+			g.emit("%s", call)
+		} else {
+			g.emit("(drop %s)", call)
+		}
+	case *intpr.StructDef:
+		// every use of a struct needs its declaration, so this rejects them all
+		return &errors.Error{Message: "wat target does not support struct types", Type: errors.UnsupportedError, Token: s.Token}
+	case *intpr.EnumDef:
+		return &errors.Error{Message: "wat target does not support enum types", Type: errors.UnsupportedError, Token: s.Token}
+	case *intpr.Try:
+		return &errors.Error{Message: "wat target does not support try statements", Type: errors.UnsupportedError, Token: s.Token}
+	case *intpr.Raise:
+		return &errors.Error{Message: "wat target does not support raise statements", Type: errors.UnsupportedError, Token: s.Token}
+	case *intpr.Spawn:
+		return &errors.Error{Message: "wat target does not support spawn statements", Type: errors.UnsupportedError, Token: s.Token}
+	case *intpr.Select:
+		return &errors.Error{Message: "wat target does not support select statements", Type: errors.UnsupportedError, Token: s.Token}
+	default:
+		return &errors.Error{Message: fmt.Sprintf("wat target does not support statement %T", stmt), Type: errors.UnsupportedError, Token: intpr.Position(stmt)}
+	}
+	return nil
+}
+
+func (g *generator) assignment(s *intpr.Assignment) *errors.Error {
+	if s.Operator.Type == tokens.COLON_EQUAL || s.Explicit {
+		if s.DataType == intpr.String {
+			return &errors.Error{Message: "wat target does not support string types", Type: errors.UnsupportedError, Token: s.Var}
+		}
+		if s.DataType.IsArray() {
+			return &errors.Error{Message: "wat target does not support array types", Type: errors.UnsupportedError, Token: s.Var}
+		}
+		if s.DataType.IsChan() {
+			return &errors.Error{Message: "wat target does not support channel types", Type: errors.UnsupportedError, Token: s.Var}
+		}
+		if s.DataType == intpr.Func {
+			return &errors.Error{Message: "wat target does not support function types", Type: errors.UnsupportedError, Token: s.Var}
+		}
+		exp, err := g.expression(s.Exp)
+		if err != nil {
+			return err
+		}
+		b := g.variable(s.Var.Value, s.DataType)
+		g.set(b, exp)
+		return nil
+	}
+	b, found := g.lookup(s.Var.Value)
+	if !found {
+		return &errors.Error{Message: fmt.Sprintf("variable %s undefined", s.Var.Value), Type: errors.ReferenceError, Token: s.Var}
+	}
+	switch s.Operator.Type {
+	case tokens.DOUBLE_PLUS:
+		g.set(b, fmt.Sprintf("(i64.add %s (i64.const 1))", g.get(b)))
+		return nil
+	case tokens.DOUBLE_MINUS:
+		g.set(b, fmt.Sprintf("(i64.sub %s (i64.const 1))", g.get(b)))
+		return nil
+	}
+	exp, err := g.expression(s.Exp)
+	if err != nil {
+		return err
+	}
+	if s.Operator.Type == tokens.EQUAL {
+		g.set(b, exp)
+		return nil
+	}
+	// the interpreter evaluates the right-hand side before reading the variable
+	value := exp
+	if hasCall(s.Exp) {
+		tmp := g.temp()
+		g.emit("(local.set %s %s)", tmp, exp)
+		value = fmt.Sprintf("(local.get %s)", tmp)
+	}
+	current := g.get(b)
+	switch s.Operator.Type {
+	case tokens.PLUS_EQUAL:
+		g.set(b, fmt.Sprintf("(i64.add %s %s)", current, value))
+	case tokens.MINUS_EQUAL:
+		g.set(b, fmt.Sprintf("(i64.sub %s %s)", current, value))
+	case tokens.STAR_EQUAL:
+		g.set(b, fmt.Sprintf("(i64.mul %s %s)", current, value))
+	case tokens.SLASH_EQUAL:
+		g.set(b, fmt.Sprintf("(call $div %s %s %s)", current, value, position(s.Operator)))
+	case tokens.MODULO_EQUAL:
+		g.set(b, fmt.Sprintf("(call $mod %s %s %s)", current, value, position(s.Operator)))
+	case tokens.AMPERSAND_EQUAL:
+		g.set(b, fmt.Sprintf("(i64.and %s %s)", current, value))
+	case tokens.PIPE_EQUAL:
+		g.set(b, fmt.Sprintf("(i64.or %s %s)", current, value))
+	case tokens.CARET_EQUAL:
+		g.set(b, fmt.Sprintf("(i64.xor %s %s)", current, value))
+	case tokens.SHIFT_LEFT_EQUAL:
+		g.set(b, fmt.Sprintf("(call $shl %s %s %s)", current, value, position(s.Operator)))
+	case tokens.SHIFT_RIGHT_EQUAL:
+		g.set(b, fmt.Sprintf("(call $shr %s %s %s)", current, value, position(s.Operator)))
+	default:
+		return &errors.Error{Message: fmt.Sprintf("wat target does not support operator %s", s.Operator.View()), Type: errors.UnsupportedError, Token: s.Operator}
+	}
+	return nil
+}
+
+func position(token tokens.Token) string {
+	return fmt.Sprintf("(i32.const %d) (i32.const %d)", token.Line, token.Char)
+}
+
+// destructure leaves the results of the call on the stack and pops them
+// into the variables, the last one first.
+func (g *generator) destructure(s *intpr.Destructure) *errors.Error {
+	exp, err := g.expression(s.Exp)
+	if err != nil {
+		return err
+	}
+	targets := make([]string, len(s.Vars))
+	for i, v := range s.Vars {
+		if s.Slots[i] < 0 {
+			targets[i] = "(drop)"
+			continue
+		}
+		var b binding
+		if s.Operator.Type == tokens.COLON_EQUAL {
+			b = g.variable(v.Value, s.Exp.DataType.Type().Elements[i])
+		} else {
+			var found bool
+			b, found = g.lookup(v.Value)
+			if !found {
+				return &errors.Error{Message: fmt.Sprintf("variable %s undefined", v.Value), Type: errors.ReferenceError, Token: v}
+			}
+		}
+		if b.global {
+			targets[i] = fmt.Sprintf("(global.set %s)", b.name)
+		} else {
+			targets[i] = fmt.Sprintf("(local.set %s)", b.name)
+		}
+	}
+	g.emit("%s", exp)
+	for i := len(targets) - 1; i >= 0; i-- {
+		g.emit("%s", targets[i])
+	}
+	return nil
+}
+
+func (g *generator) conditional(s *intpr.Conditional) *errors.Error {
+	condition, err := g.expression(s.Condition)
+	if err != nil {
+		return err
+	}
+	if s.Token.Type == tokens.IF {
+		g.open("(if %s", condition)
+		g.open("(then")
+		if err := g.block(s.Then.Statements); err != nil {
+			return err
+		}
+		g.close()
+		if s.Else != nil {
+			g.open("(else")
+			if err := g.block(s.Else.Statements); err != nil {
+				return err
+			}
+			g.close()
+		}
+		g.close()
+		return nil
+	}
+	// like the interpreter, a while loop evaluates its condition once per
+	// check and runs the else block only when the body never ran
+	var entered string
+	if s.Else != nil {
+		entered = g.unique("entered")
+		g.current.locals = append(g.current.locals, fmt.Sprintf("(local %s i32)", entered))
+		g.emit("(local.set %s (i32.const 0))", entered)
+	}
+	l := loop{breakLabel: g.unique("break"), continueLabel: g.unique("continue")}
+	g.open("(block %s", l.breakLabel)
+	g.open("(loop %s", l.continueLabel)
+	g.emit("(br_if %s (i32.eqz %s))", l.breakLabel, condition)
+	if s.Else != nil {
+		g.emit("(local.set %s (i32.const 1))", entered)
+	}
+	g.loops = append(g.loops, l)
+	if err := g.block(s.Then.Statements); err != nil {
+		return err
+	}
+	g.loops = g.loops[:len(g.loops)-1]
+	g.emit("(br %s)", l.continueLabel)
+	g.close()
+	g.close()
+	if s.Else != nil {
+		g.open("(if (i32.eqz (local.get %s))", entered)
+		g.open("(then")
+		if err := g.block(s.Else.Statements); err != nil {
+			return err
+		}
+		g.close()
+		g.close()
+	}
+	return nil
+}
+
+// match becomes a chain of ifs, each in the else branch of the previous one.
+func (g *generator) match(s *intpr.Match) *errors.Error {
+	subject, err := g.expression(s.Subject)
+	if err != nil {
+		return err
+	}
+	operands := valType(s.Subject.DataType)
+	tmp := g.unique("match")
+	g.current.locals = append(g.current.locals, fmt.Sprintf("(local %s %s)", tmp, operands))
+	g.emit("(local.set %s %s)", tmp, subject)
+	for _, arm := range s.Arms {
+		// the values after the one that matches are not evaluated
+		condition := ""
+		for i := len(arm.Values) - 1; i >= 0; i-- {
+			value, err := g.expression(arm.Values[i])
+			if err != nil {
+				return err
+			}
+			equal := fmt.Sprintf("(%s.eq (local.get %s) %s)", operands, tmp, value)
+			if condition == "" {
+				condition = equal
+			} else {
+				condition = fmt.Sprintf("(if (result i32) %s (then (i32.const 1)) (else %s))", equal, condition)
+			}
+		}
+		g.open("(if %s", condition)
+		g.open("(then")
+		if err := g.block(arm.Block.Statements); err != nil {
+			return err
+		}
+		g.close()
+		g.open("(else")
+	}
+	if s.Default != nil {
+		if err := g.block(s.Default.Statements); err != nil {
+			return err
+		}
+	}
+	for range s.Arms {
+		g.close()
+		g.close()
+	}
+	return nil
+}
+
+func (g *generator) forLoop(s *intpr.For) *errors.Error {
+	g.extend()
+	defer g.shrink()
+	if err := g.statement(s.Init); err != nil {
+		return err
+	}
+	condition, err := g.expression(s.Condition)
+	if err != nil {
+		return err
+	}
+	l := loop{breakLabel: g.unique("break"), continueLabel: g.unique("continue")}
+	top := g.unique("loop")
+	g.open("(block %s", l.breakLabel)
+	g.open("(loop %s", top)
+	g.emit("(br_if %s (i32.eqz %s))", l.breakLabel, condition)
+	g.open("(block %s", l.continueLabel)
+	g.loops = append(g.loops, l)
+	if s.Block != nil {
+		if err := g.block(s.Block.Statements); err != nil {
+			return err
+		}
+	}
+	g.loops = g.loops[:len(g.loops)-1]
+	g.close()
+	if err := g.statement(s.After); err != nil {
+		return err
+	}
+	g.emit("(br %s)", top)
+	g.close()
+	g.close()
+	return nil
+}
+
+func (g *generator) forIn(s *intpr.ForIn) *errors.Error {
+	if s.Collection != nil {
+		if s.Collection.DataType.IsArray() {
+			return &errors.Error{Message: "wat target does not support array types", Type: errors.UnsupportedError, Token: s.Collection.Token}
+		}
+		return &errors.Error{Message: "wat target does not support map types", Type: errors.UnsupportedError, Token: s.Collection.Token}
+	}
+	g.extend()
+	defer g.shrink()
+	start, err := g.expression(s.Start)
+	if err != nil {
+		return err
+	}
+	end, err := g.expression(s.End)
+	if err != nil {
+		return err
+	}
+	// "for" can't be a variable name, so the counter and the limit can't
+	// shadow a variable of the script
+	counter := g.declare("for", intpr.Int, false)
+	limit := g.declare("for", intpr.Int, false)
+	g.set(counter, start)
+	g.set(limit, end)
+	variable := g.declare(s.Var.Value, intpr.Int, false)
+	l := loop{breakLabel: g.unique("break"), continueLabel: g.unique("continue")}
+	top := g.unique("loop")
+	g.open("(block %s", l.breakLabel)
+	g.open("(loop %s", top)
+	g.emit("(br_if %s (i32.eqz (i64.lt_s %s %s)))", l.breakLabel, g.get(counter), g.get(limit))
+	g.set(variable, g.get(counter))
+	g.open("(block %s", l.continueLabel)
+	g.loops = append(g.loops, l)
+	if err := g.block(s.Block.Statements); err != nil {
+		return err
+	}
+	g.loops = g.loops[:len(g.loops)-1]
+	g.close()
+	g.set(counter, fmt.Sprintf("(i64.add %s (i64.const 1))", g.get(counter)))
+	g.emit("(br %s)", top)
+	g.close()
+	g.close()
+	return nil
+}
+
+func (g *generator) def(s *intpr.Def) *errors.Error {
+	if s.TypeParams != nil {
+		for _, instance := range s.Instances {
+			if err := g.def(instance); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	// wasm functions cannot reach the locals of another function
+	if g.current.def != nil {
+		return &errors.Error{Message: "wat target does not support nested functions", Type: errors.UnsupportedError, Token: s.NameToken}
+	}
+	// a map, an array, an optional or a channel can only come from a literal
+	// or from a parameter, so rejecting those rejects every use of them
+	for _, p := range s.Params {
+		if p.DataType.IsArray() {
+			return &errors.Error{Message: "wat target does not support array types", Type: errors.UnsupportedError, Token: p.NameToken}
+		}
+		if p.DataType.IsMap() {
+			return &errors.Error{Message: "wat target does not support map types", Type: errors.UnsupportedError, Token: p.NameToken}
+		}
+		if p.DataType == intpr.String {
+			return &errors.Error{Message: "wat target does not support string types", Type: errors.UnsupportedError, Token: p.NameToken}
+		}
+		if p.DataType.IsOptional() {
+			return &errors.Error{Message: "wat target does not support optional types", Type: errors.UnsupportedError, Token: p.NameToken}
+		}
+		if p.DataType.IsChan() {
+			return &errors.Error{Message: "wat target does not support channel types", Type: errors.UnsupportedError, Token: p.NameToken}
+		}
+	}
+	if s.DataType.IsArray() {
+		return &errors.Error{Message: "wat target does not support array types", Type: errors.UnsupportedError, Token: s.NameToken}
+	}
+	if s.DataType.IsMap() {
+		return &errors.Error{Message: "wat target does not support map types", Type: errors.UnsupportedError, Token: s.NameToken}
+	}
+	if s.DataType == intpr.String {
+		return &errors.Error{Message: "wat target does not support string types", Type: errors.UnsupportedError, Token: s.NameToken}
+	}
+	if s.DataType.IsOptional() {
+		return &errors.Error{Message: "wat target does not support optional types", Type: errors.UnsupportedError, Token: s.NameToken}
+	}
+	if s.DataType.IsChan() {
+		return &errors.Error{Message: "wat target does not support channel types", Type: errors.UnsupportedError, Token: s.NameToken}
+	}
+	fn := &function{name: g.scopes[len(g.scopes)-1][s.NameToken.Value].name, indent: 2, def: s}
+	if s.DataType != intpr.Void {
+		fn.result = valType(s.DataType)
+	}
+	g.scopes[len(g.scopes)-1][s.NameToken.Value] = binding{name: fn.name, function: true, dataType: s.DataType}
+	if guard, found := g.guards[fn.name]; found {
+		g.globals = append(g.globals, fmt.Sprintf("(global %s (mut i32) (i32.const 0))", guard))
+		g.emit("(global.set %s (i32.const 1))", guard)
+	}
+
+	outer, loops := g.current, g.loops
+	g.current, g.loops = fn, nil
+	g.extend()
+	for _, p := range s.Params {
+		name := g.unique("p_" + p.NameToken.Value)
+		fn.params = append(fn.params, fmt.Sprintf("(param %s %s)", name, valType(p.DataType)))
+		g.scopes[len(g.scopes)-1][p.NameToken.Value] = binding{name: name, dataType: p.DataType}
+	}
+	for _, stmt := range s.Body.Statements {
+		if err := g.statement(stmt); err != nil {
+			return err
+		}
+	}
+	// a function that runs off its end returns the zero value
+	if s.DataType != intpr.Void {
+		g.emit("%s", zero(s.DataType))
+	}
+	g.shrink()
+	g.current, g.loops = outer, loops
+	g.funcs = append(g.funcs, fn)
+	return nil
+}
+
+func hasCall(e *intpr.Expression) bool {
+	if e == nil {
+		return false
+	}
+	return e.Args != nil || hasCall(e.Left) || hasCall(e.Right)
+}
+
+func (g *generator) call(name tokens.Token, args []*intpr.Expression) (string, intpr.DataType, *errors.Error) {
+	b, found := g.lookup(name.Value)
+	if !found || !b.function {
+		if rest, variadic := variadicNative(name.Value, args); variadic {
+			return g.chain(name, append(args[:len(args)-1:len(args)-1], rest...))
+		}
+	}
+	values := []string{}
+	for _, a := range args {
+		value, err := g.expression(a)
+		if err != nil {
+			return "", intpr.Invalid, err
+		}
+		values = append(values, value)
+	}
+	if found && b.function {
+		call := fmt.Sprintf("(call %s)", strings.TrimSpace(b.name+" "+strings.Join(values, " ")))
+		if b.pending {
+			call = g.guard(b, name, call)
+		}
+		return call, b.dataType, nil
+	}
+	if _, found := nativeSources[name.Value]; !found {
+		return "", intpr.Invalid, &errors.Error{Message: fmt.Sprintf("wat target does not support built-in function %s", name.Value), Type: errors.UnsupportedError, Token: name}
+	}
+	g.natives[name.Value] = true
+	values = append(values, position(name))
+	return fmt.Sprintf("(call $native_%s %s)", name.Value, strings.Join(values, " ")), intpr.Int, nil
+}
+
+// variadicNative returns the elements of the array literal passed to the
+// variadic last param of a native. The wat natives take two arguments, so
+// the elements are not passed as an array.
+func variadicNative(name string, args []*intpr.Expression) ([]*intpr.Expression, bool) {
+	for _, native := range intpr.MathModule {
+		if native.Name != name || len(args) == 0 || !native.Params[len(native.Params)-1].Variadic {
+			continue
+		}
+		rest := args[len(args)-1]
+		if rest.Token.Type != tokens.LEFT_BRACE || !rest.DataType.IsArray() {
+			return nil, false
+		}
+		return rest.Args, true
+	}
+	return nil, false
+}
+
+// chain calls a native taking two arguments on the first argument and each
+// of the others in turn, as in min(min(a, b), c).
+func (g *generator) chain(name tokens.Token, args []*intpr.Expression) (string, intpr.DataType, *errors.Error) {
+	result, err := g.expression(args[0])
+	if err != nil {
+		return "", intpr.Invalid, err
+	}
+	for _, a := range args[1:] {
+		value, err := g.expression(a)
+		if err != nil {
+			return "", intpr.Invalid, err
+		}
+		g.natives[name.Value] = true
+		result = fmt.Sprintf("(call $native_%s %s %s %s)", name.Value, result, value, position(name))
+	}
+	return result, intpr.Int, nil
+}
+
+// guard wraps the call of a function whose definition comes later, so that
+// it fails when the definition has not run yet.
+func (g *generator) guard(b binding, name tokens.Token, call string) string {
+	flag, found := g.guards[b.name]
+	if !found {
+		flag = g.unique("defined_" + strings.TrimPrefix(b.name, "$f_"))
+		g.guards[b.name] = flag
+	}
+	message := fmt.Sprintf("function %s called before its definition", name.Value)
+	check := fmt.Sprintf("(if (i32.eqz (global.get %s)) (then (call $fail (i32.const %d) (i32.const %d) %s)))", flag, g.message(message), len(message), position(name))
+	result := ""
+	if b.dataType != intpr.Void {
+		result = fmt.Sprintf(" (result %s)", valType(b.dataType))
+	}
+	return fmt.Sprintf("(block%s %s %s)", result, check, call)
+}
+
+func (g *generator) expression(e *intpr.Expression) (string, *errors.Error) {
+	switch e.Token.Type {
+	case tokens.NUMBER:
+		return fmt.Sprintf("(i64.const %s)", e.Token.Value), nil
+	case tokens.TRUE:
+		return "(i32.const 1)", nil
+	case tokens.FALSE:
+		return "(i32.const 0)", nil
+	case tokens.IDENTIFIER:
+		if e.Args == nil {
+			b, found := g.lookup(e.Token.Value)
+			if !found {
+				return "", &errors.Error{Message: fmt.Sprintf("variable %s undefined", e.Token.Value), Type: errors.ReferenceError, Token: e.Token}
+			}
+			return g.get(b), nil
+		}
+		if e.Builtin == intpr.ConvertBuiltin {
+			// enums are rejected where they are declared, so this is int(x)
+			// of an int
+			return g.expression(e.Args[0])
+		}
+		call, _, err := g.call(e.Token, e.Args)
+		return call, err
+	case tokens.COMMA:
+		// only returned, so the values can be left on the stack in order
+		values := []string{}
+		for _, a := range e.Args {
+			value, err := g.expression(a)
+			if err != nil {
+				return "", err
+			}
+			values = append(values, value)
+		}
+		return strings.Join(values, " "), nil
+	case tokens.LEFT_BRACE, tokens.LEFT_BRACKET:
+		if e.DataType.IsArray() || (e.Token.Type == tokens.LEFT_BRACKET && e.Left.DataType.IsArray()) {
+			return "", &errors.Error{Message: "wat target does not support array types", Type: errors.UnsupportedError, Token: e.Token}
+		}
+		return "", &errors.Error{Message: "wat target does not support map types", Type: errors.UnsupportedError, Token: e.Token}
+	case tokens.STRING:
+		return "", &errors.Error{Message: "wat target does not support string types", Type: errors.UnsupportedError, Token: e.Token}
+	case tokens.NONE, tokens.SOME, tokens.IS, tokens.DOUBLE_QUESTION:
+		return "", &errors.Error{Message: "wat target does not support optional types", Type: errors.UnsupportedError, Token: e.Token}
+	case tokens.CHAN:
+		return "", &errors.Error{Message: "wat target does not support channel types", Type: errors.UnsupportedError, Token: e.Token}
+	case tokens.BANG:
+		operand, err := g.expression(e.Left)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("(i32.eqz %s)", operand), nil
+	case tokens.NEGATE:
+		operand, err := g.expression(e.Left)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("(i64.sub (i64.const 0) %s)", operand), nil
+	case tokens.TILDE:
+		operand, err := g.expression(e.Left)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("(i64.xor %s (i64.const -1))", operand), nil
+	}
+	left, err := g.expression(e.Left)
+	if err != nil {
+		return "", err
+	}
+	right, err := g.expression(e.Right)
+	if err != nil {
+		return "", err
+	}
+	operands := valType(e.Left.DataType)
+	var instruction string
+	switch e.Token.Type {
+	case tokens.PLUS:
+		instruction = "i64.add"
+	case tokens.MINUS:
+		instruction = "i64.sub"
+	case tokens.STAR:
+		instruction = "i64.mul"
+	case tokens.SLASH:
+		return fmt.Sprintf("(call $div %s %s %s)", left, right, position(e.Token)), nil
+	case tokens.MODULO:
+		return fmt.Sprintf("(call $mod %s %s %s)", left, right, position(e.Token)), nil
+	case tokens.AMPERSAND:
+		instruction = "i64.and"
+	case tokens.PIPE:
+		instruction = "i64.or"
+	case tokens.CARET:
+		instruction = "i64.xor"
+	case tokens.SHIFT_LEFT:
+		return fmt.Sprintf("(call $shl %s %s %s)", left, right, position(e.Token)), nil
+	case tokens.SHIFT_RIGHT:
+		return fmt.Sprintf("(call $shr %s %s %s)", left, right, position(e.Token)), nil
+	case tokens.LESS:
+		instruction = "i64.lt_s"
+	case tokens.LESS_EQUAL:
+		instruction = "i64.le_s"
+	case tokens.GREATER:
+		instruction = "i64.gt_s"
+	case tokens.GREATER_EQUAL:
+		instruction = "i64.ge_s"
+	case tokens.DOUBLE_EQUAL:
+		instruction = operands + ".eq"
+	case tokens.NOT_EQUAL:
+		instruction = operands + ".ne"
+	case tokens.AND:
+		// the right operand only runs when the left one does not decide
+		return fmt.Sprintf("(if (result i32) %s (then %s) (else (i32.const 0)))", left, right), nil
+	case tokens.OR:
+		return fmt.Sprintf("(if (result i32) %s (then (i32.const 1)) (else %s))", left, right), nil
+	default:
+		return "", &errors.Error{Message: fmt.Sprintf("wat target does not support operator %s", e.Token.View()), Type: errors.UnsupportedError, Token: e.Token}
+	}
+	return fmt.Sprintf("(%s %s %s)", instruction, left, right), nil
+}
@@ -0,0 +1,173 @@
+package watgen
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"simpl/errors"
+	"simpl/lexer"
+	"simpl/parser"
+	"strings"
+	"testing"
+)
+
+// generate returns the WAT source of a program.
+func generate(t *testing.T, name, source string) string {
+	t.Helper()
+	tokens, errs := lexer.Tokenize(source, name+".simpl", 1)
+	if len(errs) > 0 {
+		t.Fatalf("%s: tokenize: %s", name, errs[0].Message)
+	}
+	parse := parser.New(tokens)
+	program, err := parse.Parse(false)
+	if err != nil {
+		t.Fatalf("%s: parse: %s", name, err.Message)
+	}
+	wat, err := Generate(program)
+	if err != nil {
+		t.Fatalf("%s: generate: %s", name, err.Message)
+	}
+	return string(wat)
+}
+
+var declaration = regexp.MustCompile(`\((?:global|local|func) (\$\S+)`)
+
+// TestUniqueNames generates programs whose variables spell the names given
+// to shadowed variables and loop counters, which must not be declared twice.
+func TestUniqueNames(t *testing.T) {
+	sources := map[string]string{
+		"shadowed": "x := 1; { int x = 2; x_1 := 3; } x_2 := 4; { int x = 5; }",
+		"counter":  "for_1 := 7; t := 0; for i in 0..3 { t += i; }",
+		"local":    "def f() int { x := 1; { int x = 2; x_1 := 3; } return x; } y := f();",
+	}
+	for name, source := range sources {
+		declared := map[string]bool{}
+		for _, match := range declaration.FindAllStringSubmatch(generate(t, name, source), -1) {
+			id := match[1]
+			if declared[id] {
+				t.Errorf("%s: %s is declared twice", name, id)
+			}
+			declared[id] = true
+		}
+	}
+}
+
+// TestVariadicNatives checks that the arguments of min and max are passed to
+// the natives two at a time.
+func TestVariadicNatives(t *testing.T) {
+	wat := generate(t, "natives", "a := max(1, 5, 3); b := min(4);")
+	if count := strings.Count(wat, "(call $native_max "); count != 2 {
+		t.Errorf("max(1, 5, 3) calls $native_max %d times, want 2", count)
+	}
+	if strings.Contains(wat, "(call $native_min ") {
+		t.Errorf("min(4) calls $native_min")
+	}
+}
+
+// TestFunctionValues checks that a variable holding a function is rejected
+// at its statement.
+func TestFunctionValues(t *testing.T) {
+	tokens, errs := lexer.Tokenize("def h() int { return 1; }\nk := h;\n", "values.simpl", 1)
+	if len(errs) > 0 {
+		t.Fatalf("tokenize: %s", errs[0].Message)
+	}
+	parse := parser.New(tokens)
+	program, err := parse.Parse(false)
+	if err != nil {
+		t.Fatalf("parse: %s", err.Message)
+	}
+	_, err = Generate(program)
+	if err == nil || err.Type != errors.UnsupportedError || err.Message != "wat target does not support function types" || err.Token.Line != 2 {
+		t.Errorf("got %v, want the function type rejected on line 2", err)
+	}
+}
+
+// TestGlobalsInFunctions checks that a top-level function, which is defined
+// ahead of the top-level code, reads the globals declared above it.
+func TestGlobalsInFunctions(t *testing.T) {
+	wat := generate(t, "globals", "g := 5;\ndef f() int { return g; }\nr := f();\n")
+	if !strings.Contains(wat, "(return (global.get $g_g))") {
+		t.Errorf("f does not return the global g:\n%s", wat)
+	}
+	if count := strings.Count(wat, "(global $g_g "); count != 1 {
+		t.Errorf("g is declared %d times, want 1", count)
+	}
+}
+
+// TestUnsupported checks that valid source the wat target cannot translate
+// is reported as unsupported, at the statement or expression concerned.
+func TestUnsupported(t *testing.T) {
+	cases := []struct {
+		name, source, message string
+		line, column          int
+	}{
+		{"struct", "x := 1;\nstruct P { int x; }", "wat target does not support struct types", 2, 1},
+		{"try", "x := 1;\ntry { x = 2; } catch {}", "wat target does not support try statements", 2, 1},
+		{"nested function", "def f() int {\n    def g() int { return 1; }\n    return g();\n}", "wat target does not support nested functions", 2, 9},
+		{"map", "x := 1;\nm := map[int]int{};", "wat target does not support map types", 2, 17},
+		{"string", "s := \"a\";", "wat target does not support string types", 1, 1},
+	}
+	for _, c := range cases {
+		tokens, errs := lexer.Tokenize(c.source, c.name+".simpl", 1)
+		if len(errs) > 0 {
+			t.Fatalf("%s: tokenize: %s", c.name, errs[0].Message)
+		}
+		parse := parser.New(tokens)
+		program, err := parse.Parse(false)
+		if err != nil {
+			t.Fatalf("%s: parse: %s", c.name, err.Message)
+		}
+		_, err = Generate(program)
+		if err == nil || err.Type != errors.UnsupportedError || err.Message != c.message || err.Token.Line != c.line || err.Token.Char != c.column {
+			t.Errorf("%s: got %v, want an unsupported feature %q at %d:%d", c.name, err, c.message, c.line, c.column)
+		}
+	}
+}
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// TestGolden compares the WAT generated for the programs in testdata with
+// the .wat file next to each of them, and validates it with wat2wasm when it
+// is installed.
+func TestGolden(t *testing.T) {
+	filenames, err := filepath.Glob("testdata/*.simpl")
+	if err != nil || len(filenames) == 0 {
+		t.Fatalf("no programs in testdata: %v", err)
+	}
+	wat2wasm, _ := exec.LookPath("wat2wasm")
+	for _, filename := range filenames {
+		name := strings.TrimSuffix(filepath.Base(filename), ".simpl")
+		t.Run(name, func(t *testing.T) {
+			source, err := os.ReadFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wat := []byte(generate(t, name, string(source)))
+			golden := strings.TrimSuffix(filename, ".simpl") + ".wat"
+			if *update {
+				if err := os.WriteFile(golden, wat, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(wat, want) {
+				t.Errorf("generated WAT differs from %s, run go test -update after checking it:\n%s", golden, wat)
+			}
+			if wat2wasm == "" {
+				return
+			}
+			output := filepath.Join(t.TempDir(), name+".wasm")
+			validate := exec.Command(wat2wasm, "-o", output, "-")
+			validate.Stdin = bytes.NewReader(wat)
+			if out, err := validate.CombinedOutput(); err != nil {
+				t.Errorf("wat2wasm rejects the generated WAT: %v\n%s", err, out)
+			}
+		})
+	}
+}